@@ -0,0 +1,119 @@
+// Package account exports and erases everything the server keeps about a
+// user. Deleting an account only marks it, the data is purged once the grace
+// period has passed so a user who changes their mind can restore it.
+package account
+
+import "strings"
+
+// table is a table holding user data. Its rows are selected by where, which
+// takes the user's id, or their Firebase uid when byUID is set.
+type table struct {
+	name  string
+	where string
+	byUID bool
+	// columns are exported, tables without columns are only purged
+	columns []string
+}
+
+// tables are purged in this order, rows that refer to other rows go first
+var tables = []table{
+	{
+		name:    "users",
+		where:   "id = ?",
+		columns: []string{"id", "uid", "email", "name", "timezone", "locale", "is_guest", "role", "created_at", "updated_at"},
+	},
+	{
+		name:    "user_identities",
+		where:   "user_id = ?",
+		columns: []string{"uid", "provider", "email", "email_verified", "created_at", "last_seen_at"},
+	},
+	{
+		name:    "user_settings",
+		where:   "user_id = ?",
+		columns: []string{"mushaf", "daily_goal_pages", "daily_goal_minutes", "share_progress", "analytics_opt_out", "avatar_url", "updated_at"},
+	},
+	{
+		name:    "user_profile_changes",
+		where:   "user_id = ?",
+		columns: []string{"field", "old_value", "new_value", "changed_at"},
+	},
+	{
+		name:    "reading_events",
+		where:   "user_id = ?",
+		columns: []string{"session_id", "page_number", "surah_name", "seconds_open", "created_at"},
+	},
+	{
+		name:    "reading_sessions",
+		where:   "user_id = ?",
+		columns: []string{"id", "mode", "started_at", "last_heartbeat_at", "ended_at", "end_reason", "last_page", "last_surah_name"},
+	},
+	{
+		name:    "listening_events",
+		where:   "user_id = ?",
+		columns: []string{"reciter", "surah", "from_ayah", "to_ayah", "seconds_listened", "created_at"},
+	},
+	{
+		name:    "daily_summaries",
+		where:   "user_id = ?",
+		columns: []string{"date", "total_seconds", "listening_seconds", "threshold_met"},
+	},
+	{
+		name:    "user_streaks",
+		where:   "user_id = ?",
+		columns: []string{"current_streak", "longest_streak", "last_active_date"},
+	},
+	{
+		name:    "streak_events",
+		where:   "user_id = ?",
+		columns: []string{"trigger_type", "trigger_date", "total_seconds", "reason", "previous_current_streak", "previous_longest_streak", "previous_last_active_date", "current_streak", "longest_streak", "last_active_date", "created_at"},
+	},
+	{
+		name:    "user_reading_progress",
+		where:   "user_id = ?",
+		columns: []string{"page_number", "surah_name", "first_read_date", "read_count"},
+	},
+	{
+		name:    "user_daily_scores",
+		where:   "user_id = ?",
+		columns: []string{"date", "reading_time_score", "consistency_score", "progress_score", "engagement_score", "total_score", "pages_read", "reading_minutes", "listening_minutes"},
+	},
+	{
+		name:    "user_weekly_scores",
+		where:   "user_id = ?",
+		columns: []string{"year", "week", "total_score", "days_active", "total_reading_minutes", "total_pages_read"},
+	},
+	{
+		name:    "bookmarks",
+		where:   "user_id = ?",
+		byUID:   true,
+		columns: []string{"page_number", "surah_name", "created_at"},
+	},
+	{
+		// tokens and push keys are credentials of the device, not user data
+		name:    "user_devices",
+		where:   "user_id = ?",
+		columns: []string{"id", "transport", "created_at", "last_seen_at"},
+	},
+	{
+		name:  "notification_deliveries",
+		where: "outbox_id IN (SELECT id FROM notification_outbox WHERE user_id = ?)",
+	},
+	{
+		name:    "notification_outbox",
+		where:   "user_id = ?",
+		columns: []string{"kind", "title", "body", "status", "created_at", "sent_at"},
+	},
+	{
+		name:  "data_exports",
+		where: "user_id = ?",
+	},
+}
+
+// selectJSON selects the exported columns of t as one JSON object per row
+func (t table) selectJSON() string {
+	pairs := make([]string, len(t.columns))
+	for i, column := range t.columns {
+		pairs[i] = "'" + column + "', " + column
+	}
+	return "SELECT JSON_OBJECT(" + strings.Join(pairs, ", ") + ") FROM " + t.name + " WHERE " + t.where
+}
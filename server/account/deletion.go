@@ -0,0 +1,218 @@
+package account
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"fmt"
+	"time"
+
+	"github.com/boolow5/quran-app-api/apperrors"
+	"github.com/boolow5/quran-app-api/db"
+	"github.com/boolow5/quran-app-api/logger"
+	"github.com/redis/go-redis/v9"
+)
+
+// purgeBatchSize caps the accounts purged by one PurgeDue call
+const purgeBatchSize = 500
+
+// redisPatterns match the Redis keys of a user, %[1]d is their id and %[2]s
+// their Firebase uid
+var redisPatterns = []string{
+	"idempotency:%[1]d:*",
+	"ratelimit:*:user:%[1]d",
+	"ratelimit:*:user:%[1]d:device:*",
+	"bookmarks:%[2]s:*",
+}
+
+// JobQueue drops the queued jobs of a user, it is *queue.Queue
+type JobQueue interface {
+	DropUser(ctx context.Context, userID uint64) error
+}
+
+// DeletedAccount is a Firebase uid of a purged account
+type DeletedAccount struct {
+	UserID            uint64     `json:"user_id" db:"user_id"`
+	UID               string     `json:"uid" db:"uid"`
+	DeletedAt         *time.Time `json:"deleted_at" db:"deleted_at"`
+	PurgedAt          time.Time  `json:"purged_at" db:"purged_at"`
+	FirebaseDeletedAt *time.Time `json:"firebase_deleted_at" db:"firebase_deleted_at"`
+}
+
+// RequestDeletion marks the account of a user as deleted, its data is purged
+// after grace. Asking again keeps the first purge time.
+func RequestDeletion(ctx context.Context, db db.Database, userID uint64, grace time.Duration) (time.Time, error) {
+	now := time.Now()
+	_, err := db.Exec(ctx, "UPDATE users SET deleted_at = ?, purge_after = ? WHERE id = ? AND deleted_at IS NULL",
+		now, now.Add(grace), userID)
+	if err != nil {
+		return time.Time{}, fmt.Errorf("failed to delete account of user %d: %w", userID, err)
+	}
+
+	var purgeAfter time.Time
+	if err := db.Get(ctx, &purgeAfter, "SELECT purge_after FROM users WHERE id = ?", userID); err != nil {
+		return time.Time{}, fmt.Errorf("failed to get purge time of user %d: %w", userID, err)
+	}
+
+	logger.For(ctx, "account.RequestDeletion").Infof("Account of user %d will be purged after %s", userID, purgeAfter.Format(time.RFC3339))
+	return purgeAfter, nil
+}
+
+// Restore cancels the deletion of an account that has not been purged yet
+func Restore(ctx context.Context, db db.Database, userID uint64) error {
+	restored, err := db.Exec(ctx, "UPDATE users SET deleted_at = NULL, purge_after = NULL WHERE id = ? AND deleted_at IS NOT NULL", userID)
+	if err != nil {
+		return fmt.Errorf("failed to restore account of user %d: %w", userID, err)
+	}
+	if restored == 0 {
+		return apperrors.ErrConflict.WithDetails(map[string]interface{}{"reason": "account is not deleted"})
+	}
+
+	logger.For(ctx, "account.Restore").Infof("Restored account of user %d", userID)
+	return nil
+}
+
+// PurgeDue purges every account whose grace period has passed and returns
+// how many were purged. An account that fails is retried on the next run.
+func PurgeDue(ctx context.Context, db db.Database, client *redis.Client, jobs JobQueue) (int, error) {
+	var due []uint64
+	err := db.Select(ctx, &due, "SELECT id FROM users WHERE purge_after IS NOT NULL AND purge_after <= NOW() ORDER BY purge_after LIMIT ?", purgeBatchSize)
+	if err != nil {
+		return 0, fmt.Errorf("failed to get accounts to purge: %w", err)
+	}
+
+	var errs []error
+	purged := 0
+	for _, userID := range due {
+		if err := Purge(ctx, db, client, jobs, userID); err != nil {
+			errs = append(errs, err)
+			continue
+		}
+		purged++
+	}
+	return purged, errors.Join(errs...)
+}
+
+// Purge erases every row and Redis key of a user and records the account in
+// deleted_accounts, where its uids wait for their Firebase users to be deleted
+func Purge(ctx context.Context, db db.Database, client *redis.Client, jobs JobQueue, userID uint64) error {
+	var user struct {
+		UID       string     `db:"uid"`
+		DeletedAt *time.Time `db:"deleted_at"`
+	}
+	if err := db.Get(ctx, &user, "SELECT uid, deleted_at FROM users WHERE id = ?", userID); err != nil {
+		return fmt.Errorf("failed to get user %d to purge: %w", userID, err)
+	}
+
+	uids := []string{user.UID}
+	var identities []string
+	if err := db.Select(ctx, &identities, "SELECT uid FROM user_identities WHERE user_id = ? AND uid <> ?", userID, user.UID); err != nil {
+		return fmt.Errorf("failed to get identities of user %d to purge: %w", userID, err)
+	}
+	uids = append(uids, identities...)
+
+	// Redis first, a queued job must not write rows back after they are gone
+	if err := dropRedis(ctx, client, jobs, userID, user.UID); err != nil {
+		return err
+	}
+
+	tx, err := db.Begin(ctx)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	if err := recordPurge(ctx, db, tx, userID, uids, user.DeletedAt); err != nil {
+		return err
+	}
+	if err := erase(ctx, db, tx, userID, user.UID); err != nil {
+		return err
+	}
+
+	if err := tx.Commit(); err != nil {
+		return err
+	}
+
+	logger.For(ctx, "account.Purge").Infof("Purged account of user %d", userID)
+	return nil
+}
+
+// dropRedis drops the queued jobs and Redis keys of a user
+func dropRedis(ctx context.Context, client *redis.Client, jobs JobQueue, userID uint64, uid string) error {
+	if err := jobs.DropUser(ctx, userID); err != nil {
+		return fmt.Errorf("failed to drop jobs of user %d: %w", userID, err)
+	}
+	for _, pattern := range redisPatterns {
+		if err := deleteKeys(ctx, client, fmt.Sprintf(pattern, userID, uid)); err != nil {
+			return fmt.Errorf("failed to purge redis keys of user %d: %w", userID, err)
+		}
+	}
+	return nil
+}
+
+// recordPurge records the Firebase uids of a purged user in deleted_accounts
+func recordPurge(ctx context.Context, db db.Database, tx *sql.Tx, userID uint64, uids []string, deletedAt *time.Time) error {
+	for _, uid := range uids {
+		_, err := db.ExecTx(ctx, tx, "INSERT INTO deleted_accounts (user_id, uid, deleted_at) VALUES (?, ?, ?) ON DUPLICATE KEY UPDATE purged_at = NOW()",
+			userID, uid, deletedAt)
+		if err != nil {
+			return fmt.Errorf("failed to record purge of user %d: %w", userID, err)
+		}
+	}
+	return nil
+}
+
+// erase deletes every row of a user in tx
+func erase(ctx context.Context, db db.Database, tx *sql.Tx, userID uint64, uid string) error {
+	for _, t := range tables {
+		var arg interface{} = userID
+		if t.byUID {
+			arg = uid
+		}
+		if _, err := db.ExecTx(ctx, tx, "DELETE FROM "+t.name+" WHERE "+t.where, arg); err != nil {
+			return fmt.Errorf("failed to purge %s of user %d: %w", t.name, userID, err)
+		}
+	}
+	return nil
+}
+
+func deleteKeys(ctx context.Context, client *redis.Client, pattern string) error {
+	iter := client.Scan(ctx, 0, pattern, 500).Iterator()
+	var keys []string
+	for iter.Next(ctx) {
+		keys = append(keys, iter.Val())
+	}
+	if err := iter.Err(); err != nil {
+		return err
+	}
+	if len(keys) == 0 {
+		return nil
+	}
+	return client.Del(ctx, keys...).Err()
+}
+
+// PendingFirebaseDeletions returns purged accounts whose Firebase user has not
+// been deleted yet
+func PendingFirebaseDeletions(ctx context.Context, db db.Database, limit int) ([]DeletedAccount, error) {
+	var accounts []DeletedAccount
+	err := db.Select(ctx, &accounts, `
+	SELECT user_id, uid, deleted_at, purged_at, firebase_deleted_at
+	FROM deleted_accounts
+	WHERE firebase_deleted_at IS NULL
+	ORDER BY purged_at
+	LIMIT ?
+	`, limit)
+	if err != nil {
+		return nil, fmt.Errorf("failed to get accounts pending firebase deletion: %w", err)
+	}
+	return accounts, nil
+}
+
+// MarkFirebaseDeleted records that a Firebase user of a purged account is gone
+func MarkFirebaseDeleted(ctx context.Context, db db.Database, userID uint64, uid string) error {
+	_, err := db.Exec(ctx, "UPDATE deleted_accounts SET firebase_deleted_at = NOW() WHERE user_id = ? AND uid = ?", userID, uid)
+	if err != nil {
+		return fmt.Errorf("failed to mark firebase user of %d deleted: %w", userID, err)
+	}
+	return nil
+}
@@ -0,0 +1,280 @@
+package account
+
+import (
+	"archive/zip"
+	"bytes"
+	"context"
+	"database/sql"
+	"encoding/csv"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"strconv"
+	"time"
+
+	"github.com/boolow5/quran-app-api/apperrors"
+	"github.com/boolow5/quran-app-api/db"
+	"github.com/boolow5/quran-app-api/logger"
+)
+
+const (
+	FormatJSON = "json"
+	FormatCSV  = "csv"
+)
+
+const (
+	ExportPending = "pending"
+	ExportReady   = "ready"
+	ExportFailed  = "failed"
+	ExportExpired = "expired"
+)
+
+// Export is an archive of a user's data, built in the background
+type Export struct {
+	ID         uint64     `json:"id" db:"id"`
+	UserID     uint64     `json:"user_id" db:"user_id"`
+	Format     string     `json:"format" db:"format"`
+	Status     string     `json:"status" db:"status"`
+	SizeBytes  int64      `json:"size_bytes" db:"size_bytes"`
+	CreatedAt  time.Time  `json:"created_at" db:"created_at"`
+	FinishedAt *time.Time `json:"finished_at" db:"finished_at"`
+	ExpiresAt  *time.Time `json:"expires_at" db:"expires_at"`
+}
+
+// ContentType is the media type of the archive
+func (e *Export) ContentType() string {
+	if e.Format == FormatCSV {
+		return "application/zip"
+	}
+	return "application/json"
+}
+
+// FileName is the name the archive is downloaded as
+func (e *Export) FileName() string {
+	ext := ".json"
+	if e.Format == FormatCSV {
+		ext = ".zip"
+	}
+	return "quran-app-export-" + strconv.FormatUint(e.ID, 10) + ext
+}
+
+const exportColumns = "id, user_id, format, status, size_bytes, created_at, finished_at, expires_at"
+
+// RequestExport creates a pending export, the caller queues BuildExport. A
+// user asking again while one is pending gets that one back.
+func RequestExport(ctx context.Context, db db.Database, userID uint64, format string, ttl time.Duration) (*Export, bool, error) {
+	var pending Export
+	err := db.Get(ctx, &pending, "SELECT "+exportColumns+" FROM data_exports WHERE user_id = ? AND format = ? AND status = ? ORDER BY id DESC LIMIT 1",
+		userID, format, ExportPending)
+	if err == nil {
+		return &pending, false, nil
+	}
+	if !errors.Is(err, sql.ErrNoRows) {
+		return nil, false, fmt.Errorf("failed to get pending export of user %d: %w", userID, err)
+	}
+
+	id, err := db.Insert(ctx, "INSERT INTO data_exports (user_id, format, status, expires_at) VALUES (?, ?, ?, ?)",
+		userID, format, ExportPending, time.Now().Add(ttl))
+	if err != nil {
+		return nil, false, fmt.Errorf("failed to create export for user %d: %w", userID, err)
+	}
+
+	export, err := GetExport(ctx, db, userID, uint64(id))
+	return export, true, err
+}
+
+// GetExport returns an export of a user
+func GetExport(ctx context.Context, db db.Database, userID, exportID uint64) (*Export, error) {
+	var export Export
+	err := db.Get(ctx, &export, "SELECT "+exportColumns+" FROM data_exports WHERE id = ? AND user_id = ?", exportID, userID)
+	if errors.Is(err, sql.ErrNoRows) {
+		return nil, apperrors.ErrExportNotFound
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to get export %d: %w", exportID, err)
+	}
+	return &export, nil
+}
+
+// GetExportArchive returns a ready export with its archive
+func GetExportArchive(ctx context.Context, db db.Database, userID, exportID uint64) (*Export, []byte, error) {
+	export, err := GetExport(ctx, db, userID, exportID)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	switch export.Status {
+	case ExportReady:
+	case ExportPending:
+		return nil, nil, apperrors.ErrExportNotReady
+	default:
+		return nil, nil, apperrors.ErrExportNotFound.WithDetails(map[string]interface{}{"status": export.Status})
+	}
+
+	var archive []byte
+	if err := db.Get(ctx, &archive, "SELECT archive FROM data_exports WHERE id = ?", exportID); err != nil {
+		return nil, nil, fmt.Errorf("failed to get archive of export %d: %w", exportID, err)
+	}
+	return export, archive, nil
+}
+
+// BuildExport builds the archive of a pending export
+func BuildExport(ctx context.Context, db db.Database, userID, exportID uint64) error {
+	export, err := GetExport(ctx, db, userID, exportID)
+	if errors.Is(err, apperrors.ErrExportNotFound) {
+		// purged with the account while queued
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	if export.Status != ExportPending {
+		return nil
+	}
+
+	rows, err := userRows(ctx, db, userID)
+	if err != nil {
+		return err
+	}
+
+	var archive []byte
+	if export.Format == FormatCSV {
+		archive, err = csvArchive(rows)
+	} else {
+		archive, err = jsonArchive(userID, rows)
+	}
+	if err != nil {
+		return fmt.Errorf("failed to build export %d: %w", exportID, err)
+	}
+
+	_, err = db.Exec(ctx, "UPDATE data_exports SET status = ?, archive = ?, size_bytes = ?, finished_at = NOW() WHERE id = ? AND status = ?",
+		ExportReady, archive, len(archive), exportID, ExportPending)
+	if err != nil {
+		return fmt.Errorf("failed to save export %d: %w", exportID, err)
+	}
+
+	logger.For(ctx, "account.BuildExport").Infof("Built %s export %d of user %d, %d bytes", export.Format, exportID, userID, len(archive))
+	return nil
+}
+
+// FailExport marks an export that could not be built
+func FailExport(ctx context.Context, db db.Database, exportID uint64, cause error) error {
+	_, err := db.Exec(ctx, "UPDATE data_exports SET status = ?, error = ?, finished_at = NOW() WHERE id = ? AND status = ?",
+		ExportFailed, cause.Error(), exportID, ExportPending)
+	return err
+}
+
+// DeleteExpiredExports drops the archives of exports past their expiry
+func DeleteExpiredExports(ctx context.Context, db db.Database) (int64, error) {
+	expired, err := db.Exec(ctx, "UPDATE data_exports SET status = ?, archive = NULL WHERE status IN (?, ?) AND expires_at <= NOW()",
+		ExportExpired, ExportReady, ExportPending)
+	if err != nil {
+		return 0, fmt.Errorf("failed to expire exports: %w", err)
+	}
+	return expired, nil
+}
+
+// tableRows are the rows of one table as JSON objects
+type tableRows struct {
+	table table
+	rows  []json.RawMessage
+}
+
+func userRows(ctx context.Context, db db.Database, userID uint64) ([]tableRows, error) {
+	var uid string
+	if err := db.Get(ctx, &uid, "SELECT uid FROM users WHERE id = ?", userID); err != nil {
+		return nil, fmt.Errorf("failed to get uid of user %d: %w", userID, err)
+	}
+
+	var result []tableRows
+	for _, t := range tables {
+		if len(t.columns) == 0 {
+			continue
+		}
+
+		var arg interface{} = userID
+		if t.byUID {
+			arg = uid
+		}
+
+		var rows []string
+		if err := db.Select(ctx, &rows, t.selectJSON(), arg); err != nil {
+			return nil, fmt.Errorf("failed to export %s of user %d: %w", t.name, userID, err)
+		}
+
+		raw := make([]json.RawMessage, len(rows))
+		for i, row := range rows {
+			raw[i] = json.RawMessage(row)
+		}
+		result = append(result, tableRows{table: t, rows: raw})
+	}
+	return result, nil
+}
+
+// jsonArchive is one document with the rows of every table by name
+func jsonArchive(userID uint64, rows []tableRows) ([]byte, error) {
+	byTable := make(map[string][]json.RawMessage, len(rows))
+	for _, t := range rows {
+		byTable[t.table.name] = t.rows
+	}
+	return json.MarshalIndent(map[string]interface{}{
+		"user_id":     userID,
+		"exported_at": time.Now().UTC(),
+		"tables":      byTable,
+	}, "", "  ")
+}
+
+// csvArchive is a zip with one CSV file per table
+func csvArchive(rows []tableRows) ([]byte, error) {
+	var buf bytes.Buffer
+	archive := zip.NewWriter(&buf)
+
+	for _, t := range rows {
+		file, err := archive.Create(t.table.name + ".csv")
+		if err != nil {
+			return nil, err
+		}
+
+		w := csv.NewWriter(file)
+		w.Write(t.table.columns)
+		for _, raw := range t.rows {
+			decoder := json.NewDecoder(bytes.NewReader(raw))
+			decoder.UseNumber()
+			var row map[string]interface{}
+			if err := decoder.Decode(&row); err != nil {
+				return nil, err
+			}
+
+			record := make([]string, len(t.table.columns))
+			for i, column := range t.table.columns {
+				record[i] = csvValue(row[column])
+			}
+			w.Write(record)
+		}
+		w.Flush()
+		if err := w.Error(); err != nil {
+			return nil, err
+		}
+	}
+
+	if err := archive.Close(); err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
+
+func csvValue(value interface{}) string {
+	switch v := value.(type) {
+	case nil:
+		return ""
+	case string:
+		return v
+	case json.Number:
+		return v.String()
+	case bool:
+		return strconv.FormatBool(v)
+	default:
+		raw, _ := json.Marshal(v)
+		return string(raw)
+	}
+}
@@ -0,0 +1,369 @@
+package account
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"fmt"
+	"time"
+
+	"github.com/boolow5/quran-app-api/apperrors"
+	"github.com/boolow5/quran-app-api/db"
+	"github.com/boolow5/quran-app-api/logger"
+	"github.com/boolow5/quran-app-api/models"
+	"github.com/boolow5/quran-app-api/streak"
+	"github.com/redis/go-redis/v9"
+)
+
+// MergeResult is what a merge moved into the account kept
+type MergeResult struct {
+	FromUserID uint64 `json:"from_user_id,omitempty"`
+	IntoUserID uint64 `json:"into_user_id"`
+	// Rows are the rows moved or combined by table
+	Rows map[string]int64 `json:"rows"`
+	// Dates are the days with merged reading, their scores are stale until
+	// recomputed
+	Dates []string `json:"dates"`
+}
+
+// mergeStep moves or combines the rows of a table in a merge
+type mergeStep struct {
+	table string
+	query string
+	args  []interface{}
+}
+
+// mergeUser is an account taking part in a merge
+type mergeUser struct {
+	ID        uint64     `db:"id"`
+	UID       string     `db:"uid"`
+	Email     string     `db:"email"`
+	IsGuest   bool       `db:"is_guest"`
+	DeletedAt *time.Time `db:"deleted_at"`
+}
+
+func getMergeUser(ctx context.Context, db db.Database, userID uint64) (*mergeUser, error) {
+	var user mergeUser
+	err := db.Get(ctx, &user, "SELECT id, uid, email, is_guest, deleted_at FROM users WHERE id = ?", userID)
+	if errors.Is(err, sql.ErrNoRows) {
+		return nil, apperrors.ErrUserNotFound
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to get user to merge: %w", err)
+	}
+	return &user, nil
+}
+
+// LinkGuest merges the guest with the Firebase uid guestUID into the account
+// of userID. It is for a guest who signs in with a provider that already has
+// an account, a guest who links a new provider keeps their uid and account.
+// A guest who never reached the server has nothing to merge.
+func LinkGuest(ctx context.Context, db db.Database, client *redis.Client, jobs JobQueue, userID uint64, guestUID string) (*MergeResult, error) {
+	user, err := getMergeUser(ctx, db, userID)
+	if err != nil {
+		return nil, err
+	}
+	if user.IsGuest {
+		return nil, apperrors.ErrForbidden.WithDetails(map[string]interface{}{"reason": "sign in with a provider to link a guest"})
+	}
+
+	guest, err := models.GetUserByUID(ctx, db, guestUID)
+	if errors.Is(err, apperrors.ErrUserNotFound) {
+		return emptyMerge(userID), nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	if !guest.IsGuest {
+		return nil, apperrors.Invalid("guest_token", "ID token of a guest")
+	}
+	// the anonymous Firebase user is not needed after the merge
+	return merge(ctx, db, client, jobs, guest.ID, userID, false)
+}
+
+// LinkIdentity adds a sign-in to the account of userID. The sign-in must have
+// a verified email that one of the account's identities has verified too. If
+// it already has an account, that account is merged into userID.
+func LinkIdentity(ctx context.Context, db db.Database, client *redis.Client, jobs JobQueue, userID uint64, identity models.Identity) (*MergeResult, error) {
+	if identity.Email == "" || !identity.EmailVerified {
+		return nil, apperrors.Invalid("id_token", "ID token with a verified email")
+	}
+	verified, err := models.HasVerifiedEmail(ctx, db, userID, identity.Email)
+	if err != nil {
+		return nil, err
+	}
+	if !verified {
+		return nil, apperrors.ErrForbidden.WithDetails(map[string]interface{}{"reason": "the email of the sign-in is not a verified email of this account"})
+	}
+
+	owner, err := models.GetUserByUID(ctx, db, identity.UID)
+	if errors.Is(err, apperrors.ErrUserNotFound) {
+		identity.UserID = userID
+		if err := models.SaveIdentity(ctx, db, identity); err != nil {
+			return nil, err
+		}
+		logger.For(ctx, "account.LinkIdentity").Infof("Linked %s identity %s to user %d", identity.Provider, identity.UID, userID)
+		return emptyMerge(userID), nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	if owner.ID == userID {
+		return emptyMerge(userID), nil
+	}
+	return Merge(ctx, db, client, jobs, owner.ID, userID)
+}
+
+func emptyMerge(userID uint64) *MergeResult {
+	return &MergeResult{IntoUserID: userID, Rows: map[string]int64{}, Dates: []string{}}
+}
+
+// Merge moves the data and identities of the account fromID into the account
+// intoID and erases fromID. Events and bookmarks are moved, bookmarks of a
+// page both accounts saved are kept once. Daily summaries and reading
+// progress of the same day or page are added up and the streak is counted
+// again from the added up days, it is never shorter than either account's.
+// Settings, scores and other rows of one per day or week keep the row of
+// intoID, the scores of Dates should be recomputed.
+func Merge(ctx context.Context, db db.Database, client *redis.Client, jobs JobQueue, fromID, intoID uint64) (*MergeResult, error) {
+	return merge(ctx, db, client, jobs, fromID, intoID, true)
+}
+
+// merge is Merge, without keepIdentities the uids of fromID are recorded in
+// deleted_accounts for their Firebase users to be deleted
+func merge(ctx context.Context, db db.Database, client *redis.Client, jobs JobQueue, fromID, intoID uint64, keepIdentities bool) (*MergeResult, error) {
+	if fromID == intoID {
+		return nil, apperrors.ErrConflict.WithDetails(map[string]interface{}{"reason": "cannot merge an account into itself"})
+	}
+	from, err := getMergeUser(ctx, db, fromID)
+	if err != nil {
+		return nil, err
+	}
+	into, err := getMergeUser(ctx, db, intoID)
+	if err != nil {
+		return nil, err
+	}
+
+	result := emptyMerge(intoID)
+	result.FromUserID = fromID
+	err = db.Select(ctx, &result.Dates, "SELECT DATE_FORMAT(date, '%Y-%m-%d') FROM daily_summaries WHERE user_id = ? ORDER BY date", fromID)
+	if err != nil {
+		return nil, fmt.Errorf("failed to get summaries of user %d: %w", fromID, err)
+	}
+	if result.Dates == nil {
+		result.Dates = []string{}
+	}
+
+	merged, err := mergedStreak(ctx, db, fromID, intoID)
+	if err != nil {
+		return nil, err
+	}
+	previous, err := streak.GetUserStreak(ctx, db, intoID)
+	if err != nil {
+		return nil, err
+	}
+
+	var uids []string
+	if err := db.Select(ctx, &uids, "SELECT uid FROM user_identities WHERE user_id = ? AND uid <> ?", fromID, from.UID); err != nil {
+		return nil, fmt.Errorf("failed to get identities of user %d: %w", fromID, err)
+	}
+	uids = append([]string{from.UID}, uids...)
+
+	// a queued job of fromID must not write rows back after the merge
+	if err := dropRedis(ctx, client, jobs, fromID, from.UID); err != nil {
+		return nil, err
+	}
+
+	tx, err := db.Begin(ctx)
+	if err != nil {
+		return nil, err
+	}
+	defer tx.Rollback()
+
+	steps := []mergeStep{
+		{
+			table: "reading_events",
+			query: "UPDATE reading_events SET user_id = ? WHERE user_id = ?",
+			args:  []interface{}{intoID, fromID},
+		},
+		{
+			table: "reading_sessions",
+			query: "UPDATE reading_sessions SET user_id = ? WHERE user_id = ?",
+			args:  []interface{}{intoID, fromID},
+		},
+		{
+			table: "listening_events",
+			query: "UPDATE listening_events SET user_id = ? WHERE user_id = ?",
+			args:  []interface{}{intoID, fromID},
+		},
+		{
+			table: "daily_summaries",
+			query: `
+			INSERT INTO daily_summaries (user_id, date, total_seconds, listening_seconds, threshold_met)
+			SELECT ?, f.date, f.total_seconds, f.listening_seconds, f.threshold_met FROM daily_summaries f WHERE f.user_id = ?
+			ON DUPLICATE KEY UPDATE
+			threshold_met = daily_summaries.total_seconds + VALUES(total_seconds) >= ?
+				OR (? > 0 AND daily_summaries.listening_seconds + VALUES(listening_seconds) >= ?),
+			total_seconds = daily_summaries.total_seconds + VALUES(total_seconds),
+			listening_seconds = daily_summaries.listening_seconds + VALUES(listening_seconds)
+			`,
+			args: []interface{}{intoID, fromID, streak.MinReadingTimeThreshold, streak.Listening.Goal(), streak.Listening.Goal()},
+		},
+		{
+			table: "user_streaks",
+			query: `
+			INSERT INTO user_streaks (user_id, current_streak, longest_streak, last_active_date)
+			VALUES (?, ?, ?, ?)
+			ON DUPLICATE KEY UPDATE
+			current_streak = VALUES(current_streak),
+			longest_streak = VALUES(longest_streak),
+			last_active_date = VALUES(last_active_date)
+			`,
+			args: []interface{}{intoID, merged.CurrentStreak, merged.LongestStreak, merged.LastActiveDate},
+		},
+		{
+			table: "streak_events",
+			query: "UPDATE streak_events SET user_id = ? WHERE user_id = ?",
+			args:  []interface{}{intoID, fromID},
+		},
+		{
+			table: "user_reading_progress",
+			query: `
+			INSERT INTO user_reading_progress (user_id, page_number, surah_name, first_read_date, read_count)
+			SELECT ?, f.page_number, f.surah_name, f.first_read_date, f.read_count FROM user_reading_progress f WHERE f.user_id = ?
+			ON DUPLICATE KEY UPDATE
+			first_read_date = COALESCE(LEAST(user_reading_progress.first_read_date, VALUES(first_read_date)), user_reading_progress.first_read_date, VALUES(first_read_date)),
+			read_count = user_reading_progress.read_count + VALUES(read_count)
+			`,
+			args: []interface{}{intoID, fromID},
+		},
+		{
+			table: "bookmarks",
+			query: "DELETE f FROM bookmarks f JOIN bookmarks i ON i.user_id = ? AND i.page_number = f.page_number WHERE f.user_id = ?",
+			args:  []interface{}{into.UID, from.UID},
+		},
+		{
+			table: "bookmarks",
+			query: "UPDATE bookmarks SET user_id = ? WHERE user_id = ?",
+			args:  []interface{}{into.UID, from.UID},
+		},
+		{
+			table: "user_daily_scores",
+			query: "UPDATE IGNORE user_daily_scores SET user_id = ? WHERE user_id = ?",
+			args:  []interface{}{intoID, fromID},
+		},
+		{
+			table: "user_weekly_scores",
+			query: "UPDATE IGNORE user_weekly_scores SET user_id = ? WHERE user_id = ?",
+			args:  []interface{}{intoID, fromID},
+		},
+		{
+			table: "user_settings",
+			query: "UPDATE IGNORE user_settings SET user_id = ? WHERE user_id = ?",
+			args:  []interface{}{intoID, fromID},
+		},
+		{
+			table: "user_profile_changes",
+			query: "UPDATE user_profile_changes SET user_id = ? WHERE user_id = ?",
+			args:  []interface{}{intoID, fromID},
+		},
+		{
+			// reminders reach the devices of both accounts
+			table: "user_devices",
+			query: "UPDATE user_devices SET user_id = ?, uid = ? WHERE user_id = ?",
+			args:  []interface{}{intoID, into.UID, fromID},
+		},
+		{
+			table: "notification_outbox",
+			query: "UPDATE notification_outbox SET user_id = ? WHERE user_id = ?",
+			args:  []interface{}{intoID, fromID},
+		},
+	}
+	if keepIdentities {
+		steps = append(steps,
+			mergeStep{
+				// signing in with any uid of fromID reaches intoID from now on
+				table: "user_identities",
+				query: "INSERT INTO user_identities (user_id, uid, email) VALUES (?, ?, ?) ON DUPLICATE KEY UPDATE user_id = VALUES(user_id)",
+				args:  []interface{}{intoID, from.UID, from.Email},
+			},
+			mergeStep{
+				table: "user_identities",
+				query: "UPDATE user_identities SET user_id = ? WHERE user_id = ?",
+				args:  []interface{}{intoID, fromID},
+			},
+		)
+	}
+	for _, step := range steps {
+		rows, err := db.ExecTx(ctx, tx, step.query, step.args...)
+		if err != nil {
+			return nil, fmt.Errorf("failed to merge %s of user %d into %d: %w", step.table, fromID, intoID, err)
+		}
+		result.Rows[step.table] += rows
+	}
+	cause := streak.Cause{Trigger: streak.TriggerMerge, Reason: fmt.Sprintf("user %d merged", fromID)}
+	if err := streak.RecordEvent(ctx, db, tx, cause, previous, merged); err != nil {
+		return nil, err
+	}
+
+	if !keepIdentities {
+		if err := recordPurge(ctx, db, tx, fromID, uids, from.DeletedAt); err != nil {
+			return nil, err
+		}
+	}
+	// what was not moved lost to a row of intoID
+	if err := erase(ctx, db, tx, fromID, from.UID); err != nil {
+		return nil, err
+	}
+
+	if err := tx.Commit(); err != nil {
+		return nil, err
+	}
+
+	logger.For(ctx, "account.Merge").Infof("Merged user %d into %d: %v", fromID, intoID, result.Rows)
+	return result, nil
+}
+
+// mergedStreak counts the streak of two accounts from the days their added up
+// reading, or listening under the separate policy, met the threshold. The current streak is at least the one of the
+// account active last, the longest at least either account's.
+func mergedStreak(ctx context.Context, db db.Database, fromID, intoID uint64) (streak.UserStreak, error) {
+	merged := streak.UserStreak{UserID: intoID}
+
+	var days []time.Time
+	query := `
+		SELECT date FROM daily_summaries WHERE user_id IN (?, ?) GROUP BY date
+		HAVING SUM(total_seconds) >= ? OR (? > 0 AND SUM(listening_seconds) >= ?)
+		ORDER BY date
+	`
+	err := db.Select(ctx, &days, query, fromID, intoID, streak.MinReadingTimeThreshold, streak.Listening.Goal(), streak.Listening.Goal())
+	if err != nil {
+		return merged, fmt.Errorf("failed to get reading days of users %d and %d: %w", fromID, intoID, err)
+	}
+
+	var stored []streak.UserStreak
+	err = db.Select(ctx, &stored, "SELECT user_id, current_streak, longest_streak, last_active_date FROM user_streaks WHERE user_id IN (?, ?)", fromID, intoID)
+	if err != nil {
+		return merged, fmt.Errorf("failed to get streaks of users %d and %d: %w", fromID, intoID, err)
+	}
+
+	if len(days) > 0 {
+		merged.CurrentStreak, merged.LongestStreak = streak.CountStreaks(days)
+		merged.LastActiveDate = sql.NullTime{Time: days[len(days)-1], Valid: true}
+	}
+	for _, s := range stored {
+		merged.LongestStreak = max(merged.LongestStreak, s.LongestStreak)
+		if !s.LastActiveDate.Valid {
+			continue
+		}
+		switch {
+		case !merged.LastActiveDate.Valid || s.LastActiveDate.Time.After(merged.LastActiveDate.Time):
+			merged.LastActiveDate = s.LastActiveDate
+			merged.CurrentStreak = s.CurrentStreak
+		case s.LastActiveDate.Time.Equal(merged.LastActiveDate.Time):
+			merged.CurrentStreak = max(merged.CurrentStreak, s.CurrentStreak)
+		}
+	}
+	merged.LongestStreak = max(merged.LongestStreak, merged.CurrentStreak)
+	return merged, nil
+}
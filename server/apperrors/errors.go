@@ -0,0 +1,150 @@
+// Package apperrors is the error model of the API. An Error carries a stable
+// machine readable Code, the HTTP status it maps to, and the cause, which is
+// logged but never sent to clients. The message clients see comes from the
+// localised catalog in messages.go.
+package apperrors
+
+import (
+	"database/sql"
+	"errors"
+	"fmt"
+	"net/http"
+)
+
+// Code identifies an error for clients, codes are part of the API and must not change
+type Code string
+
+const (
+	CodeInvalidRequest       Code = "invalid_request"
+	CodeValidationFailed     Code = "validation_failed"
+	CodeNoFieldsToUpdate     Code = "no_fields_to_update"
+	CodeUnauthenticated      Code = "unauthenticated"
+	CodeInvalidToken         Code = "invalid_token"
+	CodeTokenExpired         Code = "token_expired"
+	CodeForbidden            Code = "forbidden"
+	CodeNotFound             Code = "not_found"
+	CodeUserNotFound         Code = "user_not_found"
+	CodeDeviceNotFound       Code = "device_not_found"
+	CodeNotificationNotFound Code = "notification_not_found"
+	CodeJobNotFound          Code = "job_not_found"
+	CodeWebPushNotConfigured Code = "web_push_not_configured"
+	CodeConflict             Code = "conflict"
+	CodeUserAlreadyExists    Code = "user_already_exists"
+	CodeAccountDeleted       Code = "account_deleted"
+	CodeExportNotFound       Code = "export_not_found"
+	CodeExportNotReady       Code = "export_not_ready"
+	CodeSessionNotFound      Code = "session_not_found"
+	CodeSessionEnded         Code = "session_ended"
+	CodeRateLimited          Code = "rate_limited"
+	CodeIdempotencyKeyReused Code = "idempotency_key_reused"
+	CodeRequestInProgress    Code = "request_in_progress"
+	CodeInternal             Code = "internal"
+	CodeUnavailable          Code = "unavailable"
+)
+
+// Error is a domain error with the HTTP status it is served with
+type Error struct {
+	Code   Code
+	Status int
+	// Message is the English fallback when the catalog has no entry for Code
+	Message string
+	// Details are extra machine readable values, e.g. the invalid fields
+	Details map[string]interface{}
+	// Err is the cause, for logs only
+	Err error
+}
+
+func (e *Error) Error() string {
+	if e.Err != nil {
+		return fmt.Sprintf("%s: %s: %v", e.Code, e.Message, e.Err)
+	}
+	return fmt.Sprintf("%s: %s", e.Code, e.Message)
+}
+
+func (e *Error) Unwrap() error {
+	return e.Err
+}
+
+// Is matches any *Error with the same code, so errors.Is(err, ErrUserNotFound)
+// holds for a wrapped or annotated copy
+func (e *Error) Is(target error) bool {
+	t, ok := target.(*Error)
+	return ok && t.Code == e.Code
+}
+
+// Wrap returns a copy of e with err as its cause
+func (e *Error) Wrap(err error) *Error {
+	c := *e
+	c.Err = err
+	return &c
+}
+
+// WithDetails returns a copy of e with details added
+func (e *Error) WithDetails(details map[string]interface{}) *Error {
+	c := *e
+	c.Details = make(map[string]interface{}, len(e.Details)+len(details))
+	for k, v := range e.Details {
+		c.Details[k] = v
+	}
+	for k, v := range details {
+		c.Details[k] = v
+	}
+	return &c
+}
+
+// New defines a domain error, packages declare theirs as variables
+func New(code Code, status int, message string) *Error {
+	return &Error{Code: code, Status: status, Message: message}
+}
+
+var (
+	ErrInvalidRequest       = New(CodeInvalidRequest, http.StatusBadRequest, "invalid request")
+	ErrValidationFailed     = New(CodeValidationFailed, http.StatusBadRequest, "some fields are missing or invalid")
+	ErrNoFieldsToUpdate     = New(CodeNoFieldsToUpdate, http.StatusBadRequest, "no fields to update")
+	ErrUnauthenticated      = New(CodeUnauthenticated, http.StatusUnauthorized, "authentication required")
+	ErrInvalidToken         = New(CodeInvalidToken, http.StatusUnauthorized, "invalid token")
+	ErrTokenExpired         = New(CodeTokenExpired, http.StatusUnauthorized, "token expired")
+	ErrForbidden            = New(CodeForbidden, http.StatusForbidden, "you are not allowed to do this")
+	ErrNotFound             = New(CodeNotFound, http.StatusNotFound, "not found")
+	ErrUserNotFound         = New(CodeUserNotFound, http.StatusNotFound, "user not found")
+	ErrDeviceNotFound       = New(CodeDeviceNotFound, http.StatusNotFound, "device not found")
+	ErrNotificationNotFound = New(CodeNotificationNotFound, http.StatusNotFound, "notification not found")
+	ErrJobNotFound          = New(CodeJobNotFound, http.StatusNotFound, "job not found")
+	ErrWebPushNotConfigured = New(CodeWebPushNotConfigured, http.StatusNotFound, "web push is not configured")
+	ErrConflict             = New(CodeConflict, http.StatusConflict, "conflict")
+	ErrUserAlreadyExists    = New(CodeUserAlreadyExists, http.StatusConflict, "user already exists")
+	ErrAccountDeleted       = New(CodeAccountDeleted, http.StatusGone, "account is scheduled for deletion")
+	ErrExportNotFound       = New(CodeExportNotFound, http.StatusNotFound, "export not found")
+	ErrExportNotReady       = New(CodeExportNotReady, http.StatusConflict, "export is not ready")
+	ErrSessionNotFound      = New(CodeSessionNotFound, http.StatusNotFound, "reading session not found")
+	ErrSessionEnded         = New(CodeSessionEnded, http.StatusConflict, "reading session has ended")
+	ErrRateLimited          = New(CodeRateLimited, http.StatusTooManyRequests, "too many requests")
+	ErrIdempotencyKeyReused = New(CodeIdempotencyKeyReused, http.StatusUnprocessableEntity, "idempotency key was used for a different request")
+	ErrRequestInProgress    = New(CodeRequestInProgress, http.StatusConflict, "a request with this idempotency key is in progress")
+	ErrInternal             = New(CodeInternal, http.StatusInternalServerError, "something went wrong")
+	ErrUnavailable          = New(CodeUnavailable, http.StatusServiceUnavailable, "service temporarily unavailable")
+)
+
+// InvalidRequest is ErrInvalidRequest with a specific reason, reason is shown
+// to clients in details.reason so it must not contain internal values
+func InvalidRequest(reason string) *Error {
+	return ErrInvalidRequest.WithDetails(map[string]interface{}{"reason": reason})
+}
+
+// Internal wraps an unexpected error, clients only see the generic message
+func Internal(err error) *Error {
+	return ErrInternal.Wrap(err)
+}
+
+// From converts any error to an *Error. sql.ErrNoRows becomes ErrNotFound and
+// everything unknown becomes ErrInternal so raw driver errors never reach clients.
+func From(err error) *Error {
+	var e *Error
+	if errors.As(err, &e) {
+		return e
+	}
+	if errors.Is(err, sql.ErrNoRows) {
+		return ErrNotFound.Wrap(err)
+	}
+	return Internal(err)
+}
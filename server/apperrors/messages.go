@@ -0,0 +1,204 @@
+package apperrors
+
+import "strings"
+
+// DefaultLocale is used when neither the locale nor its base language has a message
+const DefaultLocale = "en"
+
+// messages holds the text clients see per code and locale, clients should
+// branch on the code and only display the message
+var messages = map[Code]map[string]string{
+	CodeInvalidRequest: {
+		"en": "The request is invalid.",
+		"so": "Codsigu ma saxna.",
+		"ar": "الطلب غير صالح.",
+		"tr": "İstek geçersiz.",
+		"ur": "درخواست درست نہیں ہے۔",
+	},
+	CodeValidationFailed: {
+		"en": "Some fields are missing or invalid.",
+		"so": "Qaar ka mid ah xogta ayaa maqan ama khaldan.",
+		"ar": "بعض الحقول مفقودة أو غير صالحة.",
+		"tr": "Bazı alanlar eksik veya geçersiz.",
+		"ur": "کچھ خانے خالی یا غلط ہیں۔",
+	},
+	CodeNoFieldsToUpdate: {
+		"en": "There is nothing to update.",
+		"so": "Wax la cusboonaysiiyo ma jiraan.",
+		"ar": "لا يوجد ما يتم تحديثه.",
+		"tr": "Güncellenecek bir şey yok.",
+		"ur": "تبدیل کرنے کے لیے کچھ نہیں ہے۔",
+	},
+	CodeUnauthenticated: {
+		"en": "Please sign in to continue.",
+		"so": "Fadlan gal si aad u sii waddo.",
+		"ar": "يرجى تسجيل الدخول للمتابعة.",
+		"tr": "Devam etmek için lütfen giriş yapın.",
+		"ur": "جاری رکھنے کے لیے براہ کرم سائن ان کریں۔",
+	},
+	CodeInvalidToken: {
+		"en": "Your session is not valid, please sign in again.",
+		"so": "Fadhigaagu ma ansaxo, fadlan mar kale gal.",
+		"ar": "جلستك غير صالحة، يرجى تسجيل الدخول مرة أخرى.",
+		"tr": "Oturumunuz geçersiz, lütfen tekrar giriş yapın.",
+		"ur": "آپ کا سیشن درست نہیں، براہ کرم دوبارہ سائن ان کریں۔",
+	},
+	CodeTokenExpired: {
+		"en": "Your session has expired, please sign in again.",
+		"so": "Fadhigaagu wuu dhacay, fadlan mar kale gal.",
+		"ar": "انتهت صلاحية جلستك، يرجى تسجيل الدخول مرة أخرى.",
+		"tr": "Oturumunuzun süresi doldu, lütfen tekrar giriş yapın.",
+		"ur": "آپ کا سیشن ختم ہو گیا، براہ کرم دوبارہ سائن ان کریں۔",
+	},
+	CodeForbidden: {
+		"en": "You are not allowed to do this.",
+		"so": "Looma ogola inaad tan samayso.",
+		"ar": "غير مسموح لك بالقيام بذلك.",
+		"tr": "Bunu yapmaya yetkiniz yok.",
+		"ur": "آپ کو یہ کرنے کی اجازت نہیں ہے۔",
+	},
+	CodeNotFound: {
+		"en": "We could not find what you asked for.",
+		"so": "Waxaad codsatay lama helin.",
+		"ar": "لم نتمكن من العثور على ما طلبته.",
+		"tr": "İstediğiniz şey bulunamadı.",
+		"ur": "آپ کی مطلوبہ چیز نہیں ملی۔",
+	},
+	CodeUserNotFound: {
+		"en": "We could not find your account.",
+		"so": "Akoonkaaga lama helin.",
+		"ar": "لم نتمكن من العثور على حسابك.",
+		"tr": "Hesabınız bulunamadı.",
+		"ur": "آپ کا اکاؤنٹ نہیں ملا۔",
+	},
+	CodeDeviceNotFound: {
+		"en": "This device is not registered.",
+		"so": "Qalabkan lama diiwaangelin.",
+		"ar": "هذا الجهاز غير مسجل.",
+		"tr": "Bu cihaz kayıtlı değil.",
+		"ur": "یہ آلہ رجسٹرڈ نہیں ہے۔",
+	},
+	CodeNotificationNotFound: {
+		"en": "Notification not found.",
+	},
+	CodeJobNotFound: {
+		"en": "Job not found.",
+	},
+	CodeWebPushNotConfigured: {
+		"en": "Browser notifications are not available.",
+		"so": "Ogeysiisyada browser-ka lama heli karo.",
+		"ar": "إشعارات المتصفح غير متاحة.",
+		"tr": "Tarayıcı bildirimleri kullanılamıyor.",
+		"ur": "براؤزر نوٹیفیکیشن دستیاب نہیں ہیں۔",
+	},
+	CodeConflict: {
+		"en": "This conflicts with the current state, please refresh and try again.",
+		"so": "Tani waxay ka hor imanaysaa xaaladda hadda, fadlan cusboonaysii oo isku day mar kale.",
+		"ar": "هذا يتعارض مع الحالة الحالية، يرجى التحديث والمحاولة مرة أخرى.",
+		"tr": "Bu mevcut durumla çelişiyor, lütfen yenileyip tekrar deneyin.",
+		"ur": "یہ موجودہ حالت سے متصادم ہے، براہ کرم ریفریش کر کے دوبارہ کوشش کریں۔",
+	},
+	CodeUserAlreadyExists: {
+		"en": "An account already exists.",
+		"so": "Akoon horey ayuu u jiray.",
+		"ar": "يوجد حساب بالفعل.",
+		"tr": "Bu hesap zaten var.",
+		"ur": "اکاؤنٹ پہلے سے موجود ہے۔",
+	},
+	CodeAccountDeleted: {
+		"en": "This account is scheduled for deletion. Restore it to continue.",
+		"so": "Akoonkan waxaa loo qorsheeyay in la tirtiro. Soo celi si aad u sii waddo.",
+		"ar": "هذا الحساب مجدول للحذف. استعده للمتابعة.",
+		"tr": "Bu hesabın silinmesi planlandı. Devam etmek için hesabı geri yükleyin.",
+		"ur": "یہ اکاؤنٹ حذف ہونے والا ہے۔ جاری رکھنے کے لیے اسے بحال کریں۔",
+	},
+	CodeExportNotFound: {
+		"en": "The export could not be found.",
+		"so": "Xogta la soo saaray lama helin.",
+		"ar": "لم يتم العثور على ملف التصدير.",
+		"tr": "Dışa aktarma bulunamadı.",
+		"ur": "ایکسپورٹ نہیں ملا۔",
+	},
+	CodeExportNotReady: {
+		"en": "The export is still being prepared, please try again shortly.",
+		"so": "Xogta weli waa la diyaarinayaa, fadlan dhawaan isku day.",
+		"ar": "لا يزال التصدير قيد التحضير، يرجى المحاولة بعد قليل.",
+		"tr": "Dışa aktarma hâlâ hazırlanıyor, lütfen birazdan tekrar deneyin.",
+		"ur": "ایکسپورٹ ابھی تیار ہو رہا ہے، براہ کرم تھوڑی دیر بعد کوشش کریں۔",
+	},
+	CodeSessionNotFound: {
+		"en": "The reading session could not be found.",
+		"so": "Fadhiga akhriska lama helin.",
+		"ar": "لم يتم العثور على جلسة القراءة.",
+		"tr": "Okuma oturumu bulunamadı.",
+		"ur": "پڑھنے کا سیشن نہیں ملا۔",
+	},
+	CodeSessionEnded: {
+		"en": "The reading session has ended, please start a new one.",
+		"so": "Fadhiga akhriska wuu dhammaaday, fadlan mid cusub bilow.",
+		"ar": "انتهت جلسة القراءة، يرجى بدء جلسة جديدة.",
+		"tr": "Okuma oturumu sona erdi, lütfen yeni bir oturum başlatın.",
+		"ur": "پڑھنے کا سیشن ختم ہو گیا ہے، براہ کرم نیا سیشن شروع کریں۔",
+	},
+	CodeRateLimited: {
+		"en": "Too many requests, please slow down and try again shortly.",
+		"so": "Codsiyo aad u badan, fadlan yara sug oo mar kale isku day.",
+		"ar": "طلبات كثيرة جدًا، يرجى التمهل والمحاولة بعد قليل.",
+		"tr": "Çok fazla istek, lütfen biraz bekleyip tekrar deneyin.",
+		"ur": "بہت زیادہ درخواستیں، براہ کرم تھوڑا رک کر دوبارہ کوشش کریں۔",
+	},
+	CodeIdempotencyKeyReused: {
+		"en": "This request key was already used for a different request.",
+		"so": "Furahan codsiga waxaa horay loogu isticmaalay codsi kale.",
+		"ar": "تم استخدام مفتاح الطلب هذا لطلب مختلف من قبل.",
+		"tr": "Bu istek anahtarı daha önce farklı bir istek için kullanıldı.",
+		"ur": "یہ درخواست کی کلید پہلے کسی دوسری درخواست کے لیے استعمال ہو چکی ہے۔",
+	},
+	CodeRequestInProgress: {
+		"en": "Your previous attempt is still being processed, please try again shortly.",
+		"so": "Isku daygaagii hore weli waa la habaynayaa, fadlan dhawaan isku day.",
+		"ar": "لا تزال محاولتك السابقة قيد المعالجة، يرجى المحاولة بعد قليل.",
+		"tr": "Önceki denemeniz hâlâ işleniyor, lütfen birazdan tekrar deneyin.",
+		"ur": "آپ کی پچھلی کوشش پر ابھی کام جاری ہے، براہ کرم تھوڑی دیر بعد کوشش کریں۔",
+	},
+	CodeInternal: {
+		"en": "Something went wrong, please try again.",
+		"so": "Wax baa khaldamay, fadlan isku day mar kale.",
+		"ar": "حدث خطأ ما، يرجى المحاولة مرة أخرى.",
+		"tr": "Bir şeyler ters gitti, lütfen tekrar deneyin.",
+		"ur": "کچھ غلط ہو گیا، براہ کرم دوبارہ کوشش کریں۔",
+	},
+	CodeUnavailable: {
+		"en": "The service is temporarily unavailable, please try again shortly.",
+		"so": "Adeegga si ku meel gaar ah looma heli karo, fadlan dhawaan isku day.",
+		"ar": "الخدمة غير متاحة مؤقتًا، يرجى المحاولة بعد قليل.",
+		"tr": "Hizmet geçici olarak kullanılamıyor, lütfen birazdan tekrar deneyin.",
+		"ur": "سروس عارضی طور پر دستیاب نہیں، براہ کرم تھوڑی دیر بعد کوشش کریں۔",
+	},
+}
+
+// RegisterMessages adds or replaces the messages of a code, packages with their
+// own codes call it from init
+func RegisterMessages(code Code, variants map[string]string) {
+	messages[code] = variants
+}
+
+// Localize returns the text for e in locale, falling back to the base language,
+// then English, then e.Message
+func (e *Error) Localize(locale string) string {
+	variants := messages[e.Code]
+	locale = strings.ReplaceAll(strings.ToLower(strings.TrimSpace(locale)), "_", "-")
+
+	if msg, ok := variants[locale]; ok {
+		return msg
+	}
+	if base, _, found := strings.Cut(locale, "-"); found {
+		if msg, ok := variants[base]; ok {
+			return msg
+		}
+	}
+	if msg, ok := variants[DefaultLocale]; ok {
+		return msg
+	}
+	return e.Message
+}
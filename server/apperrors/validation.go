@@ -0,0 +1,48 @@
+package apperrors
+
+import (
+	"encoding/json"
+	"errors"
+	"strings"
+
+	"github.com/go-playground/validator/v10"
+)
+
+// Binding converts an error from gin's ShouldBind into ErrValidationFailed
+// with the failing fields, or ErrInvalidRequest when the body is not valid JSON
+func Binding(err error) *Error {
+	var validationErrs validator.ValidationErrors
+	if errors.As(err, &validationErrs) {
+		fields := make(map[string]string, len(validationErrs))
+		for _, fe := range validationErrs {
+			fields[fieldName(fe)] = fe.Tag()
+		}
+		return ErrValidationFailed.Wrap(err).WithDetails(map[string]interface{}{"fields": fields})
+	}
+
+	var typeErr *json.UnmarshalTypeError
+	if errors.As(err, &typeErr) {
+		return ErrValidationFailed.Wrap(err).WithDetails(map[string]interface{}{
+			"fields": map[string]string{typeErr.Field: "type"},
+		})
+	}
+
+	return ErrInvalidRequest.Wrap(err).WithDetails(map[string]interface{}{"reason": "malformed body"})
+}
+
+// fieldName is the struct path without the type name, e.g. "date" for "form.Date"
+func fieldName(fe validator.FieldError) string {
+	ns := fe.Namespace()
+	if i := strings.Index(ns, "."); i >= 0 {
+		ns = ns[i+1:]
+	}
+	return ns
+}
+
+// Invalid is ErrValidationFailed for one field that broke rule, e.g.
+// Invalid("page_number", "between 1 and 604")
+func Invalid(field, rule string) *Error {
+	return ErrValidationFailed.WithDetails(map[string]interface{}{
+		"fields": map[string]string{field: rule},
+	})
+}
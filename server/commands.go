@@ -0,0 +1,251 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"flag"
+	"fmt"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/boolow5/quran-app-api/account"
+	"github.com/boolow5/quran-app-api/apperrors"
+	"github.com/boolow5/quran-app-api/config"
+	"github.com/boolow5/quran-app-api/db"
+	"github.com/boolow5/quran-app-api/logger"
+	"github.com/boolow5/quran-app-api/middlewares"
+	"github.com/boolow5/quran-app-api/models"
+	"github.com/boolow5/quran-app-api/queue"
+	"github.com/boolow5/quran-app-api/streak"
+)
+
+// command is an admin task run with `quran-app-api [flags] <name> [args]`
+// against the configured MySQL and Redis instead of starting the server
+type command struct {
+	usage string
+	run   func(ctx context.Context, cfg *config.Config, db db.Database, args []string) error
+}
+
+var commands = map[string]command{
+	"purge-accounts": {
+		usage: "[-user id] purge deleted accounts past their grace period now, or one deleted account",
+		run:   purgeAccounts,
+	},
+	"delete-firebase-accounts": {
+		usage: "[-limit n] [-dry-run] delete the Firebase users of purged accounts",
+		run:   deleteFirebaseAccounts,
+	},
+	"recompute-streaks": {
+		usage: "[-user id] [-apply] recompute streaks from daily summaries and list the ones that drifted, -apply stores them",
+		run:   recomputeStreaks,
+	},
+	"set-role": {
+		usage: "<user-id> <role> give a user the user, support or admin role",
+		run:   setRole,
+	},
+}
+
+// runCommand runs the admin command named by args[0]
+func runCommand(cfg *config.Config, args []string) error {
+	cmd, ok := commands[args[0]]
+	if !ok {
+		names := make([]string, 0, len(commands))
+		for name, cmd := range commands {
+			names = append(names, fmt.Sprintf("  %s %s", name, cmd.usage))
+		}
+		sort.Strings(names)
+		return fmt.Errorf("unknown command %q, commands are:\n%s", args[0], strings.Join(names, "\n"))
+	}
+
+	db, _ := SetupServices(cfg)
+	defer models.MySQLDB.Close()
+	defer models.Redis.Close()
+
+	return cmd.run(context.Background(), cfg, db, args[1:])
+}
+
+func purgeAccounts(ctx context.Context, cfg *config.Config, db db.Database, args []string) error {
+	fs := flag.NewFlagSet("purge-accounts", flag.ContinueOnError)
+	userID := fs.Uint64("user", 0, "purge this deleted account even if its grace period is not over")
+	if err := fs.Parse(args); err != nil {
+		return err
+	}
+
+	jobs := queue.New(models.Redis)
+	if *userID == 0 {
+		purged, err := account.PurgeDue(ctx, db, models.Redis, jobs)
+		logger.Component("main.purgeAccounts").Infof("Purged %d deleted accounts", purged)
+		return err
+	}
+
+	var user models.User
+	if err := db.Get(ctx, &user, "SELECT * FROM users WHERE id = ?", *userID); err != nil {
+		return fmt.Errorf("failed to get user %d: %w", *userID, err)
+	}
+	if !user.DeletedAt.Valid {
+		// a typo must not erase someone who never asked for it
+		return fmt.Errorf("user %d has not deleted their account", *userID)
+	}
+	return account.Purge(ctx, db, models.Redis, jobs, *userID)
+}
+
+func deleteFirebaseAccounts(ctx context.Context, cfg *config.Config, db db.Database, args []string) error {
+	fs := flag.NewFlagSet("delete-firebase-accounts", flag.ContinueOnError)
+	limit := fs.Int("limit", 1000, "most accounts to delete in this run")
+	dryRun := fs.Bool("dry-run", false, "list the accounts without deleting them")
+	if err := fs.Parse(args); err != nil {
+		return err
+	}
+
+	accounts, err := account.PendingFirebaseDeletions(ctx, db, *limit)
+	if err != nil {
+		return err
+	}
+	if len(accounts) == 0 || *dryRun {
+		for _, acc := range accounts {
+			fmt.Fprintf(os.Stdout, "%d\t%s\tpurged %s\n", acc.UserID, acc.UID, acc.PurgedAt.Format("2006-01-02 15:04"))
+		}
+		logger.Component("main.deleteFirebaseAccounts").Infof("%d Firebase users to delete", len(accounts))
+		return nil
+	}
+
+	auth, err := middlewares.NewFirebaseAuth(cfg.Firebase.CredentialsJSON)
+	if err != nil {
+		return err
+	}
+
+	uids := make([]string, len(accounts))
+	for i, acc := range accounts {
+		uids[i] = acc.UID
+	}
+	failed, err := auth.DeleteUsers(ctx, uids)
+	if err != nil {
+		return err
+	}
+
+	var errs []error
+	deleted := 0
+	for _, acc := range accounts {
+		if reason, ok := failed[acc.UID]; ok {
+			errs = append(errs, fmt.Errorf("user %d (%s): %s", acc.UserID, acc.UID, reason))
+			continue
+		}
+		// signing in again after the purge creates a new account, it is deleted with the Firebase user
+		if err := deleteRecreatedUser(ctx, db, acc.UID); err != nil {
+			errs = append(errs, err)
+		}
+		if err := account.MarkFirebaseDeleted(ctx, db, acc.UserID, acc.UID); err != nil {
+			errs = append(errs, err)
+			continue
+		}
+		deleted++
+	}
+
+	logger.Component("main.deleteFirebaseAccounts").Infof("Deleted %d of %d Firebase users", deleted, len(accounts))
+	return errors.Join(errs...)
+}
+
+func deleteRecreatedUser(ctx context.Context, db db.Database, uid string) error {
+	user, err := models.GetUserByUID(ctx, db, uid)
+	if errors.Is(err, apperrors.ErrUserNotFound) {
+		return nil
+	}
+	if err != nil {
+		return fmt.Errorf("failed to look up %s: %w", uid, err)
+	}
+
+	if _, err := db.Exec(ctx, "UPDATE users SET deleted_at = NOW(), purge_after = NOW() WHERE id = ?", user.ID); err != nil {
+		return fmt.Errorf("failed to delete recreated user %d: %w", user.ID, err)
+	}
+	return nil
+}
+
+func setRole(ctx context.Context, cfg *config.Config, db db.Database, args []string) error {
+	if len(args) != 2 {
+		return fmt.Errorf("usage: set-role <user-id> <role>")
+	}
+	userID, err := strconv.ParseUint(args[0], 10, 64)
+	if err != nil {
+		return fmt.Errorf("invalid user id %q", args[0])
+	}
+	if !models.ValidRole(args[1]) {
+		return fmt.Errorf("invalid role %q, roles are %s", args[1], strings.Join(models.Roles, ", "))
+	}
+
+	found, err := models.SetRole(ctx, db, userID, args[1])
+	if err != nil {
+		return err
+	}
+	if !found {
+		return fmt.Errorf("user %d not found", userID)
+	}
+	logger.Component("main.setRole").Infof("User %d is now %s", userID, args[1])
+	return nil
+}
+
+func recomputeStreaks(ctx context.Context, cfg *config.Config, db db.Database, args []string) error {
+	fs := flag.NewFlagSet("recompute-streaks", flag.ContinueOnError)
+	userID := fs.Uint64("user", 0, "only recompute this user")
+	apply := fs.Bool("apply", false, "store the recomputed streaks of users that drifted")
+	if err := fs.Parse(args); err != nil {
+		return err
+	}
+
+	userIDs := []uint64{*userID}
+	var lastID uint64
+	checked, drifted, failed := 0, 0, 0
+	for {
+		if *userID == 0 {
+			userIDs = nil
+			if err := db.Select(ctx, &userIDs, "SELECT id FROM users WHERE deleted_at IS NULL AND id > ? ORDER BY id LIMIT 500", lastID); err != nil {
+				return fmt.Errorf("failed to list users: %w", err)
+			}
+			if len(userIDs) == 0 {
+				break
+			}
+			lastID = userIDs[len(userIDs)-1]
+		}
+
+		for _, id := range userIDs {
+			// one user's bad data must not stop the others from being checked
+			drift, err := streak.RecomputeUser(ctx, db, id, time.Now())
+			if err != nil {
+				logger.Component("main.recomputeStreaks").Errorf("Failed to recompute streak of user %d: %v", id, err)
+				failed++
+				continue
+			}
+			checked++
+			if len(drift.Fields) == 0 {
+				continue
+			}
+			drifted++
+			fmt.Fprintf(os.Stdout, "%d\t%s\t%s\t-> %s\n", id, strings.Join(drift.Fields, ","), formatStreak(drift.Stored), formatStreak(drift.Computed))
+			if *apply {
+				if err := streak.FixDrift(ctx, db, drift, streak.Cause{Reason: "recompute-streaks command"}); err != nil {
+					logger.Component("main.recomputeStreaks").Errorf("Failed to fix streak of user %d: %v", id, err)
+					failed++
+				}
+			}
+		}
+		if *userID != 0 {
+			break
+		}
+	}
+
+	logger.Component("main.recomputeStreaks").Infof("%d of %d streaks drifted, applied: %t", drifted, checked, *apply)
+	if failed > 0 {
+		return fmt.Errorf("failed to recompute or fix the streaks of %d users, see the log for each", failed)
+	}
+	return nil
+}
+
+func formatStreak(s streak.UserStreak) string {
+	lastActive := "-"
+	if s.LastActiveDate.Valid {
+		lastActive = s.LastActiveDate.Time.Format("2006-01-02")
+	}
+	return fmt.Sprintf("current=%d longest=%d last_active=%s", s.CurrentStreak, s.LongestStreak, lastActive)
+}
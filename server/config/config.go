@@ -0,0 +1,265 @@
+// Package config loads the server configuration into a typed struct. Values
+// come from, in increasing precedence: the defaults below, a YAML file
+// (-config or CONFIG_FILE), environment variables and command line flags.
+// Every field names its YAML key, variable and flag in its tags, see
+// config.example.yaml for a full file.
+package config
+
+import (
+	"strings"
+	"time"
+)
+
+type Config struct {
+	AppName string `yaml:"app_name" env:"APP_NAME" flag:"app-name"`
+
+	HTTP        HTTP        `yaml:"http"`
+	MySQL       MySQL       `yaml:"mysql"`
+	Redis       Redis       `yaml:"redis"`
+	Firebase    Firebase    `yaml:"firebase"`
+	Push        Push        `yaml:"push"`
+	Log         Log         `yaml:"log"`
+	Tracing     Tracing     `yaml:"tracing"`
+	Metrics     Metrics     `yaml:"metrics"`
+	OpenAPI     OpenAPI     `yaml:"openapi"`
+	RateLimit   RateLimit   `yaml:"rate_limit"`
+	Idempotency Idempotency `yaml:"idempotency"`
+	Account     Account     `yaml:"account"`
+	Admin       Admin       `yaml:"admin"`
+	Cron        Cron        `yaml:"cron"`
+	Reminders   Reminders   `yaml:"reminders"`
+	Streak      Streak      `yaml:"streak"`
+	Queue       Queue       `yaml:"queue"`
+}
+
+type HTTP struct {
+	Addr string `yaml:"addr" env:"HTTP_ADDR" flag:"http.addr"`
+	// CORSOrigins are host[:port] values, the scheme of the Origin header is ignored
+	CORSOrigins    []string `yaml:"cors_origins" env:"CORS_ORIGINS" flag:"http.cors-origins"`
+	TrustedProxies []string `yaml:"trusted_proxies" env:"TRUSTED_PROXIES" flag:"http.trusted-proxies"`
+	// ShutdownTimeout bounds the whole shutdown, keep it below the orchestrator's grace period
+	ShutdownTimeout time.Duration `yaml:"shutdown_timeout" env:"SHUTDOWN_TIMEOUT" flag:"http.shutdown-timeout"`
+	// DrainDelay is how long /readyz fails before the listener closes
+	DrainDelay time.Duration `yaml:"drain_delay" env:"SHUTDOWN_DRAIN_DELAY" flag:"http.drain-delay"`
+}
+
+type MySQL struct {
+	URL              string `yaml:"url" env:"QURAN_API_MYSQL_URL" secret:"true"`
+	CreateTablesPath string `yaml:"create_tables_path" env:"QURAN_API_MYSQL_CREATE_TABLES_PATH" flag:"mysql.create-tables-path"`
+}
+
+type Redis struct {
+	// Host is host[:port], the port defaults to 6379
+	Host     string `yaml:"host" env:"REDIS_HOST" flag:"redis.host"`
+	Password string `yaml:"password" env:"REDIS_PASSWORD" secret:"true"`
+}
+
+// Addr is Host with the default port added when it has none
+func (r Redis) Addr() string {
+	if !strings.Contains(r.Host, ":") {
+		return r.Host + ":6379"
+	}
+	return r.Host
+}
+
+type Firebase struct {
+	// Credentials is the base64 encoded service account JSON
+	Credentials string `yaml:"credentials" env:"FIREBASE_CREDENTIALS" secret:"true"`
+	// CredentialsFile is a path to the service account JSON, used when Credentials is empty
+	CredentialsFile string `yaml:"credentials_file" env:"FIREBASE_CREDENTIALS_FILE" flag:"firebase.credentials-file"`
+
+	// CredentialsJSON is the decoded service account, set by Load
+	CredentialsJSON []byte `yaml:"-"`
+}
+
+type Push struct {
+	// Transport is "fcm", or "fake" to record messages in memory
+	Transport       string `yaml:"transport" env:"PUSH_TRANSPORT" flag:"push.transport"`
+	Concurrency     int    `yaml:"concurrency" env:"PUSH_CONCURRENCY" flag:"push.concurrency"`
+	FCMIcon         string `yaml:"fcm_icon" env:"FCM_ICON" flag:"push.fcm-icon"`
+	VAPIDPublicKey  string `yaml:"vapid_public_key" env:"VAPID_PUBLIC_KEY" flag:"push.vapid-public-key"`
+	VAPIDPrivateKey string `yaml:"vapid_private_key" env:"VAPID_PRIVATE_KEY" secret:"true"`
+	VAPIDSubject    string `yaml:"vapid_subject" env:"VAPID_SUBJECT" flag:"push.vapid-subject"`
+}
+
+type Log struct {
+	Level  string `yaml:"level" env:"LOG_LEVEL" flag:"log.level"`
+	Format string `yaml:"format" env:"LOG_FORMAT" flag:"log.format"`
+}
+
+type Tracing struct {
+	// Exporter is "otlp", "stdout" or "none"
+	Exporter    string  `yaml:"exporter" env:"OTEL_TRACES_EXPORTER" flag:"tracing.exporter"`
+	ServiceName string  `yaml:"service_name" env:"OTEL_SERVICE_NAME" flag:"tracing.service-name"`
+	SampleRatio float64 `yaml:"sample_ratio" env:"TRACE_SAMPLE_RATIO" flag:"tracing.sample-ratio"`
+}
+
+type Metrics struct {
+	// Token protects /metrics with a bearer token when set
+	Token string `yaml:"token" env:"METRICS_TOKEN" secret:"true"`
+}
+
+type OpenAPI struct {
+	// ValidateRequests rejects requests that do not match the document
+	ValidateRequests bool `yaml:"validate_requests" env:"OPENAPI_VALIDATE_REQUESTS" flag:"openapi.validate-requests"`
+	// ValidateResponses logs and counts responses that do not match the document,
+	// it buffers every response so keep it to staging
+	ValidateResponses bool `yaml:"validate_responses" env:"OPENAPI_VALIDATE_RESPONSES" flag:"openapi.validate-responses"`
+}
+
+// RateLimit limits are "<requests>/<duration> [burst=<n>]", e.g. "120/1m burst=60",
+// an empty limit lets everything through. IP applies before authentication,
+// the route group limits apply per user and per device.
+type RateLimit struct {
+	Enabled bool `yaml:"enabled" env:"RATE_LIMIT_ENABLED" flag:"rate-limit.enabled"`
+	// Allowlist holds IPs, CIDRs and Firebase UIDs of internal callers that are never limited
+	Allowlist []string `yaml:"allowlist" env:"RATE_LIMIT_ALLOWLIST" flag:"rate-limit.allowlist"`
+
+	IP            string `yaml:"ip" env:"RATE_LIMIT_IP" flag:"rate-limit.ip"`
+	Reading       string `yaml:"reading" env:"RATE_LIMIT_READING" flag:"rate-limit.reading"`
+	Bookmarks     string `yaml:"bookmarks" env:"RATE_LIMIT_BOOKMARKS" flag:"rate-limit.bookmarks"`
+	Notifications string `yaml:"notifications" env:"RATE_LIMIT_NOTIFICATIONS" flag:"rate-limit.notifications"`
+	Account       string `yaml:"account" env:"RATE_LIMIT_ACCOUNT" flag:"rate-limit.account"`
+	Admin         string `yaml:"admin" env:"RATE_LIMIT_ADMIN" flag:"rate-limit.admin"`
+}
+
+type Idempotency struct {
+	// TTL is how long a response is replayed for its Idempotency-Key
+	TTL time.Duration `yaml:"ttl" env:"IDEMPOTENCY_TTL" flag:"idempotency.ttl"`
+	// LockTTL frees the key of a request that never finished, e.g. after a crash
+	LockTTL time.Duration `yaml:"lock_ttl" env:"IDEMPOTENCY_LOCK_TTL" flag:"idempotency.lock-ttl"`
+}
+
+type Account struct {
+	// DeletionGracePeriod is how long a deleted account can be restored before its data is purged
+	DeletionGracePeriod time.Duration `yaml:"deletion_grace_period" env:"ACCOUNT_DELETION_GRACE_PERIOD" flag:"account.deletion-grace-period"`
+	// ExportTTL is how long a data export can be downloaded
+	ExportTTL time.Duration `yaml:"export_ttl" env:"ACCOUNT_EXPORT_TTL" flag:"account.export-ttl"`
+}
+
+type Admin struct {
+	// UIDs are given the admin role at startup, other roles are given from
+	// the admin API or with the set-role command
+	UIDs []string `yaml:"uids" env:"ADMIN_UIDS" flag:"admin.uids"`
+}
+
+// Cron schedules use the standard five field syntax
+type Cron struct {
+	ReminderSchedule     string `yaml:"reminder_schedule" env:"CRON_REMINDER_SCHEDULE" flag:"cron.reminder-schedule"`
+	StreakSchedule       string `yaml:"streak_schedule" env:"CRON_STREAK_SCHEDULE" flag:"cron.streak-schedule"`
+	DeviceExpirySchedule string `yaml:"device_expiry_schedule" env:"CRON_DEVICE_EXPIRY_SCHEDULE" flag:"cron.device-expiry-schedule"`
+	// AccountCleanupSchedule purges deleted accounts and expired data exports
+	AccountCleanupSchedule string `yaml:"account_cleanup_schedule" env:"CRON_ACCOUNT_CLEANUP_SCHEDULE" flag:"cron.account-cleanup-schedule"`
+	// SessionTimeoutSchedule ends the reading sessions that stopped sending heartbeats
+	SessionTimeoutSchedule string `yaml:"session_timeout_schedule" env:"CRON_SESSION_TIMEOUT_SCHEDULE" flag:"cron.session-timeout-schedule"`
+	// DeviceExpiryDays is how long a device may go without registering its token
+	DeviceExpiryDays int `yaml:"device_expiry_days" env:"DEVICE_EXPIRY_DAYS" flag:"cron.device-expiry-days"`
+}
+
+// Reminders are the local hours (0-23) streak reminders go out at
+type Reminders struct {
+	MorningHour     int `yaml:"morning_hour" env:"REMINDER_MORNING_HOUR" flag:"reminders.morning-hour"`
+	EveningHour     int `yaml:"evening_hour" env:"REMINDER_EVENING_HOUR" flag:"reminders.evening-hour"`
+	LateEveningHour int `yaml:"late_evening_hour" env:"REMINDER_LATE_EVENING_HOUR" flag:"reminders.late-evening-hour"`
+}
+
+type Streak struct {
+	// MinReadingSeconds is the reading time a day needs to count towards the streak
+	MinReadingSeconds int `yaml:"min_reading_seconds" env:"STREAK_MIN_READING_SECONDS" flag:"streak.min-reading-seconds"`
+	// SessionTimeout ends a reading session that sent no heartbeat for this long
+	SessionTimeout time.Duration `yaml:"session_timeout" env:"STREAK_SESSION_TIMEOUT" flag:"streak.session-timeout"`
+	// ListeningPolicy is how listening to a recitation counts towards the
+	// day: full counts it as reading, partial counts ListeningWeight of it and
+	// separate gives it its own goal of MinListeningSeconds
+	ListeningPolicy string `yaml:"listening_policy" env:"STREAK_LISTENING_POLICY" flag:"streak.listening-policy"`
+	// ListeningWeight is the share of listening counted as reading by the
+	// partial policy, and towards scores by the separate one
+	ListeningWeight     float64 `yaml:"listening_weight" env:"STREAK_LISTENING_WEIGHT" flag:"streak.listening-weight"`
+	MinListeningSeconds int     `yaml:"min_listening_seconds" env:"STREAK_MIN_LISTENING_SECONDS" flag:"streak.min-listening-seconds"`
+}
+
+type Queue struct {
+	Workers int `yaml:"workers" env:"QUEUE_WORKERS" flag:"queue.workers"`
+}
+
+// Default returns the configuration used when nothing is set
+func Default() *Config {
+	return &Config{
+		HTTP: HTTP{
+			Addr: "0.0.0.0:1140",
+			CORSOrigins: []string{
+				"quran-api.mahad.dev",
+				"localhost:4580",
+				"127.0.0.1:4580",
+				"192.168.100.50:1140",
+			},
+			TrustedProxies:  []string{"127.0.0.1:1140", "localhost:1140", ""},
+			ShutdownTimeout: 25 * time.Second,
+			DrainDelay:      5 * time.Second,
+		},
+		MySQL: MySQL{
+			CreateTablesPath: "./db/create_tables.sql",
+		},
+		Redis: Redis{
+			Host: "localhost",
+		},
+		Push: Push{
+			Transport:   "fcm",
+			Concurrency: 4,
+		},
+		Log: Log{
+			Level:  "info",
+			Format: "json",
+		},
+		Tracing: Tracing{
+			Exporter:    "none",
+			ServiceName: "quran-app-api",
+			SampleRatio: 1,
+		},
+		OpenAPI: OpenAPI{
+			ValidateRequests: true,
+		},
+		RateLimit: RateLimit{
+			Enabled: true,
+			IP:      "600/1m burst=300",
+			// the app flushes its offline queue of reading events in one go
+			Reading:       "60/1m burst=200",
+			Bookmarks:     "60/1m burst=60",
+			Notifications: "20/1m burst=10",
+			Account:       "20/1m burst=10",
+		},
+		Idempotency: Idempotency{
+			TTL:     24 * time.Hour,
+			LockTTL: time.Minute,
+		},
+		Account: Account{
+			DeletionGracePeriod: 30 * 24 * time.Hour,
+			ExportTTL:           7 * 24 * time.Hour,
+		},
+		Cron: Cron{
+			ReminderSchedule:       "5 * * * *",
+			StreakSchedule:         "0 */6 * * *",
+			DeviceExpirySchedule:   "30 3 * * *",
+			AccountCleanupSchedule: "15 4 * * *",
+			SessionTimeoutSchedule: "*/5 * * * *",
+			DeviceExpiryDays:       60,
+		},
+		Reminders: Reminders{
+			// TODO: change to 6am
+			MorningHour:     4,
+			EveningHour:     18,
+			LateEveningHour: 19,
+		},
+		Streak: Streak{
+			MinReadingSeconds: 300,
+			SessionTimeout:    10 * time.Minute,
+			ListeningPolicy:   "partial",
+			ListeningWeight:   0.5,
+			// a goal twice the reading one, as listening is half as much by default
+			MinListeningSeconds: 600,
+		},
+		Queue: Queue{
+			Workers: 4,
+		},
+	}
+}
@@ -0,0 +1,189 @@
+package config
+
+import (
+	"encoding/base64"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"reflect"
+	"strconv"
+	"strings"
+	"time"
+
+	"gopkg.in/yaml.v3"
+)
+
+// Options are the flags that are not configuration values
+type Options struct {
+	// File is the YAML file to read, from -config or CONFIG_FILE
+	File string
+	// PrintConfig asks main to print the redacted configuration and exit
+	PrintConfig bool
+	// Command is what follows the flags, an admin command and its arguments
+	// that main runs instead of the server
+	Command []string
+}
+
+// Load builds the configuration from the defaults, the file, the environment
+// and args (usually os.Args[1:]) and validates it
+func Load(args []string) (*Config, Options, error) {
+	cfg := Default()
+
+	fs := flag.NewFlagSet("quran-app-api", flag.ContinueOnError)
+	opts := Options{}
+	fs.StringVar(&opts.File, "config", os.Getenv("CONFIG_FILE"), "YAML configuration file")
+	fs.BoolVar(&opts.PrintConfig, "print-config", false, "print the configuration with secrets redacted and exit")
+
+	// flags are declared first so -help lists them, and applied last
+	flagValues := map[string]*string{}
+	walk(reflect.ValueOf(cfg).Elem(), "", func(field reflect.StructField, _ reflect.Value, _ string) {
+		if name := field.Tag.Get("flag"); name != "" {
+			flagValues[name] = fs.String(name, "", fmt.Sprintf("overrides %s", field.Tag.Get("env")))
+		}
+	})
+	if err := fs.Parse(args); err != nil {
+		return nil, opts, err
+	}
+	opts.Command = fs.Args()
+
+	if opts.File != "" {
+		if err := loadFile(cfg, opts.File); err != nil {
+			return nil, opts, err
+		}
+	}
+
+	var errs []error
+	set := map[string]bool{}
+	fs.Visit(func(f *flag.Flag) { set[f.Name] = true })
+	walk(reflect.ValueOf(cfg).Elem(), "", func(field reflect.StructField, value reflect.Value, path string) {
+		if env := field.Tag.Get("env"); env != "" {
+			if raw, ok := os.LookupEnv(env); ok {
+				if err := setValue(value, raw); err != nil {
+					errs = append(errs, fmt.Errorf("%s (%s): %v", path, env, err))
+				}
+			}
+		}
+		if name := field.Tag.Get("flag"); set[name] {
+			if err := setValue(value, *flagValues[name]); err != nil {
+				errs = append(errs, fmt.Errorf("%s (-%s): %v", path, name, err))
+			}
+		}
+	})
+	if len(errs) > 0 {
+		return nil, opts, errors.Join(errs...)
+	}
+
+	if err := cfg.decodeCredentials(); err != nil {
+		return nil, opts, err
+	}
+
+	return cfg, opts, cfg.Validate()
+}
+
+func loadFile(cfg *Config, path string) error {
+	f, err := os.Open(path)
+	if err != nil {
+		return fmt.Errorf("config file: %v", err)
+	}
+	defer f.Close()
+
+	decoder := yaml.NewDecoder(f)
+	// a typo in a key would otherwise silently keep the default
+	decoder.KnownFields(true)
+	if err := decoder.Decode(cfg); err != nil && !errors.Is(err, io.EOF) {
+		return fmt.Errorf("config file %s: %v", path, err)
+	}
+	return nil
+}
+
+// decodeCredentials decodes the Firebase service account once for every user of it
+func (c *Config) decodeCredentials() error {
+	if c.Firebase.Credentials != "" {
+		credentials, err := base64.StdEncoding.DecodeString(strings.TrimSpace(c.Firebase.Credentials))
+		if err != nil {
+			return fmt.Errorf("firebase.credentials (FIREBASE_CREDENTIALS) is not valid base64: %v", err)
+		}
+		c.Firebase.CredentialsJSON = credentials
+		return nil
+	}
+
+	if c.Firebase.CredentialsFile != "" {
+		credentials, err := os.ReadFile(c.Firebase.CredentialsFile)
+		if err != nil {
+			return fmt.Errorf("firebase.credentials_file (FIREBASE_CREDENTIALS_FILE): %v", err)
+		}
+		c.Firebase.CredentialsJSON = credentials
+	}
+	return nil
+}
+
+// walk calls fn for every configurable field below v with its YAML path
+func walk(v reflect.Value, prefix string, fn func(field reflect.StructField, value reflect.Value, path string)) {
+	t := v.Type()
+	for i := 0; i < t.NumField(); i++ {
+		field := t.Field(i)
+		key := strings.Split(field.Tag.Get("yaml"), ",")[0]
+		if key == "-" {
+			continue
+		}
+		path := key
+		if prefix != "" {
+			path = prefix + "." + key
+		}
+
+		if field.Type.Kind() == reflect.Struct {
+			walk(v.Field(i), path, fn)
+			continue
+		}
+		fn(field, v.Field(i), path)
+	}
+}
+
+var durationType = reflect.TypeOf(time.Duration(0))
+
+// setValue parses raw into value, lists are comma separated
+func setValue(value reflect.Value, raw string) error {
+	raw = strings.TrimSpace(raw)
+
+	switch {
+	case value.Type() == durationType:
+		d, err := time.ParseDuration(raw)
+		if err != nil {
+			return err
+		}
+		value.SetInt(int64(d))
+	case value.Kind() == reflect.String:
+		value.SetString(raw)
+	case value.Kind() == reflect.Int:
+		n, err := strconv.Atoi(raw)
+		if err != nil {
+			return fmt.Errorf("%q is not a whole number", raw)
+		}
+		value.SetInt(int64(n))
+	case value.Kind() == reflect.Float64:
+		f, err := strconv.ParseFloat(raw, 64)
+		if err != nil {
+			return fmt.Errorf("%q is not a number", raw)
+		}
+		value.SetFloat(f)
+	case value.Kind() == reflect.Bool:
+		b, err := strconv.ParseBool(raw)
+		if err != nil {
+			return fmt.Errorf("%q is not true or false", raw)
+		}
+		value.SetBool(b)
+	case value.Kind() == reflect.Slice && value.Type().Elem().Kind() == reflect.String:
+		list := []string{}
+		for _, item := range strings.Split(raw, ",") {
+			if item = strings.TrimSpace(item); item != "" {
+				list = append(list, item)
+			}
+		}
+		value.Set(reflect.ValueOf(list))
+	default:
+		return fmt.Errorf("unsupported type %s", value.Type())
+	}
+	return nil
+}
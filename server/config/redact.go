@@ -0,0 +1,47 @@
+package config
+
+import (
+	"reflect"
+	"strings"
+	"time"
+
+	"gopkg.in/yaml.v3"
+)
+
+const redacted = "[REDACTED]"
+
+// Redacted returns the configuration as nested maps keyed like the YAML file,
+// with secrets replaced so it can be logged. Unset secrets stay empty so a
+// missing one is still visible.
+func (c *Config) Redacted() map[string]interface{} {
+	out := map[string]interface{}{}
+	walk(reflect.ValueOf(c).Elem(), "", func(field reflect.StructField, value reflect.Value, path string) {
+		var v interface{} = value.Interface()
+		if d, ok := v.(time.Duration); ok {
+			v = d.String()
+		}
+		if field.Tag.Get("secret") == "true" && !value.IsZero() {
+			v = redacted
+		}
+
+		keys := strings.Split(path, ".")
+		m := out
+		for _, key := range keys[:len(keys)-1] {
+			if _, ok := m[key]; !ok {
+				m[key] = map[string]interface{}{}
+			}
+			m = m[key].(map[string]interface{})
+		}
+		m[keys[len(keys)-1]] = v
+	})
+	return out
+}
+
+// Dump is Redacted as YAML, for -print-config
+func (c *Config) Dump() string {
+	b, err := yaml.Marshal(c.Redacted())
+	if err != nil {
+		return err.Error()
+	}
+	return string(b)
+}
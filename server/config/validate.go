@@ -0,0 +1,161 @@
+package config
+
+import (
+	"errors"
+	"fmt"
+	"net"
+	"strings"
+	"time"
+
+	"github.com/boolow5/quran-app-api/ratelimit"
+	"github.com/robfig/cron/v3"
+	log "github.com/sirupsen/logrus"
+)
+
+// Validate reports every invalid value at once, so a new environment is fixed
+// in one round instead of one crash per setting
+func (c *Config) Validate() error {
+	var errs []error
+	fail := func(format string, args ...interface{}) {
+		errs = append(errs, fmt.Errorf(format, args...))
+	}
+
+	if _, _, err := net.SplitHostPort(c.HTTP.Addr); err != nil {
+		fail("http.addr (HTTP_ADDR) must be host:port, got %q", c.HTTP.Addr)
+	}
+	if c.HTTP.ShutdownTimeout <= 0 {
+		fail("http.shutdown_timeout (SHUTDOWN_TIMEOUT) must be positive")
+	}
+	if c.HTTP.DrainDelay < 0 || c.HTTP.DrainDelay >= c.HTTP.ShutdownTimeout {
+		fail("http.drain_delay (SHUTDOWN_DRAIN_DELAY) must be between 0 and http.shutdown_timeout")
+	}
+	for _, origin := range c.HTTP.CORSOrigins {
+		if strings.Contains(origin, "/") {
+			fail("http.cors_origins (CORS_ORIGINS) takes host[:port] without a scheme or path, got %q", origin)
+		}
+	}
+
+	if c.MySQL.URL == "" {
+		fail("mysql.url (QURAN_API_MYSQL_URL) is required")
+	}
+	if c.Redis.Host == "" {
+		fail("redis.host (REDIS_HOST) is required")
+	}
+
+	// token verification needs the service account even when pushes are faked
+	if len(c.Firebase.CredentialsJSON) == 0 {
+		fail("firebase.credentials (FIREBASE_CREDENTIALS) or firebase.credentials_file (FIREBASE_CREDENTIALS_FILE) is required")
+	}
+
+	switch c.Push.Transport {
+	case "fcm", "fake":
+	default:
+		fail("push.transport (PUSH_TRANSPORT) must be fcm or fake, got %q", c.Push.Transport)
+	}
+	if c.Push.Concurrency < 1 {
+		fail("push.concurrency (PUSH_CONCURRENCY) must be at least 1")
+	}
+	if (c.Push.VAPIDPublicKey == "") != (c.Push.VAPIDPrivateKey == "") {
+		fail("push.vapid_public_key (VAPID_PUBLIC_KEY) and push.vapid_private_key (VAPID_PRIVATE_KEY) must be set together")
+	}
+
+	if _, err := log.ParseLevel(c.Log.Level); err != nil {
+		fail("log.level (LOG_LEVEL) must be debug, info, warn or error, got %q", c.Log.Level)
+	}
+	switch c.Log.Format {
+	case "json", "text":
+	default:
+		fail("log.format (LOG_FORMAT) must be json or text, got %q", c.Log.Format)
+	}
+
+	switch c.Tracing.Exporter {
+	case "otlp", "stdout", "none":
+	default:
+		fail("tracing.exporter (OTEL_TRACES_EXPORTER) must be otlp, stdout or none, got %q", c.Tracing.Exporter)
+	}
+	if c.Tracing.SampleRatio < 0 || c.Tracing.SampleRatio > 1 {
+		fail("tracing.sample_ratio (TRACE_SAMPLE_RATIO) must be between 0 and 1")
+	}
+
+	if c.OpenAPI.ValidateResponses && !c.OpenAPI.ValidateRequests {
+		fail("openapi.validate_responses (OPENAPI_VALIDATE_RESPONSES) needs openapi.validate_requests (OPENAPI_VALIDATE_REQUESTS)")
+	}
+
+	for name, limit := range map[string]string{
+		"rate_limit.ip (RATE_LIMIT_IP)":                       c.RateLimit.IP,
+		"rate_limit.reading (RATE_LIMIT_READING)":             c.RateLimit.Reading,
+		"rate_limit.bookmarks (RATE_LIMIT_BOOKMARKS)":         c.RateLimit.Bookmarks,
+		"rate_limit.notifications (RATE_LIMIT_NOTIFICATIONS)": c.RateLimit.Notifications,
+		"rate_limit.account (RATE_LIMIT_ACCOUNT)":             c.RateLimit.Account,
+		"rate_limit.admin (RATE_LIMIT_ADMIN)":                 c.RateLimit.Admin,
+	} {
+		if _, err := ratelimit.ParseLimit(limit); err != nil {
+			fail("%s: %v", name, err)
+		}
+	}
+
+	if c.Idempotency.TTL <= 0 {
+		fail("idempotency.ttl (IDEMPOTENCY_TTL) must be positive")
+	}
+	if c.Idempotency.LockTTL <= 0 || c.Idempotency.LockTTL > c.Idempotency.TTL {
+		fail("idempotency.lock_ttl (IDEMPOTENCY_LOCK_TTL) must be between 0 and idempotency.ttl")
+	}
+
+	if c.Account.DeletionGracePeriod < 0 {
+		fail("account.deletion_grace_period (ACCOUNT_DELETION_GRACE_PERIOD) must not be negative")
+	}
+	if c.Account.ExportTTL <= 0 {
+		fail("account.export_ttl (ACCOUNT_EXPORT_TTL) must be positive")
+	}
+
+	for name, schedule := range map[string]string{
+		"cron.reminder_schedule (CRON_REMINDER_SCHEDULE)":               c.Cron.ReminderSchedule,
+		"cron.streak_schedule (CRON_STREAK_SCHEDULE)":                   c.Cron.StreakSchedule,
+		"cron.device_expiry_schedule (CRON_DEVICE_EXPIRY_SCHEDULE)":     c.Cron.DeviceExpirySchedule,
+		"cron.account_cleanup_schedule (CRON_ACCOUNT_CLEANUP_SCHEDULE)": c.Cron.AccountCleanupSchedule,
+		"cron.session_timeout_schedule (CRON_SESSION_TIMEOUT_SCHEDULE)": c.Cron.SessionTimeoutSchedule,
+	} {
+		if _, err := cron.ParseStandard(schedule); err != nil {
+			fail("%s: %v", name, err)
+		}
+	}
+	if c.Cron.DeviceExpiryDays < 1 {
+		fail("cron.device_expiry_days (DEVICE_EXPIRY_DAYS) must be at least 1")
+	}
+
+	for name, hour := range map[string]int{
+		"reminders.morning_hour (REMINDER_MORNING_HOUR)":           c.Reminders.MorningHour,
+		"reminders.evening_hour (REMINDER_EVENING_HOUR)":           c.Reminders.EveningHour,
+		"reminders.late_evening_hour (REMINDER_LATE_EVENING_HOUR)": c.Reminders.LateEveningHour,
+	} {
+		if hour < 0 || hour > 23 {
+			fail("%s must be between 0 and 23", name)
+		}
+	}
+
+	if c.Streak.MinReadingSeconds < 1 {
+		fail("streak.min_reading_seconds (STREAK_MIN_READING_SECONDS) must be at least 1")
+	}
+	if c.Streak.SessionTimeout < time.Minute {
+		fail("streak.session_timeout (STREAK_SESSION_TIMEOUT) must be at least 1m")
+	}
+	switch c.Streak.ListeningPolicy {
+	case "full", "partial", "separate":
+	default:
+		fail("streak.listening_policy (STREAK_LISTENING_POLICY) must be full, partial or separate, got %q", c.Streak.ListeningPolicy)
+	}
+	if c.Streak.ListeningWeight < 0 || c.Streak.ListeningWeight > 1 {
+		fail("streak.listening_weight (STREAK_LISTENING_WEIGHT) must be between 0 and 1")
+	}
+	if c.Streak.MinListeningSeconds < 1 {
+		fail("streak.min_listening_seconds (STREAK_MIN_LISTENING_SECONDS) must be at least 1")
+	}
+	if c.Queue.Workers < 1 {
+		fail("queue.workers (QUEUE_WORKERS) must be at least 1")
+	}
+
+	if len(errs) > 0 {
+		return fmt.Errorf("invalid configuration:\n%w", errors.Join(errs...))
+	}
+	return nil
+}
@@ -0,0 +1,190 @@
+package controllers
+
+import (
+	"database/sql"
+	"strconv"
+
+	"github.com/boolow5/quran-app-api/account"
+	"github.com/boolow5/quran-app-api/apperrors"
+	"github.com/boolow5/quran-app-api/logger"
+	"github.com/boolow5/quran-app-api/middlewares"
+	"github.com/boolow5/quran-app-api/models"
+	"github.com/boolow5/quran-app-api/notifications"
+	"github.com/boolow5/quran-app-api/queue"
+	"github.com/boolow5/quran-app-api/scheduler"
+	"github.com/gin-gonic/gin"
+)
+
+// GetNotification returns an outbox message with its delivery log
+func GetNotification(c *gin.Context) {
+	id, err := strconv.ParseUint(c.Param("id"), 10, 64)
+	if err != nil {
+		middlewares.AbortWithError(c, apperrors.InvalidRequest("invalid notification id"))
+		return
+	}
+
+	msg, deliveries, err := notifications.GetOutboxMessage(c.Request.Context(), models.MySQLDB, id)
+	if err == sql.ErrNoRows {
+		middlewares.AbortWithError(c, apperrors.ErrNotificationNotFound)
+		return
+	}
+	if err != nil {
+		logger.For(c.Request.Context(), "controllers.GetNotification").Errorf("Error getting notification: %v", err)
+		middlewares.AbortWithError(c, err)
+		return
+	}
+
+	if deliveries == nil {
+		deliveries = []notifications.DeliveryAttempt{}
+	}
+
+	c.JSON(200, gin.H{
+		"notification": msg,
+		"deliveries":   deliveries,
+	})
+}
+
+// GetUserNotifications lists the latest outbox messages of a user
+func GetUserNotifications(c *gin.Context) {
+	userID, err := strconv.ParseUint(c.Query("user_id"), 10, 64)
+	if err != nil {
+		middlewares.AbortWithError(c, apperrors.InvalidRequest("user_id is required"))
+		return
+	}
+
+	messages, err := notifications.GetOutboxMessagesForUser(c.Request.Context(), models.MySQLDB, userID, 50)
+	if err != nil {
+		logger.For(c.Request.Context(), "controllers.GetUserNotifications").Errorf("Error getting notifications: %v", err)
+		middlewares.AbortWithError(c, err)
+		return
+	}
+
+	if messages == nil {
+		messages = []notifications.OutboxMessage{}
+	}
+
+	c.JSON(200, messages)
+}
+
+// GetJobs returns the cron jobs and which replica is currently running them
+func GetJobs(sched *scheduler.Scheduler) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		leader, err := scheduler.Owner(c.Request.Context(), models.Redis, scheduler.LeaderKey)
+		if err != nil {
+			logger.For(c.Request.Context(), "controllers.GetJobs").Errorf("Error getting leader: %v", err)
+		}
+
+		c.JSON(200, gin.H{
+			"leader":    leader,
+			"instance":  sched.InstanceID(),
+			"is_leader": sched.IsLeader(),
+			"jobs":      sched.Jobs(),
+		})
+	}
+}
+
+// GetJobRuns returns the latest job runs, optionally filtered with ?job=
+func GetJobRuns(c *gin.Context) {
+	limit, err := strconv.Atoi(c.DefaultQuery("limit", "50"))
+	if err != nil || limit < 1 || limit > 500 {
+		middlewares.AbortWithError(c, apperrors.InvalidRequest("limit must be between 1 and 500"))
+		return
+	}
+
+	runs, err := scheduler.GetJobRuns(c.Request.Context(), models.MySQLDB, c.Query("job"), limit)
+	if err != nil {
+		logger.For(c.Request.Context(), "controllers.GetJobRuns").Errorf("Error getting job runs: %v", err)
+		middlewares.AbortWithError(c, err)
+		return
+	}
+
+	if runs == nil {
+		runs = []scheduler.JobRun{}
+	}
+
+	c.JSON(200, runs)
+}
+
+// GetQueueStats returns the size of the background job queue
+func GetQueueStats(q *queue.Queue) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		stats, err := q.Stats(c.Request.Context())
+		if err != nil {
+			logger.For(c.Request.Context(), "controllers.GetQueueStats").Errorf("Error getting queue stats: %v", err)
+			middlewares.AbortWithError(c, err)
+			return
+		}
+
+		c.JSON(200, stats)
+	}
+}
+
+// GetDeadJobs returns the latest jobs that failed all of their attempts
+func GetDeadJobs(q *queue.Queue) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		limit, err := strconv.Atoi(c.DefaultQuery("limit", "50"))
+		if err != nil || limit < 1 || limit > 500 {
+			middlewares.AbortWithError(c, apperrors.InvalidRequest("limit must be between 1 and 500"))
+			return
+		}
+
+		jobs, err := q.DeadJobs(c.Request.Context(), int64(limit))
+		if err != nil {
+			logger.For(c.Request.Context(), "controllers.GetDeadJobs").Errorf("Error getting dead jobs: %v", err)
+			middlewares.AbortWithError(c, err)
+			return
+		}
+
+		c.JSON(200, jobs)
+	}
+}
+
+// RetryDeadJob puts a dead job back on its user's queue
+func RetryDeadJob(q *queue.Queue) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		retried, err := q.RetryDead(c.Request.Context(), c.Param("id"))
+		if err != nil {
+			logger.For(c.Request.Context(), "controllers.RetryDeadJob").Errorf("Error retrying job: %v", err)
+			middlewares.AbortWithError(c, err)
+			return
+		}
+
+		if !retried {
+			middlewares.AbortWithError(c, apperrors.ErrJobNotFound)
+			return
+		}
+
+		c.JSON(200, gin.H{
+			"success": true,
+		})
+	}
+}
+
+// MergeUsers merges one account into another for support, e.g. a user whose
+// two sign-ins have no email in common
+func MergeUsers(q *queue.Queue) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		form := struct {
+			FromUserID uint64 `json:"from_user_id" binding:"required"`
+			IntoUserID uint64 `json:"into_user_id" binding:"required"`
+		}{}
+		if err := c.ShouldBindJSON(&form); err != nil {
+			middlewares.AbortWithError(c, apperrors.Binding(err))
+			return
+		}
+		middlewares.SetAuditTarget(c, form.IntoUserID)
+		middlewares.SetAuditDetails(c, map[string]interface{}{"from_user_id": form.FromUserID})
+
+		result, err := account.Merge(c.Request.Context(), models.MySQLDB, models.Redis, q, form.FromUserID, form.IntoUserID)
+		if err != nil {
+			logger.For(c.Request.Context(), "controllers.MergeUsers").Errorf("Error merging user %d into %d: %v", form.FromUserID, form.IntoUserID, err)
+			middlewares.AbortWithError(c, err)
+			return
+		}
+
+		logger.For(c.Request.Context(), "controllers.MergeUsers").Infof("%s merged user %d into %d", c.GetString("user_id"), form.FromUserID, form.IntoUserID)
+		recomputeMergedScores(c, q, result)
+
+		c.JSON(200, result)
+	}
+}
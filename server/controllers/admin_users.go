@@ -0,0 +1,491 @@
+package controllers
+
+import (
+	"database/sql"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/boolow5/quran-app-api/apperrors"
+	"github.com/boolow5/quran-app-api/logger"
+	"github.com/boolow5/quran-app-api/middlewares"
+	"github.com/boolow5/quran-app-api/models"
+	"github.com/boolow5/quran-app-api/notifications"
+	"github.com/boolow5/quran-app-api/streak"
+	"github.com/gin-gonic/gin"
+)
+
+// maxSummaryDays caps the range of GET /admin/users/:id/summaries
+const maxSummaryDays = 366
+
+// adminLimit parses ?limit=, between 1 and max
+func adminLimit(c *gin.Context, max int) (int, bool) {
+	limit, err := strconv.Atoi(c.DefaultQuery("limit", "50"))
+	if err != nil || limit < 1 || limit > max {
+		middlewares.AbortWithError(c, apperrors.Invalid("limit", "between 1 and "+strconv.Itoa(max)))
+		return 0, false
+	}
+	return limit, true
+}
+
+// targetUser returns the user of an admin route's :id
+func targetUser(c *gin.Context) (*models.UserRecord, bool) {
+	userID, err := strconv.ParseUint(c.Param("id"), 10, 64)
+	if err != nil || userID == 0 {
+		middlewares.AbortWithError(c, apperrors.Invalid("id", "positive integer"))
+		return nil, false
+	}
+
+	user, err := models.GetUserRecord(c.Request.Context(), models.MySQLDB, userID)
+	if err != nil {
+		middlewares.AbortWithError(c, err)
+		return nil, false
+	}
+	return user, true
+}
+
+// adminCause is the cause of a streak change made by the admin of c
+func adminCause(c *gin.Context, reason string) streak.Cause {
+	cause := streak.Cause{Trigger: streak.TriggerAdmin, Reason: reason}
+	if actor, ok := middlewares.GetUser(c); ok {
+		cause.ActorUserID = &actor.ID
+	}
+	return cause
+}
+
+// SearchUsers finds users by id, uid, email or name
+func SearchUsers(c *gin.Context) {
+	search := c.Query("q")
+	if len(search) < 2 {
+		middlewares.AbortWithError(c, apperrors.Invalid("q", "at least 2 characters"))
+		return
+	}
+	limit, ok := adminLimit(c, 100)
+	if !ok {
+		return
+	}
+
+	users, err := models.SearchUsers(c.Request.Context(), models.MySQLDB, search, limit)
+	if err != nil {
+		logger.For(c.Request.Context(), "controllers.SearchUsers").Errorf("Error searching users: %v", err)
+		middlewares.AbortWithError(c, err)
+		return
+	}
+
+	if users == nil {
+		users = []models.UserRecord{}
+	}
+
+	c.JSON(200, users)
+}
+
+// GetUser returns a user with their sign-ins and streak
+func GetUser(c *gin.Context) {
+	user, ok := targetUser(c)
+	if !ok {
+		return
+	}
+
+	identities, err := models.GetIdentities(c.Request.Context(), models.MySQLDB, user.ID)
+	if err != nil {
+		logger.For(c.Request.Context(), "controllers.GetUser").Errorf("Error getting identities: %v", err)
+		middlewares.AbortWithError(c, err)
+		return
+	}
+	if identities == nil {
+		identities = []models.Identity{}
+	}
+
+	current, err := streak.GetUserStreak(c.Request.Context(), models.MySQLDB, user.ID)
+	if err != nil {
+		logger.For(c.Request.Context(), "controllers.GetUser").Errorf("Error getting streak: %v", err)
+		middlewares.AbortWithError(c, err)
+		return
+	}
+
+	c.JSON(200, gin.H{
+		"user":       user,
+		"identities": identities,
+		"streak":     current,
+	})
+}
+
+// GetUserSummaries returns the daily summaries of a user, the last 30 days by
+// default
+func GetUserSummaries(c *gin.Context) {
+	user, ok := targetUser(c)
+	if !ok {
+		return
+	}
+
+	to := time.Now().UTC()
+	if value := c.Query("to"); value != "" {
+		parsed, err := time.Parse("2006-01-02", value)
+		if err != nil {
+			middlewares.AbortWithError(c, apperrors.Invalid("to", "YYYY-MM-DD"))
+			return
+		}
+		to = parsed
+	}
+	from := to.AddDate(0, 0, -29)
+	if value := c.Query("from"); value != "" {
+		parsed, err := time.Parse("2006-01-02", value)
+		if err != nil {
+			middlewares.AbortWithError(c, apperrors.Invalid("from", "YYYY-MM-DD"))
+			return
+		}
+		from = parsed
+	}
+	if from.After(to) || to.Sub(from) > maxSummaryDays*24*time.Hour {
+		middlewares.AbortWithError(c, apperrors.Invalid("from", "at most 366 days before to"))
+		return
+	}
+
+	summaries, err := streak.GetDailySummaries(c.Request.Context(), models.MySQLDB, user.ID, from, to)
+	if err != nil {
+		logger.For(c.Request.Context(), "controllers.GetUserSummaries").Errorf("Error getting summaries: %v", err)
+		middlewares.AbortWithError(c, err)
+		return
+	}
+
+	if summaries == nil {
+		summaries = []streak.DailySummary{}
+	}
+
+	c.JSON(200, summaries)
+}
+
+func GetUserStreakAdmin(c *gin.Context) {
+	user, ok := targetUser(c)
+	if !ok {
+		return
+	}
+
+	current, err := streak.GetUserStreak(c.Request.Context(), models.MySQLDB, user.ID)
+	if err != nil {
+		logger.For(c.Request.Context(), "controllers.GetUserStreakAdmin").Errorf("Error getting streak: %v", err)
+		middlewares.AbortWithError(c, err)
+		return
+	}
+
+	c.JSON(200, current)
+}
+
+// GetUserStreakTimeline replays the latest changes of a user's streak from
+// streak_events
+func GetUserStreakTimeline(c *gin.Context) {
+	user, ok := targetUser(c)
+	if !ok {
+		return
+	}
+	limit, ok := adminLimit(c, 1000)
+	if !ok {
+		return
+	}
+
+	events, err := streak.GetEvents(c.Request.Context(), models.MySQLDB, user.ID, limit)
+	if err != nil {
+		logger.For(c.Request.Context(), "controllers.GetUserStreakTimeline").Errorf("Error getting streak events: %v", err)
+		middlewares.AbortWithError(c, err)
+		return
+	}
+
+	current, err := streak.GetUserStreak(c.Request.Context(), models.MySQLDB, user.ID)
+	if err != nil {
+		logger.For(c.Request.Context(), "controllers.GetUserStreakTimeline").Errorf("Error getting streak: %v", err)
+		middlewares.AbortWithError(c, err)
+		return
+	}
+
+	c.JSON(200, streak.Replay(events, current))
+}
+
+// RecomputeUserStreak compares a user's streak with the one recomputed from
+// their daily summaries
+func RecomputeUserStreak(c *gin.Context) {
+	user, ok := targetUser(c)
+	if !ok {
+		return
+	}
+
+	drift, err := streak.RecomputeUser(c.Request.Context(), models.MySQLDB, user.ID, time.Now())
+	if err != nil {
+		logger.For(c.Request.Context(), "controllers.RecomputeUserStreak").Errorf("Error recomputing streak: %v", err)
+		middlewares.AbortWithError(c, err)
+		return
+	}
+
+	c.JSON(200, drift)
+}
+
+// FixUserStreak stores the streak recomputed from a user's daily summaries
+// when it differs from the stored one
+func FixUserStreak(c *gin.Context) {
+	user, ok := targetUser(c)
+	if !ok {
+		return
+	}
+
+	form := struct {
+		Reason string `json:"reason" binding:"max=500"`
+	}{}
+	if err := c.ShouldBindJSON(&form); err != nil {
+		middlewares.AbortWithError(c, apperrors.Binding(err))
+		return
+	}
+
+	drift, err := streak.RecomputeUser(c.Request.Context(), models.MySQLDB, user.ID, time.Now())
+	if err != nil {
+		logger.For(c.Request.Context(), "controllers.FixUserStreak").Errorf("Error recomputing streak: %v", err)
+		middlewares.AbortWithError(c, err)
+		return
+	}
+
+	cause := adminCause(c, form.Reason)
+	cause.Trigger = streak.TriggerRecompute
+	if err := streak.FixDrift(c.Request.Context(), models.MySQLDB, drift, cause); err != nil {
+		logger.For(c.Request.Context(), "controllers.FixUserStreak").Errorf("Error storing recomputed streak: %v", err)
+		middlewares.AbortWithError(c, err)
+		return
+	}
+
+	middlewares.SetAuditDetails(c, map[string]interface{}{
+		"reason": form.Reason,
+		"before": drift.Stored,
+		"after":  drift.Computed,
+		"fields": drift.Fields,
+	})
+
+	c.JSON(200, drift)
+}
+
+// AdjustUserStreak overwrites a user's streak, the reason and the streak
+// before and after go to the audit log and the streak's timeline
+func AdjustUserStreak(c *gin.Context) {
+	user, ok := targetUser(c)
+	if !ok {
+		return
+	}
+
+	form := struct {
+		CurrentStreak  *int   `json:"current_streak" binding:"required,min=0"`
+		LongestStreak  *int   `json:"longest_streak" binding:"omitempty,min=0"`
+		LastActiveDate string `json:"last_active_date" binding:"omitempty,datetime=2006-01-02"`
+		Reason         string `json:"reason" binding:"required,max=500"`
+	}{}
+	if err := c.ShouldBindJSON(&form); err != nil {
+		middlewares.AbortWithError(c, apperrors.Binding(err))
+		return
+	}
+
+	before, err := streak.GetUserStreak(c.Request.Context(), models.MySQLDB, user.ID)
+	if err != nil {
+		logger.For(c.Request.Context(), "controllers.AdjustUserStreak").Errorf("Error getting streak: %v", err)
+		middlewares.AbortWithError(c, err)
+		return
+	}
+
+	after := before
+	after.UserID = user.ID
+	after.CurrentStreak = *form.CurrentStreak
+	if form.LongestStreak != nil {
+		after.LongestStreak = *form.LongestStreak
+	}
+	after.LongestStreak = max(after.LongestStreak, after.CurrentStreak)
+	if form.LastActiveDate != "" {
+		date, _ := time.Parse("2006-01-02", form.LastActiveDate)
+		after.LastActiveDate = sql.NullTime{Time: date, Valid: true}
+	}
+
+	if err := streak.SetStreak(c.Request.Context(), models.MySQLDB, after, adminCause(c, form.Reason)); err != nil {
+		logger.For(c.Request.Context(), "controllers.AdjustUserStreak").Errorf("Error setting streak: %v", err)
+		middlewares.AbortWithError(c, err)
+		return
+	}
+
+	middlewares.SetAuditDetails(c, map[string]interface{}{
+		"reason": form.Reason,
+		"before": before,
+		"after":  after,
+	})
+	logger.For(c.Request.Context(), "controllers.AdjustUserStreak").Infof("Streak of user %d set from %d to %d: %s", user.ID, before.CurrentStreak, after.CurrentStreak, form.Reason)
+
+	c.JSON(200, after)
+}
+
+// GetUserDevicesAdmin returns a user's devices with their push tokens
+func GetUserDevicesAdmin(c *gin.Context) {
+	user, ok := targetUser(c)
+	if !ok {
+		return
+	}
+
+	devices, err := models.GetDevicesByUserID(c.Request.Context(), models.MySQLDB, user.ID)
+	if err != nil {
+		logger.For(c.Request.Context(), "controllers.GetUserDevicesAdmin").Errorf("Error getting devices: %v", err)
+		middlewares.AbortWithError(c, err)
+		return
+	}
+
+	if devices == nil {
+		devices = []models.UserDevice{}
+	}
+
+	c.JSON(200, devices)
+}
+
+// SendTestPush queues a push to every device of a user, its delivery log is
+// at GET /admin/notifications/:id
+func SendTestPush(c *gin.Context) {
+	user, ok := targetUser(c)
+	if !ok {
+		return
+	}
+
+	form := struct {
+		Title string `json:"title" binding:"max=100"`
+		Body  string `json:"body" binding:"max=500"`
+	}{}
+	if err := c.ShouldBindJSON(&form); err != nil {
+		middlewares.AbortWithError(c, apperrors.Binding(err))
+		return
+	}
+	if form.Title == "" {
+		form.Title = "Test notification"
+	}
+	if form.Body == "" {
+		form.Body = "This is a test notification from support."
+	}
+
+	devices, err := models.GetDevicesByUserID(c.Request.Context(), models.MySQLDB, user.ID)
+	if err != nil {
+		logger.For(c.Request.Context(), "controllers.SendTestPush").Errorf("Error getting devices: %v", err)
+		middlewares.AbortWithError(c, err)
+		return
+	}
+	if len(devices) == 0 {
+		middlewares.AbortWithError(c, apperrors.ErrDeviceNotFound)
+		return
+	}
+
+	outboxID, err := notifications.Enqueue(c.Request.Context(), models.MySQLDB, notifications.OutboxMessage{
+		UserID:   user.ID,
+		Kind:     notifications.KindTestPush,
+		Title:    form.Title,
+		Body:     form.Body,
+		Priority: notifications.FCMPriorityHigh,
+	})
+	if err != nil {
+		logger.For(c.Request.Context(), "controllers.SendTestPush").Errorf("Error queueing test push: %v", err)
+		middlewares.AbortWithError(c, err)
+		return
+	}
+
+	middlewares.SetAuditDetails(c, map[string]interface{}{"outbox_id": outboxID})
+
+	c.JSON(http.StatusAccepted, gin.H{
+		"notification_id": outboxID,
+		"devices":         len(devices),
+	})
+}
+
+// SetUserRole gives a user a role
+func SetUserRole(c *gin.Context) {
+	user, ok := targetUser(c)
+	if !ok {
+		return
+	}
+
+	form := struct {
+		Role string `json:"role" binding:"required"`
+	}{}
+	if err := c.ShouldBindJSON(&form); err != nil {
+		middlewares.AbortWithError(c, apperrors.Binding(err))
+		return
+	}
+	if !models.ValidRole(form.Role) {
+		middlewares.AbortWithError(c, apperrors.Invalid("role", "one of user, support, admin"))
+		return
+	}
+	if actor, _ := middlewares.GetUser(c); actor != nil && actor.ID == user.ID {
+		// the last admin must not lock everyone out
+		middlewares.AbortWithError(c, apperrors.ErrForbidden.WithDetails(map[string]interface{}{"reason": "you cannot change your own role"}))
+		return
+	}
+
+	if _, err := models.SetRole(c.Request.Context(), models.MySQLDB, user.ID, form.Role); err != nil {
+		logger.For(c.Request.Context(), "controllers.SetUserRole").Errorf("Error setting role: %v", err)
+		middlewares.AbortWithError(c, err)
+		return
+	}
+
+	middlewares.SetAuditDetails(c, map[string]interface{}{
+		"before": user.Role,
+		"after":  form.Role,
+	})
+	user.Role = form.Role
+
+	c.JSON(200, user)
+}
+
+// ProcessStreaks runs ProcessDailyStreaks again for a day, e.g. after the
+// cron job failed
+func ProcessStreaks(c *gin.Context) {
+	form := struct {
+		Date string `json:"date" binding:"required,datetime=2006-01-02"`
+	}{}
+	if err := c.ShouldBindJSON(&form); err != nil {
+		middlewares.AbortWithError(c, apperrors.Binding(err))
+		return
+	}
+	date, _ := time.Parse("2006-01-02", form.Date)
+	if date.After(time.Now()) {
+		middlewares.AbortWithError(c, apperrors.Invalid("date", "not in the future"))
+		return
+	}
+
+	if err := streak.ProcessDailyStreaks(c.Request.Context(), models.MySQLDB, date, adminCause(c, "daily streaks processed again")); err != nil {
+		logger.For(c.Request.Context(), "controllers.ProcessStreaks").Errorf("Error processing streaks of %s: %v", form.Date, err)
+		middlewares.AbortWithError(c, err)
+		return
+	}
+
+	c.JSON(200, gin.H{
+		"message": "ok",
+		"success": true,
+	})
+}
+
+// GetAuditLog returns the latest admin actions, optionally of one actor or on
+// one user
+func GetAuditLog(c *gin.Context) {
+	limit, ok := adminLimit(c, 500)
+	if !ok {
+		return
+	}
+
+	filter := models.AuditFilter{Limit: limit}
+	for param, dest := range map[string]*uint64{"actor_id": &filter.ActorUserID, "user_id": &filter.TargetUserID} {
+		if value := c.Query(param); value != "" {
+			id, err := strconv.ParseUint(value, 10, 64)
+			if err != nil {
+				middlewares.AbortWithError(c, apperrors.Invalid(param, "positive integer"))
+				return
+			}
+			*dest = id
+		}
+	}
+
+	entries, err := models.GetAuditLog(c.Request.Context(), models.MySQLDB, filter)
+	if err != nil {
+		logger.For(c.Request.Context(), "controllers.GetAuditLog").Errorf("Error getting audit log: %v", err)
+		middlewares.AbortWithError(c, err)
+		return
+	}
+
+	if entries == nil {
+		entries = []models.AuditEntry{}
+	}
+
+	c.JSON(200, entries)
+}
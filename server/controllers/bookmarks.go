@@ -1,9 +1,12 @@
 package controllers
 
 import (
-	"fmt"
+	"errors"
 	"strings"
 
+	"github.com/boolow5/quran-app-api/apperrors"
+	"github.com/boolow5/quran-app-api/logger"
+	"github.com/boolow5/quran-app-api/middlewares"
 	"github.com/boolow5/quran-app-api/models"
 	"github.com/gin-gonic/gin"
 )
@@ -11,19 +14,15 @@ import (
 func GetBookmarks(c *gin.Context) {
 	userID, ok := c.MustGet("user_id").(string)
 	if !ok {
-		fmt.Printf("[controllers.GetBookmarks] user_id not found\n")
-		c.JSON(400, gin.H{
-			"error": "user_id not found",
-		})
+		logger.For(c.Request.Context(), "controllers.GetBookmarks").Warn("user_id not found")
+		middlewares.AbortWithError(c, apperrors.ErrUnauthenticated)
 		return
 	}
 
 	bookmarks, err := models.GetBookmarksForUser(c.Request.Context(), models.MySQLDB, userID)
 	if err != nil {
-		fmt.Printf("[controllers.GetBookmarks] Error getting bookmarks: %v\n", err)
-		c.JSON(500, gin.H{
-			"error": err.Error(),
-		})
+		logger.For(c.Request.Context(), "controllers.GetBookmarks").Errorf("Error getting bookmarks: %v", err)
+		middlewares.AbortWithError(c, err)
 		return
 	}
 
@@ -37,30 +36,24 @@ func GetBookmarks(c *gin.Context) {
 func AddBookmark(c *gin.Context) {
 	userID, ok := c.MustGet("user_id").(string)
 	if !ok {
-		fmt.Printf("[controllers.AddBookmark] user_id not found\n")
-		c.JSON(400, gin.H{
-			"error": "user_id not found",
-		})
+		logger.For(c.Request.Context(), "controllers.AddBookmark").Warn("user_id not found")
+		middlewares.AbortWithError(c, apperrors.ErrUnauthenticated)
 		return
 	}
 
 	var bookmark models.Bookmark
 	err := c.ShouldBind(&bookmark)
 	if err != nil {
-		fmt.Printf("[controllers.AddBookmark] Error binding JSON: %v\n", err)
-		c.JSON(400, gin.H{
-			"error": err.Error(),
-		})
+		logger.For(c.Request.Context(), "controllers.AddBookmark").Warnf("Error binding JSON: %v", err)
+		middlewares.AbortWithError(c, apperrors.Binding(err))
 		return
 	}
 
 	bookmark.UserID = userID
 	err = bookmark.Save(c.Request.Context(), models.MySQLDB)
 	if err != nil {
-		fmt.Printf("[controllers.AddBookmark] Error saving bookmark: %v\n", err)
-		c.JSON(500, gin.H{
-			"error": err.Error(),
-		})
+		logger.For(c.Request.Context(), "controllers.AddBookmark").Errorf("Error saving bookmark: %v", err)
+		middlewares.AbortWithError(c, err)
 		return
 	}
 
@@ -70,19 +63,15 @@ func AddBookmark(c *gin.Context) {
 func RemoveBookmark(c *gin.Context) {
 	userID, ok := c.MustGet("user_id").(string)
 	if !ok {
-		fmt.Printf("[controllers.RemoveBookmark] user_id not found\n")
-		c.JSON(400, gin.H{
-			"error": "user_id not found",
-		})
+		logger.For(c.Request.Context(), "controllers.RemoveBookmark").Warn("user_id not found")
+		middlewares.AbortWithError(c, apperrors.ErrUnauthenticated)
 		return
 	}
 
 	pageNumberStr, ok := c.Params.Get("pageNumber")
 	if !ok {
-		fmt.Printf("[controllers.RemoveBookmark] pageNumber not found\n")
-		c.JSON(400, gin.H{
-			"error": "pageNumber not found",
-		})
+		logger.For(c.Request.Context(), "controllers.RemoveBookmark").Warn("PageNumber not found")
+		middlewares.AbortWithError(c, apperrors.InvalidRequest("pageNumber is required"))
 		return
 	}
 
@@ -94,24 +83,22 @@ func RemoveBookmark(c *gin.Context) {
 		pageNumbers = append(pageNumbers, pageNumberStr)
 	}
 
-	fmt.Printf("[controllers.RemoveBookmark] pageNumbers: %v\t pageNumberStr: %v\n", pageNumbers, pageNumberStr)
+	logger.For(c.Request.Context(), "controllers.RemoveBookmark").Debugf("PageNumbers: %v pageNumberStr: %v", pageNumbers, pageNumberStr)
 
-	errMsgs := []string{}
+	errs := []error{}
 
 	for _, p := range pageNumbers {
 		err := models.RemoveBookmarkForUser(c.Request.Context(), models.MySQLDB, userID, p)
 		if err != nil {
-			fmt.Printf("[controllers.RemoveBookmark] Error removing bookmark: %v\n", err)
-			errMsgs = append(errMsgs, err.Error())
+			logger.For(c.Request.Context(), "controllers.RemoveBookmark").Errorf("Error removing bookmark: %v", err)
+			errs = append(errs, err)
 		} else {
-			fmt.Printf("[controllers.RemoveBookmark] Bookmark for page %s removed successfully\n", p)
+			logger.For(c.Request.Context(), "controllers.RemoveBookmark").Infof("Bookmark for page %s removed successfully", p)
 		}
 	}
 
-	if len(errMsgs) > 0 {
-		c.JSON(500, gin.H{
-			"error": strings.Join(errMsgs, ", "),
-		})
+	if len(errs) > 0 {
+		middlewares.AbortWithError(c, errors.Join(errs...))
 		return
 	}
 
@@ -1,51 +1,138 @@
 package controllers
 
 import (
-	"log"
+	"context"
+	"time"
 
+	"github.com/boolow5/quran-app-api/config"
 	"github.com/boolow5/quran-app-api/db"
+	"github.com/boolow5/quran-app-api/health"
+	"github.com/boolow5/quran-app-api/idempotency"
+	"github.com/boolow5/quran-app-api/logger"
 	"github.com/boolow5/quran-app-api/middlewares"
+	"github.com/boolow5/quran-app-api/models"
+	"github.com/boolow5/quran-app-api/openapi"
+	"github.com/boolow5/quran-app-api/queue"
+	"github.com/boolow5/quran-app-api/ratelimit"
+	"github.com/boolow5/quran-app-api/scheduler"
 	"github.com/gin-gonic/gin"
 )
 
-func SetupHandlers(router *gin.Engine, db db.Database) {
+func SetupHandlers(router *gin.Engine, db db.Database, cfg *config.Config, sched *scheduler.Scheduler, q *queue.Queue, checker *health.Checker) {
 	// Initialize Firebase Auth
-	// "./meezansync-95a7c-firebase-adminsdk-plq74-147577be30.json"
-	auth, err := middlewares.NewFirebaseAuth("")
+	auth, err := middlewares.NewFirebaseAuth(cfg.Firebase.CredentialsJSON)
 	if err != nil {
-		log.Fatalf("Error initializing Firebase Auth: %v", err)
+		logger.Component("controllers.SetupHandlers").Fatalf("Error initializing Firebase Auth: %v", err)
 	}
-	router.SetTrustedProxies([]string{"127.0.0.1:1140", "localhost:1140", ""})
+	checker.Add("firebase", 3*time.Second, auth.Check)
+	router.SetTrustedProxies(cfg.HTTP.TrustedProxies)
 
-	r := router.Group("/api/v1")
+	spec, err := openapi.Load(context.Background())
+	if err != nil {
+		logger.Component("controllers.SetupHandlers").Fatal(err)
+	}
+
+	r := router.Group(openapi.BasePath)
 
-	r.Use(middlewares.Cors())
+	limit := rateLimits(cfg.RateLimit)
+
+	r.Use(middlewares.Cors(cfg.HTTP.CORSOrigins))
+	r.Use(limit.ip)
+	r.GET("/openapi.json", spec.Serve)
 
 	authenicated := r.Group("")
 	authenicated.Use(auth.Middleware(db))
+	if cfg.OpenAPI.ValidateRequests {
+		authenicated.Use(middlewares.ValidateRequest(spec, cfg.OpenAPI.ValidateResponses))
+	}
+	authenicated.Use(middlewares.Idempotency(idempotency.NewStore(models.Redis), cfg.Idempotency.TTL, cfg.Idempotency.LockTTL))
+
+	// the only route left to an account waiting to be deleted, it is
+	// registered before ActiveAccount so the check does not apply to it
+	authenicated.POST("/me/restore", limit.account, RestoreMe)
+	authenicated.Use(middlewares.ActiveAccount())
 
 	// recent pages
-	recentPages := authenicated.Group("/recent-pages")
+	recentPages := authenicated.Group("/recent-pages", limit.reading)
 	recentPages.GET("", GetRecentPages)
 
-	bookmarks := authenicated.Group("/bookmarks")
+	bookmarks := authenicated.Group("/bookmarks", limit.bookmarks)
 	// bookmarks.Use(middlewares.JWTAuthentication())
 	bookmarks.GET("", GetBookmarks)
 	bookmarks.POST("", AddBookmark)
 	bookmarks.DELETE("/:pageNumber", RemoveBookmark)
 
 	// streak handlers
-	streaks := authenicated.Group("/streaks")
+	streaks := authenicated.Group("/streaks", limit.reading)
 	streaks.GET("", GetUserStreak)
-	streaks.POST("/read-event", RecordReadingEvent)
-	streaks.PUT("", UpdateDailySummary)
+	streaks.POST("/read-event", RecordReadingEvent(q))
+	streaks.POST("/listen-event", RecordListeningEvent(q))
+	streaks.GET("/listening-progress", GetListeningProgress)
+	streaks.PUT("", UpdateDailySummary(q))
+
+	// reading sessions
+	sessions := authenicated.Group("/sessions", limit.reading)
+	sessions.GET("", GetSessions)
+	sessions.POST("", StartSession)
+	sessions.GET("/analytics", GetSessionAnalytics)
+	sessions.GET("/:id", GetSession)
+	sessions.POST("/:id/heartbeat", SessionHeartbeat(q))
+	sessions.POST("/:id/end", EndSession(q))
 
 	// /api/v1/login
-	authenicated.POST("/login", auth.Login(db))
+	authenicated.POST("/login", limit.account, auth.Login(db))
+
+	// profile and settings
+	me := authenicated.Group("/me", limit.account)
+	me.GET("", GetMe)
+	me.PATCH("", UpdateMe)
+	me.GET("/history", GetMeHistory)
+	me.DELETE("", DeleteMe(cfg.Account.DeletionGracePeriod))
+	me.POST("/export", ExportMe(q, cfg.Account.ExportTTL))
+	me.GET("/export/:id", GetMeExport)
+	me.GET("/export/:id/download", DownloadMeExport)
+	me.POST("/link-guest", LinkGuest(auth, q))
+	me.GET("/identities", GetMeIdentities)
+	me.POST("/identities", LinkIdentity(auth, q))
 
 	// notifications
-	notifications := authenicated.Group("/notifications")
+	notifications := authenicated.Group("/notifications", limit.notifications)
 	notifications.POST("/device-fcm-token", CreateOrUpdateFCMToken)
+	notifications.POST("/web-push-subscription", CreateOrUpdateWebPushSubscription)
+	notifications.GET("/web-push-public-key", GetWebPushPublicKey(cfg.Push.VAPIDPublicKey))
+	notifications.GET("/devices", GetDevices)
+	notifications.DELETE("/devices/:id", RemoveDevice)
+
+	// admin
+	admin := authenicated.Group("/admin")
+	admin.Use(middlewares.RequireRole(models.RoleSupport), limit.admin, middlewares.Audit(db))
+	adminOnly := middlewares.RequireRole(models.RoleAdmin)
+	admin.GET("/notifications", GetUserNotifications)
+	admin.GET("/notifications/:id", GetNotification)
+	admin.GET("/jobs", GetJobs(sched))
+	admin.GET("/jobs/runs", GetJobRuns)
+	admin.GET("/queue", GetQueueStats(q))
+	admin.GET("/queue/dead", GetDeadJobs(q))
+	admin.POST("/queue/dead/:id/retry", adminOnly, RetryDeadJob(q))
+	admin.GET("/users", SearchUsers)
+	admin.POST("/users/merge", adminOnly, MergeUsers(q))
+	admin.GET("/users/:id", GetUser)
+	admin.GET("/users/:id/summaries", GetUserSummaries)
+	admin.GET("/users/:id/streak", GetUserStreakAdmin)
+	admin.PUT("/users/:id/streak", adminOnly, AdjustUserStreak)
+	admin.GET("/users/:id/streak/timeline", GetUserStreakTimeline)
+	admin.GET("/users/:id/streak/recompute", RecomputeUserStreak)
+	admin.POST("/users/:id/streak/recompute", adminOnly, FixUserStreak)
+	admin.GET("/users/:id/devices", GetUserDevicesAdmin)
+	admin.POST("/users/:id/test-push", SendTestPush)
+	admin.PUT("/users/:id/role", adminOnly, SetUserRole)
+	admin.POST("/streaks/process", adminOnly, ProcessStreaks)
+	admin.GET("/audit", adminOnly, GetAuditLog)
+
+	// every route must be in openapi/openapi.yaml, the apps are written against it
+	if err := spec.CheckRoutes(router.Routes()); err != nil {
+		logger.Component("controllers.SetupHandlers").Fatalf("Routes do not match the OpenAPI document:\n%v", err)
+	}
 
 	// // handle all OPTIONS requests
 	// r.OPTIONS("/*any", func(c *gin.Context) {
@@ -68,3 +155,36 @@ func SetupHandlers(router *gin.Engine, db db.Database) {
 	// 	c.AbortWithStatus(204)
 	// })
 }
+
+// groupLimits are the rate limit middlewares of the route groups
+type groupLimits struct {
+	ip, reading, bookmarks, notifications, account, admin gin.HandlerFunc
+}
+
+// rateLimits builds the limiter of every route group, they all let requests
+// through when rate limiting is disabled
+func rateLimits(cfg config.RateLimit) groupLimits {
+	if !cfg.Enabled {
+		next := func(c *gin.Context) { c.Next() }
+		return groupLimits{next, next, next, next, next, next}
+	}
+
+	// the limits were checked by config.Validate
+	parse := func(s string) ratelimit.Limit {
+		limit, err := ratelimit.ParseLimit(s)
+		if err != nil {
+			logger.Component("controllers.rateLimits").Fatal(err)
+		}
+		return limit
+	}
+
+	limiter := middlewares.NewRateLimiter(ratelimit.New(models.Redis), ratelimit.NewAllowlist(cfg.Allowlist))
+	return groupLimits{
+		ip:            limiter.ByIP(parse(cfg.IP)),
+		reading:       limiter.ByUser("reading", parse(cfg.Reading)),
+		bookmarks:     limiter.ByUser("bookmarks", parse(cfg.Bookmarks)),
+		notifications: limiter.ByUser("notifications", parse(cfg.Notifications)),
+		account:       limiter.ByUser("account", parse(cfg.Account)),
+		admin:         limiter.ByUser("admin", parse(cfg.Admin)),
+	}
+}
@@ -0,0 +1,365 @@
+package controllers
+
+import (
+	"errors"
+	"io"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/boolow5/quran-app-api/account"
+	"github.com/boolow5/quran-app-api/apperrors"
+	"github.com/boolow5/quran-app-api/logger"
+	"github.com/boolow5/quran-app-api/middlewares"
+	"github.com/boolow5/quran-app-api/models"
+	"github.com/boolow5/quran-app-api/queue"
+	"github.com/boolow5/quran-app-api/streak"
+	"github.com/gin-gonic/gin"
+)
+
+// maxProfileChanges caps GET /me/history
+const maxProfileChanges = 100
+
+func GetMe(c *gin.Context) {
+	userID, ok := c.MustGet("db_user_id").(uint64)
+	if !ok {
+		logger.For(c.Request.Context(), "controllers.GetMe").Warn("user_id not found")
+		middlewares.AbortWithError(c, apperrors.ErrUnauthenticated)
+		return
+	}
+
+	profile, err := models.GetProfile(c.Request.Context(), models.MySQLDB, userID)
+	if err != nil {
+		logger.For(c.Request.Context(), "controllers.GetMe").Errorf("Error getting profile: %v", err)
+		middlewares.AbortWithError(c, err)
+		return
+	}
+
+	c.JSON(200, profile)
+}
+
+func UpdateMe(c *gin.Context) {
+	userID, ok := c.MustGet("db_user_id").(uint64)
+	if !ok {
+		logger.For(c.Request.Context(), "controllers.UpdateMe").Warn("user_id not found")
+		middlewares.AbortWithError(c, apperrors.ErrUnauthenticated)
+		return
+	}
+
+	var update models.ProfileUpdate
+	if err := c.ShouldBindJSON(&update); err != nil {
+		logger.For(c.Request.Context(), "controllers.UpdateMe").Warnf("Error binding JSON: %v", err)
+		middlewares.AbortWithError(c, apperrors.Binding(err))
+		return
+	}
+
+	profile, err := models.UpdateProfile(c.Request.Context(), models.MySQLDB, userID, update)
+	if err != nil {
+		logger.For(c.Request.Context(), "controllers.UpdateMe").Warnf("Error updating profile: %v", err)
+		middlewares.AbortWithError(c, err)
+		return
+	}
+
+	c.JSON(200, profile)
+}
+
+func GetMeHistory(c *gin.Context) {
+	userID, ok := c.MustGet("db_user_id").(uint64)
+	if !ok {
+		logger.For(c.Request.Context(), "controllers.GetMeHistory").Warn("user_id not found")
+		middlewares.AbortWithError(c, apperrors.ErrUnauthenticated)
+		return
+	}
+
+	limit := 50
+	if value := c.Query("limit"); value != "" {
+		parsed, err := strconv.Atoi(value)
+		if err != nil || parsed < 1 || parsed > maxProfileChanges {
+			middlewares.AbortWithError(c, apperrors.Invalid("limit", "between 1 and 100"))
+			return
+		}
+		limit = parsed
+	}
+
+	changes, err := models.GetProfileChanges(c.Request.Context(), models.MySQLDB, userID, limit)
+	if err != nil {
+		logger.For(c.Request.Context(), "controllers.GetMeHistory").Errorf("Error getting profile changes: %v", err)
+		middlewares.AbortWithError(c, err)
+		return
+	}
+
+	if changes == nil {
+		changes = []models.ProfileChange{}
+	}
+
+	c.JSON(200, changes)
+}
+
+// ExportMe starts building an archive of the user's data, the client polls
+// GET /me/export/:id until it is ready
+func ExportMe(q *queue.Queue, ttl time.Duration) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		userID, ok := c.MustGet("db_user_id").(uint64)
+		if !ok {
+			logger.For(c.Request.Context(), "controllers.ExportMe").Warn("user_id not found")
+			middlewares.AbortWithError(c, apperrors.ErrUnauthenticated)
+			return
+		}
+
+		form := struct {
+			Format string `json:"format" binding:"omitempty,oneof=json csv"`
+		}{}
+		if err := c.ShouldBindJSON(&form); err != nil && !errors.Is(err, io.EOF) {
+			logger.For(c.Request.Context(), "controllers.ExportMe").Warnf("Error binding JSON: %v", err)
+			middlewares.AbortWithError(c, apperrors.Binding(err))
+			return
+		}
+		if form.Format == "" {
+			form.Format = account.FormatJSON
+		}
+
+		export, created, err := account.RequestExport(c.Request.Context(), models.MySQLDB, userID, form.Format, ttl)
+		if err != nil {
+			logger.For(c.Request.Context(), "controllers.ExportMe").Errorf("Error requesting export: %v", err)
+			middlewares.AbortWithError(c, err)
+			return
+		}
+
+		if created {
+			err = q.Enqueue(c.Request.Context(), userID, queue.TypeBuildExport, queue.BuildExport{ExportID: export.ID})
+			if err != nil {
+				logger.For(c.Request.Context(), "controllers.ExportMe").Errorf("Error queueing export %d: %v", export.ID, err)
+				middlewares.AbortWithError(c, apperrors.ErrUnavailable.Wrap(err))
+				return
+			}
+		}
+
+		c.JSON(http.StatusAccepted, export)
+	}
+}
+
+func GetMeExport(c *gin.Context) {
+	userID, ok := c.MustGet("db_user_id").(uint64)
+	if !ok {
+		logger.For(c.Request.Context(), "controllers.GetMeExport").Warn("user_id not found")
+		middlewares.AbortWithError(c, apperrors.ErrUnauthenticated)
+		return
+	}
+
+	exportID, err := strconv.ParseUint(c.Param("id"), 10, 64)
+	if err != nil || exportID == 0 {
+		middlewares.AbortWithError(c, apperrors.Invalid("id", "positive integer"))
+		return
+	}
+
+	export, err := account.GetExport(c.Request.Context(), models.MySQLDB, userID, exportID)
+	if err != nil {
+		logger.For(c.Request.Context(), "controllers.GetMeExport").Warnf("Error getting export: %v", err)
+		middlewares.AbortWithError(c, err)
+		return
+	}
+
+	c.JSON(200, export)
+}
+
+func DownloadMeExport(c *gin.Context) {
+	userID, ok := c.MustGet("db_user_id").(uint64)
+	if !ok {
+		logger.For(c.Request.Context(), "controllers.DownloadMeExport").Warn("user_id not found")
+		middlewares.AbortWithError(c, apperrors.ErrUnauthenticated)
+		return
+	}
+
+	exportID, err := strconv.ParseUint(c.Param("id"), 10, 64)
+	if err != nil || exportID == 0 {
+		middlewares.AbortWithError(c, apperrors.Invalid("id", "positive integer"))
+		return
+	}
+
+	export, archive, err := account.GetExportArchive(c.Request.Context(), models.MySQLDB, userID, exportID)
+	if err != nil {
+		logger.For(c.Request.Context(), "controllers.DownloadMeExport").Warnf("Error getting export: %v", err)
+		middlewares.AbortWithError(c, err)
+		return
+	}
+
+	c.Header("Content-Disposition", `attachment; filename="`+export.FileName()+`"`)
+	c.Data(200, export.ContentType(), archive)
+}
+
+// DeleteMe schedules the user's account for deletion, it can be restored
+// until the grace period is over
+func DeleteMe(grace time.Duration) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		userID, ok := c.MustGet("db_user_id").(uint64)
+		if !ok {
+			logger.For(c.Request.Context(), "controllers.DeleteMe").Warn("user_id not found")
+			middlewares.AbortWithError(c, apperrors.ErrUnauthenticated)
+			return
+		}
+
+		purgeAfter, err := account.RequestDeletion(c.Request.Context(), models.MySQLDB, userID, grace)
+		if err != nil {
+			logger.For(c.Request.Context(), "controllers.DeleteMe").Errorf("Error deleting account: %v", err)
+			middlewares.AbortWithError(c, err)
+			return
+		}
+
+		c.JSON(http.StatusAccepted, gin.H{
+			"success":     true,
+			"purge_after": purgeAfter,
+		})
+	}
+}
+
+func RestoreMe(c *gin.Context) {
+	userID, ok := c.MustGet("db_user_id").(uint64)
+	if !ok {
+		logger.For(c.Request.Context(), "controllers.RestoreMe").Warn("user_id not found")
+		middlewares.AbortWithError(c, apperrors.ErrUnauthenticated)
+		return
+	}
+
+	if err := account.Restore(c.Request.Context(), models.MySQLDB, userID); err != nil {
+		logger.For(c.Request.Context(), "controllers.RestoreMe").Warnf("Error restoring account: %v", err)
+		middlewares.AbortWithError(c, err)
+		return
+	}
+
+	c.JSON(200, gin.H{
+		"message": "ok",
+		"success": true,
+	})
+}
+
+// LinkGuest merges a guest's reading, bookmarks and streak into the
+// signed-in account, for a guest who signed in with a provider that
+// already had an account
+func LinkGuest(auth *middlewares.FirebaseAuth, q *queue.Queue) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		userID, ok := c.MustGet("db_user_id").(uint64)
+		if !ok {
+			logger.For(c.Request.Context(), "controllers.LinkGuest").Warn("user_id not found")
+			middlewares.AbortWithError(c, apperrors.ErrUnauthenticated)
+			return
+		}
+
+		form := struct {
+			GuestToken string `json:"guest_token" binding:"required"`
+		}{}
+		if err := c.ShouldBindJSON(&form); err != nil {
+			logger.For(c.Request.Context(), "controllers.LinkGuest").Warnf("Error binding JSON: %v", err)
+			middlewares.AbortWithError(c, apperrors.Binding(err))
+			return
+		}
+
+		guestUID, err := auth.VerifyGuestToken(c.Request.Context(), form.GuestToken)
+		if err != nil {
+			middlewares.AbortWithError(c, err)
+			return
+		}
+
+		result, err := account.LinkGuest(c.Request.Context(), models.MySQLDB, models.Redis, q, userID, guestUID)
+		if err != nil {
+			logger.For(c.Request.Context(), "controllers.LinkGuest").Errorf("Error linking guest %s: %v", guestUID, err)
+			middlewares.AbortWithError(c, err)
+			return
+		}
+
+		recomputeMergedScores(c, q, result)
+
+		current, err := streak.GetUserStreak(c.Request.Context(), models.MySQLDB, userID)
+		if err != nil {
+			logger.For(c.Request.Context(), "controllers.LinkGuest").Errorf("Error getting streak: %v", err)
+			middlewares.AbortWithError(c, err)
+			return
+		}
+
+		c.JSON(200, gin.H{
+			"merge":  result,
+			"streak": current,
+		})
+	}
+}
+
+// recomputeMergedScores queues the scores of merged days, they were computed
+// from one account's reading
+func recomputeMergedScores(c *gin.Context, q *queue.Queue, result *account.MergeResult) {
+	for _, date := range result.Dates {
+		err := q.Enqueue(c.Request.Context(), result.IntoUserID, queue.TypeRecomputeScore, queue.RecomputeScore{Date: date})
+		if err != nil {
+			logger.For(c.Request.Context(), "controllers.recomputeMergedScores").Errorf("Error queueing score of %s: %v", date, err)
+		}
+	}
+}
+
+func GetMeIdentities(c *gin.Context) {
+	userID, ok := c.MustGet("db_user_id").(uint64)
+	if !ok {
+		logger.For(c.Request.Context(), "controllers.GetMeIdentities").Warn("user_id not found")
+		middlewares.AbortWithError(c, apperrors.ErrUnauthenticated)
+		return
+	}
+
+	identities, err := models.GetIdentities(c.Request.Context(), models.MySQLDB, userID)
+	if err != nil {
+		logger.For(c.Request.Context(), "controllers.GetMeIdentities").Errorf("Error getting identities: %v", err)
+		middlewares.AbortWithError(c, err)
+		return
+	}
+
+	if identities == nil {
+		identities = []models.Identity{}
+	}
+
+	c.JSON(200, identities)
+}
+
+// LinkIdentity adds another sign-in of the user to their account, e.g. Apple
+// on a second phone. If that sign-in already has an account it is merged in.
+func LinkIdentity(auth *middlewares.FirebaseAuth, q *queue.Queue) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		userID, ok := c.MustGet("db_user_id").(uint64)
+		if !ok {
+			logger.For(c.Request.Context(), "controllers.LinkIdentity").Warn("user_id not found")
+			middlewares.AbortWithError(c, apperrors.ErrUnauthenticated)
+			return
+		}
+
+		form := struct {
+			IDToken string `json:"id_token" binding:"required"`
+		}{}
+		if err := c.ShouldBindJSON(&form); err != nil {
+			logger.For(c.Request.Context(), "controllers.LinkIdentity").Warnf("Error binding JSON: %v", err)
+			middlewares.AbortWithError(c, apperrors.Binding(err))
+			return
+		}
+
+		identity, err := auth.VerifyIdentityToken(c.Request.Context(), form.IDToken)
+		if err != nil {
+			middlewares.AbortWithError(c, err)
+			return
+		}
+
+		result, err := account.LinkIdentity(c.Request.Context(), models.MySQLDB, models.Redis, q, userID, identity)
+		if err != nil {
+			logger.For(c.Request.Context(), "controllers.LinkIdentity").Warnf("Error linking identity %s: %v", identity.UID, err)
+			middlewares.AbortWithError(c, err)
+			return
+		}
+
+		recomputeMergedScores(c, q, result)
+
+		identities, err := models.GetIdentities(c.Request.Context(), models.MySQLDB, userID)
+		if err != nil {
+			logger.For(c.Request.Context(), "controllers.LinkIdentity").Errorf("Error getting identities: %v", err)
+			middlewares.AbortWithError(c, err)
+			return
+		}
+
+		c.JSON(200, gin.H{
+			"merge":      result,
+			"identities": identities,
+		})
+	}
+}
@@ -1,8 +1,11 @@
 package controllers
 
 import (
-	"fmt"
+	"strconv"
 
+	"github.com/boolow5/quran-app-api/apperrors"
+	"github.com/boolow5/quran-app-api/logger"
+	"github.com/boolow5/quran-app-api/middlewares"
 	"github.com/boolow5/quran-app-api/models"
 	"github.com/gin-gonic/gin"
 )
@@ -10,19 +13,15 @@ import (
 func CreateOrUpdateFCMToken(c *gin.Context) {
 	userID, ok := c.MustGet("db_user_id").(uint64)
 	if !ok {
-		fmt.Printf("[controllers.GetBookmarks] user_id not found\n")
-		c.JSON(400, gin.H{
-			"error": "user_id not found",
-		})
+		logger.For(c.Request.Context(), "controllers.CreateOrUpdateFCMToken").Warn("user_id not found")
+		middlewares.AbortWithError(c, apperrors.ErrUnauthenticated)
 		return
 	}
 
 	form := models.UserDevice{}
 	if err := c.ShouldBind(&form); err != nil {
-		fmt.Printf("[controllers.GetBookmarks] Error binding JSON: %v\n", err)
-		c.JSON(400, gin.H{
-			"error": err.Error(),
-		})
+		logger.For(c.Request.Context(), "controllers.CreateOrUpdateFCMToken").Warnf("Error binding JSON: %v", err)
+		middlewares.AbortWithError(c, apperrors.Binding(err))
 		return
 	}
 
@@ -30,10 +29,36 @@ func CreateOrUpdateFCMToken(c *gin.Context) {
 
 	err := models.CreateOrUpdateFCMToken(c.Request.Context(), models.MySQLDB, form)
 	if err != nil {
-		fmt.Printf("[controllers.GetBookmarks] Error getting bookmarks: %v\n", err)
-		c.JSON(500, gin.H{
-			"error": err.Error(),
-		})
+		logger.For(c.Request.Context(), "controllers.CreateOrUpdateFCMToken").Errorf("Error saving device token: %v", err)
+		middlewares.AbortWithError(c, err)
+		return
+	}
+
+	c.JSON(200, gin.H{
+		"message": "ok",
+		"success": true,
+	})
+
+}
+
+func CreateOrUpdateWebPushSubscription(c *gin.Context) {
+	userID, ok := c.MustGet("db_user_id").(uint64)
+	if !ok {
+		logger.For(c.Request.Context(), "controllers.CreateOrUpdateWebPushSubscription").Warn("user_id not found")
+		middlewares.AbortWithError(c, apperrors.ErrUnauthenticated)
+		return
+	}
+
+	form := models.WebPushSubscription{}
+	if err := c.ShouldBindJSON(&form); err != nil {
+		middlewares.AbortWithError(c, apperrors.Binding(err))
+		return
+	}
+
+	err := models.CreateOrUpdateWebPushSubscription(c.Request.Context(), models.MySQLDB, c.GetString("user_id"), userID, form)
+	if err != nil {
+		logger.For(c.Request.Context(), "controllers.CreateOrUpdateWebPushSubscription").Errorf("Error saving subscription: %v", err)
+		middlewares.AbortWithError(c, err)
 		return
 	}
 
@@ -41,5 +66,72 @@ func CreateOrUpdateFCMToken(c *gin.Context) {
 		"message": "ok",
 		"success": true,
 	})
+}
+
+// GetWebPushPublicKey returns the VAPID key browsers need to subscribe
+func GetWebPushPublicKey(publicKey string) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		if publicKey == "" {
+			middlewares.AbortWithError(c, apperrors.ErrWebPushNotConfigured)
+			return
+		}
+
+		c.JSON(200, gin.H{
+			"public_key": publicKey,
+		})
+	}
+}
+
+func GetDevices(c *gin.Context) {
+	userID, ok := c.MustGet("db_user_id").(uint64)
+	if !ok {
+		logger.For(c.Request.Context(), "controllers.GetDevices").Warn("user_id not found")
+		middlewares.AbortWithError(c, apperrors.ErrUnauthenticated)
+		return
+	}
+
+	devices, err := models.GetDevicesByUserID(c.Request.Context(), models.MySQLDB, userID)
+	if err != nil {
+		logger.For(c.Request.Context(), "controllers.GetDevices").Errorf("Error getting devices: %v", err)
+		middlewares.AbortWithError(c, err)
+		return
+	}
+
+	if devices == nil {
+		devices = []models.UserDevice{}
+	}
+
+	c.JSON(200, devices)
+}
+
+func RemoveDevice(c *gin.Context) {
+	userID, ok := c.MustGet("db_user_id").(uint64)
+	if !ok {
+		logger.For(c.Request.Context(), "controllers.RemoveDevice").Warn("user_id not found")
+		middlewares.AbortWithError(c, apperrors.ErrUnauthenticated)
+		return
+	}
+
+	deviceID, err := strconv.ParseUint(c.Param("id"), 10, 64)
+	if err != nil {
+		middlewares.AbortWithError(c, apperrors.InvalidRequest("invalid device id"))
+		return
+	}
 
+	deleted, err := models.DeleteDeviceForUser(c.Request.Context(), models.MySQLDB, userID, deviceID)
+	if err != nil {
+		logger.For(c.Request.Context(), "controllers.RemoveDevice").Errorf("Error removing device: %v", err)
+		middlewares.AbortWithError(c, err)
+		return
+	}
+
+	if !deleted {
+		middlewares.AbortWithError(c, apperrors.ErrDeviceNotFound)
+		return
+	}
+
+	c.JSON(200, gin.H{
+		"success": true,
+		"message": "Device removed successfully",
+	})
 }
@@ -0,0 +1,225 @@
+package controllers
+
+import (
+	"context"
+	"errors"
+	"io"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/boolow5/quran-app-api/apperrors"
+	"github.com/boolow5/quran-app-api/db"
+	"github.com/boolow5/quran-app-api/logger"
+	"github.com/boolow5/quran-app-api/middlewares"
+	"github.com/boolow5/quran-app-api/models"
+	"github.com/boolow5/quran-app-api/queue"
+	"github.com/boolow5/quran-app-api/streak"
+	"github.com/gin-gonic/gin"
+)
+
+// maxAnalyticsDays caps the range of GET /sessions/analytics
+const maxAnalyticsDays = 366
+
+// sessionPages is the body of a heartbeat or the end of a session
+type sessionPages struct {
+	Pages []streak.PageVisit `json:"pages" binding:"max=200,dive"`
+}
+
+// sessionID parses the :id of a session route
+func sessionID(c *gin.Context) (uint64, bool) {
+	id, err := strconv.ParseUint(c.Param("id"), 10, 64)
+	if err != nil || id == 0 {
+		middlewares.AbortWithError(c, apperrors.Invalid("id", "positive integer"))
+		return 0, false
+	}
+	return id, true
+}
+
+func StartSession(c *gin.Context) {
+	userID, ok := c.MustGet("db_user_id").(uint64)
+	if !ok {
+		logger.For(c.Request.Context(), "controllers.StartSession").Warn("user_id not found")
+		middlewares.AbortWithError(c, apperrors.ErrUnauthenticated)
+		return
+	}
+
+	form := struct {
+		Mode       string `json:"mode" binding:"required"`
+		PageNumber int    `json:"page_number" binding:"omitempty,min=1,max=604"`
+		SurahName  string `json:"surah_name" binding:"max=100"`
+	}{}
+	if err := c.ShouldBindJSON(&form); err != nil {
+		middlewares.AbortWithError(c, apperrors.Binding(err))
+		return
+	}
+	if !streak.ValidMode(form.Mode) {
+		middlewares.AbortWithError(c, apperrors.Invalid("mode", "one of reading, listening, memorising"))
+		return
+	}
+
+	session := streak.Session{
+		UserID:        userID,
+		DeviceID:      c.GetHeader(middlewares.DeviceIDHeader),
+		Mode:          form.Mode,
+		LastSurahName: form.SurahName,
+	}
+	if len(session.DeviceID) > 128 {
+		session.DeviceID = session.DeviceID[:128]
+	}
+	if form.PageNumber > 0 {
+		session.LastPage = &form.PageNumber
+	}
+
+	session, err := streak.StartSession(c.Request.Context(), models.MySQLDB, session)
+	if err != nil {
+		logger.For(c.Request.Context(), "controllers.StartSession").Errorf("Error starting session: %v", err)
+		middlewares.AbortWithError(c, err)
+		return
+	}
+
+	c.JSON(http.StatusCreated, session)
+}
+
+// SessionHeartbeat records the pages read since the last heartbeat, the app
+// sends one at least every few minutes while the mushaf is open
+func SessionHeartbeat(q *queue.Queue) gin.HandlerFunc {
+	return recordSessionPages(q, "controllers.SessionHeartbeat", streak.Heartbeat)
+}
+
+// EndSession records the last pages of a session and ends it
+func EndSession(q *queue.Queue) gin.HandlerFunc {
+	return recordSessionPages(q, "controllers.EndSession", streak.EndSession)
+}
+
+func recordSessionPages(q *queue.Queue, component string, record func(ctx context.Context, db db.Database, userID, sessionID uint64, pages []streak.PageVisit) (streak.Session, error)) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		userID, ok := c.MustGet("db_user_id").(uint64)
+		if !ok {
+			logger.For(c.Request.Context(), component).Warn("user_id not found")
+			middlewares.AbortWithError(c, apperrors.ErrUnauthenticated)
+			return
+		}
+		id, ok := sessionID(c)
+		if !ok {
+			return
+		}
+
+		var form sessionPages
+		if err := c.ShouldBindJSON(&form); err != nil && !errors.Is(err, io.EOF) {
+			middlewares.AbortWithError(c, apperrors.Binding(err))
+			return
+		}
+
+		session, err := record(c.Request.Context(), models.MySQLDB, userID, id, form.Pages)
+		if err != nil {
+			logger.For(c.Request.Context(), component).Warnf("Error recording pages of session %d: %v", id, err)
+			middlewares.AbortWithError(c, err)
+			return
+		}
+
+		if len(form.Pages) > 0 {
+			// the summary, streak and score are rebuilt by the job queue
+			if err := q.EnqueueReadingUpdate(c.Request.Context(), userID, time.Now()); err != nil {
+				logger.For(c.Request.Context(), component).Errorf("Error queueing summary update: %v", err)
+			}
+		}
+
+		c.JSON(200, session)
+	}
+}
+
+func GetSession(c *gin.Context) {
+	userID, ok := c.MustGet("db_user_id").(uint64)
+	if !ok {
+		logger.For(c.Request.Context(), "controllers.GetSession").Warn("user_id not found")
+		middlewares.AbortWithError(c, apperrors.ErrUnauthenticated)
+		return
+	}
+	id, ok := sessionID(c)
+	if !ok {
+		return
+	}
+
+	session, err := streak.GetSession(c.Request.Context(), models.MySQLDB, userID, id)
+	if err != nil {
+		middlewares.AbortWithError(c, err)
+		return
+	}
+
+	c.JSON(200, session)
+}
+
+func GetSessions(c *gin.Context) {
+	userID, ok := c.MustGet("db_user_id").(uint64)
+	if !ok {
+		logger.For(c.Request.Context(), "controllers.GetSessions").Warn("user_id not found")
+		middlewares.AbortWithError(c, apperrors.ErrUnauthenticated)
+		return
+	}
+
+	limit := 20
+	if value := c.Query("limit"); value != "" {
+		parsed, err := strconv.Atoi(value)
+		if err != nil || parsed < 1 || parsed > 100 {
+			middlewares.AbortWithError(c, apperrors.Invalid("limit", "between 1 and 100"))
+			return
+		}
+		limit = parsed
+	}
+
+	sessions, err := streak.GetSessions(c.Request.Context(), models.MySQLDB, userID, limit)
+	if err != nil {
+		logger.For(c.Request.Context(), "controllers.GetSessions").Errorf("Error getting sessions: %v", err)
+		middlewares.AbortWithError(c, err)
+		return
+	}
+
+	if sessions == nil {
+		sessions = []streak.Session{}
+	}
+
+	c.JSON(200, sessions)
+}
+
+// GetSessionAnalytics describes the sessions of the last 30 days by default
+func GetSessionAnalytics(c *gin.Context) {
+	userID, ok := c.MustGet("db_user_id").(uint64)
+	if !ok {
+		logger.For(c.Request.Context(), "controllers.GetSessionAnalytics").Warn("user_id not found")
+		middlewares.AbortWithError(c, apperrors.ErrUnauthenticated)
+		return
+	}
+
+	to := time.Now()
+	if value := c.Query("to"); value != "" {
+		parsed, err := time.Parse("2006-01-02", value)
+		if err != nil {
+			middlewares.AbortWithError(c, apperrors.Invalid("to", "YYYY-MM-DD"))
+			return
+		}
+		to = parsed
+	}
+	from := to.AddDate(0, 0, -29)
+	if value := c.Query("from"); value != "" {
+		parsed, err := time.Parse("2006-01-02", value)
+		if err != nil {
+			middlewares.AbortWithError(c, apperrors.Invalid("from", "YYYY-MM-DD"))
+			return
+		}
+		from = parsed
+	}
+	if from.After(to) || to.Sub(from) > maxAnalyticsDays*24*time.Hour {
+		middlewares.AbortWithError(c, apperrors.Invalid("from", "at most 366 days before to"))
+		return
+	}
+
+	analytics, err := streak.GetSessionAnalytics(c.Request.Context(), models.MySQLDB, userID, from, to)
+	if err != nil {
+		logger.For(c.Request.Context(), "controllers.GetSessionAnalytics").Errorf("Error getting session analytics: %v", err)
+		middlewares.AbortWithError(c, err)
+		return
+	}
+
+	c.JSON(200, analytics)
+}
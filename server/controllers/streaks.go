@@ -1,10 +1,14 @@
 package controllers
 
 import (
-	"fmt"
 	"time"
 
+	"github.com/boolow5/quran-app-api/apperrors"
+	"github.com/boolow5/quran-app-api/logger"
+	"github.com/boolow5/quran-app-api/metrics"
+	"github.com/boolow5/quran-app-api/middlewares"
 	"github.com/boolow5/quran-app-api/models"
+	"github.com/boolow5/quran-app-api/queue"
 	"github.com/boolow5/quran-app-api/streak"
 	"github.com/gin-gonic/gin"
 )
@@ -12,19 +16,15 @@ import (
 func GetRecentPages(c *gin.Context) {
 	userID, ok := c.MustGet("db_user_id").(uint64)
 	if !ok {
-		fmt.Printf("[controllers.GetBookmarks] user_id not found\n")
-		c.JSON(400, gin.H{
-			"error": "user_id not found",
-		})
+		logger.For(c.Request.Context(), "controllers.GetRecentPages").Warn("user_id not found")
+		middlewares.AbortWithError(c, apperrors.ErrUnauthenticated)
 		return
 	}
 
 	pages, err := streak.GetRecentPages(c.Request.Context(), models.MySQLDB, userID, 3)
 	if err != nil {
-		fmt.Printf("[controllers.GetRecentPages] Error getting recent pages: %v\n", err)
-		c.JSON(500, gin.H{
-			"error": err.Error(),
-		})
+		logger.For(c.Request.Context(), "controllers.GetRecentPages").Errorf("Error getting recent pages: %v", err)
+		middlewares.AbortWithError(c, err)
 		return
 	}
 
@@ -35,117 +35,160 @@ func GetRecentPages(c *gin.Context) {
 	c.JSON(200, pages)
 }
 
-func RecordReadingEvent(c *gin.Context) {
-	userID, ok := c.MustGet("db_user_id").(uint64)
-	if !ok {
-		fmt.Printf("[controllers.GetBookmarks] user_id not found\n")
-		c.JSON(400, gin.H{
-			"error": "user_id not found",
-		})
-		return
-	}
-
-	form := streak.ReadingEvent{}
-	if err := c.ShouldBind(&form); err != nil {
-		fmt.Printf("[controllers.GetBookmarks] Error binding JSON: %v\n", err)
-		c.JSON(400, gin.H{
-			"error": err.Error(),
-		})
-		return
-	}
-
-	form.UserID = userID
-	form.CreatedAt = time.Now()
-
-	err := streak.RecordReadingEvent(c.Request.Context(), models.MySQLDB, form)
-	if err != nil {
-		fmt.Printf("[controllers.GetBookmarks] Error getting bookmarks: %v\n", err)
-		c.JSON(500, gin.H{
-			"error": err.Error(),
-		})
-		return
-	}
-
-	// go func(userID uint64, date time.Time) {
-	totalSeconds, err := streak.UpdateDailySummary(c.Request.Context(), models.MySQLDB, userID, form.CreatedAt)
-	if err != nil {
-		fmt.Printf("[controllers.GetBookmarks] Error getting bookmarks: %v\n", err)
-		return
+func RecordReadingEvent(q *queue.Queue) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		userID, ok := c.MustGet("db_user_id").(uint64)
+		if !ok {
+			logger.For(c.Request.Context(), "controllers.RecordReadingEvent").Warn("user_id not found")
+			middlewares.AbortWithError(c, apperrors.ErrUnauthenticated)
+			return
+		}
+
+		form := streak.ReadingEvent{}
+		if err := c.ShouldBind(&form); err != nil {
+			logger.For(c.Request.Context(), "controllers.RecordReadingEvent").Warnf("Error binding JSON: %v", err)
+			middlewares.AbortWithError(c, apperrors.Binding(err))
+			return
+		}
+
+		form.UserID = userID
+		form.CreatedAt = time.Now()
+
+		err := streak.RecordReadingEvent(c.Request.Context(), models.MySQLDB, form)
+		if err != nil {
+			logger.For(c.Request.Context(), "controllers.RecordReadingEvent").Errorf("Error recording reading event: %v", err)
+			middlewares.AbortWithError(c, err)
+			return
+		}
+		metrics.ReadingEventsIngested.Inc()
+
+		// the summary, streak and score are rebuilt by the job queue
+		err = q.EnqueueReadingUpdate(c.Request.Context(), userID, form.CreatedAt)
+		if err != nil {
+			logger.For(c.Request.Context(), "controllers.RecordReadingEvent").Errorf("Error queueing summary update: %v", err)
+		}
+
+		dailyProgress(c, "controllers.RecordReadingEvent", userID, form.CreatedAt)
 	}
-	fmt.Println("Updated daily summary for user: ", userID)
-	// }(userID, form.CreatedAt)
+}
 
-	percentage := float64(totalSeconds) / streak.MinReadingTimeThreshold * 100
-	if percentage > 100 {
-		percentage = 100
+// RecordListeningEvent records time spent listening to a recitation, it counts
+// towards the day by the streak.Listening policy
+func RecordListeningEvent(q *queue.Queue) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		userID, ok := c.MustGet("db_user_id").(uint64)
+		if !ok {
+			logger.For(c.Request.Context(), "controllers.RecordListeningEvent").Warn("user_id not found")
+			middlewares.AbortWithError(c, apperrors.ErrUnauthenticated)
+			return
+		}
+
+		form := streak.ListeningEvent{}
+		if err := c.ShouldBind(&form); err != nil {
+			logger.For(c.Request.Context(), "controllers.RecordListeningEvent").Warnf("Error binding JSON: %v", err)
+			middlewares.AbortWithError(c, apperrors.Binding(err))
+			return
+		}
+
+		form.UserID = userID
+		form.CreatedAt = time.Now()
+
+		err := streak.RecordListeningEvent(c.Request.Context(), models.MySQLDB, form)
+		if err != nil {
+			logger.For(c.Request.Context(), "controllers.RecordListeningEvent").Errorf("Error recording listening event: %v", err)
+			middlewares.AbortWithError(c, err)
+			return
+		}
+		metrics.ListeningEventsIngested.Inc()
+
+		// the summary, streak and score are rebuilt by the job queue
+		err = q.EnqueueReadingUpdate(c.Request.Context(), userID, form.CreatedAt)
+		if err != nil {
+			logger.For(c.Request.Context(), "controllers.RecordListeningEvent").Errorf("Error queueing summary update: %v", err)
+		}
+
+		dailyProgress(c, "controllers.RecordListeningEvent", userID, form.CreatedAt)
 	}
-
-	c.JSON(200, gin.H{
-		"message":         "ok",
-		"success":         true,
-		"total_seconds":   totalSeconds,
-		"percentage_done": percentage,
-	})
 }
 
-func UpdateDailySummary(c *gin.Context) {
+func GetListeningProgress(c *gin.Context) {
 	userID, ok := c.MustGet("db_user_id").(uint64)
 	if !ok {
-		fmt.Printf("[controllers.GetBookmarks] user_id not found\n")
-		c.JSON(400, gin.H{
-			"error": "user_id not found",
-		})
+		logger.For(c.Request.Context(), "controllers.GetListeningProgress").Warn("user_id not found")
+		middlewares.AbortWithError(c, apperrors.ErrUnauthenticated)
 		return
 	}
 
-	form := struct {
-		Date time.Time `json:"date"`
-	}{}
-	if err := c.ShouldBind(&form); err != nil {
-		fmt.Printf("[controllers.GetBookmarks] Error binding JSON: %v\n", err)
-		c.JSON(400, gin.H{
-			"error": err.Error(),
-		})
+	progress, err := streak.GetListeningProgress(c.Request.Context(), models.MySQLDB, userID)
+	if err != nil {
+		logger.For(c.Request.Context(), "controllers.GetListeningProgress").Errorf("Error getting listening progress: %v", err)
+		middlewares.AbortWithError(c, err)
 		return
 	}
 
-	totalSeconds, err := streak.UpdateDailySummary(c.Request.Context(), models.MySQLDB, userID, form.Date)
+	c.JSON(200, progress)
+}
+
+// dailyProgress responds with the activity of a user on a day and how much of
+// the day's goal it met
+func dailyProgress(c *gin.Context, component string, userID uint64, date time.Time) {
+	activity, err := streak.GetDailyActivity(c.Request.Context(), models.MySQLDB, userID, date)
 	if err != nil {
-		fmt.Printf("[controllers.GetBookmarks] Error getting bookmarks: %v\n", err)
-		c.JSON(500, gin.H{
-			"error": err.Error(),
-		})
+		logger.For(c.Request.Context(), component).Errorf("Error getting daily total: %v", err)
+		middlewares.AbortWithError(c, err)
 		return
 	}
 
-	percentage := float64(totalSeconds) / streak.MinReadingTimeThreshold * 100
-	if percentage > 100 {
-		percentage = 100
-	}
-
 	c.JSON(200, gin.H{
-		"message":         "ok",
-		"success":         true,
-		"total_seconds":   totalSeconds,
-		"percentage_done": percentage,
+		"message":           "ok",
+		"success":           true,
+		"total_seconds":     activity.Total(),
+		"reading_seconds":   activity.ReadingSeconds,
+		"listening_seconds": activity.ListeningSeconds,
+		"percentage_done":   activity.PercentageDone(),
 	})
 }
 
+func UpdateDailySummary(q *queue.Queue) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		userID, ok := c.MustGet("db_user_id").(uint64)
+		if !ok {
+			logger.For(c.Request.Context(), "controllers.UpdateDailySummary").Warn("user_id not found")
+			middlewares.AbortWithError(c, apperrors.ErrUnauthenticated)
+			return
+		}
+
+		form := struct {
+			Date time.Time `json:"date"`
+		}{}
+		if err := c.ShouldBind(&form); err != nil {
+			logger.For(c.Request.Context(), "controllers.UpdateDailySummary").Warnf("Error binding JSON: %v", err)
+			middlewares.AbortWithError(c, apperrors.Binding(err))
+			return
+		}
+
+		err := q.EnqueueReadingUpdate(c.Request.Context(), userID, form.Date)
+		if err != nil {
+			logger.For(c.Request.Context(), "controllers.UpdateDailySummary").Errorf("Error queueing summary update: %v", err)
+			middlewares.AbortWithError(c, err)
+			return
+		}
+
+		dailyProgress(c, "controllers.UpdateDailySummary", userID, form.Date)
+	}
+}
+
 func UpdateStreak(c *gin.Context) {
 	userID, ok := c.MustGet("db_user_id").(uint64)
 	if !ok {
-		fmt.Printf("[controllers.GetBookmarks] user_id not found\n")
-		c.JSON(400, gin.H{
-			"error": "user_id not found",
-		})
+		logger.For(c.Request.Context(), "controllers.UpdateStreak").Warn("user_id not found")
+		middlewares.AbortWithError(c, apperrors.ErrUnauthenticated)
 		return
 	}
 
 	if userID < 1 {
-		fmt.Printf("[controllers.GetBookmarks] Invalid user ID: %v\n", userID)
-		c.JSON(400, gin.H{
-			"error": "Invalid user ID",
-		})
+		logger.For(c.Request.Context(), "controllers.UpdateStreak").Warnf("Invalid user ID: %v", userID)
+		middlewares.AbortWithError(c, apperrors.ErrUnauthenticated)
 		return
 	}
 
@@ -154,19 +197,15 @@ func UpdateStreak(c *gin.Context) {
 		Seconds int       `json:"seconds"`
 	}{}
 	if err := c.ShouldBind(&form); err != nil {
-		fmt.Printf("[controllers.GetBookmarks] Error binding JSON: %v\n", err)
-		c.JSON(400, gin.H{
-			"error": err.Error(),
-		})
+		logger.For(c.Request.Context(), "controllers.UpdateStreak").Warnf("Error binding JSON: %v", err)
+		middlewares.AbortWithError(c, apperrors.Binding(err))
 		return
 	}
 
-	err := streak.UpdateStreak(c.Request.Context(), models.MySQLDB, userID, form.Date, form.Seconds > 300)
+	err := streak.UpdateStreak(c.Request.Context(), models.MySQLDB, userID, form.Date, form.Seconds > 300, streak.Cause{Trigger: streak.TriggerReadEvent})
 	if err != nil {
-		fmt.Printf("[controllers.GetBookmarks] Error getting bookmarks: %v\n", err)
-		c.JSON(500, gin.H{
-			"error": err.Error(),
-		})
+		logger.For(c.Request.Context(), "controllers.UpdateStreak").Errorf("Error updating streak: %v", err)
+		middlewares.AbortWithError(c, err)
 		return
 	}
 
@@ -179,27 +218,21 @@ func UpdateStreak(c *gin.Context) {
 func GetUserStreak(c *gin.Context) {
 	userID, ok := c.MustGet("db_user_id").(uint64)
 	if !ok {
-		fmt.Printf("[controllers.GetBookmarks] user_id not found\n")
-		c.JSON(400, gin.H{
-			"error": "user_id not found",
-		})
+		logger.For(c.Request.Context(), "controllers.GetUserStreak").Warn("user_id not found")
+		middlewares.AbortWithError(c, apperrors.ErrUnauthenticated)
 		return
 	}
 
 	if userID < 1 {
-		fmt.Printf("[controllers.GetBookmarks] Invalid user ID: %v\n", userID)
-		c.JSON(400, gin.H{
-			"error": "Invalid user ID",
-		})
+		logger.For(c.Request.Context(), "controllers.GetUserStreak").Warnf("Invalid user ID: %v", userID)
+		middlewares.AbortWithError(c, apperrors.ErrUnauthenticated)
 		return
 	}
 
 	streak, err := streak.GetUserStreak(c.Request.Context(), models.MySQLDB, userID)
 	if err != nil {
-		fmt.Printf("[controllers.GetBookmarks] Error getting bookmarks: %v\n", err)
-		c.JSON(500, gin.H{
-			"error": err.Error(),
-		})
+		logger.For(c.Request.Context(), "controllers.GetUserStreak").Errorf("Error getting streak: %v", err)
+		middlewares.AbortWithError(c, err)
 		return
 	}
 
@@ -2,42 +2,96 @@ package main
 
 import (
 	"context"
-	"fmt"
 	"time"
 
+	"github.com/boolow5/quran-app-api/account"
+	"github.com/boolow5/quran-app-api/config"
 	"github.com/boolow5/quran-app-api/db"
+	"github.com/boolow5/quran-app-api/logger"
 	"github.com/boolow5/quran-app-api/models"
 	"github.com/boolow5/quran-app-api/notifications"
+	"github.com/boolow5/quran-app-api/queue"
+	"github.com/boolow5/quran-app-api/scheduler"
 	"github.com/boolow5/quran-app-api/streak"
-	"github.com/robfig/cron/v3"
+	"github.com/redis/go-redis/v9"
 )
 
-func StartCronJobs(db db.Database) {
-	c := cron.New()
+// StartCronJobs registers the periodic jobs and runs them on whichever replica is the leader
+func StartCronJobs(ctx context.Context, db db.Database, client *redis.Client, sched *scheduler.Scheduler, q *queue.Queue, cfg *config.Config) {
+	jobs := []scheduler.Job{
+		{
+			// Run every hour
+			Name:     "timezone_notifications",
+			Schedule: cfg.Cron.ReminderSchedule,
+			// reminders target the user's current local hour, a late run must stay within the hour
+			MaxLateness: 50 * time.Minute,
+			Run: func(ctx context.Context) error {
+				logger.For(ctx, "main.StartCronJobs").Info("Sending timezone aware notifications")
+				return notifications.SendTimezoneAwareNotifications(ctx, db, cfg.Reminders)
+			},
+		},
+		{
+			Name:        "daily_streaks",
+			Schedule:    cfg.Cron.StreakSchedule,
+			MaxLateness: 6 * time.Hour,
+			Run: func(ctx context.Context) error {
+				today := time.Now()
+				logger.For(ctx, "main.StartCronJobs").Infof("Processing daily streaks for %s", today.Format("2006-01-02"))
+				return streak.ProcessDailyStreaks(ctx, db, today, streak.Cause{Trigger: streak.TriggerCron})
+			},
+		},
+		{
+			Name:        "expire_stale_devices",
+			Schedule:    cfg.Cron.DeviceExpirySchedule,
+			MaxLateness: 24 * time.Hour,
+			Run: func(ctx context.Context) error {
+				maxAge := time.Duration(cfg.Cron.DeviceExpiryDays) * 24 * time.Hour
+				logger.For(ctx, "main.StartCronJobs").Infof("Expiring devices not seen for %s", maxAge)
 
-	// Run every hour
-	_, err := c.AddFunc("5 * * * *", func() {
-		fmt.Printf("Sending timezone aware notifications\n")
-		ctx := context.Background()
-		err := notifications.SendTimezoneAwareNotifications(ctx, db)
-		if err != nil {
-			fmt.Printf("Error sending notifications: %v\n", err)
-		}
-	})
+				expired, err := models.ExpireStaleDevices(ctx, db, maxAge)
+				if err != nil {
+					return err
+				}
+				logger.For(ctx, "main.StartCronJobs").Infof("Expired %d stale devices", expired)
+				return nil
+			},
+		},
+		{
+			Name:        "session_timeout",
+			Schedule:    cfg.Cron.SessionTimeoutSchedule,
+			MaxLateness: 5 * time.Minute,
+			Run: func(ctx context.Context) error {
+				closed, err := streak.CloseIdleSessions(ctx, db, time.Now())
+				if err != nil {
+					return err
+				}
+				logger.For(ctx, "main.StartCronJobs").Infof("Ended %d idle reading sessions", closed)
+				return nil
+			},
+		},
+		{
+			Name:        "account_cleanup",
+			Schedule:    cfg.Cron.AccountCleanupSchedule,
+			MaxLateness: 24 * time.Hour,
+			Run: func(ctx context.Context) error {
+				expired, err := account.DeleteExpiredExports(ctx, db)
+				if err != nil {
+					return err
+				}
+				logger.For(ctx, "main.StartCronJobs").Infof("Deleted %d expired data exports", expired)
 
-	if err != nil {
-		fmt.Printf("Failed to set up cron job: %v", err)
+				purged, err := account.PurgeDue(ctx, db, client, q)
+				logger.For(ctx, "main.StartCronJobs").Infof("Purged %d deleted accounts", purged)
+				return err
+			},
+		},
 	}
 
-	_, err = c.AddFunc("0 */6 * * *", func() {
-		today := time.Now()
-		fmt.Printf("Processing daily streaks for %s\n", today.Format("2006-01-02"))
-
-		err = streak.ProcessDailyStreaks(context.Background(), models.MySQLDB, today)
-		if err != nil {
-			fmt.Printf("Error processing daily streaks: %v\n", err)
+	for _, job := range jobs {
+		if err := sched.Add(job); err != nil {
+			logger.For(ctx, "main.StartCronJobs").Errorf("Failed to set up cron job: %v", err)
 		}
-	})
+	}
 
-	c.Start()
+	sched.Start(ctx)
 }
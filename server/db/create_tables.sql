@@ -45,7 +45,8 @@ CREATE TABLE IF NOT EXISTS user_devices (
     user_id bigint unsigned NOT NULL,
     device_token VARCHAR(255) NOT NULL,
     -- add index for user_id and uid
-    INDEX idx_user_id_uid (user_id, uid)
+    INDEX idx_user_id_uid (user_id, uid),
+    UNIQUE KEY idx_device_token (device_token)
 );
 
 ----------------------------------
@@ -97,3 +98,237 @@ CREATE TABLE IF NOT EXISTS bookmarks (
     UNIQUE KEY idx_page_number (page_number)
 );
 
+
+----------------------------------
+ALTER TABLE users ADD COLUMN locale VARCHAR(10) NOT NULL DEFAULT 'en' AFTER timezone;
+
+----------------------------------
+CREATE TABLE IF NOT EXISTS notification_outbox (
+    id bigint unsigned NOT NULL AUTO_INCREMENT PRIMARY KEY,
+    user_id bigint unsigned NOT NULL,
+    kind VARCHAR(100) NOT NULL DEFAULT '',
+    title VARCHAR(255) NOT NULL,
+    body TEXT NOT NULL,
+    image_url VARCHAR(500) NOT NULL DEFAULT '',
+    topic VARCHAR(100) NOT NULL DEFAULT '',
+    priority VARCHAR(10) NOT NULL DEFAULT 'high',
+    analytics_label VARCHAR(50) NOT NULL DEFAULT '',
+    data JSON,
+    status VARCHAR(20) NOT NULL DEFAULT 'pending',
+    attempts INT NOT NULL DEFAULT 0,
+    max_attempts INT NOT NULL DEFAULT 5,
+    next_attempt_at TIMESTAMP NOT NULL DEFAULT CURRENT_TIMESTAMP,
+    last_error TEXT,
+    claim_id VARCHAR(64) NOT NULL DEFAULT '',
+    claimed_at TIMESTAMP NULL,
+    sent_at TIMESTAMP NULL,
+    created_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP,
+    updated_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP ON UPDATE CURRENT_TIMESTAMP,
+    INDEX idx_status_next_attempt (status, next_attempt_at),
+    INDEX idx_claim_id (claim_id),
+    INDEX idx_user_created (user_id, created_at)
+);
+
+----------------------------------
+CREATE TABLE IF NOT EXISTS notification_deliveries (
+    id bigint unsigned NOT NULL AUTO_INCREMENT PRIMARY KEY,
+    outbox_id bigint unsigned NOT NULL,
+    attempt INT NOT NULL,
+    device_token VARCHAR(255) NOT NULL,
+    success tinyint NOT NULL DEFAULT 0,
+    fcm_message_id VARCHAR(255) NOT NULL DEFAULT '',
+    error_code VARCHAR(100) NOT NULL DEFAULT '',
+    error_message TEXT,
+    created_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP,
+    INDEX idx_outbox_id (outbox_id)
+);
+
+----------------------------------
+ALTER TABLE user_devices ADD COLUMN created_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP;
+
+----------------------------------
+ALTER TABLE user_devices ADD COLUMN last_seen_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP;
+
+----------------------------------
+ALTER TABLE user_devices ADD COLUMN transport VARCHAR(20) NOT NULL DEFAULT 'fcm';
+
+----------------------------------
+ALTER TABLE user_devices ADD COLUMN subscription TEXT NULL;
+
+----------------------------------
+CREATE TABLE IF NOT EXISTS job_runs (
+    id bigint unsigned NOT NULL AUTO_INCREMENT PRIMARY KEY,
+    job_name VARCHAR(100) NOT NULL,
+    scheduled_for DATETIME NOT NULL,
+    instance_id VARCHAR(255) NOT NULL,
+    status VARCHAR(20) NOT NULL,
+    error TEXT,
+    started_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP,
+    finished_at TIMESTAMP NULL,
+    duration_ms bigint NOT NULL DEFAULT 0,
+    -- one row per scheduled time, a second replica cannot record the same run
+    UNIQUE KEY idx_job_scheduled (job_name, scheduled_for),
+    INDEX idx_status (status)
+);
+
+----------------------------------
+CREATE TABLE IF NOT EXISTS user_settings (
+    user_id bigint unsigned NOT NULL PRIMARY KEY,
+    mushaf VARCHAR(20) NOT NULL DEFAULT 'madani',
+    daily_goal_pages INT NOT NULL DEFAULT 0,
+    daily_goal_minutes INT NOT NULL DEFAULT 0,
+    share_progress tinyint(1) NOT NULL DEFAULT 0,
+    analytics_opt_out tinyint(1) NOT NULL DEFAULT 0,
+    avatar_url VARCHAR(500) NOT NULL DEFAULT '',
+    updated_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP ON UPDATE CURRENT_TIMESTAMP
+);
+
+----------------------------------
+CREATE TABLE IF NOT EXISTS user_profile_changes (
+    id bigint unsigned NOT NULL AUTO_INCREMENT PRIMARY KEY,
+    user_id bigint unsigned NOT NULL,
+    field VARCHAR(50) NOT NULL,
+    old_value VARCHAR(500) NOT NULL DEFAULT '',
+    new_value VARCHAR(500) NOT NULL DEFAULT '',
+    changed_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP,
+    INDEX idx_user_changed (user_id, changed_at)
+);
+
+----------------------------------
+ALTER TABLE users ADD COLUMN deleted_at TIMESTAMP NULL;
+
+----------------------------------
+ALTER TABLE users ADD COLUMN purge_after TIMESTAMP NULL;
+
+----------------------------------
+ALTER TABLE users ADD INDEX idx_purge_after (purge_after);
+
+----------------------------------
+CREATE TABLE IF NOT EXISTS data_exports (
+    id bigint unsigned NOT NULL AUTO_INCREMENT PRIMARY KEY,
+    user_id bigint unsigned NOT NULL,
+    format VARCHAR(10) NOT NULL,
+    status VARCHAR(20) NOT NULL DEFAULT 'pending',
+    error TEXT,
+    archive LONGBLOB,
+    size_bytes bigint NOT NULL DEFAULT 0,
+    created_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP,
+    finished_at TIMESTAMP NULL,
+    expires_at TIMESTAMP NULL,
+    INDEX idx_user_created (user_id, created_at),
+    INDEX idx_status_expires (status, expires_at)
+);
+
+----------------------------------
+CREATE TABLE IF NOT EXISTS deleted_accounts (
+    user_id bigint unsigned NOT NULL,
+    -- kept after the purge until the Firebase user is deleted too, a user
+    -- with several identities has a row for each of their uids
+    uid varchar(100) NOT NULL,
+    deleted_at TIMESTAMP NULL,
+    purged_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP,
+    firebase_deleted_at TIMESTAMP NULL,
+    PRIMARY KEY (user_id, uid),
+    INDEX idx_firebase_deleted (firebase_deleted_at)
+);
+
+----------------------------------
+ALTER TABLE users ADD COLUMN is_guest tinyint(1) NOT NULL DEFAULT 0 AFTER locale;
+
+----------------------------------
+CREATE TABLE IF NOT EXISTS user_identities (
+    id bigint unsigned NOT NULL AUTO_INCREMENT PRIMARY KEY,
+    user_id bigint unsigned NOT NULL,
+    -- a Firebase uid, users.uid is the one the account was created with
+    uid varchar(100) NOT NULL,
+    provider VARCHAR(50) NOT NULL DEFAULT '',
+    email varchar(100) NOT NULL DEFAULT '',
+    email_verified tinyint(1) NOT NULL DEFAULT 0,
+    created_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP,
+    last_seen_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP,
+    UNIQUE KEY idx_uid (uid),
+    INDEX idx_user_id (user_id),
+    INDEX idx_email (email)
+);
+
+----------------------------------
+ALTER TABLE users ADD COLUMN role VARCHAR(20) NOT NULL DEFAULT 'user' AFTER is_guest;
+
+----------------------------------
+CREATE TABLE IF NOT EXISTS admin_audit_log (
+    id bigint unsigned NOT NULL AUTO_INCREMENT PRIMARY KEY,
+    actor_user_id bigint unsigned NOT NULL,
+    -- kept when either account is purged, support must be able to answer for it
+    actor_uid varchar(100) NOT NULL,
+    method VARCHAR(10) NOT NULL,
+    route VARCHAR(255) NOT NULL,
+    target_user_id bigint unsigned NULL,
+    status INT NOT NULL,
+    details JSON,
+    ip VARCHAR(64) NOT NULL DEFAULT '',
+    created_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP,
+    INDEX idx_created (created_at),
+    INDEX idx_actor_created (actor_user_id, created_at),
+    INDEX idx_target_created (target_user_id, created_at)
+);
+
+----------------------------------
+CREATE TABLE IF NOT EXISTS streak_events (
+    id bigint unsigned NOT NULL AUTO_INCREMENT PRIMARY KEY,
+    user_id bigint unsigned NOT NULL,
+    -- read_event, cron, admin, merge or recompute, rows are only ever inserted
+    trigger_type VARCHAR(20) NOT NULL,
+    trigger_date DATE NOT NULL,
+    total_seconds INT NULL,
+    actor_user_id bigint unsigned NULL,
+    reason VARCHAR(500) NOT NULL DEFAULT '',
+    previous_current_streak INT NOT NULL,
+    previous_longest_streak INT NOT NULL,
+    previous_last_active_date DATE NULL,
+    current_streak INT NOT NULL,
+    longest_streak INT NOT NULL,
+    last_active_date DATE NULL,
+    created_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP,
+    INDEX idx_user_id (user_id, id)
+);
+
+----------------------------------
+CREATE TABLE IF NOT EXISTS reading_sessions (
+    id bigint unsigned NOT NULL AUTO_INCREMENT PRIMARY KEY,
+    user_id bigint unsigned NOT NULL,
+    device_id VARCHAR(128) NOT NULL DEFAULT '',
+    -- reading, listening or memorising
+    mode VARCHAR(20) NOT NULL,
+    started_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP,
+    last_heartbeat_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP,
+    ended_at TIMESTAMP NULL,
+    -- ended by the app, timeout without a heartbeat, or replaced by a new session on the device
+    end_reason VARCHAR(20) NOT NULL DEFAULT '',
+    last_page INT NULL,
+    last_surah_name VARCHAR(100) NOT NULL DEFAULT '',
+    INDEX idx_user_started (user_id, started_at),
+    INDEX idx_open (ended_at, last_heartbeat_at)
+);
+
+----------------------------------
+ALTER TABLE reading_events ADD COLUMN session_id bigint unsigned NULL AFTER user_id, ADD INDEX idx_session (session_id);
+
+----------------------------------
+CREATE TABLE IF NOT EXISTS listening_events (
+    id bigint unsigned NOT NULL AUTO_INCREMENT PRIMARY KEY,
+    user_id bigint unsigned NOT NULL,
+    reciter VARCHAR(100) NOT NULL,
+    -- the ayahs from_ayah to to_ayah of the surah, both included
+    surah INT NOT NULL,
+    from_ayah INT NOT NULL,
+    to_ayah INT NOT NULL,
+    seconds_listened INT NOT NULL,
+    created_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP,
+    INDEX idx_user_created (user_id, created_at)
+);
+
+----------------------------------
+ALTER TABLE daily_summaries ADD COLUMN listening_seconds INT NOT NULL DEFAULT 0 AFTER total_seconds;
+
+----------------------------------
+ALTER TABLE user_daily_scores ADD COLUMN listening_minutes INT NOT NULL DEFAULT 0 AFTER reading_minutes;
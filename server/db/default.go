@@ -5,16 +5,12 @@ import (
 	"fmt"
 	"os"
 	"strings"
-)
 
-// InitTables reads the content of create_tables.sql and executes it
-func InitTables(db Database) {
-	// read file as string
-	filePath := os.Getenv("QURAN_API_MYSQL_CREATE_TABLES_PATH")
-	if strings.TrimSpace(filePath) == "" {
-		filePath = "./db/create_tables.sql"
-	}
+	"github.com/boolow5/quran-app-api/logger"
+)
 
+// InitTables reads the content of create_tables.sql at filePath and executes it
+func InitTables(db Database, filePath string) {
 	// read file
 	fileContent, err := os.ReadFile(filePath)
 	if err != nil {
@@ -44,24 +40,116 @@ func InitTables(db Database) {
 		tableName := getTableName(statement)
 		_, err = db.Exec(context.Background(), statement)
 		if err != nil {
-			if (strings.Contains(err.Error(), "already exists") || strings.Contains(err.Error(), "Duplicate table")) {
-				fmt.Printf("[DB] Table %s already exists\n", tableName)
+			if strings.Contains(err.Error(), "already exists") || strings.Contains(err.Error(), "Duplicate table") {
+				logger.Component("db.InitTables").Infof("Table %s already exists", tableName)
+				continue
+			}
+			// ALTER statements are re-run on every boot, MySQL has no ADD COLUMN IF NOT EXISTS
+			if strings.Contains(err.Error(), "Duplicate column name") || strings.Contains(err.Error(), "Duplicate key name") {
+				logger.Component("db.InitTables").Infof("Table %s already altered", tableName)
 				continue
 			}
 			panic(fmt.Sprintf("[DB] Failed to create table: %s, ERROR: %v", tableName, err))
 		}
 
-		fmt.Printf("[DB] Table %s created\n", tableName)
+		logger.Component("db.InitTables").Infof("Table %s created", tableName)
 	}
 
+	migratePrimaryKeys(db)
+	migrateUniqueKeys(db)
+
 	if len(statements) == 0 {
-		fmt.Println("[WARN] No statements found in create_tables.sql")
+		logger.Component("db.InitTables").Info("No statements found in create_tables.sql")
 		return
 	}
-	fmt.Println("[DB] InitTables success")
+	logger.Component("db.InitTables").Info("InitTables success")
+}
+
+// primaryKeys are primary keys that gained a column after their table was
+// created. An ALTER re-run on every boot would rebuild the table each time, so
+// each one runs only while information_schema shows the column missing.
+var primaryKeys = []struct {
+	table, column, statement string
+}{
+	// a user with several identities has a row for each of their uids
+	{"deleted_accounts", "uid", "ALTER TABLE deleted_accounts DROP PRIMARY KEY, ADD PRIMARY KEY (user_id, uid)"},
+}
+
+func migratePrimaryKeys(db Database) {
+	for _, key := range primaryKeys {
+		var count int
+		err := db.Get(context.Background(), &count, `
+			SELECT COUNT(*) FROM information_schema.KEY_COLUMN_USAGE
+			WHERE TABLE_SCHEMA = DATABASE() AND TABLE_NAME = ? AND CONSTRAINT_NAME = 'PRIMARY' AND COLUMN_NAME = ?
+		`, key.table, key.column)
+		if err != nil {
+			panic(fmt.Sprintf("[DB] Failed to get primary key of %s, ERROR: %v", key.table, err))
+		}
+		if count > 0 {
+			continue
+		}
+
+		if _, err := db.Exec(context.Background(), key.statement); err != nil {
+			panic(fmt.Sprintf("[DB] Failed to alter primary key of %s, ERROR: %v", key.table, err))
+		}
+		logger.Component("db.InitTables").Infof("Primary key of %s now includes %s", key.table, key.column)
+	}
+}
+
+// uniqueKeys are unique keys added to tables that may hold duplicates, the
+// statements remove the duplicates and add the key. Like primaryKeys they run
+// only while information_schema shows the key missing.
+var uniqueKeys = []struct {
+	table, index string
+	statements   []string
+}{
+	// a device token belongs to the device's latest row
+	{"user_devices", "idx_device_token", []string{
+		"DELETE older FROM user_devices older JOIN user_devices newer ON older.device_token = newer.device_token AND older.id < newer.id",
+		"ALTER TABLE user_devices ADD UNIQUE KEY idx_device_token (device_token)",
+	}},
+}
+
+func migrateUniqueKeys(db Database) {
+	for _, key := range uniqueKeys {
+		var count int
+		err := db.Get(context.Background(), &count, `
+			SELECT COUNT(*) FROM information_schema.STATISTICS
+			WHERE TABLE_SCHEMA = DATABASE() AND TABLE_NAME = ? AND INDEX_NAME = ?
+		`, key.table, key.index)
+		if err != nil {
+			panic(fmt.Sprintf("[DB] Failed to get index %s of %s, ERROR: %v", key.index, key.table, err))
+		}
+		if count > 0 {
+			continue
+		}
+
+		for _, statement := range key.statements {
+			if _, err := db.Exec(context.Background(), statement); err != nil {
+				panic(fmt.Sprintf("[DB] Failed to add index %s to %s, ERROR: %v", key.index, key.table, err))
+			}
+		}
+		logger.Component("db.InitTables").Infof("Index %s added to %s", key.index, key.table)
+	}
 }
 
 func getTableName(statement string) string {
+	if strings.HasPrefix(strings.ToUpper(statement), "ALTER TABLE") {
+		statement = strings.TrimSpace(statement[len("ALTER TABLE"):])
+		return strings.Fields(statement)[0]
+	}
+
+	// clean up statements like DELETE ... FROM table
+	if !strings.Contains(strings.ToUpper(statement), "CREATE TABLE") {
+		fields := strings.Fields(statement)
+		for i, field := range fields {
+			if strings.EqualFold(field, "FROM") && i+1 < len(fields) {
+				return fields[i+1]
+			}
+		}
+		return fields[0]
+	}
+
 	if strings.Contains(strings.ToUpper(statement), "EXISTS") {
 		statement = strings.Split(statement, "EXISTS ")[1]
 		statement = strings.Split(statement, "(")[0]
@@ -4,12 +4,16 @@ import (
 	"context"
 	"database/sql"
 	"errors"
-	"fmt"
 	"strings"
+	"time"
 
 	"github.com/boolow5/quran-app-api/logger"
+	"github.com/boolow5/quran-app-api/metrics"
+	"github.com/boolow5/quran-app-api/tracing"
 	_ "github.com/go-sql-driver/mysql"
 	"github.com/jmoiron/sqlx"
+	"go.opentelemetry.io/otel/attribute"
+	semconv "go.opentelemetry.io/otel/semconv/v1.24.0"
 )
 
 var (
@@ -20,6 +24,7 @@ var (
 
 type Database interface {
 	Get(ctx context.Context, dest interface{}, query string, args ...interface{}) error
+	GetTx(ctx context.Context, tx *sql.Tx, dest interface{}, query string, args ...interface{}) error
 	Exec(ctx context.Context, query string, args ...interface{}) (RowsAffected int64, err error)
 	ExecTx(ctx context.Context, tx *sql.Tx, query string, args ...interface{}) (RowsAffected int64, err error)
 	Select(ctx context.Context, dest interface{}, query string, args ...interface{}) error
@@ -31,9 +36,37 @@ type MySQLDB struct {
 	db *sqlx.DB
 }
 
+// instrument starts a span for a call and returns the function that ends it
+// and records its duration
+func instrument(ctx context.Context, operation, query string) (context.Context, func(error)) {
+	started := time.Now()
+	attrs := []attribute.KeyValue{semconv.DBSystemMySQL}
+	if query != "" {
+		attrs = append(attrs,
+			semconv.DBStatement(tracing.SanitizeSQL(query)),
+			semconv.DBOperation(tracing.SQLOperation(query)),
+		)
+	}
+	ctx, span := tracing.Start(ctx, "db."+operation, attrs...)
+
+	return ctx, func(err error) {
+		status := "ok"
+		if errors.Is(err, sql.ErrNoRows) {
+			status = "no_rows"
+		} else if err != nil {
+			status = "error"
+		}
+		metrics.DBQueryDuration.WithLabelValues(operation, status).Observe(time.Since(started).Seconds())
+		tracing.EndUnless(span, err, sql.ErrNoRows)
+	}
+}
+
 // Exec implements Database.
 func (m MySQLDB) Exec(ctx context.Context, query string, args ...interface{}) (RowsAffected int64, err error) {
-	result, err := m.db.Exec(query, args...)
+	ctx, done := instrument(ctx, "exec", query)
+	defer func() { done(err) }()
+
+	result, err := m.db.ExecContext(ctx, query, args...)
 	if err != nil {
 		return 0, err
 	}
@@ -45,7 +78,10 @@ func (m MySQLDB) Exec(ctx context.Context, query string, args ...interface{}) (R
 
 // ExecTx implements Database.
 func (m MySQLDB) ExecTx(ctx context.Context, tx *sql.Tx, query string, args ...interface{}) (RowsAffected int64, err error) {
-	result, err := tx.Exec(query, args...)
+	ctx, done := instrument(ctx, "exec_tx", query)
+	defer func() { done(err) }()
+
+	result, err := tx.ExecContext(ctx, query, args...)
 	if err != nil {
 		return 0, err
 	}
@@ -56,18 +92,35 @@ func (m MySQLDB) ExecTx(ctx context.Context, tx *sql.Tx, query string, args ...i
 }
 
 // Get implements Database.
-func (m MySQLDB) Get(ctx context.Context, dest interface{}, query string, args ...interface{}) error {
-	return m.db.Get(dest, query, args...)
+func (m MySQLDB) Get(ctx context.Context, dest interface{}, query string, args ...interface{}) (err error) {
+	ctx, done := instrument(ctx, "get", query)
+	defer func() { done(err) }()
+
+	return m.db.GetContext(ctx, dest, query, args...)
+}
+
+// GetTx implements Database.
+func (m MySQLDB) GetTx(ctx context.Context, tx *sql.Tx, dest interface{}, query string, args ...interface{}) (err error) {
+	ctx, done := instrument(ctx, "get_tx", query)
+	defer func() { done(err) }()
+
+	return sqlx.GetContext(ctx, &sqlx.Tx{Tx: tx, Mapper: m.db.Mapper}, dest, query, args...)
 }
 
 // Select implements Database.
-func (m MySQLDB) Select(ctx context.Context, dest interface{}, query string, args ...interface{}) error {
-	return m.db.Select(dest, query, args...)
+func (m MySQLDB) Select(ctx context.Context, dest interface{}, query string, args ...interface{}) (err error) {
+	ctx, done := instrument(ctx, "select", query)
+	defer func() { done(err) }()
+
+	return m.db.SelectContext(ctx, dest, query, args...)
 }
 
 // Insert implements Database.
 func (m MySQLDB) Insert(ctx context.Context, query string, args ...interface{}) (insertedID int64, err error) {
-	result, err := m.db.Exec(query, args...)
+	ctx, done := instrument(ctx, "insert", query)
+	defer func() { done(err) }()
+
+	result, err := m.db.ExecContext(ctx, query, args...)
 	if err != nil {
 		return 0, err
 	}
@@ -75,14 +128,34 @@ func (m MySQLDB) Insert(ctx context.Context, query string, args ...interface{})
 	return result.LastInsertId()
 }
 
-// Begin implements Database.
-func (m MySQLDB) Begin(ctx context.Context) (*sql.Tx, error) {
-	return m.db.Begin()
+// Begin implements Database. The transaction is rolled back if ctx is
+// cancelled before it is committed.
+func (m MySQLDB) Begin(ctx context.Context) (tx *sql.Tx, err error) {
+	ctx, done := instrument(ctx, "begin", "")
+	defer func() { done(err) }()
+
+	return m.db.BeginTx(ctx, nil)
+}
+
+// Ping checks the connection to MySQL
+func (m MySQLDB) Ping(ctx context.Context) error {
+	return m.db.PingContext(ctx)
+}
+
+// Close closes the connection pool, it is called once on shutdown
+func (m MySQLDB) Close() error {
+	return m.db.Close()
+}
+
+// WrapMysqlDB uses a connection pool that is already open, tests open one
+// with their own driver
+func WrapMysqlDB(conn *sql.DB) *MySQLDB {
+	return &MySQLDB{db: sqlx.NewDb(conn, "mysql")}
 }
 
 func NewMysqlDB(dsn string) (*MySQLDB, error) {
 	if strings.TrimSpace(dsn) == "" {
-		fmt.Printf("NewMysqlDB: dsn is empty")
+		logger.Component("db.NewMysqlDB").Info("NewMysqlDB: dsn is empty")
 		return nil, errors.New("MySQL dsn is empty")
 	}
 	// log.Infof("NewMysqlDB dsn 0: %s", dsn)
@@ -95,7 +168,7 @@ func NewMysqlDB(dsn string) (*MySQLDB, error) {
 	db, err := sqlx.Connect("mysql", dsn)
 	if err != nil {
 		// log.Infof("NewMysqlDB dsn 1: %s", dsn)
-		fmt.Printf("NewMysqlDB failed to connect: %v", err)
+		logger.Component("db.NewMysqlDB").Errorf("NewMysqlDB failed to connect: %v", err)
 		return nil, err
 	}
 
@@ -103,7 +176,7 @@ func NewMysqlDB(dsn string) (*MySQLDB, error) {
 	err = db.Ping()
 	if err != nil {
 		// log.Infof("NewMysqlDB dsn 2: %s", dsn)
-		fmt.Printf("NewMysqlDB failed to ping: %v", err)
+		logger.Component("db.NewMysqlDB").Errorf("NewMysqlDB failed to ping: %v", err)
 		return nil, err
 	}
 
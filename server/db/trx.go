@@ -34,6 +34,11 @@ func (t *TxDatabase) Get(ctx context.Context, dest interface{}, query string, ar
 	return t.db.Get(ctx, dest, query, args...)
 }
 
+// GetTx remains unchanged as it explicitly handles transactions
+func (t *TxDatabase) GetTx(ctx context.Context, tx *sql.Tx, dest interface{}, query string, args ...interface{}) error {
+	return t.db.GetTx(ctx, tx, dest, query, args...)
+}
+
 // Exec checks for transaction in context
 func (t *TxDatabase) Exec(ctx context.Context, query string, args ...interface{}) (int64, error) {
 	if tx, ok := GetTx(ctx); ok {
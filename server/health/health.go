@@ -0,0 +1,136 @@
+// Package health serves /healthz and /readyz. Liveness only says the process
+// is serving, readiness runs every registered dependency check with a timeout.
+package health
+
+import (
+	"context"
+	"net/http"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/boolow5/quran-app-api/logger"
+	"github.com/gin-gonic/gin"
+)
+
+// DefaultTimeout bounds a check that was added without one
+const DefaultTimeout = 2 * time.Second
+
+// CheckFunc returns an error when a dependency cannot be reached
+type CheckFunc func(ctx context.Context) error
+
+type check struct {
+	name    string
+	timeout time.Duration
+	fn      CheckFunc
+}
+
+// Checker runs the readiness checks
+type Checker struct {
+	checks   []check
+	draining atomic.Bool
+}
+
+func New() *Checker {
+	return &Checker{}
+}
+
+// Add registers a readiness check, fn must give up when ctx is done
+func (h *Checker) Add(name string, timeout time.Duration, fn CheckFunc) *Checker {
+	if timeout <= 0 {
+		timeout = DefaultTimeout
+	}
+	h.checks = append(h.checks, check{name: name, timeout: timeout, fn: fn})
+	return h
+}
+
+// Drain makes /readyz fail so the load balancer stops sending traffic
+// while in-flight requests finish
+func (h *Checker) Drain() {
+	h.draining.Store(true)
+}
+
+// Result is the outcome of one check
+type Result struct {
+	Status    string `json:"status"`
+	LatencyMS int64  `json:"latency_ms"`
+	Error     string `json:"error,omitempty"`
+}
+
+// Run runs all checks concurrently and reports whether all of them passed
+func (h *Checker) Run(ctx context.Context) (map[string]Result, bool) {
+	results := make(map[string]Result, len(h.checks))
+	var mu sync.Mutex
+	var wg sync.WaitGroup
+
+	for _, c := range h.checks {
+		wg.Add(1)
+		go func(c check) {
+			defer wg.Done()
+
+			checkCtx, cancel := context.WithTimeout(ctx, c.timeout)
+			defer cancel()
+
+			started := time.Now()
+			err := runCheck(checkCtx, c.fn)
+			result := Result{Status: "ok", LatencyMS: time.Since(started).Milliseconds()}
+			if err != nil {
+				result.Status = "fail"
+				result.Error = err.Error()
+			}
+
+			mu.Lock()
+			results[c.name] = result
+			mu.Unlock()
+		}(c)
+	}
+	wg.Wait()
+
+	ok := true
+	for _, r := range results {
+		if r.Status != "ok" {
+			ok = false
+		}
+	}
+	return results, ok
+}
+
+// runCheck returns when fn does or when ctx expires, whichever is first, so a
+// check that ignores ctx cannot hang the probe
+func runCheck(ctx context.Context, fn CheckFunc) error {
+	done := make(chan error, 1)
+	go func() { done <- fn(ctx) }()
+
+	select {
+	case err := <-done:
+		return err
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+// Liveness handles /healthz. It does not touch dependencies, a restart would
+// not fix them.
+func (h *Checker) Liveness() gin.HandlerFunc {
+	return func(c *gin.Context) {
+		c.JSON(http.StatusOK, gin.H{"status": "ok"})
+	}
+}
+
+// Readiness handles /readyz
+func (h *Checker) Readiness() gin.HandlerFunc {
+	return func(c *gin.Context) {
+		if h.draining.Load() {
+			c.JSON(http.StatusServiceUnavailable, gin.H{"status": "draining"})
+			return
+		}
+
+		results, ok := h.Run(c.Request.Context())
+		if !ok {
+			logger.For(c.Request.Context(), "health.Readiness").WithField("checks", results).Warn("Not ready")
+			c.JSON(http.StatusServiceUnavailable, gin.H{"status": "fail", "checks": results})
+			return
+		}
+		c.JSON(http.StatusOK, gin.H{"status": "ok", "checks": results})
+	}
+}
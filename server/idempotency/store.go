@@ -0,0 +1,144 @@
+// Package idempotency remembers the responses of mutating requests sent with
+// an Idempotency-Key header, so a client retrying after a dropped connection
+// gets the first response back instead of repeating the change.
+package idempotency
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"time"
+
+	"github.com/redis/go-redis/v9"
+)
+
+const keyPrefix = "idempotency:"
+
+// releaseScript deletes a key only if it still holds the given pending record
+var releaseScript = redis.NewScript(`
+if redis.call("GET", KEYS[1]) == ARGV[1] then
+	return redis.call("DEL", KEYS[1])
+end
+return 0
+`)
+
+// completeScript replaces a key with the response only if it still holds the
+// given pending record
+var completeScript = redis.NewScript(`
+if redis.call("GET", KEYS[1]) == ARGV[1] then
+	redis.call("SET", KEYS[1], ARGV[2], "PX", ARGV[3])
+	return 1
+end
+return 0
+`)
+
+// ErrClaimLost is returned by Claim.Complete when the pending record expired
+// before the request finished, another request may have claimed the key
+var ErrClaimLost = errors.New("idempotency key was released or claimed again before the request finished")
+
+// Record is what is stored under a key, a pending record is replaced by the
+// response once the first request finishes
+type Record struct {
+	Fingerprint string    `json:"fingerprint"`
+	Pending     bool      `json:"pending,omitempty"`
+	Status      int       `json:"status,omitempty"`
+	ContentType string    `json:"content_type,omitempty"`
+	Body        []byte    `json:"body,omitempty"`
+	CreatedAt   time.Time `json:"created_at"`
+}
+
+// Fingerprint identifies a request by its method, path, query and body
+func Fingerprint(method, uri string, body []byte) string {
+	h := sha256.New()
+	fmt.Fprintf(h, "%s %s\n", method, uri)
+	h.Write(body)
+	return hex.EncodeToString(h.Sum(nil))
+}
+
+type Store struct {
+	redis *redis.Client
+}
+
+func NewStore(client *redis.Client) *Store {
+	return &Store{redis: client}
+}
+
+// Claim stores a pending record for key unless one exists. It returns the
+// claim to finish the request with, or the existing record when the key was
+// used before. The pending record expires after lockTTL so a crashed request
+// does not block the key forever.
+func (s *Store) Claim(ctx context.Context, key, fingerprint string, lockTTL time.Duration) (*Claim, *Record, error) {
+	pending, err := json.Marshal(Record{Fingerprint: fingerprint, Pending: true, CreatedAt: time.Now()})
+	if err != nil {
+		return nil, nil, err
+	}
+
+	ok, err := s.redis.SetNX(ctx, keyPrefix+key, pending, lockTTL).Result()
+	if err != nil {
+		return nil, nil, fmt.Errorf("failed to claim idempotency key: %w", err)
+	}
+	if ok {
+		return &Claim{store: s, key: keyPrefix + key, pending: string(pending), fingerprint: fingerprint}, nil, nil
+	}
+
+	raw, err := s.redis.Get(ctx, keyPrefix+key).Bytes()
+	if errors.Is(err, redis.Nil) {
+		// expired between the two calls, the client's next retry claims it
+		return nil, &Record{Fingerprint: fingerprint, Pending: true}, nil
+	}
+	if err != nil {
+		return nil, nil, fmt.Errorf("failed to get idempotency key: %w", err)
+	}
+
+	var existing Record
+	if err := json.Unmarshal(raw, &existing); err != nil {
+		return nil, nil, fmt.Errorf("invalid idempotency record: %w", err)
+	}
+	return nil, &existing, nil
+}
+
+// Claim is a key held by the request being processed
+type Claim struct {
+	store       *Store
+	key         string
+	pending     string
+	fingerprint string
+}
+
+// Complete replaces the pending record with the response, kept for ttl. The
+// response is not stored and ErrClaimLost returned when the key no longer
+// holds this request's pending record.
+func (c *Claim) Complete(ctx context.Context, status int, contentType string, body []byte, ttl time.Duration) error {
+	data, err := json.Marshal(Record{
+		Fingerprint: c.fingerprint,
+		Status:      status,
+		ContentType: contentType,
+		Body:        body,
+		CreatedAt:   time.Now(),
+	})
+	if err != nil {
+		return err
+	}
+
+	stored, err := completeScript.Run(ctx, c.store.redis, []string{c.key}, c.pending, data, ttl.Milliseconds()).Int()
+	if err != nil {
+		return fmt.Errorf("failed to save idempotent response: %w", err)
+	}
+	if stored == 0 {
+		return ErrClaimLost
+	}
+	return nil
+}
+
+// Release frees the key so the request can be retried, for requests that
+// failed without a response worth replaying
+func (c *Claim) Release(ctx context.Context) error {
+	err := releaseScript.Run(ctx, c.store.redis, []string{c.key}, c.pending).Err()
+	if err != nil && !errors.Is(err, redis.Nil) {
+		return fmt.Errorf("failed to release idempotency key: %w", err)
+	}
+	return nil
+}
@@ -1,23 +1,73 @@
 package logger
 
 import (
+	"context"
 	"os"
+	"strings"
 
 	log "github.com/sirupsen/logrus"
 )
 
-type Fields log.Fields
+type Fields = log.Fields
 
-func Setup() {
+type contextKey struct{}
 
-	// log.SetFormatter(&log.JSONFormatter{
-	// 	TimestampFormat: "2006-01-02 15:04",
-	// 	PrettyPrint:     true,
-	// })
+// Setup configures JSON output at level (debug, info, warn or error, default
+// info). format "text" switches to human readable lines for local development.
+func Setup(level, format string) {
+	if strings.EqualFold(format, "text") {
+		log.SetFormatter(&log.TextFormatter{FullTimestamp: true})
+	} else {
+		log.SetFormatter(&log.JSONFormatter{
+			TimestampFormat: "2006-01-02T15:04:05.000Z07:00",
+			FieldMap: log.FieldMap{
+				log.FieldKeyMsg: "message",
+			},
+		})
+	}
 
 	log.SetOutput(os.Stdout)
-	// log.SetLevel(log.DebugLevel)
-	log.SetLevel(log.InfoLevel)
+
+	parsed, err := log.ParseLevel(level)
+	if err != nil {
+		parsed = log.InfoLevel
+	}
+	log.SetLevel(parsed)
+
+	log.AddHook(redactHook{})
+}
+
+// WithContext returns a copy of ctx that carries entry, later FromContext calls
+// log with its fields
+func WithContext(ctx context.Context, entry *log.Entry) context.Context {
+	return context.WithValue(ctx, contextKey{}, entry)
+}
+
+// FromContext returns the logger carried by ctx, e.g. with the request id and
+// user id set by the request middleware, or the standard logger
+func FromContext(ctx context.Context) *log.Entry {
+	if ctx != nil {
+		if entry, ok := ctx.Value(contextKey{}).(*log.Entry); ok {
+			return entry
+		}
+	}
+	return log.NewEntry(log.StandardLogger())
+}
+
+// For returns the context logger tagged with the component that logs, usually
+// "<package>.<function>"
+func For(ctx context.Context, component string) *log.Entry {
+	return FromContext(ctx).WithField("component", component)
+}
+
+// Component returns a logger tagged with component for code without a context
+func Component(component string) *log.Entry {
+	return log.WithField("component", component)
+}
+
+// AddFields returns a copy of ctx whose logger has the extra fields
+func AddFields(ctx context.Context, fields Fields) context.Context {
+	return WithContext(ctx, FromContext(ctx).WithFields(log.Fields(fields)))
 }
 
 func Info(args ...interface{}) {
@@ -44,6 +94,14 @@ func Warnf(format string, args ...interface{}) {
 	log.Warnf(format, args...)
 }
 
+func Error(args ...interface{}) {
+	log.Error(args...)
+}
+
+func Errorf(format string, args ...interface{}) {
+	log.Errorf(format, args...)
+}
+
 func Fatal(args ...interface{}) {
 	log.Fatal(args...)
 }
@@ -0,0 +1,88 @@
+package logger
+
+import (
+	"fmt"
+	"regexp"
+	"strings"
+
+	log "github.com/sirupsen/logrus"
+)
+
+const redacted = "[REDACTED]"
+
+// sensitiveKeys are field names whose values never reach the logs
+var sensitiveKeys = []string{"token", "authorization", "password", "secret", "credential", "private_key", "subscription", "cookie"}
+
+// sensitivePatterns catch secrets that end up inside messages and error strings
+var sensitivePatterns = []*regexp.Regexp{
+	// Authorization headers
+	regexp.MustCompile(`(?i)bearer\s+[A-Za-z0-9\-_.=]+`),
+	// JWTs such as Firebase ID tokens
+	regexp.MustCompile(`eyJ[A-Za-z0-9\-_]+\.[A-Za-z0-9\-_]+\.[A-Za-z0-9\-_]*`),
+	// FCM registration tokens, "<instance id>:<token>"
+	regexp.MustCompile(`[A-Za-z0-9\-_]{11,}:APA91[A-Za-z0-9\-_]{20,}`),
+	// anything else that looks like a long opaque token
+	regexp.MustCompile(`[A-Za-z0-9\-_]{100,}`),
+}
+
+// Redact replaces tokens and secrets in s
+func Redact(s string) string {
+	for _, pattern := range sensitivePatterns {
+		s = pattern.ReplaceAllString(s, redacted)
+	}
+	return s
+}
+
+// RedactToken keeps the first characters of a token so it can still be told
+// apart from others in the logs
+func RedactToken(token string) string {
+	if len(token) <= 8 {
+		return redacted
+	}
+	return token[:6] + "..." + redacted
+}
+
+func isSensitiveKey(key string) bool {
+	key = strings.ToLower(key)
+	for _, sensitive := range sensitiveKeys {
+		if strings.Contains(key, sensitive) {
+			return true
+		}
+	}
+	return false
+}
+
+// redactHook scrubs every entry before it is written
+type redactHook struct{}
+
+func (redactHook) Levels() []log.Level {
+	return log.AllLevels
+}
+
+func (redactHook) Fire(entry *log.Entry) error {
+	entry.Message = Redact(entry.Message)
+
+	// entries share their Data map with the logger they came from, copy before changing it
+	data := make(log.Fields, len(entry.Data))
+	for key, value := range entry.Data {
+		switch {
+		case isSensitiveKey(key):
+			data[key] = redacted
+		case key == log.ErrorKey:
+			if err, ok := value.(error); ok {
+				data[key] = Redact(err.Error())
+			} else {
+				data[key] = Redact(fmt.Sprint(value))
+			}
+		default:
+			if s, ok := value.(string); ok {
+				data[key] = Redact(s)
+			} else {
+				data[key] = value
+			}
+		}
+	}
+	entry.Data = data
+
+	return nil
+}
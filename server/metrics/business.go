@@ -0,0 +1,77 @@
+package metrics
+
+import (
+	"context"
+	"time"
+
+	"github.com/boolow5/quran-app-api/logger"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+)
+
+const businessInterval = time.Minute
+
+var (
+	ActiveStreaks = promauto.NewGauge(prometheus.GaugeOpts{
+		Namespace: namespace,
+		Name:      "active_streaks",
+		Help:      "Users whose current streak is above zero.",
+	})
+
+	DailyReaders = promauto.NewGauge(prometheus.GaugeOpts{
+		Namespace: namespace,
+		Name:      "daily_readers",
+		Help:      "Users with at least one reading event today (server time).",
+	})
+
+	EventsToday = promauto.NewGauge(prometheus.GaugeOpts{
+		Namespace: namespace,
+		Name:      "reading_events_today",
+		Help:      "Reading events stored today (server time).",
+	})
+
+	OutboxPending = promauto.NewGauge(prometheus.GaugeOpts{
+		Namespace: namespace,
+		Name:      "notification_outbox_pending",
+		Help:      "Push notifications waiting to be sent.",
+	})
+)
+
+// getter is the part of db.Database the business gauges need, the db package
+// itself reports to this package
+type getter interface {
+	Get(ctx context.Context, dest interface{}, query string, args ...interface{}) error
+}
+
+var businessQueries = []struct {
+	gauge prometheus.Gauge
+	query string
+}{
+	{ActiveStreaks, "SELECT COUNT(*) FROM user_streaks WHERE current_streak > 0"},
+	{DailyReaders, "SELECT COUNT(DISTINCT user_id) FROM reading_events WHERE created_at >= CURDATE()"},
+	{EventsToday, "SELECT COUNT(*) FROM reading_events WHERE created_at >= CURDATE()"},
+	{OutboxPending, "SELECT COUNT(*) FROM notification_outbox WHERE status IN ('pending', 'sending')"},
+}
+
+// StartBusinessGauges refreshes the business gauges every minute until ctx is cancelled
+func StartBusinessGauges(ctx context.Context, db getter) {
+	ticker := time.NewTicker(businessInterval)
+	defer ticker.Stop()
+
+	for {
+		for _, q := range businessQueries {
+			var value float64
+			if err := db.Get(ctx, &value, q.query); err != nil {
+				logger.For(ctx, "metrics.StartBusinessGauges").WithError(err).Warn("Failed to refresh business gauge")
+				continue
+			}
+			q.gauge.Set(value)
+		}
+
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+	}
+}
@@ -0,0 +1,131 @@
+// Package metrics holds the Prometheus collectors of the server, they are
+// served on /metrics
+package metrics
+
+import (
+	"net/http"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+)
+
+const namespace = "quran_api"
+
+var (
+	HTTPRequests = promauto.NewCounterVec(prometheus.CounterOpts{
+		Namespace: namespace,
+		Name:      "http_requests_total",
+		Help:      "HTTP requests by route and status code.",
+	}, []string{"method", "route", "status"})
+
+	HTTPDuration = promauto.NewHistogramVec(prometheus.HistogramOpts{
+		Namespace: namespace,
+		Name:      "http_request_duration_seconds",
+		Help:      "HTTP request latency by route and status code.",
+		Buckets:   []float64{.005, .01, .025, .05, .1, .25, .5, 1, 2.5, 5, 10},
+	}, []string{"method", "route", "status"})
+
+	DBQueryDuration = promauto.NewHistogramVec(prometheus.HistogramOpts{
+		Namespace: namespace,
+		Name:      "db_query_duration_seconds",
+		Help:      "MySQL call latency by operation and outcome.",
+		Buckets:   []float64{.001, .0025, .005, .01, .025, .05, .1, .25, .5, 1, 2.5, 5},
+	}, []string{"operation", "status"})
+
+	JobRuns = promauto.NewCounterVec(prometheus.CounterOpts{
+		Namespace: namespace,
+		Name:      "cron_job_runs_total",
+		Help:      "Cron job runs by job and status (succeeded, failed, skipped).",
+	}, []string{"job", "status"})
+
+	JobDuration = promauto.NewHistogramVec(prometheus.HistogramOpts{
+		Namespace: namespace,
+		Name:      "cron_job_duration_seconds",
+		Help:      "Cron job run time by job and status.",
+		Buckets:   []float64{.1, .5, 1, 5, 15, 30, 60, 120, 300, 600, 1800, 3600},
+	}, []string{"job", "status"})
+
+	JobLastSuccess = promauto.NewGaugeVec(prometheus.GaugeOpts{
+		Namespace: namespace,
+		Name:      "cron_job_last_success_timestamp_seconds",
+		Help:      "Unix time of the last successful run of a job on this replica.",
+	}, []string{"job"})
+
+	SchedulerLeader = promauto.NewGauge(prometheus.GaugeOpts{
+		Namespace: namespace,
+		Name:      "scheduler_leader",
+		Help:      "1 if this replica is the cron leader.",
+	})
+
+	PushSends = promauto.NewCounterVec(prometheus.CounterOpts{
+		Namespace: namespace,
+		Name:      "push_sends_total",
+		Help:      "Push notifications sent by transport and status (success, failure).",
+	}, []string{"transport", "status"})
+
+	PushFailures = promauto.NewCounterVec(prometheus.CounterOpts{
+		Namespace: namespace,
+		Name:      "push_failures_total",
+		Help:      "Failed push notifications by transport and error code.",
+	}, []string{"transport", "code"})
+
+	PushInvalidTokens = promauto.NewCounter(prometheus.CounterOpts{
+		Namespace: namespace,
+		Name:      "push_invalid_tokens_total",
+		Help:      "Device tokens deleted because the push service rejected them.",
+	})
+
+	QueueJobs = promauto.NewCounterVec(prometheus.CounterOpts{
+		Namespace: namespace,
+		Name:      "queue_jobs_total",
+		Help:      "Background jobs by type and status (succeeded, retried, dead).",
+	}, []string{"type", "status"})
+
+	ReadingEventsIngested = promauto.NewCounter(prometheus.CounterOpts{
+		Namespace: namespace,
+		Name:      "reading_events_ingested_total",
+		Help:      "Reading events accepted by the API.",
+	})
+
+	ListeningEventsIngested = promauto.NewCounter(prometheus.CounterOpts{
+		Namespace: namespace,
+		Name:      "listening_events_ingested_total",
+		Help:      "Listening events accepted by the API.",
+	})
+
+	RateLimitDecisions = promauto.NewCounterVec(prometheus.CounterOpts{
+		Namespace: namespace,
+		Name:      "rate_limit_decisions_total",
+		Help:      "Rate limiter decisions per route group, result is allowed, limited, allowlisted or error.",
+	}, []string{"group", "result"})
+
+	IdempotentRequests = promauto.NewCounterVec(prometheus.CounterOpts{
+		Namespace: namespace,
+		Name:      "idempotent_requests_total",
+		Help:      "Requests with an Idempotency-Key, result is stored, replayed, mismatch, in_progress, lost or error.",
+	}, []string{"result"})
+
+	ContractViolations = promauto.NewCounterVec(prometheus.CounterOpts{
+		Namespace: namespace,
+		Name:      "openapi_response_violations_total",
+		Help:      "Responses that did not match the OpenAPI document, counted when response validation is on.",
+	}, []string{"method", "route"})
+)
+
+// ObserveJob records the outcome of a cron job run
+func ObserveJob(job, status string, duration time.Duration) {
+	JobRuns.WithLabelValues(job, status).Inc()
+	if duration > 0 {
+		JobDuration.WithLabelValues(job, status).Observe(duration.Seconds())
+	}
+	if status == "succeeded" {
+		JobLastSuccess.WithLabelValues(job).SetToCurrentTime()
+	}
+}
+
+// Handler serves the metrics of the default registry
+func Handler() http.Handler {
+	return promhttp.Handler()
+}
@@ -0,0 +1,27 @@
+package middlewares
+
+import (
+	"github.com/boolow5/quran-app-api/apperrors"
+	"github.com/gin-gonic/gin"
+)
+
+// ActiveAccount rejects users whose account is waiting out its deletion grace
+// period. Routes registered before it is added, i.e. restoring the account,
+// stay reachable. It must run after FirebaseAuth.
+func ActiveAccount() gin.HandlerFunc {
+	return func(c *gin.Context) {
+		user, ok := GetUser(c)
+		if !ok {
+			AbortWithError(c, apperrors.ErrUnauthenticated)
+			return
+		}
+
+		if user.DeletedAt.Valid {
+			AbortWithError(c, apperrors.ErrAccountDeleted.WithDetails(map[string]interface{}{
+				"purge_after": user.PurgeAfter.Time,
+			}))
+			return
+		}
+		c.Next()
+	}
+}
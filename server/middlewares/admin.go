@@ -0,0 +1,108 @@
+package middlewares
+
+import (
+	"context"
+	"strconv"
+	"strings"
+
+	"github.com/boolow5/quran-app-api/apperrors"
+	"github.com/boolow5/quran-app-api/db"
+	"github.com/boolow5/quran-app-api/logger"
+	"github.com/boolow5/quran-app-api/models"
+	"github.com/gin-gonic/gin"
+)
+
+// RequireRole allows requests from users whose role includes role, it must
+// run after FirebaseAuth.Middleware
+func RequireRole(role string) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		user, ok := GetUser(c)
+		if !ok || !user.HasRole(role) {
+			var uid interface{}
+			if ok {
+				uid = user.UID
+			}
+			logger.For(c.Request.Context(), "middlewares.RequireRole").Warnf("%s access denied for %v", role, uid)
+			AbortWithError(c, apperrors.ErrForbidden)
+			return
+		}
+		c.Next()
+	}
+}
+
+const (
+	auditTargetKey  = "audit_target_user_id"
+	auditDetailsKey = "audit_details"
+)
+
+// SetAuditTarget records the user an admin request acts on in its audit entry
+func SetAuditTarget(c *gin.Context, userID uint64) {
+	c.Set(auditTargetKey, userID)
+}
+
+// SetAuditDetails adds details, e.g. a value before and after and the reason
+// for changing it, to the audit entry of an admin request
+func SetAuditDetails(c *gin.Context, details map[string]interface{}) {
+	current, _ := c.Get(auditDetailsKey)
+	merged, _ := current.(map[string]interface{})
+	if merged == nil {
+		merged = map[string]interface{}{}
+	}
+	for k, v := range details {
+		merged[k] = v
+	}
+	c.Set(auditDetailsKey, merged)
+}
+
+// Audit writes every request to the admin audit log once it has been
+// handled, with its path and query parameters and the details set by the
+// handler. It must run after FirebaseAuth.Middleware.
+func Audit(db db.Database) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		c.Next()
+
+		user, ok := GetUser(c)
+		if !ok {
+			return
+		}
+
+		entry := models.AuditEntry{
+			ActorUserID: user.ID,
+			ActorUID:    user.UID,
+			Method:      c.Request.Method,
+			Route:       c.FullPath(),
+			Status:      c.Writer.Status(),
+			IP:          c.ClientIP(),
+		}
+		if len(c.Errors) > 0 {
+			// the status is written by ErrorHandler after this returns
+			entry.Status = apperrors.From(c.Errors.Last().Err).Status
+		}
+
+		details := map[string]interface{}{}
+		for _, param := range c.Params {
+			details[param.Key] = param.Value
+		}
+		if query := c.Request.URL.RawQuery; query != "" {
+			details["query"] = query
+		}
+		if extra, ok := c.Get(auditDetailsKey); ok {
+			for k, v := range extra.(map[string]interface{}) {
+				details[k] = v
+			}
+		}
+		if target, ok := c.Get(auditTargetKey); ok {
+			id := target.(uint64)
+			entry.TargetUserID = &id
+		} else if id, err := strconv.ParseUint(c.Param("id"), 10, 64); err == nil && strings.Contains(entry.Route, "/users/:id") {
+			entry.TargetUserID = &id
+		}
+		entry.Details = details
+
+		// the request is done, its context may be canceled
+		ctx := context.WithoutCancel(c.Request.Context())
+		if err := models.RecordAudit(ctx, db, entry); err != nil {
+			logger.For(ctx, "middlewares.Audit").Errorf("Error recording %s %s by user %d: %v", entry.Method, entry.Route, entry.ActorUserID, err)
+		}
+	}
+}
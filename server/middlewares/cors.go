@@ -1,22 +1,15 @@
 package middlewares
 
 import (
-	"fmt"
 	"strings"
 
+	"github.com/boolow5/quran-app-api/apperrors"
+	"github.com/boolow5/quran-app-api/logger"
 	"github.com/gin-gonic/gin"
 )
 
-var (
-	AllowedOrigins = []string{
-		"quran-api.mahad.dev",
-		"localhost:4580",
-		"127.0.0.1:4580",
-		"192.168.100.50:1140",
-	}
-)
-
-func Cors() gin.HandlerFunc {
+// Cors allows browser requests from origins, a list of host[:port] values
+func Cors(origins []string) gin.HandlerFunc {
 	return func(c *gin.Context) {
 		headerOrigin := c.Request.Header.Get("Origin")
 		if headerOrigin == "" {
@@ -24,21 +17,21 @@ func Cors() gin.HandlerFunc {
 			return
 		}
 
-		fmt.Printf("[middleware] Origin: '%s'\n", headerOrigin)
-		if IsAllowedOrigin(headerOrigin) {
-			fmt.Printf("[middleware] Origin allowed: %s\n", headerOrigin)
+		logger.For(c.Request.Context(), "middlewares.Cors").Debugf("Origin: '%s'", headerOrigin)
+		if IsAllowedOrigin(origins, headerOrigin) {
+			logger.For(c.Request.Context(), "middlewares.Cors").Debugf("Origin allowed: %s", headerOrigin)
 			c.Writer.Header().Set("Access-Control-Allow-Origin", c.Request.Header.Get("Origin"))
 		} else {
-			fmt.Printf("[middleware] Origin not allowed: %s\n", headerOrigin)
-			c.AbortWithStatus(403)
+			logger.For(c.Request.Context(), "middlewares.Cors").Debugf("Origin not allowed: %s", headerOrigin)
+			AbortWithError(c, apperrors.ErrForbidden.WithDetails(map[string]interface{}{"reason": "origin not allowed"}))
 			return
 		}
 
 		c.Writer.Header().Set("Access-Control-Allow-Credentials", "true")
-		c.Writer.Header().Set("Access-Control-Allow-Methods", "POST, OPTIONS, GET, PUT, DELETE")
-		c.Writer.Header().Set("Access-Control-Allow-Headers", "Accept, Content-Type, Content-Length, Accept-Encoding, X-CSRF-Token, Authorization")
+		c.Writer.Header().Set("Access-Control-Allow-Methods", "POST, OPTIONS, GET, PUT, PATCH, DELETE")
+		c.Writer.Header().Set("Access-Control-Allow-Headers", "Accept, Content-Type, Content-Length, Accept-Encoding, X-CSRF-Token, Authorization, "+IdempotencyKeyHeader+", "+DeviceIDHeader)
 		if c.Request.Method == "OPTIONS" {
-			fmt.Printf("[middleware] OPTIONS request\n")
+			logger.For(c.Request.Context(), "middlewares.Cors").Debug("OPTIONS request")
 			c.AbortWithStatus(204)
 			return
 		}
@@ -46,12 +39,12 @@ func Cors() gin.HandlerFunc {
 	}
 }
 
-func IsAllowedOrigin(origin string) bool {
+func IsAllowedOrigin(allowedOrigins []string, origin string) bool {
 	if strings.HasPrefix(origin, "http") {
 		origin = strings.Split(origin, "//")[1]
 	}
 
-	for _, allowedOrigin := range AllowedOrigins {
+	for _, allowedOrigin := range allowedOrigins {
 		if allowedOrigin == origin {
 			return true
 		}
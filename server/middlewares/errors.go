@@ -0,0 +1,94 @@
+package middlewares
+
+import (
+	"fmt"
+	"net/http"
+	"reflect"
+	"runtime/debug"
+	"strings"
+
+	"github.com/boolow5/quran-app-api/apperrors"
+	"github.com/boolow5/quran-app-api/logger"
+	"github.com/gin-gonic/gin"
+	"github.com/gin-gonic/gin/binding"
+	"github.com/go-playground/validator/v10"
+)
+
+// ErrorResponse is the body of every error response
+type ErrorResponse struct {
+	Code      apperrors.Code         `json:"code"`
+	Message   string                 `json:"message"`
+	Details   map[string]interface{} `json:"details,omitempty"`
+	RequestID string                 `json:"request_id,omitempty"`
+	// Error repeats Message for clients written before codes existed
+	Error string `json:"error"`
+}
+
+func init() {
+	// validation details name fields the way clients send them
+	if v, ok := binding.Validator.Engine().(*validator.Validate); ok {
+		v.RegisterTagNameFunc(func(field reflect.StructField) string {
+			name := strings.Split(field.Tag.Get("json"), ",")[0]
+			if name == "" || name == "-" {
+				return field.Name
+			}
+			return name
+		})
+	}
+}
+
+// AbortWithError stops the request with err, ErrorHandler writes the response
+func AbortWithError(c *gin.Context, err error) {
+	_ = c.Error(err)
+	c.Abort()
+}
+
+// ErrorHandler writes the last error added with AbortWithError as an
+// ErrorResponse with the status of its apperrors code, and turns panics into
+// internal errors. It must run before every handler that reports errors.
+func ErrorHandler() gin.HandlerFunc {
+	return func(c *gin.Context) {
+		defer func() {
+			if recovered := recover(); recovered != nil {
+				logger.For(c.Request.Context(), "middlewares.ErrorHandler").Errorf("Panic: %v\n%s", recovered, debug.Stack())
+				writeError(c, apperrors.Internal(fmt.Errorf("panic: %v", recovered)))
+			}
+		}()
+
+		c.Next()
+
+		if len(c.Errors) == 0 || c.Writer.Written() {
+			return
+		}
+		writeError(c, c.Errors.Last().Err)
+	}
+}
+
+func writeError(c *gin.Context, err error) {
+	e := apperrors.From(err)
+	if e.Status >= http.StatusInternalServerError {
+		logger.For(c.Request.Context(), "middlewares.ErrorHandler").Errorf("%s %s: %v", c.Request.Method, c.FullPath(), err)
+	}
+	message := e.Localize(RequestLocale(c))
+
+	c.AbortWithStatusJSON(e.Status, ErrorResponse{
+		Code:      e.Code,
+		Message:   message,
+		Details:   e.Details,
+		RequestID: c.GetString("request_id"),
+		Error:     message,
+	})
+}
+
+// RequestLocale is the locale saved for the user, or else the first language
+// of the Accept-Language header
+func RequestLocale(c *gin.Context) string {
+	if locale := c.GetString("locale"); locale != "" {
+		return locale
+	}
+
+	header := c.GetHeader("Accept-Language")
+	first, _, _ := strings.Cut(header, ",")
+	tag, _, _ := strings.Cut(first, ";")
+	return strings.TrimSpace(tag)
+}
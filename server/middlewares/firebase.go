@@ -2,15 +2,19 @@ package middlewares
 
 import (
 	"context"
-	"encoding/base64"
+	"errors"
 	"fmt"
+	"io"
 	"net/http"
-	"os"
 	"strings"
 
 	firebase "firebase.google.com/go/v4"
+	"firebase.google.com/go/v4/auth"
+	"github.com/boolow5/quran-app-api/apperrors"
 	"github.com/boolow5/quran-app-api/db"
+	"github.com/boolow5/quran-app-api/logger"
 	"github.com/boolow5/quran-app-api/models"
+	"github.com/boolow5/quran-app-api/tracing"
 	"github.com/gin-gonic/gin"
 	"google.golang.org/api/option"
 )
@@ -19,42 +23,53 @@ type FirebaseAuth struct {
 	app *firebase.App
 }
 
-// NewFirebaseAuth initializes Firebase Auth
-func NewFirebaseAuth(credentialsFile string) (*FirebaseAuth, error) {
-	opt := option.WithCredentialsFile(credentialsFile)
-	if credentialsFile == "" {
-		s := os.Getenv("FIREBASE_CREDENTIALS")
-		fmt.Printf("FIREBASE_CREDENTIALS: %v...\n", s[:10])
-		credentialsJSON, err := base64.StdEncoding.DecodeString(s)
-		if err != nil {
-			return nil, err
-		}
+// NewFirebaseAuth initializes Firebase Auth with the service account JSON
+func NewFirebaseAuth(credentialsJSON []byte) (*FirebaseAuth, error) {
+	app, err := firebase.NewApp(context.Background(), nil, option.WithCredentialsJSON(credentialsJSON))
+	if err != nil {
+		return nil, fmt.Errorf("error initializing firebase: %v", err)
+	}
 
-		opt = option.WithCredentialsJSON(credentialsJSON)
-	} else {
-		fmt.Printf("FIREBASE_CREDENTIALS: %v\n", credentialsFile)
+	return &FirebaseAuth{app: app}, nil
+}
+
+// idTokenCertsURL serves the keys VerifyIDToken checks signatures against
+const idTokenCertsURL = "https://www.googleapis.com/robot/v1/metadata/x509/securetoken@system.gserviceaccount.com"
+
+// Check reports whether tokens can be verified: the auth client can be created
+// and Google's signing keys can be fetched
+func (fa *FirebaseAuth) Check(ctx context.Context) error {
+	if _, err := fa.app.Auth(ctx); err != nil {
+		return fmt.Errorf("auth client: %v", err)
 	}
 
-	app, err := firebase.NewApp(context.Background(), nil, opt)
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, idTokenCertsURL, nil)
 	if err != nil {
-		return nil, fmt.Errorf("error initializing firebase: %v", err)
+		return err
 	}
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	io.Copy(io.Discard, resp.Body)
 
-	return &FirebaseAuth{app: app}, nil
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("signing keys: %s", resp.Status)
+	}
+	return nil
 }
 
 // Middleware verifies the Firebase JWT token for Gin
 func (fa *FirebaseAuth) Middleware(db db.Database) gin.HandlerFunc {
 	return func(c *gin.Context) {
-		fmt.Printf("[middleware] Verifying Firebase JWT token\n")
+		logger.For(c.Request.Context(), "middlewares.FirebaseAuth").Debug("Verifying Firebase JWT token")
 
 		// Get token from Authorization header
 		authHeader := c.GetHeader("Authorization")
 		if authHeader == "" {
-			fmt.Printf("[middleware] No authorization header\n")
-			c.AbortWithStatusJSON(http.StatusUnauthorized, gin.H{
-				"error": "No authorization header",
-			})
+			logger.For(c.Request.Context(), "middlewares.FirebaseAuth").Warn("No authorization header")
+			AbortWithError(c, apperrors.ErrUnauthenticated)
 			return
 		}
 
@@ -64,122 +79,207 @@ func (fa *FirebaseAuth) Middleware(db db.Database) gin.HandlerFunc {
 		idToken := strings.Replace(authHeader, "Bearer ", "", 1)
 
 		if idToken == "" {
-			fmt.Printf("[middleware] No token found in Authorization header\n")
-			c.AbortWithStatusJSON(http.StatusUnauthorized, gin.H{
-				"error": "No token found in Authorization header",
-			})
+			logger.For(c.Request.Context(), "middlewares.FirebaseAuth").Warn("No token found in Authorization header")
+			AbortWithError(c, apperrors.ErrUnauthenticated)
 			return
 		}
 
 		// Initialize Firebase Auth client
 		client, err := fa.app.Auth(c.Request.Context())
 		if err != nil {
-			fmt.Printf("[middleware] Error initializing auth client: %v\n", err)
-			c.AbortWithStatusJSON(http.StatusInternalServerError, gin.H{
-				"error": "Error initializing auth client",
-			})
+			logger.For(c.Request.Context(), "middlewares.FirebaseAuth").Errorf("Error initializing auth client: %v", err)
+			AbortWithError(c, apperrors.ErrUnavailable.Wrap(err))
 			return
 		}
 
 		// Verify the token
-		token, err := client.VerifyIDToken(c.Request.Context(), idToken)
+		verifyCtx, span := tracing.Start(c.Request.Context(), "firebase.VerifyIDToken")
+		token, err := client.VerifyIDToken(verifyCtx, idToken)
+		tracing.End(span, err)
 		if err != nil {
-			fmt.Printf("[middleware] Error verifying token: %v\n", err)
-			c.AbortWithStatusJSON(http.StatusUnauthorized, gin.H{
-				"error": "Invalid token",
-			})
+			logger.For(c.Request.Context(), "middlewares.FirebaseAuth").Warnf("Error verifying token: %v", err)
+			if auth.IsIDTokenExpired(err) {
+				AbortWithError(c, apperrors.ErrTokenExpired.Wrap(err))
+			} else {
+				AbortWithError(c, apperrors.ErrInvalidToken.Wrap(err))
+			}
 			return
 		}
 
 		id, ok := token.Claims["user_id"].(string)
 		if !ok {
-			fmt.Printf("[middleware] Invalid user ID: %T\n", token.Claims["user_id"])
-			c.AbortWithStatusJSON(http.StatusUnauthorized, gin.H{
-				"error": "Invalid token",
-			})
+			logger.For(c.Request.Context(), "middlewares.FirebaseAuth").Warnf("Invalid user ID: %T", token.Claims["user_id"])
+			AbortWithError(c, apperrors.ErrInvalidToken)
 			return
 		}
 
-		email, ok := token.Claims["email"].(string)
-		if !ok {
-			fmt.Printf("[middleware] Invalid email: %T\n", token.Claims["email"])
-			c.AbortWithStatusJSON(http.StatusUnauthorized, gin.H{
-				"error": "Invalid token",
-			})
+		// anonymous sign-ins have no email, they are kept as guests
+		guest := isGuest(token)
+		if _, ok := token.Claims["email"].(string); !ok && !guest {
+			logger.For(c.Request.Context(), "middlewares.FirebaseAuth").Warnf("Invalid email: %T", token.Claims["email"])
+			AbortWithError(c, apperrors.ErrInvalidToken)
 			return
 		}
 
-		fmt.Printf("[middleware] User ID: %s, Email: %s\n", id, email)
-		fmt.Printf("[middleware] User ID: %s\n", token.UID)
-
-		// Create user object from token claims
-		user := models.User{
-			UID:   id,
-			Email: email,
-		}
-
-		fmt.Printf("[middleware] User: %+v\n", user)
+		logger.For(c.Request.Context(), "middlewares.FirebaseAuth").Debugf("User ID: %s", token.UID)
 
 		// Sync with local database
-		dbID, err := SyncFirebaseUser(c.Request.Context(), db, user)
+		identity := tokenIdentity(token)
+		identity.UID = id
+		synced, err := SyncFirebaseUser(c.Request.Context(), db, identity)
 		if err != nil {
-			fmt.Printf("[middleware] Error syncing user: %v\n", err)
-			c.AbortWithStatusJSON(http.StatusInternalServerError, gin.H{
-				"error": "Error syncing user",
-			})
+			logger.For(c.Request.Context(), "middlewares.FirebaseAuth").Errorf("Error syncing user: %v", err)
+			AbortWithError(c, err)
 			return
 		}
 
-		fmt.Printf("[middleware] dbID: %v\n", dbID)
+		SetLogUser(c, synced.ID, id)
 
-		// Set user in Gin context
-		c.Set("db_user_id", dbID)
-		c.Set("user_id", id)
-		c.Set("user", &user)
+		// Set user in Gin context, user_id is the uid the account was created
+		// with whichever identity signed in
+		c.Set("db_user_id", synced.ID)
+		c.Set("user_id", synced.UID)
+		c.Set("user", &synced)
 		c.Next()
 	}
 }
 
+// anonymousProvider is the sign_in_provider of Firebase anonymous sign-ins
+const anonymousProvider = "anonymous"
+
+// guestName is stored as the name of guests until they link a provider
+const guestName = "Guest"
+
+func isGuest(token *auth.Token) bool {
+	return token.Firebase.SignInProvider == anonymousProvider
+}
+
+// tokenIdentity is the identity a verified token signs in with
+func tokenIdentity(token *auth.Token) models.Identity {
+	email, _ := token.Claims["email"].(string)
+	verified, _ := token.Claims["email_verified"].(bool)
+	return models.Identity{
+		UID:           token.UID,
+		Provider:      token.Firebase.SignInProvider,
+		Email:         email,
+		EmailVerified: verified,
+	}
+}
+
+// VerifyToken verifies an ID token sent in a request body, field names it in
+// the validation error of a bad token
+func (fa *FirebaseAuth) VerifyToken(ctx context.Context, field, idToken string) (*auth.Token, error) {
+	client, err := fa.app.Auth(ctx)
+	if err != nil {
+		return nil, apperrors.ErrUnavailable.Wrap(err)
+	}
+
+	verifyCtx, span := tracing.Start(ctx, "firebase.VerifyIDToken")
+	token, err := client.VerifyIDToken(verifyCtx, idToken)
+	tracing.End(span, err)
+	if err != nil {
+		logger.For(ctx, "middlewares.VerifyToken").Warnf("Error verifying %s: %v", field, err)
+		return nil, apperrors.Invalid(field, "valid ID token").Wrap(err)
+	}
+	return token, nil
+}
+
+// VerifyGuestToken verifies the ID token of an anonymous sign-in and returns
+// its uid
+func (fa *FirebaseAuth) VerifyGuestToken(ctx context.Context, idToken string) (string, error) {
+	token, err := fa.VerifyToken(ctx, "guest_token", idToken)
+	if err != nil {
+		return "", err
+	}
+	if !isGuest(token) {
+		return "", apperrors.Invalid("guest_token", "ID token of a guest")
+	}
+	return token.UID, nil
+}
+
+// VerifyIdentityToken verifies the ID token of a sign-in to link to an
+// account
+func (fa *FirebaseAuth) VerifyIdentityToken(ctx context.Context, idToken string) (models.Identity, error) {
+	token, err := fa.VerifyToken(ctx, "id_token", idToken)
+	if err != nil {
+		return models.Identity{}, err
+	}
+	return tokenIdentity(token), nil
+}
+
+// maxDeleteUsers is the most uids Firebase deletes in one call
+const maxDeleteUsers = 1000
+
+// DeleteUsers deletes Firebase users, uids that do not exist count as deleted.
+// It returns the reason of every uid that could not be deleted.
+func (fa *FirebaseAuth) DeleteUsers(ctx context.Context, uids []string) (map[string]string, error) {
+	client, err := fa.app.Auth(ctx)
+	if err != nil {
+		return nil, fmt.Errorf("auth client: %v", err)
+	}
+
+	failed := map[string]string{}
+	for start := 0; start < len(uids); start += maxDeleteUsers {
+		batch := uids[start:min(start+maxDeleteUsers, len(uids))]
+		result, err := client.DeleteUsers(ctx, batch)
+		if err != nil {
+			return failed, fmt.Errorf("failed to delete firebase users: %w", err)
+		}
+		for _, info := range result.Errors {
+			failed[batch[info.Index]] = info.Reason
+		}
+	}
+	return failed, nil
+}
+
 func (fa *FirebaseAuth) Login(db db.Database) gin.HandlerFunc {
 	return func(c *gin.Context) {
 		form := models.User{}
 
 		if err := c.ShouldBind(&form); err != nil {
-			c.JSON(http.StatusBadRequest, gin.H{
-				"error": err.Error(),
-			})
+			AbortWithError(c, apperrors.Binding(err))
 			return
 		}
 
-		fmt.Printf("[middleware] Login User: %+v\n", form)
+		logger.For(c.Request.Context(), "middlewares.Login").Debugf("Login User: %+v", form)
 
-		// get user by uid
-		var user models.User
-		query := "SELECT * FROM users WHERE uid = ?"
-		err := db.Get(c.Request.Context(), &user, query, form.UID)
-		if err != nil {
-			fmt.Printf("[middleware] Login Error getting user: %v\n", err)
-			fmt.Printf("\tQuery: %v\n", strings.Replace(query, "?", "'"+form.UID+"'", 1))
-			c.JSON(http.StatusInternalServerError, gin.H{
-				"error": err.Error(),
-			})
+		// the user is the one the token signed in, the uid in the body must be
+		// one of their identities
+		user, ok := GetUser(c)
+		if !ok {
+			AbortWithError(c, apperrors.ErrUnauthenticated)
 			return
 		}
+		if form.UID != user.UID {
+			owner, err := models.GetUserByUID(c.Request.Context(), db, form.UID)
+			if err != nil && !errors.Is(err, apperrors.ErrUserNotFound) {
+				logger.For(c.Request.Context(), "middlewares.Login").Errorf("Login Error getting user: %v", err)
+				AbortWithError(c, err)
+				return
+			}
+			if err != nil || owner.ID != user.ID {
+				logger.For(c.Request.Context(), "middlewares.Login").Warnf("Login of user %d with uid %s of another user", user.ID, form.UID)
+				AbortWithError(c, apperrors.ErrForbidden)
+				return
+			}
+		}
 
-		if user.ID == 0 {
-			c.JSON(http.StatusUnauthorized, gin.H{
-				"error": "Invalid or expired token",
-			})
-			return
+		// if found update the name if it's empty, or still the one given to guests
+		if user.Name == "" || (user.Name == guestName && form.Name != "") {
+			_, err := db.Exec(c.Request.Context(), "UPDATE users SET name = ? WHERE id = ?", form.Name, user.ID)
+			if err != nil {
+				AbortWithError(c, err)
+				return
+			}
 		}
 
-		// if found update the name if it's empty
-		if user.Name == "" {
-			_, err := db.Exec(c.Request.Context(), "UPDATE users SET name = ? WHERE uid = ?", form.Name, form.UID)
+		// the app sends its UI language so reminders can be localised, it is
+		// validated and recorded like a change made on /me
+		if locale := strings.TrimSpace(form.Locale); locale != "" && locale != user.Locale {
+			_, err := models.UpdateProfile(c.Request.Context(), db, user.ID, models.ProfileUpdate{Locale: &locale})
 			if err != nil {
-				c.JSON(http.StatusInternalServerError, gin.H{
-					"error": err.Error(),
-				})
+				logger.For(c.Request.Context(), "middlewares.Login").Warnf("Login Error updating locale: %v", err)
+				AbortWithError(c, err)
 				return
 			}
 		}
@@ -189,54 +289,67 @@ func (fa *FirebaseAuth) Login(db db.Database) gin.HandlerFunc {
 		})
 	}
 }
-func SyncFirebaseUser(ctx context.Context, db db.Database, firebaseUser models.User) (id uint64, err error) {
-	var user models.User = models.User{UID: firebaseUser.UID, Email: firebaseUser.Email, Name: firebaseUser.Name}
-	query := "SELECT * FROM users WHERE uid = ?"
-	err = db.Get(ctx, &user, query, firebaseUser.UID)
+
+// SyncFirebaseUser returns the user of the identity a token signs in with.
+// An identity seen for the first time gets a new user, even when another
+// user has its verified email: the app links it to that user with
+// POST /me/identities once the user signed in there. Guests are stored
+// without an email.
+func SyncFirebaseUser(ctx context.Context, db db.Database, identity models.Identity) (models.User, error) {
+	guest := identity.Provider == anonymousProvider
+	user, err := models.GetUserByUID(ctx, db, identity.UID)
+	if errors.Is(err, apperrors.ErrUserNotFound) {
+		user, err = createUser(ctx, db, identity, guest)
+	}
 	if err != nil {
-		fmt.Printf("[middleware] Error getting user from database: %v\n", err)
-		fmt.Printf("\tQuery: %v\n", strings.Replace(query, "?", "'"+firebaseUser.UID+"'", 1))
-	} else {
-		fmt.Printf("[middleware] User found in database: %v\n", user)
-	}
-
-	if user.ID > 0 { // Found in database
-		fmt.Printf("[middleware] User found in database: %v\n", user)
-		changed := false
-		if strings.TrimSpace(firebaseUser.Name) != "" {
-			user.Name = firebaseUser.Name
-			changed = true
-		}
+		logger.For(ctx, "middlewares.SyncFirebaseUser").Errorf("Error getting user of %s: %v", identity.UID, err)
+		return models.User{}, err
+	}
 
-		if strings.TrimSpace(firebaseUser.Email) != "" {
-			user.Email = firebaseUser.Email
-			changed = true
-		}
+	identity.UserID = user.ID
+	if err := models.SaveIdentity(ctx, db, identity); err != nil {
+		return *user, err
+	}
 
-		if changed {
-			_, err = db.Exec(ctx, "UPDATE users SET email = ?, name = ? WHERE uid = ?", user.Email, user.Name, user.UID)
-		} else {
-			err = fmt.Errorf("Missing name or email")
-		}
-		return user.ID, err
+	// the users row follows the identity the account was created with
+	if identity.UID != user.UID {
+		return *user, nil
 	}
 
-	fmt.Printf("[middleware] User not found in database: %v\n", user)
+	changed := false
+	if strings.TrimSpace(identity.Email) != "" && identity.Email != user.Email {
+		user.Email = identity.Email
+		changed = true
+	}
 
-	user = firebaseUser
-	query = `
-    INSERT INTO users (uid, email, name)
-    VALUES (?, ?, ?)
-    ON DUPLICATE KEY UPDATE
-    email = VALUES(email),
-    name = VALUES(name)
-  `
-	insertedID, err := db.Insert(ctx, query, user.UID, user.Email, user.Name)
-	if err == nil {
-		user.ID = uint64(insertedID)
+	// a guest who links a provider in the app keeps their uid
+	if user.IsGuest && !guest {
+		user.IsGuest = false
+		changed = true
 	}
 
-	return user.ID, err
+	if changed {
+		_, err = db.Exec(ctx, "UPDATE users SET email = ?, is_guest = ? WHERE id = ?", user.Email, user.IsGuest, user.ID)
+	}
+	return *user, err
+}
+
+// createUser creates the user of a new identity
+func createUser(ctx context.Context, db db.Database, identity models.Identity, guest bool) (*models.User, error) {
+	logger.For(ctx, "middlewares.SyncFirebaseUser").Infof("Creating user for %s", identity.UID)
+
+	user := models.User{UID: identity.UID, Email: identity.Email, IsGuest: guest}
+	if guest {
+		user.Name = guestName
+	}
+	// a concurrent first request may have created it, LAST_INSERT_ID returns its id
+	insertedID, err := db.Insert(ctx, "INSERT INTO users (uid, email, name, is_guest) VALUES (?, ?, ?, ?) ON DUPLICATE KEY UPDATE id = LAST_INSERT_ID(id)",
+		user.UID, user.Email, user.Name, user.IsGuest)
+	if err != nil {
+		return nil, err
+	}
+	user.ID = uint64(insertedID)
+	return &user, nil
 }
 
 // GetUser helper function to get user from Gin context
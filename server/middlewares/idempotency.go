@@ -0,0 +1,122 @@
+package middlewares
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"io"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/boolow5/quran-app-api/apperrors"
+	"github.com/boolow5/quran-app-api/idempotency"
+	"github.com/boolow5/quran-app-api/logger"
+	"github.com/boolow5/quran-app-api/metrics"
+	"github.com/gin-gonic/gin"
+)
+
+const (
+	IdempotencyKeyHeader = "Idempotency-Key"
+	// IdempotentReplayedHeader marks a response served from the store
+	IdempotentReplayedHeader = "Idempotent-Replayed"
+)
+
+const maxIdempotencyKeyLength = 255
+
+// Idempotency replays the stored response of a POST, PUT or DELETE sent again
+// with the same Idempotency-Key. Keys are per user, a key reused with another
+// method, path or body is rejected, and a retry that arrives while the first
+// request is still running gets a 409. Only responses written by handlers are
+// kept, errors release the key so the client can retry. It must run after
+// FirebaseAuth.
+func Idempotency(store *idempotency.Store, ttl, lockTTL time.Duration) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		key := c.GetHeader(IdempotencyKeyHeader)
+		if key == "" || !isMutating(c.Request.Method) {
+			c.Next()
+			return
+		}
+		if len(key) > maxIdempotencyKeyLength {
+			AbortWithError(c, apperrors.Invalid(IdempotencyKeyHeader, "max 255"))
+			return
+		}
+
+		userID, ok := c.Get("db_user_id")
+		if !ok {
+			AbortWithError(c, apperrors.ErrUnauthenticated)
+			return
+		}
+
+		body, err := io.ReadAll(c.Request.Body)
+		if err != nil {
+			AbortWithError(c, apperrors.InvalidRequest("unreadable body"))
+			return
+		}
+		c.Request.Body = io.NopCloser(bytes.NewReader(body))
+
+		ctx := c.Request.Context()
+		fingerprint := idempotency.Fingerprint(c.Request.Method, c.Request.URL.RequestURI(), body)
+		claim, existing, err := store.Claim(ctx, strconv.FormatUint(userID.(uint64), 10)+":"+key, fingerprint, lockTTL)
+		if err != nil {
+			// duplicates are less harmful than failing every write while Redis is down
+			logger.For(ctx, "middlewares.Idempotency").Errorf("Processing without idempotency: %v", err)
+			metrics.IdempotentRequests.WithLabelValues("error").Inc()
+			c.Next()
+			return
+		}
+
+		if existing != nil {
+			switch {
+			case existing.Fingerprint != fingerprint:
+				metrics.IdempotentRequests.WithLabelValues("mismatch").Inc()
+				AbortWithError(c, apperrors.ErrIdempotencyKeyReused)
+			case existing.Pending:
+				metrics.IdempotentRequests.WithLabelValues("in_progress").Inc()
+				c.Header("Retry-After", "1")
+				AbortWithError(c, apperrors.ErrRequestInProgress)
+			default:
+				metrics.IdempotentRequests.WithLabelValues("replayed").Inc()
+				c.Header(IdempotentReplayedHeader, "true")
+				c.Data(existing.Status, existing.ContentType, existing.Body)
+				c.Abort()
+			}
+			return
+		}
+
+		recorder := &responseRecorder{ResponseWriter: c.Writer}
+		c.Writer = recorder
+		c.Next()
+		c.Writer = recorder.ResponseWriter
+
+		// the request may be cancelled by now, the key must still be settled
+		settleCtx := context.WithoutCancel(ctx)
+		if !recorder.Written() || recorder.Status() >= http.StatusInternalServerError {
+			if err := claim.Release(settleCtx); err != nil {
+				logger.For(ctx, "middlewares.Idempotency").Error(err)
+			}
+			return
+		}
+
+		err = claim.Complete(settleCtx, recorder.Status(), recorder.Header().Get("Content-Type"), recorder.body.Bytes(), ttl)
+		if errors.Is(err, idempotency.ErrClaimLost) {
+			// the handler outlived lockTTL, a retry may have run it again
+			logger.For(ctx, "middlewares.Idempotency").Warnf("Response of %s %s not stored: %v", c.Request.Method, c.FullPath(), err)
+			metrics.IdempotentRequests.WithLabelValues("lost").Inc()
+			return
+		}
+		if err != nil {
+			logger.For(ctx, "middlewares.Idempotency").Error(err)
+			return
+		}
+		metrics.IdempotentRequests.WithLabelValues("stored").Inc()
+	}
+}
+
+func isMutating(method string) bool {
+	switch method {
+	case http.MethodPost, http.MethodPut, http.MethodPatch, http.MethodDelete:
+		return true
+	}
+	return false
+}
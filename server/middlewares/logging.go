@@ -0,0 +1,85 @@
+package middlewares
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"time"
+
+	"github.com/boolow5/quran-app-api/logger"
+	"github.com/boolow5/quran-app-api/tracing"
+	"github.com/gin-gonic/gin"
+	"github.com/sirupsen/logrus"
+)
+
+// RequestIDHeader is read from the client or proxy and echoed in the response
+const RequestIDHeader = "X-Request-ID"
+
+// RequestLogger gives every request an id and a logger carried by the request
+// context, and logs one line per request with its route, status and latency
+func RequestLogger() gin.HandlerFunc {
+	return func(c *gin.Context) {
+		started := time.Now()
+
+		requestID := c.GetHeader(RequestIDHeader)
+		if requestID == "" || len(requestID) > 64 {
+			requestID = newRequestID()
+		}
+		c.Set("request_id", requestID)
+		c.Header(RequestIDHeader, requestID)
+
+		route := c.FullPath()
+		if route == "" {
+			route = "unmatched"
+		}
+
+		fields := logrus.Fields{
+			"request_id": requestID,
+			"method":     c.Request.Method,
+			"route":      route,
+		}
+		// the tracing middleware runs first, so logs can be joined with the trace
+		if traceID := tracing.TraceID(c.Request.Context()); traceID != "" {
+			fields["trace_id"] = traceID
+		}
+		entry := logger.FromContext(c.Request.Context()).WithFields(fields)
+		c.Request = c.Request.WithContext(logger.WithContext(c.Request.Context(), entry))
+
+		c.Next()
+
+		// the auth middleware adds the user id to the request's logger
+		entry = logger.FromContext(c.Request.Context()).WithFields(logrus.Fields{
+			"status":     c.Writer.Status(),
+			"latency_ms": time.Since(started).Milliseconds(),
+			"client_ip":  c.ClientIP(),
+			"size":       c.Writer.Size(),
+		})
+		if len(c.Errors) > 0 {
+			entry = entry.WithField("errors", c.Errors.String())
+		}
+
+		switch status := c.Writer.Status(); {
+		case status >= 500:
+			entry.Error("request failed")
+		case status >= 400:
+			entry.Warn("request rejected")
+		default:
+			entry.Info("request completed")
+		}
+	}
+}
+
+// SetLogUser adds the user to the request's logger, so every later log line of
+// the request can be found by user id
+func SetLogUser(c *gin.Context, userID uint64, uid string) {
+	ctx := logger.AddFields(c.Request.Context(), logger.Fields{
+		"user_id": userID,
+		"uid":     uid,
+	})
+	c.Request = c.Request.WithContext(ctx)
+}
+
+func newRequestID() string {
+	b := make([]byte, 8)
+	rand.Read(b)
+	return hex.EncodeToString(b)
+}
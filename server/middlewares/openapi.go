@@ -0,0 +1,153 @@
+package middlewares
+
+import (
+	"bytes"
+	"errors"
+	"io"
+	"strings"
+
+	"github.com/boolow5/quran-app-api/apperrors"
+	"github.com/boolow5/quran-app-api/logger"
+	"github.com/boolow5/quran-app-api/metrics"
+	"github.com/boolow5/quran-app-api/openapi"
+	"github.com/getkin/kin-openapi/openapi3"
+	"github.com/getkin/kin-openapi/openapi3filter"
+	"github.com/gin-gonic/gin"
+)
+
+var validationOptions = &openapi3filter.Options{
+	MultiError: true,
+	// the token is verified by FirebaseAuth before this runs
+	AuthenticationFunc: openapi3filter.NoopAuthenticationFunc,
+	// handlers see the body exactly as the client sent it
+	SkipSettingDefaults: true,
+}
+
+// ValidateRequest rejects requests that do not match the OpenAPI document with
+// ErrValidationFailed. With checkResponses, responses are validated too and
+// every mismatch is logged and counted, it is meant for staging and CI where
+// the apps' traffic shows when the server drifted from the contract.
+func ValidateRequest(spec *openapi.Spec, checkResponses bool) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		route, ok := spec.Route(c.Request.Method, c.FullPath())
+		if !ok {
+			// CheckRoutes fails at startup for undocumented routes, this is a 404
+			c.Next()
+			return
+		}
+
+		params := make(map[string]string, len(c.Params))
+		for _, p := range c.Params {
+			params[p.Key] = p.Value
+		}
+
+		input := &openapi3filter.RequestValidationInput{
+			Request:    c.Request,
+			PathParams: params,
+			Route:      route,
+			Options:    validationOptions,
+		}
+		if err := openapi3filter.ValidateRequest(c.Request.Context(), input); err != nil {
+			appErr := contractError(err)
+			logger.For(c.Request.Context(), "middlewares.ValidateRequest").Warnf("%s %s does not match the contract: %v", route.Method, route.Path, appErr.Details)
+			AbortWithError(c, appErr)
+			return
+		}
+
+		if !checkResponses {
+			c.Next()
+			return
+		}
+
+		recorder := &responseRecorder{ResponseWriter: c.Writer}
+		c.Writer = recorder
+		c.Next()
+		c.Writer = recorder.ResponseWriter
+
+		if !recorder.Written() {
+			// aborted with an error, ErrorHandler writes the envelope after this returns
+			return
+		}
+
+		err := openapi3filter.ValidateResponse(c.Request.Context(), &openapi3filter.ResponseValidationInput{
+			RequestValidationInput: input,
+			Status:                 recorder.Status(),
+			Header:                 recorder.Header(),
+			Body:                   io.NopCloser(bytes.NewReader(recorder.body.Bytes())),
+			Options:                validationOptions,
+		})
+		if err != nil {
+			fields := map[string]string{}
+			collectFields(err, fields)
+			if len(fields) == 0 {
+				fields["body"] = err.Error()
+			}
+			logger.For(c.Request.Context(), "middlewares.ValidateRequest").Errorf("%s %s responded %d outside the contract: %v", route.Method, route.Path, recorder.Status(), fields)
+			metrics.ContractViolations.WithLabelValues(route.Method, route.Path).Inc()
+		}
+	}
+}
+
+// contractError lists the failing parameters and body fields of a request
+// validation error the same way apperrors.Binding does
+func contractError(err error) *apperrors.Error {
+	fields := map[string]string{}
+	collectFields(err, fields)
+	if len(fields) == 0 {
+		return apperrors.ErrInvalidRequest.Wrap(err).WithDetails(map[string]interface{}{"reason": "malformed body"})
+	}
+	return apperrors.ErrValidationFailed.Wrap(err).WithDetails(map[string]interface{}{"fields": fields})
+}
+
+// collectFields maps every failing parameter and body field of a validation
+// error to the schema keyword it broke, e.g. "seconds_open": "minimum"
+func collectFields(err error, fields map[string]string) {
+	switch e := err.(type) {
+	case openapi3.MultiError:
+		for _, inner := range e {
+			collectFields(inner, fields)
+		}
+	case *openapi3filter.RequestError:
+		if e.Parameter != nil {
+			fields[e.Parameter.Name] = schemaRule(e.Err, e.Reason)
+			return
+		}
+		collectFields(e.Err, fields)
+	case *openapi3filter.ResponseError:
+		collectFields(e.Err, fields)
+	case *openapi3.SchemaError:
+		field := strings.Join(e.JSONPointer(), ".")
+		if field == "" {
+			field = "body"
+		}
+		fields[field] = e.SchemaField
+	}
+}
+
+// schemaRule is the schema keyword a parameter broke, e.g. "maximum"
+func schemaRule(err error, reason string) string {
+	var schemaErr *openapi3.SchemaError
+	if errors.As(err, &schemaErr) && schemaErr.SchemaField != "" {
+		return schemaErr.SchemaField
+	}
+	if reason != "" {
+		return reason
+	}
+	return "invalid"
+}
+
+// responseRecorder keeps a copy of the body for response validation
+type responseRecorder struct {
+	gin.ResponseWriter
+	body bytes.Buffer
+}
+
+func (r *responseRecorder) Write(b []byte) (int, error) {
+	r.body.Write(b)
+	return r.ResponseWriter.Write(b)
+}
+
+func (r *responseRecorder) WriteString(s string) (int, error) {
+	r.body.WriteString(s)
+	return r.ResponseWriter.WriteString(s)
+}
@@ -0,0 +1,107 @@
+package middlewares
+
+import (
+	"math"
+	"strconv"
+	"time"
+
+	"github.com/boolow5/quran-app-api/apperrors"
+	"github.com/boolow5/quran-app-api/logger"
+	"github.com/boolow5/quran-app-api/metrics"
+	"github.com/boolow5/quran-app-api/ratelimit"
+	"github.com/gin-gonic/gin"
+)
+
+// DeviceIDHeader identifies an app install, clients that send it get a bucket
+// per device on top of the one per user
+const DeviceIDHeader = "X-Device-ID"
+
+// maxDeviceIDLength keeps made up device ids from bloating Redis keys
+const maxDeviceIDLength = 128
+
+type RateLimiter struct {
+	limiter   *ratelimit.Limiter
+	allowlist *ratelimit.Allowlist
+}
+
+func NewRateLimiter(limiter *ratelimit.Limiter, allowlist *ratelimit.Allowlist) *RateLimiter {
+	return &RateLimiter{limiter: limiter, allowlist: allowlist}
+}
+
+// ByIP limits requests per client IP, it runs before authentication so a
+// flood of bad tokens does not reach Firebase
+func (rl *RateLimiter) ByIP(limit ratelimit.Limit) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		ip := c.ClientIP()
+		if rl.allowlist.AllowsIP(ip) {
+			metrics.RateLimitDecisions.WithLabelValues("ip", "allowlisted").Inc()
+			c.Next()
+			return
+		}
+
+		rl.take(c, "ip", limit, "ip:"+ip)
+	}
+}
+
+// ByUser limits an authenticated route group per user, and per device when
+// the client sends DeviceIDHeader. It must run after FirebaseAuth.
+func (rl *RateLimiter) ByUser(group string, limit ratelimit.Limit) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		if rl.allowlist.AllowsUID(c.GetString("user_id")) || rl.allowlist.AllowsIP(c.ClientIP()) {
+			metrics.RateLimitDecisions.WithLabelValues(group, "allowlisted").Inc()
+			c.Next()
+			return
+		}
+
+		userID, ok := c.Get("db_user_id")
+		if !ok {
+			AbortWithError(c, apperrors.ErrUnauthenticated)
+			return
+		}
+
+		// the device bucket is the user's, a device id sent by someone else
+		// cannot drain it
+		userKey := group + ":user:" + strconv.FormatUint(userID.(uint64), 10)
+		keys := []string{userKey}
+		if device := c.GetHeader(DeviceIDHeader); device != "" && len(device) <= maxDeviceIDLength {
+			keys = append(keys, userKey+":device:"+device)
+		}
+
+		rl.take(c, group, limit, keys...)
+	}
+}
+
+func (rl *RateLimiter) take(c *gin.Context, group string, limit ratelimit.Limit, keys ...string) {
+	if limit.Unlimited() {
+		c.Next()
+		return
+	}
+
+	result, err := rl.limiter.Take(c.Request.Context(), limit, keys...)
+	if err != nil {
+		// an outage of Redis should not take the API down with it
+		logger.For(c.Request.Context(), "middlewares.RateLimit").Warnf("Letting %s through: %v", group, err)
+		metrics.RateLimitDecisions.WithLabelValues(group, "error").Inc()
+		c.Next()
+		return
+	}
+
+	c.Header("X-RateLimit-Limit", strconv.Itoa(limit.Burst))
+	c.Header("X-RateLimit-Remaining", strconv.Itoa(max(result.Remaining, 0)))
+
+	if !result.Allowed {
+		retryAfter := int(math.Ceil(result.RetryAfter.Seconds()))
+		if retryAfter < 1 {
+			retryAfter = 1
+		}
+		c.Header("Retry-After", strconv.Itoa(retryAfter))
+
+		logger.For(c.Request.Context(), "middlewares.RateLimit").Warnf("Limited %s on %v, retry in %s", group, keys, time.Duration(retryAfter)*time.Second)
+		metrics.RateLimitDecisions.WithLabelValues(group, "limited").Inc()
+		AbortWithError(c, apperrors.ErrRateLimited.WithDetails(map[string]interface{}{"retry_after": retryAfter}))
+		return
+	}
+
+	metrics.RateLimitDecisions.WithLabelValues(group, "allowed").Inc()
+	c.Next()
+}
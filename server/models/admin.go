@@ -0,0 +1,66 @@
+package models
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/boolow5/quran-app-api/apperrors"
+	"github.com/boolow5/quran-app-api/db"
+)
+
+// UserRecord is a user as support sees them
+type UserRecord struct {
+	ID         uint64     `json:"id" db:"id"`
+	UID        string     `json:"uid" db:"uid"`
+	Email      string     `json:"email" db:"email"`
+	Name       string     `json:"name" db:"name"`
+	Timezone   string     `json:"timezone" db:"timezone"`
+	Locale     string     `json:"locale" db:"locale"`
+	IsGuest    bool       `json:"is_guest" db:"is_guest"`
+	Role       string     `json:"role" db:"role"`
+	CreatedAt  time.Time  `json:"created_at" db:"created_at"`
+	DeletedAt  *time.Time `json:"deleted_at" db:"deleted_at"`
+	PurgeAfter *time.Time `json:"purge_after" db:"purge_after"`
+}
+
+const userRecordColumns = "u.id, u.uid, u.email, u.name, COALESCE(u.timezone, 'UTC') AS timezone, u.locale, u.is_guest, u.role, u.created_at, u.deleted_at, u.purge_after"
+
+// SearchUsers finds users by id, or by a uid or part of an email or name of
+// any of their identities, newest first
+func SearchUsers(ctx context.Context, db db.Database, search string, limit int) ([]UserRecord, error) {
+	search = strings.TrimSpace(search)
+	like := "%" + strings.NewReplacer(`\`, `\\`, "%", `\%`, "_", `\_`).Replace(search) + "%"
+	id, _ := strconv.ParseUint(search, 10, 64)
+
+	var users []UserRecord
+	err := db.Select(ctx, &users, `
+	SELECT `+userRecordColumns+`
+	FROM users u
+	WHERE u.id = ? OR u.uid = ? OR u.email LIKE ? OR u.name LIKE ?
+	OR u.id IN (SELECT i.user_id FROM user_identities i WHERE i.uid = ? OR i.email LIKE ?)
+	ORDER BY u.id DESC
+	LIMIT ?
+	`, id, search, like, like, search, like, limit)
+	if err != nil {
+		return nil, fmt.Errorf("failed to search users: %w", err)
+	}
+	return users, nil
+}
+
+// GetUserRecord returns a user as support sees them
+func GetUserRecord(ctx context.Context, db db.Database, userID uint64) (*UserRecord, error) {
+	var user UserRecord
+	err := db.Get(ctx, &user, "SELECT "+userRecordColumns+" FROM users u WHERE u.id = ?", userID)
+	if errors.Is(err, sql.ErrNoRows) {
+		return nil, apperrors.ErrUserNotFound
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to get user %d: %w", userID, err)
+	}
+	return &user, nil
+}
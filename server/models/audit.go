@@ -0,0 +1,82 @@
+package models
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"fmt"
+	"time"
+
+	"github.com/boolow5/quran-app-api/db"
+)
+
+// AuditEntry is a request to the admin API
+type AuditEntry struct {
+	ID           uint64                 `json:"id" db:"id"`
+	ActorUserID  uint64                 `json:"actor_user_id" db:"actor_user_id"`
+	ActorUID     string                 `json:"actor_uid" db:"actor_uid"`
+	Method       string                 `json:"method" db:"method"`
+	Route        string                 `json:"route" db:"route"`
+	TargetUserID *uint64                `json:"target_user_id" db:"target_user_id"`
+	Status       int                    `json:"status" db:"status"`
+	Details      map[string]interface{} `json:"details" db:"-"`
+	RawDetails   sql.NullString         `json:"-" db:"details"`
+	IP           string                 `json:"ip" db:"ip"`
+	CreatedAt    time.Time              `json:"created_at" db:"created_at"`
+}
+
+// AuditFilter narrows GetAuditLog, zero fields match every entry
+type AuditFilter struct {
+	ActorUserID  uint64
+	TargetUserID uint64
+	Limit        int
+}
+
+// RecordAudit appends an entry to the admin audit log
+func RecordAudit(ctx context.Context, db db.Database, entry AuditEntry) error {
+	var details interface{}
+	if len(entry.Details) > 0 {
+		raw, err := json.Marshal(entry.Details)
+		if err != nil {
+			return fmt.Errorf("failed to encode audit details: %w", err)
+		}
+		details = string(raw)
+	}
+
+	_, err := db.Exec(ctx, `
+	INSERT INTO admin_audit_log (actor_user_id, actor_uid, method, route, target_user_id, status, details, ip)
+	VALUES (?, ?, ?, ?, ?, ?, ?, ?)
+	`, entry.ActorUserID, entry.ActorUID, entry.Method, entry.Route, entry.TargetUserID, entry.Status, details, entry.IP)
+	if err != nil {
+		return fmt.Errorf("failed to record audit entry: %w", err)
+	}
+	return nil
+}
+
+// GetAuditLog returns the latest audit entries
+func GetAuditLog(ctx context.Context, db db.Database, filter AuditFilter) ([]AuditEntry, error) {
+	query := "SELECT id, actor_user_id, actor_uid, method, route, target_user_id, status, details, ip, created_at FROM admin_audit_log WHERE 1 = 1"
+	var args []interface{}
+	if filter.ActorUserID > 0 {
+		query += " AND actor_user_id = ?"
+		args = append(args, filter.ActorUserID)
+	}
+	if filter.TargetUserID > 0 {
+		query += " AND target_user_id = ?"
+		args = append(args, filter.TargetUserID)
+	}
+	query += " ORDER BY id DESC LIMIT ?"
+	args = append(args, filter.Limit)
+
+	var entries []AuditEntry
+	if err := db.Select(ctx, &entries, query, args...); err != nil {
+		return nil, fmt.Errorf("failed to get audit log: %w", err)
+	}
+	for i := range entries {
+		entries[i].Details = map[string]interface{}{}
+		if entries[i].RawDetails.Valid {
+			json.Unmarshal([]byte(entries[i].RawDetails.String), &entries[i].Details)
+		}
+	}
+	return entries, nil
+}
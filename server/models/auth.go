@@ -1,6 +1,7 @@
 package models
 
 import (
+	"database/sql"
 	"strings"
 	"time"
 
@@ -20,17 +21,27 @@ type User struct {
 	Email     string    `json:"email" db:"email"`
 	Name      string    `json:"name" db:"name"`
 	Timezone  string    `json:"timezone" db:"timezone"`
+	Locale    string    `json:"locale" db:"locale"`
+	IsGuest   bool      `json:"is_guest" db:"is_guest"`
+	Role      string    `json:"role" db:"role"`
 	Streaks   *int      `json:"streaks" db:"streaks"`
 	LastPage  *int      `json:"last_page" db:"last_page"`
 	CreatedAt time.Time `json:"created_at" db:"created_at"`
 	UpdatedAt time.Time `json:"updated_at" db:"updated_at"`
+	// DeletedAt is set while the account waits out its deletion grace period
+	DeletedAt  sql.NullTime `json:"-" db:"deleted_at"`
+	PurgeAfter sql.NullTime `json:"-" db:"purge_after"`
 }
 
 type NotificationUser struct {
-	ID       uint64 `db:"id"`
-	Name     string `db:"name"`
-	Timezone string `db:"timezone"`
-	Tokens   string `db:"tokens"`
+	ID            uint64 `db:"id"`
+	Name          string `db:"name"`
+	Timezone      string `db:"timezone"`
+	Locale        string `db:"locale"`
+	CurrentStreak int    `db:"current_streak"`
+	LastPage      int    `db:"last_page"`
+	PagesRead     int    `db:"pages_read"`
+	Tokens        string `db:"tokens"`
 }
 
 func (u *NotificationUser) GetTokens() []string {
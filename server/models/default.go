@@ -3,9 +3,13 @@ package models
 import (
 	"github.com/boolow5/quran-app-api/db"
 	rdb "github.com/boolow5/redis"
+	"github.com/redis/go-redis/v9"
 )
 
 var (
 	RedisDB *rdb.RedisDB
 	MySQLDB *db.MySQLDB
+	// Redis is a plain client on the same server as RedisDB, for commands the
+	// wrapper does not expose such as SET NX and scripts
+	Redis *redis.Client
 )
@@ -0,0 +1,87 @@
+package models
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"fmt"
+	"time"
+
+	"github.com/boolow5/quran-app-api/apperrors"
+	"github.com/boolow5/quran-app-api/db"
+)
+
+// Identity is a Firebase sign-in of a user. Someone who signs in with Google
+// on one phone and Apple on another has two identities and one user.
+type Identity struct {
+	ID            uint64    `json:"id" db:"id"`
+	UserID        uint64    `json:"user_id" db:"user_id"`
+	UID           string    `json:"uid" db:"uid"`
+	Provider      string    `json:"provider" db:"provider"`
+	Email         string    `json:"email" db:"email"`
+	EmailVerified bool      `json:"email_verified" db:"email_verified"`
+	CreatedAt     time.Time `json:"created_at" db:"created_at"`
+	LastSeenAt    time.Time `json:"last_seen_at" db:"last_seen_at"`
+}
+
+// GetUserByUID returns the user of a Firebase uid, found by their identities
+// or, for users who have not signed in since identities were added, by
+// users.uid
+func GetUserByUID(ctx context.Context, db db.Database, uid string) (*User, error) {
+	var user User
+	err := db.Get(ctx, &user, "SELECT u.* FROM user_identities i JOIN users u ON u.id = i.user_id WHERE i.uid = ?", uid)
+	if errors.Is(err, sql.ErrNoRows) {
+		err = db.Get(ctx, &user, "SELECT * FROM users WHERE uid = ?", uid)
+	}
+	if errors.Is(err, sql.ErrNoRows) {
+		return nil, apperrors.ErrUserNotFound
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to get user of %s: %w", uid, err)
+	}
+	return &user, nil
+}
+
+// HasVerifiedEmail reports whether one of a user's identities has verified
+// email
+func HasVerifiedEmail(ctx context.Context, db db.Database, userID uint64, email string) (bool, error) {
+	var count int
+	err := db.Get(ctx, &count, "SELECT COUNT(*) FROM user_identities WHERE user_id = ? AND email = ? AND email_verified = 1", userID, email)
+	if err != nil {
+		return false, fmt.Errorf("failed to check email of user %d: %w", userID, err)
+	}
+	return count > 0, nil
+}
+
+// SaveIdentity adds an identity to identity.UserID, or updates the email and
+// last use of an identity the user already has
+func SaveIdentity(ctx context.Context, db db.Database, identity Identity) error {
+	_, err := db.Exec(ctx, `
+	INSERT INTO user_identities (user_id, uid, provider, email, email_verified, last_seen_at)
+	VALUES (?, ?, ?, ?, ?, NOW())
+	ON DUPLICATE KEY UPDATE
+	provider = VALUES(provider),
+	email = VALUES(email),
+	email_verified = VALUES(email_verified),
+	last_seen_at = VALUES(last_seen_at)
+	`, identity.UserID, identity.UID, identity.Provider, identity.Email, identity.EmailVerified)
+	if err != nil {
+		return fmt.Errorf("failed to save identity %s of user %d: %w", identity.UID, identity.UserID, err)
+	}
+	return nil
+}
+
+// GetIdentities returns the identities of a user, oldest first
+func GetIdentities(ctx context.Context, db db.Database, userID uint64) ([]Identity, error) {
+	var identities []Identity
+	err := db.Select(ctx, &identities, `
+	SELECT id, user_id, uid, provider, email, email_verified, created_at, last_seen_at
+	FROM user_identities
+	WHERE user_id = ?
+	ORDER BY id
+	`, userID)
+	if err != nil {
+		return nil, fmt.Errorf("failed to get identities of user %d: %w", userID, err)
+	}
+	return identities, nil
+}
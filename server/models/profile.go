@@ -0,0 +1,287 @@
+package models
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"fmt"
+	"net/url"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/boolow5/quran-app-api/apperrors"
+	"github.com/boolow5/quran-app-api/db"
+)
+
+// Mushaf layouts the apps can render
+const (
+	MushafMadani  = "madani"
+	MushafIndoPak = "indopak"
+	MushafWarsh   = "warsh"
+)
+
+// Profile is a user with their settings, users without a user_settings row
+// get the defaults
+type Profile struct {
+	ID               uint64    `json:"id" db:"id"`
+	UID              string    `json:"uid" db:"uid"`
+	Email            string    `json:"email" db:"email"`
+	Name             string    `json:"name" db:"name"`
+	Timezone         string    `json:"timezone" db:"timezone"`
+	Locale           string    `json:"locale" db:"locale"`
+	IsGuest          bool      `json:"is_guest" db:"is_guest"`
+	Role             string    `json:"role" db:"role"`
+	Mushaf           string    `json:"mushaf" db:"mushaf"`
+	DailyGoalPages   int       `json:"daily_goal_pages" db:"daily_goal_pages"`
+	DailyGoalMinutes int       `json:"daily_goal_minutes" db:"daily_goal_minutes"`
+	ShareProgress    bool      `json:"share_progress" db:"share_progress"`
+	AnalyticsOptOut  bool      `json:"analytics_opt_out" db:"analytics_opt_out"`
+	AvatarURL        string    `json:"avatar_url" db:"avatar_url"`
+	CreatedAt        time.Time `json:"created_at" db:"created_at"`
+	UpdatedAt        time.Time `json:"updated_at" db:"updated_at"`
+}
+
+// ProfileUpdate is a PATCH of a profile, nil fields are left unchanged
+type ProfileUpdate struct {
+	Name             *string `json:"name"`
+	Timezone         *string `json:"timezone"`
+	Locale           *string `json:"locale"`
+	Mushaf           *string `json:"mushaf"`
+	DailyGoalPages   *int    `json:"daily_goal_pages"`
+	DailyGoalMinutes *int    `json:"daily_goal_minutes"`
+	ShareProgress    *bool   `json:"share_progress"`
+	AnalyticsOptOut  *bool   `json:"analytics_opt_out"`
+	AvatarURL        *string `json:"avatar_url"`
+}
+
+// ProfileChange is one field changed by a profile update
+type ProfileChange struct {
+	ID        uint64    `json:"id" db:"id"`
+	UserID    uint64    `json:"user_id" db:"user_id"`
+	Field     string    `json:"field" db:"field"`
+	OldValue  string    `json:"old_value" db:"old_value"`
+	NewValue  string    `json:"new_value" db:"new_value"`
+	ChangedAt time.Time `json:"changed_at" db:"changed_at"`
+}
+
+var localePattern = regexp.MustCompile(`^[a-z]{2,3}(-[A-Za-z0-9]{2,8})*$`)
+
+// Validate checks every set field and reports all invalid ones at once
+func (u ProfileUpdate) Validate() error {
+	fields := map[string]string{}
+
+	if u.Name != nil {
+		if name := strings.TrimSpace(*u.Name); name == "" || len(name) > 100 {
+			fields["name"] = "between 1 and 100 characters"
+		}
+	}
+	if u.Timezone != nil {
+		// "Local" is the server's zone, not something a user lives in
+		if _, err := time.LoadLocation(*u.Timezone); err != nil || *u.Timezone == "" || *u.Timezone == "Local" {
+			fields["timezone"] = "IANA time zone, e.g. Africa/Mogadishu"
+		}
+	}
+	if u.Locale != nil && (len(*u.Locale) > 10 || !localePattern.MatchString(*u.Locale)) {
+		fields["locale"] = "language tag, e.g. so or en-GB"
+	}
+	if u.Mushaf != nil {
+		switch *u.Mushaf {
+		case MushafMadani, MushafIndoPak, MushafWarsh:
+		default:
+			fields["mushaf"] = "madani, indopak or warsh"
+		}
+	}
+	if u.DailyGoalPages != nil && (*u.DailyGoalPages < 0 || *u.DailyGoalPages > 604) {
+		fields["daily_goal_pages"] = "between 0 and 604"
+	}
+	if u.DailyGoalMinutes != nil && (*u.DailyGoalMinutes < 0 || *u.DailyGoalMinutes > 1440) {
+		fields["daily_goal_minutes"] = "between 0 and 1440"
+	}
+	if u.AvatarURL != nil && *u.AvatarURL != "" {
+		parsed, err := url.Parse(*u.AvatarURL)
+		if err != nil || parsed.Scheme != "https" || parsed.Host == "" || len(*u.AvatarURL) > 500 {
+			fields["avatar_url"] = "https URL of at most 500 characters, or empty to remove"
+		}
+	}
+
+	if len(fields) > 0 {
+		return apperrors.ErrValidationFailed.WithDetails(map[string]interface{}{"fields": fields})
+	}
+	return nil
+}
+
+// apply sets the fields of u on p and returns what changed
+func (u ProfileUpdate) apply(p *Profile) []ProfileChange {
+	var changes []ProfileChange
+	setString := func(field string, value *string, target *string) {
+		if value != nil && strings.TrimSpace(*value) != *target {
+			changes = append(changes, ProfileChange{Field: field, OldValue: *target, NewValue: strings.TrimSpace(*value)})
+			*target = strings.TrimSpace(*value)
+		}
+	}
+	setInt := func(field string, value *int, target *int) {
+		if value != nil && *value != *target {
+			changes = append(changes, ProfileChange{Field: field, OldValue: strconv.Itoa(*target), NewValue: strconv.Itoa(*value)})
+			*target = *value
+		}
+	}
+	setBool := func(field string, value *bool, target *bool) {
+		if value != nil && *value != *target {
+			changes = append(changes, ProfileChange{Field: field, OldValue: strconv.FormatBool(*target), NewValue: strconv.FormatBool(*value)})
+			*target = *value
+		}
+	}
+
+	setString("name", u.Name, &p.Name)
+	setString("timezone", u.Timezone, &p.Timezone)
+	setString("locale", u.Locale, &p.Locale)
+	setString("mushaf", u.Mushaf, &p.Mushaf)
+	setInt("daily_goal_pages", u.DailyGoalPages, &p.DailyGoalPages)
+	setInt("daily_goal_minutes", u.DailyGoalMinutes, &p.DailyGoalMinutes)
+	setBool("share_progress", u.ShareProgress, &p.ShareProgress)
+	setBool("analytics_opt_out", u.AnalyticsOptOut, &p.AnalyticsOptOut)
+	setString("avatar_url", u.AvatarURL, &p.AvatarURL)
+	return changes
+}
+
+// Empty reports whether the update sets no field
+func (u ProfileUpdate) Empty() bool {
+	return u == ProfileUpdate{}
+}
+
+// profileQuery selects the profile of a user, users without settings get the
+// defaults
+const profileQuery = `
+	SELECT
+		u.id,
+		u.uid,
+		u.email,
+		u.name,
+		COALESCE(u.timezone, 'UTC') AS timezone,
+		u.locale,
+		u.is_guest,
+		u.role,
+		COALESCE(s.mushaf, 'madani') AS mushaf,
+		COALESCE(s.daily_goal_pages, 0) AS daily_goal_pages,
+		COALESCE(s.daily_goal_minutes, 0) AS daily_goal_minutes,
+		COALESCE(s.share_progress, 0) AS share_progress,
+		COALESCE(s.analytics_opt_out, 0) AS analytics_opt_out,
+		COALESCE(s.avatar_url, '') AS avatar_url,
+		u.created_at,
+		GREATEST(u.updated_at, COALESCE(s.updated_at, u.updated_at)) AS updated_at
+	FROM users u
+	LEFT JOIN user_settings s ON s.user_id = u.id
+	WHERE u.id = ?
+	`
+
+// GetProfile returns the profile of a user
+func GetProfile(ctx context.Context, db db.Database, userID uint64) (*Profile, error) {
+	var profile Profile
+	err := db.Get(ctx, &profile, profileQuery, userID)
+	if errors.Is(err, sql.ErrNoRows) {
+		return nil, apperrors.ErrUserNotFound
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to get profile of user %d: %w", userID, err)
+	}
+	return &profile, nil
+}
+
+// lockProfile reads the profile of a user for update in tx, so an update
+// applies to the values it overwrites
+func lockProfile(ctx context.Context, db db.Database, tx *sql.Tx, userID uint64) (*Profile, error) {
+	var profile Profile
+	err := db.GetTx(ctx, tx, &profile, profileQuery+"FOR UPDATE", userID)
+	if errors.Is(err, sql.ErrNoRows) {
+		return nil, apperrors.ErrUserNotFound
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to lock profile of user %d: %w", userID, err)
+	}
+	return &profile, nil
+}
+
+// UpdateProfile applies update and records every changed field in
+// user_profile_changes, all in one transaction that locks the profile
+func UpdateProfile(ctx context.Context, db db.Database, userID uint64, update ProfileUpdate) (*Profile, error) {
+	if update.Empty() {
+		return nil, apperrors.ErrNoFieldsToUpdate
+	}
+	if err := update.Validate(); err != nil {
+		return nil, err
+	}
+
+	tx, err := db.Begin(ctx)
+	if err != nil {
+		return nil, err
+	}
+	defer tx.Rollback()
+
+	profile, err := lockProfile(ctx, db, tx, userID)
+	if err != nil {
+		return nil, err
+	}
+
+	changes := update.apply(profile)
+	if len(changes) == 0 {
+		return profile, nil
+	}
+
+	_, err = db.ExecTx(ctx, tx, "UPDATE users SET name = ?, timezone = ?, locale = ? WHERE id = ?",
+		profile.Name, profile.Timezone, profile.Locale, userID)
+	if err != nil {
+		return nil, fmt.Errorf("failed to update user %d: %w", userID, err)
+	}
+
+	query := `
+	INSERT INTO user_settings
+		(user_id, mushaf, daily_goal_pages, daily_goal_minutes, share_progress, analytics_opt_out, avatar_url)
+	VALUES
+		(?, ?, ?, ?, ?, ?, ?)
+	ON DUPLICATE KEY UPDATE
+		mushaf = VALUES(mushaf),
+		daily_goal_pages = VALUES(daily_goal_pages),
+		daily_goal_minutes = VALUES(daily_goal_minutes),
+		share_progress = VALUES(share_progress),
+		analytics_opt_out = VALUES(analytics_opt_out),
+		avatar_url = VALUES(avatar_url)
+	`
+	_, err = db.ExecTx(ctx, tx, query, userID, profile.Mushaf, profile.DailyGoalPages, profile.DailyGoalMinutes,
+		profile.ShareProgress, profile.AnalyticsOptOut, profile.AvatarURL)
+	if err != nil {
+		return nil, fmt.Errorf("failed to save settings of user %d: %w", userID, err)
+	}
+
+	for _, change := range changes {
+		_, err = db.ExecTx(ctx, tx, "INSERT INTO user_profile_changes (user_id, field, old_value, new_value) VALUES (?, ?, ?, ?)",
+			userID, change.Field, change.OldValue, change.NewValue)
+		if err != nil {
+			return nil, fmt.Errorf("failed to record profile change of user %d: %w", userID, err)
+		}
+	}
+
+	if err := tx.Commit(); err != nil {
+		return nil, err
+	}
+
+	return GetProfile(ctx, db, userID)
+}
+
+// GetProfileChanges returns the latest profile changes of a user
+func GetProfileChanges(ctx context.Context, db db.Database, userID uint64, limit int) ([]ProfileChange, error) {
+	var changes []ProfileChange
+	query := `
+	SELECT id, user_id, field, old_value, new_value, changed_at
+	FROM user_profile_changes
+	WHERE user_id = ?
+	ORDER BY changed_at DESC, id DESC
+	LIMIT ?
+	`
+	err := db.Select(ctx, &changes, query, userID, limit)
+	if err != nil {
+		return nil, fmt.Errorf("failed to get profile changes of user %d: %w", userID, err)
+	}
+	return changes, nil
+}
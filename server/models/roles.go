@@ -0,0 +1,77 @@
+package models
+
+import (
+	"context"
+	"errors"
+	"fmt"
+
+	"github.com/boolow5/quran-app-api/apperrors"
+	"github.com/boolow5/quran-app-api/db"
+)
+
+// Roles give access to /api/v1/admin, each includes the ones before it
+const (
+	RoleUser    = "user"
+	RoleSupport = "support"
+	RoleAdmin   = "admin"
+)
+
+// Roles are the roles from least to most access
+var Roles = []string{RoleUser, RoleSupport, RoleAdmin}
+
+func roleRank(role string) int {
+	for i, r := range Roles {
+		if r == role {
+			return i
+		}
+	}
+	return -1
+}
+
+// ValidRole reports whether role is one of Roles
+func ValidRole(role string) bool {
+	return roleRank(role) >= 0
+}
+
+// HasRole reports whether the user's role includes role
+func (u *User) HasRole(role string) bool {
+	return roleRank(role) >= 0 && roleRank(u.Role) >= roleRank(role)
+}
+
+// SetRole changes the role of a user, it reports whether the user exists
+func SetRole(ctx context.Context, db db.Database, userID uint64, role string) (bool, error) {
+	if _, err := db.Exec(ctx, "UPDATE users SET role = ? WHERE id = ?", role, userID); err != nil {
+		return false, fmt.Errorf("failed to set role of user %d: %w", userID, err)
+	}
+	var count int
+	if err := db.Get(ctx, &count, "SELECT COUNT(*) FROM users WHERE id = ?", userID); err != nil {
+		return false, fmt.Errorf("failed to get user %d: %w", userID, err)
+	}
+	return count > 0, nil
+}
+
+// GrantAdmins gives the admin role to the users of Firebase uids that do not
+// have it yet, it returns how many were granted. It bootstraps the first
+// admins, who give roles to others from the admin API.
+func GrantAdmins(ctx context.Context, db db.Database, uids []string) (int64, error) {
+	var granted int64
+	for _, uid := range uids {
+		user, err := GetUserByUID(ctx, db, uid)
+		if errors.Is(err, apperrors.ErrUserNotFound) {
+			// granted on a restart after they sign in, or with the set-role command
+			continue
+		}
+		if err != nil {
+			return granted, err
+		}
+		if user.Role == RoleAdmin {
+			continue
+		}
+		rows, err := db.Exec(ctx, "UPDATE users SET role = ? WHERE id = ?", RoleAdmin, user.ID)
+		if err != nil {
+			return granted, fmt.Errorf("failed to grant admin to %s: %w", uid, err)
+		}
+		granted += rows
+	}
+	return granted, nil
+}
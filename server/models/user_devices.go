@@ -2,18 +2,41 @@ package models
 
 import (
 	"context"
+	"crypto/sha256"
+	"database/sql"
+	"encoding/hex"
+	"encoding/json"
 	"fmt"
+	"time"
 
+	"github.com/boolow5/quran-app-api/apperrors"
 	"github.com/boolow5/quran-app-api/db"
+	"github.com/boolow5/quran-app-api/logger"
+	"github.com/boolow5/quran-app-api/utils"
 )
 
 // "github.com/boolow5/quran-app-api/db"
 
 type UserDevice struct {
-	ID          uint64 `json:"id" db:"id"`
-	UID         string `json:"uid" db:"uid"`
-	UserID      uint64 `json:"user_id" db:"user_id"`
-	DeviceToken string `json:"device_token" db:"device_token"`
+	ID          uint64    `json:"id" db:"id"`
+	UID         string    `json:"uid" db:"uid"`
+	UserID      uint64    `json:"user_id" db:"user_id"`
+	DeviceToken string    `json:"device_token" db:"device_token"`
+	CreatedAt   time.Time `json:"created_at" db:"created_at"`
+	LastSeenAt  time.Time `json:"last_seen_at" db:"last_seen_at"`
+	// Transport is "fcm" for the mobile apps or "webpush" for browsers
+	Transport string `json:"transport" db:"transport"`
+	// Subscription is the browser's push subscription JSON, it holds the encryption keys
+	Subscription sql.NullString `json:"-" db:"subscription"`
+}
+
+// WebPushSubscription is the PushSubscription.toJSON() of a browser
+type WebPushSubscription struct {
+	Endpoint string `json:"endpoint" binding:"required,url"`
+	Keys     struct {
+		P256dh string `json:"p256dh" binding:"required"`
+		Auth   string `json:"auth" binding:"required"`
+	} `json:"keys" binding:"required"`
 }
 
 // GetID implements db.Model.
@@ -50,20 +73,20 @@ func GetDevicesByUserID(ctx context.Context, db db.Database, userID uint64) ([]U
 
 // GetDeviceTokensByUserID finds all device tokens for a user
 func GetDeviceTokensByUserID(ctx context.Context, db db.Database, userID uint64) (tokens []string, fullName string, err error) {
-	fmt.Printf("[GetDeviceTokensByUserID] userID: %d\n", userID)
+	logger.For(ctx, "models.GetDeviceTokensByUserID").Debugf("UserID: %d", userID)
 	query := "SELECT device_token FROM user_devices WHERE user_id = ?"
 	err = db.Select(ctx, &tokens, query, userID)
 	if err != nil {
-		fmt.Printf("[GetDeviceTokensByUserID] error: %v\n", err)
+		logger.For(ctx, "models.GetDeviceTokensByUserID").Errorf("Error: %v", err)
 		return nil, "", err
 	}
 
-	fmt.Printf("[GetDeviceTokensByUserID] tokens: %v\n", len(tokens))
+	logger.For(ctx, "models.GetDeviceTokensByUserID").Debugf("Tokens: %v", len(tokens))
 	if len(tokens) > 0 {
 		query = "SELECT name FROM users WHERE id = ?"
 		err := db.Select(ctx, &fullName, query, userID)
 		if err != nil {
-			fmt.Printf("[GetDeviceTokensByUserID] full name error: %v\n", err)
+			logger.For(ctx, "models.GetDeviceTokensByUserID").Errorf("Full name error: %v", err)
 			return nil, "", err
 		}
 	}
@@ -73,18 +96,95 @@ func GetDeviceTokensByUserID(ctx context.Context, db db.Database, userID uint64)
 
 func CreateOrUpdateFCMToken(ctx context.Context, db db.Database, form UserDevice) error {
 	if form.DeviceToken == "" {
-		return fmt.Errorf("device token is required")
+		return apperrors.Invalid("device_token", "required")
 	}
 
 	if form.UserID < 1 {
 		return fmt.Errorf("user id is required")
 	}
 
-	query := "INSERT INTO user_devices (uid, user_id, device_token) VALUES (?, ?, ?) ON DUPLICATE KEY UPDATE device_token = ?"
-	_, err := db.Exec(ctx, query, form.UID, form.UserID, form.DeviceToken, form.DeviceToken)
+	// a token belongs to the last user who signed in on the device
+	query := `
+	INSERT INTO user_devices (uid, user_id, device_token, transport, last_seen_at)
+	VALUES (?, ?, ?, 'fcm', NOW())
+	ON DUPLICATE KEY UPDATE
+		uid = VALUES(uid),
+		user_id = VALUES(user_id),
+		last_seen_at = NOW()
+	`
+	_, err := db.Exec(ctx, query, form.UID, form.UserID, form.DeviceToken)
 	if err != nil {
 		return fmt.Errorf("failed to create or update user device: %w", err)
 	}
 
 	return nil
 }
+
+// CreateOrUpdateWebPushSubscription registers a browser as a device of the user.
+// Endpoints can be longer than device_token allows, so the token is a hash of it.
+func CreateOrUpdateWebPushSubscription(ctx context.Context, db db.Database, uid string, userID uint64, subscription WebPushSubscription) error {
+	if userID < 1 {
+		return fmt.Errorf("user id is required")
+	}
+
+	raw, err := json.Marshal(subscription)
+	if err != nil {
+		return fmt.Errorf("invalid web push subscription: %w", err)
+	}
+
+	hash := sha256.Sum256([]byte(subscription.Endpoint))
+	query := `
+	INSERT INTO user_devices (uid, user_id, device_token, transport, subscription, last_seen_at)
+	VALUES (?, ?, ?, 'webpush', ?, NOW())
+	ON DUPLICATE KEY UPDATE
+		uid = VALUES(uid),
+		user_id = VALUES(user_id),
+		subscription = VALUES(subscription),
+		last_seen_at = NOW()
+	`
+	_, err = db.Exec(ctx, query, uid, userID, "webpush:"+hex.EncodeToString(hash[:]), string(raw))
+	if err != nil {
+		return fmt.Errorf("failed to create or update web push subscription: %w", err)
+	}
+
+	return nil
+}
+
+// DeleteDeviceForUser revokes one of the user's devices
+func DeleteDeviceForUser(ctx context.Context, db db.Database, userID, deviceID uint64) (bool, error) {
+	deleted, err := db.Exec(ctx, "DELETE FROM user_devices WHERE id = ? AND user_id = ?", deviceID, userID)
+	if err != nil {
+		return false, fmt.Errorf("failed to delete user device: %w", err)
+	}
+
+	return deleted > 0, nil
+}
+
+// DeleteDeviceTokens removes tokens FCM reported as unregistered or invalid
+func DeleteDeviceTokens(ctx context.Context, db db.Database, tokens []string) (int64, error) {
+	if len(tokens) == 0 {
+		return 0, nil
+	}
+
+	args := make([]interface{}, len(tokens))
+	for i, token := range tokens {
+		args[i] = token
+	}
+
+	deleted, err := db.Exec(ctx, "DELETE FROM user_devices WHERE device_token IN "+utils.Placeholders(len(tokens)), args...)
+	if err != nil {
+		return 0, fmt.Errorf("failed to delete device tokens: %w", err)
+	}
+
+	return deleted, nil
+}
+
+// ExpireStaleDevices removes devices that have not registered their token for maxAge
+func ExpireStaleDevices(ctx context.Context, db db.Database, maxAge time.Duration) (int64, error) {
+	deleted, err := db.Exec(ctx, "DELETE FROM user_devices WHERE last_seen_at < NOW() - INTERVAL ? SECOND", int64(maxAge.Seconds()))
+	if err != nil {
+		return 0, fmt.Errorf("failed to expire stale devices: %w", err)
+	}
+
+	return deleted, nil
+}
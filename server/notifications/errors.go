@@ -0,0 +1,84 @@
+package notifications
+
+import (
+	"strings"
+
+	"firebase.google.com/go/v4/messaging"
+)
+
+// FCMErrorClass tells the sender what to do with a token after a failed send
+type FCMErrorClass int
+
+const (
+	// FCMErrorPermanent failed for a reason retrying cannot fix, but the token may still be good
+	FCMErrorPermanent FCMErrorClass = iota
+	// FCMErrorRetryable may succeed if the send is tried again later
+	FCMErrorRetryable
+	// FCMErrorInvalidToken means the token will never work again and should be deleted
+	FCMErrorInvalidToken
+)
+
+const (
+	FCMErrorCodeNotRegistered     = "registration-token-not-registered"
+	FCMErrorCodeInvalidToken      = "invalid-registration-token"
+	FCMErrorCodeSenderIDMismatch  = "sender-id-mismatch"
+	FCMErrorCodeInvalidArgument   = "invalid-argument"
+	FCMErrorCodeQuotaExceeded     = "quota-exceeded"
+	FCMErrorCodeServerUnavailable = "server-unavailable"
+	FCMErrorCodeInternal          = "internal-error"
+	FCMErrorCodeThirdPartyAuth    = "third-party-auth-error"
+	FCMErrorCodeUnknown           = "unknown-error"
+
+	// FCMErrorCodeUnsupportedTransport is recorded when no pusher handles the device's transport
+	FCMErrorCodeUnsupportedTransport = "unsupported-transport"
+)
+
+// retryableCodes are the FCM errors that may succeed if the send is tried again later
+var retryableCodes = []string{
+	FCMErrorCodeQuotaExceeded,
+	FCMErrorCodeServerUnavailable,
+	FCMErrorCodeInternal,
+	FCMErrorCodeUnknown,
+}
+
+// fcmErrorCode maps an FCM send error to the code stored in the delivery log
+func fcmErrorCode(err error) string {
+	switch {
+	case err == nil:
+		return ""
+	case messaging.IsUnregistered(err):
+		return FCMErrorCodeNotRegistered
+	case messaging.IsSenderIDMismatch(err):
+		return FCMErrorCodeSenderIDMismatch
+	case messaging.IsInvalidArgument(err):
+		// FCM reports malformed tokens as INVALID_ARGUMENT, tell them apart from bad payloads
+		if strings.Contains(strings.ToLower(err.Error()), "registration token") {
+			return FCMErrorCodeInvalidToken
+		}
+		return FCMErrorCodeInvalidArgument
+	case messaging.IsQuotaExceeded(err):
+		return FCMErrorCodeQuotaExceeded
+	case messaging.IsUnavailable(err):
+		return FCMErrorCodeServerUnavailable
+	case messaging.IsInternal(err):
+		return FCMErrorCodeInternal
+	case messaging.IsThirdPartyAuthError(err):
+		return FCMErrorCodeThirdPartyAuth
+	default:
+		return FCMErrorCodeUnknown
+	}
+}
+
+// classifyFCMError decides whether a failed token is retried, kept or deleted
+func classifyFCMError(code string) FCMErrorClass {
+	switch code {
+	case FCMErrorCodeNotRegistered, FCMErrorCodeInvalidToken, FCMErrorCodeSenderIDMismatch:
+		return FCMErrorInvalidToken
+	}
+	for _, c := range retryableCodes {
+		if c == code {
+			return FCMErrorRetryable
+		}
+	}
+	return FCMErrorPermanent
+}
@@ -0,0 +1,77 @@
+package notifications
+
+import (
+	"context"
+	"fmt"
+	"sync"
+)
+
+// FakePusher records messages in memory instead of sending them, for tests and
+// local development without a Firebase project
+type FakePusher struct {
+	mu       sync.Mutex
+	sent     []PushMessage
+	failures map[string]string
+	counter  int
+}
+
+func NewFakePusher() *FakePusher {
+	return &FakePusher{failures: map[string]string{}}
+}
+
+// FailToken makes every send to token fail with the given error code,
+// e.g. FCMErrorCodeNotRegistered
+func (f *FakePusher) FailToken(token, code string) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.failures[token] = code
+}
+
+// Send implements Pusher.
+func (f *FakePusher) Send(ctx context.Context, messages []PushMessage) []PushResult {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	results := make([]PushResult, len(messages))
+	for i, msg := range messages {
+		if code, ok := f.failures[msg.Token]; ok {
+			results[i] = PushResult{Err: fmt.Errorf("fake %s", code), Code: code}
+			continue
+		}
+
+		f.counter++
+		f.sent = append(f.sent, msg)
+		results[i] = PushResult{MessageID: fmt.Sprintf("fake-message-%d", f.counter)}
+	}
+
+	return results
+}
+
+// Sent returns a copy of every message delivered so far
+func (f *FakePusher) Sent() []PushMessage {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	return append([]PushMessage{}, f.sent...)
+}
+
+// SentTo returns the messages delivered to one token
+func (f *FakePusher) SentTo(token string) []PushMessage {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	messages := []PushMessage{}
+	for _, msg := range f.sent {
+		if msg.Token == token {
+			messages = append(messages, msg)
+		}
+	}
+	return messages
+}
+
+// Reset forgets recorded messages and configured failures
+func (f *FakePusher) Reset() {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.sent = nil
+	f.failures = map[string]string{}
+}
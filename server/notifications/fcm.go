@@ -0,0 +1,122 @@
+package notifications
+
+import (
+	"context"
+	"fmt"
+	"sync"
+
+	firebase "firebase.google.com/go/v4"
+	"firebase.google.com/go/v4/messaging"
+	"github.com/boolow5/quran-app-api/tracing"
+	"go.opentelemetry.io/otel/attribute"
+	"google.golang.org/api/option"
+)
+
+const (
+	// FCMMaxBatchSize is the most messages FCM accepts in one SendEach call
+	FCMMaxBatchSize = 500
+
+	// DefaultSendConcurrency is how many batches a pusher sends at the same time
+	DefaultSendConcurrency = 4
+)
+
+// FCMPusher sends through Firebase Cloud Messaging with SendEach
+type FCMPusher struct {
+	client      *messaging.Client
+	concurrency int
+	// icon is the image of messages that have none
+	icon string
+}
+
+func NewFCMPusher(ctx context.Context, credentialsJSON []byte, concurrency int, icon string) (*FCMPusher, error) {
+	app, err := firebase.NewApp(ctx, nil, option.WithCredentialsJSON(credentialsJSON))
+	if err != nil {
+		return nil, fmt.Errorf("error initializing app: %v", err)
+	}
+
+	client, err := app.Messaging(ctx)
+	if err != nil {
+		return nil, fmt.Errorf("error getting Messaging client: %w", err)
+	}
+
+	if concurrency < 1 {
+		concurrency = DefaultSendConcurrency
+	}
+
+	return &FCMPusher{client: client, concurrency: concurrency, icon: icon}, nil
+}
+
+// Send implements Pusher. Messages are sent in chunks of FCMMaxBatchSize with up
+// to concurrency chunks in flight.
+func (p *FCMPusher) Send(ctx context.Context, messages []PushMessage) []PushResult {
+	results := make([]PushResult, len(messages))
+
+	sem := make(chan struct{}, p.concurrency)
+	var wg sync.WaitGroup
+
+	for start := 0; start < len(messages); start += FCMMaxBatchSize {
+		end := min(start+FCMMaxBatchSize, len(messages))
+
+		wg.Add(1)
+		sem <- struct{}{}
+		go func(start, end int) {
+			defer wg.Done()
+			defer func() { <-sem }()
+
+			chunk := make([]*messaging.Message, 0, end-start)
+			for _, msg := range messages[start:end] {
+				chunk = append(chunk, toFCMMessage(msg, p.icon))
+			}
+
+			sendCtx, span := tracing.Start(ctx, "fcm.SendEach", attribute.Int("messaging.batch.message_count", len(chunk)))
+			resp, err := p.client.SendEach(sendCtx, chunk)
+			if err == nil {
+				span.SetAttributes(
+					attribute.Int("fcm.success_count", resp.SuccessCount),
+					attribute.Int("fcm.failure_count", resp.FailureCount),
+				)
+			}
+			tracing.End(span, err)
+			for i := range chunk {
+				var result PushResult
+				switch {
+				case err != nil:
+					// the whole request failed, e.g. network or credentials
+					result.Err = err
+				case i < len(resp.Responses) && resp.Responses[i] != nil:
+					result.MessageID = resp.Responses[i].MessageID
+					result.Err = resp.Responses[i].Error
+				}
+				result.Code = fcmErrorCode(result.Err)
+				results[start+i] = result
+			}
+		}(start, end)
+	}
+
+	wg.Wait()
+	return results
+}
+
+func toFCMMessage(msg PushMessage, icon string) *messaging.Message {
+	imgUrl := msg.ImageURL
+	if imgUrl == "" {
+		imgUrl = icon
+	}
+
+	return &messaging.Message{
+		Notification: &messaging.Notification{
+			Title:    msg.Title,
+			Body:     msg.Body,
+			ImageURL: imgUrl,
+		},
+		Topic: msg.Topic,
+		Android: &messaging.AndroidConfig{
+			Priority: string(msg.Priority),
+		},
+		FCMOptions: &messaging.FCMOptions{
+			AnalyticsLabel: msg.AnalyticsLabel,
+		},
+		Data:  msg.Data,
+		Token: msg.Token,
+	}
+}
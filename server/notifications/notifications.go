@@ -2,17 +2,16 @@ package notifications
 
 import (
 	"context"
-	"encoding/base64"
+	"errors"
 	"fmt"
-	"os"
+	"strconv"
 	"strings"
 	"time"
 
-	firebase "firebase.google.com/go"
-	"firebase.google.com/go/messaging"
+	"github.com/boolow5/quran-app-api/config"
 	"github.com/boolow5/quran-app-api/db"
+	"github.com/boolow5/quran-app-api/logger"
 	"github.com/boolow5/quran-app-api/models"
-	"google.golang.org/api/option"
 )
 
 type FCMPriority string
@@ -23,43 +22,6 @@ const (
 	FCMPriorityLow    FCMPriority = "low"
 )
 
-var (
-	FirebaseClient *messaging.Client
-)
-
-func InitFirebase() {
-	var err error
-	FirebaseClient, err = GetFCMClient()
-	if err != nil {
-		panic(err)
-	}
-
-	fmt.Println("Firebase successfully initialized")
-}
-
-func GetFCMClient() (client *messaging.Client, err error) {
-	credentialsJSON, err := base64.StdEncoding.DecodeString(os.Getenv("FIREBASE_CREDENTIALS"))
-	if err != nil {
-		return nil, err
-	}
-
-	opt := option.WithCredentialsJSON(credentialsJSON)
-
-	app, err := firebase.NewApp(context.Background(), nil, opt)
-	if err != nil {
-		fmt.Printf("error initializing app: %v", err)
-		return nil, fmt.Errorf("error initializing app: %v", err)
-	}
-
-	client, err = app.Messaging(context.Background())
-	if err != nil {
-		fmt.Printf("error getting Messaging client: %v", err)
-		return nil, err
-	}
-
-	return client, nil
-}
-
 func firstName(name string) string {
 	parts := strings.Split(name, " ")
 	if len(parts) > 0 {
@@ -69,91 +31,91 @@ func firstName(name string) string {
 	return name
 }
 
-// SendPushNotification sends a notification to a user
-func SendPushNotification(tokens []string, topic, title, message, imgUrl string, priority FCMPriority, data map[string]string, analyticsLabel string) error {
-	if imgUrl == "" {
-		imgUrl = os.Getenv("FCM_ICON")
-	}
-	// send notification
-	notification := messaging.Notification{
-		Title:    title,
-		Body:     message,
-		ImageURL: imgUrl,
+// SendPushNotification sends a notification directly to the given devices,
+// bypassing the outbox
+func SendPushNotification(ctx context.Context, pusher Pusher, tokens []string, topic, title, message, imgUrl string, priority FCMPriority, data map[string]string, analyticsLabel string) error {
+	messages := make([]PushMessage, len(tokens))
+	for i, token := range tokens {
+		messages[i] = PushMessage{
+			Token:          token,
+			Title:          title,
+			Body:           message,
+			ImageURL:       imgUrl,
+			Topic:          topic,
+			Priority:       priority,
+			Data:           data,
+			AnalyticsLabel: analyticsLabel,
+		}
 	}
 
-	errs := []string{}
-
-	for _, token := range tokens {
-		sendResult, err := FirebaseClient.Send(context.Background(), &messaging.Message{
-			Notification: &notification,
-			Topic:        topic,
-			Android: &messaging.AndroidConfig{
-				Priority: string(priority),
-			},
-			FCMOptions: &messaging.FCMOptions{
-				AnalyticsLabel: analyticsLabel,
-			},
-			Data:  data,
-			Token: token,
-		})
-		if err != nil {
-			errs = append(errs, err.Error())
-			fmt.Printf("Failed to send message: %v\n", err)
-		} else {
-			fmt.Printf("Successfully sent message: %s\n", sendResult)
+	failures := 0
+	codes := map[string]int{}
+	for _, result := range pusher.Send(ctx, messages) {
+		if result.Err != nil {
+			failures++
+			codes[result.Code]++
 		}
-
 	}
 
-	if len(errs) > 0 {
-		fmt.Printf("Errors: %v\n", errs)
-		return fmt.Errorf(strings.Join(errs, "\n"))
+	if failures > 0 {
+		logger.For(ctx, "notifications.SendPushNotification").Errorf("Failed to send to %d of %d tokens: %v", failures, len(tokens), codes)
+		return fmt.Errorf("failed to send to %d of %d tokens: %v", failures, len(tokens), codes)
 	}
 
 	return nil
 }
 
-func SendTimezoneAwareNotifications(ctx context.Context, db db.Database) error {
+// SendTimezoneAwareNotifications reminds users whose local hour is one of the reminder hours
+func SendTimezoneAwareNotifications(ctx context.Context, db db.Database, hours config.Reminders) error {
 	// now := time.Now().UTC()
 
-	// TODO: change to 6am
-	morningUsers, err := GetUsersForLocalHour(ctx, db, 4)
+	// every failure is returned so the job run is marked failed instead of
+	// looking like a quiet hour
+	var errs []error
+
+	morningUsers, err := GetUsersForLocalHour(ctx, db, hours.MorningHour)
 	if err != nil {
-		fmt.Printf("error getting morning users: %w", err)
+		logger.For(ctx, "notifications.SendTimezoneAwareNotifications").Errorf("Error getting morning users: %v", err)
+		errs = append(errs, err)
 	} else {
-		fmt.Printf("Morning users: %d\n", len(morningUsers))
+		logger.For(ctx, "notifications.SendTimezoneAwareNotifications").Infof("Morning users: %d", len(morningUsers))
 	}
 
-	eveningUsers, err := GetUsersForLocalHour(ctx, db, 18)
+	eveningUsers, err := GetUsersForLocalHour(ctx, db, hours.EveningHour)
 	if err != nil {
-		fmt.Printf("error getting evening users: %w", err)
+		logger.For(ctx, "notifications.SendTimezoneAwareNotifications").Errorf("Error getting evening users: %v", err)
+		errs = append(errs, err)
 	} else {
-		fmt.Printf("Evening users: %d\n", len(eveningUsers))
+		logger.For(ctx, "notifications.SendTimezoneAwareNotifications").Infof("Evening users: %d", len(eveningUsers))
 	}
 
-	lateEviningUsers, err := GetUsersForLocalHour(ctx, db, 19)
+	lateEviningUsers, err := GetUsersForLocalHour(ctx, db, hours.LateEveningHour)
 	if err != nil {
-		fmt.Printf("error getting late evening users: %w", err)
+		logger.For(ctx, "notifications.SendTimezoneAwareNotifications").Errorf("Error getting late evening users: %v", err)
+		errs = append(errs, err)
 	} else {
-		fmt.Printf("Late Evening users: %d\n", len(lateEviningUsers))
+		logger.For(ctx, "notifications.SendTimezoneAwareNotifications").Infof("Late Evening users: %d", len(lateEviningUsers))
 	}
 
-	err = sendStreakNotification("", "Good Morning", "%s! Don't forget to read Quran today to maintain your streak!", morningUsers)
+	err = sendStreakNotification(ctx, db, "", TemplateStreakReminderMorning, morningUsers)
 	if err != nil {
-		fmt.Printf("Failed to send morning notification to users %d: %v\n", len(morningUsers), err)
+		logger.For(ctx, "notifications.SendTimezoneAwareNotifications").Errorf("Failed to send morning notification to users %d: %v", len(morningUsers), err)
+		errs = append(errs, err)
 	}
 
-	err = sendStreakNotification("", "Good Evening", "%s! Don't forget to read Quran today to maintain your streak!", eveningUsers)
+	err = sendStreakNotification(ctx, db, "", TemplateStreakReminderEvening, eveningUsers)
 	if err != nil {
-		fmt.Printf("Failed to send evening notification to user %d: %v\n", len(eveningUsers), err)
+		logger.For(ctx, "notifications.SendTimezoneAwareNotifications").Errorf("Failed to send evening notification to user %d: %v", len(eveningUsers), err)
+		errs = append(errs, err)
 	}
 
-	err = sendStreakNotification("", "Good Evening", "%s! Don't forget to read Quran today to maintain your streak!", lateEviningUsers)
+	err = sendStreakNotification(ctx, db, "", TemplateStreakReminderEvening, lateEviningUsers)
 	if err != nil {
-		fmt.Printf("Failed to send late evening notification to user %d: %v\n", len(lateEviningUsers), err)
+		logger.For(ctx, "notifications.SendTimezoneAwareNotifications").Errorf("Failed to send late evening notification to user %d: %v", len(lateEviningUsers), err)
+		errs = append(errs, err)
 	}
 
-	return nil
+	return errors.Join(errs...)
 }
 
 // GetUsersForLocalHour gets users where their local time matches the target hour
@@ -175,13 +137,13 @@ func GetUsersForLocalHour(ctx context.Context, db db.Database, targetHour int) (
 	for _, tz := range timezones {
 		loc, err := time.LoadLocation(tz)
 		if err != nil {
-			fmt.Printf("Invalid timezone %s: %v\n", tz, err)
+			logger.For(ctx, "notifications.GetUsersForLocalHour").Warnf("Invalid timezone %s: %v", tz, err)
 			continue
 		}
 
 		// Convert UTC time to local time for this timezone
 		localTime := now.In(loc)
-		fmt.Printf("%s Local time: %s hour: %d\n", tz, localTime.Format("2006-01-02 15:04:05"), localTime.Hour())
+		logger.For(ctx, "notifications.GetUsersForLocalHour").Debugf("%s Local time: %s hour: %d", tz, localTime.Format("2006-01-02 15:04:05"), localTime.Hour())
 
 		// If current hour in this timezone matches our target, add it to matching timezones
 		if localTime.Hour() == targetHour {
@@ -191,13 +153,13 @@ func GetUsersForLocalHour(ctx context.Context, db db.Database, targetHour int) (
 
 	// No matching timezones for this hour
 	if len(matchingTimezones) == 0 {
-		fmt.Printf("No matching timezones for hour %d\n", targetHour)
-		fmt.Println("All timezones:", timezones)
+		logger.For(ctx, "notifications.GetUsersForLocalHour").Infof("No matching timezones for hour %d", targetHour)
+		logger.For(ctx, "notifications.GetUsersForLocalHour").Debugf("All timezones: %v", timezones)
 		return []models.NotificationUser{}, nil
 	}
 
-	fmt.Printf("Found %d matching timezones for hour %d\n", len(matchingTimezones), targetHour)
-	fmt.Println(matchingTimezones)
+	logger.For(ctx, "notifications.GetUsersForLocalHour").Infof("Found %d matching timezones for hour %d", len(matchingTimezones), targetHour)
+	logger.For(ctx, "notifications.GetUsersForLocalHour").Infof("%v", matchingTimezones)
 
 	// Build query with placeholders for timezone list
 	placeholders := ""
@@ -216,41 +178,118 @@ func GetUsersForLocalHour(ctx context.Context, db db.Database, targetHour int) (
       u.id as id,
       u.name as name,
       u.timezone as timezone,
+      u.locale as locale,
+      st.current_streak as current_streak,
+      COALESCE((
+        SELECT re.page_number FROM reading_events re
+        WHERE re.user_id = u.id
+        ORDER BY re.created_at DESC
+        LIMIT 1
+      ), 0) as last_page,
+      (SELECT COUNT(DISTINCT re.page_number) FROM reading_events re WHERE re.user_id = u.id) as pages_read,
       GROUP_CONCAT(d.device_token SEPARATOR ',') as tokens
   FROM users u
 	JOIN user_streaks st ON u.id = st.user_id
 	LEFT JOIN user_devices d ON d.user_id = u.id
 	WHERE
       u.timezone IN (%s)
+	    AND u.deleted_at IS NULL
 	    AND st.current_streak > 0
       AND st.last_active_date != DATE(NOW())
       AND d.device_token IS NOT NULL
-  GROUP BY u.id, u.name, u.timezone
+  GROUP BY u.id, u.name, u.timezone, u.locale, st.current_streak
 	`, placeholders)
 
 	// fmt.Printf("query: %s args: %v\n", query, args)
 
 	err = db.Select(ctx, &users, query, args...)
 	if err != nil {
-		fmt.Printf("error fetching users for notification: %w", err)
+		logger.For(ctx, "notifications.GetUsersForLocalHour").Errorf("Error fetching users for notification: %v", err)
 		return nil, fmt.Errorf("error fetching users for notification: %w", err)
 	}
 
-	fmt.Printf("Found %d users for notification\n", len(users))
+	logger.For(ctx, "notifications.GetUsersForLocalHour").Infof("Found %d users for notification", len(users))
 
 	return users, nil
 }
 
-func sendStreakNotification(topic, title, msgFormat string, users []models.NotificationUser) error {
-	fmt.Printf("[sendStreakNotification] title: %s users: %d\n", title, len(users))
+// notificationVars builds the template variables for a user
+func notificationVars(user models.NotificationUser) TemplateVars {
+	targetPage := user.LastPage + 1
+	if targetPage < 1 || targetPage > TotalQuranPages {
+		targetPage = 1
+	}
+
+	return TemplateVars{
+		Name:         firstName(user.Name),
+		Streak:       user.CurrentStreak,
+		PlanProgress: min(user.PagesRead*100/TotalQuranPages, 100),
+		TargetPage:   targetPage,
+	}
+}
+
+// sendStreakNotification queues a rendered reminder per user, the outbox workers deliver them
+func sendStreakNotification(ctx context.Context, db db.Database, topic, templateName string, users []models.NotificationUser) error {
+	logger.For(ctx, "notifications.sendStreakNotification").Debugf("Template: %s users: %d", templateName, len(users))
+	messages := make([]OutboxMessage, 0, len(users))
 	for _, user := range users {
-		tokens := user.GetTokens()
-		fmt.Printf("[sendStreakNotification] tokens: %d\t%+v\n", len(tokens), tokens)
-		message := fmt.Sprintf(msgFormat, firstName(user.Name))
-		err := SendPushNotification(tokens, topic, title, message, "", FCMPriorityHigh, nil, "")
+		title, message, err := RenderTemplate(templateName, user.Locale, notificationVars(user))
 		if err != nil {
-			fmt.Printf("Failed to send push notification to user %s: %v\n", user.Name, err)
+			logger.For(ctx, "notifications.sendStreakNotification").Errorf("Failed to render notification for user %d: %v", user.ID, err)
+			continue
 		}
+		messages = append(messages, OutboxMessage{
+			UserID:   user.ID,
+			Kind:     templateName,
+			Topic:    topic,
+			Title:    title,
+			Body:     message,
+			Priority: FCMPriorityHigh,
+		})
 	}
-	return nil
+
+	return EnqueueBatch(ctx, db, messages)
+}
+
+// SendStreakMilestone queues a congratulation for reaching a streak milestone,
+// at most one per user and milestone
+func SendStreakMilestone(ctx context.Context, db db.Database, userID uint64, streak int) error {
+	milestone := strconv.Itoa(streak)
+
+	var sent int
+	query := `
+	SELECT COUNT(*) FROM notification_outbox
+	WHERE user_id = ? AND kind = ? AND JSON_UNQUOTE(JSON_EXTRACT(data, '$.streak')) = ?
+	`
+	err := db.Get(ctx, &sent, query, userID, TemplateStreakMilestone, milestone)
+	if err != nil {
+		return fmt.Errorf("failed to check previous milestones: %w", err)
+	}
+	if sent > 0 {
+		return nil
+	}
+
+	var user models.NotificationUser
+	err = db.Get(ctx, &user, "SELECT id, name, locale FROM users WHERE id = ?", userID)
+	if err != nil {
+		return fmt.Errorf("failed to get user %d: %w", userID, err)
+	}
+
+	title, body, err := RenderTemplate(TemplateStreakMilestone, user.Locale, TemplateVars{
+		Name:   firstName(user.Name),
+		Streak: streak,
+	})
+	if err != nil {
+		return err
+	}
+
+	_, err = Enqueue(ctx, db, OutboxMessage{
+		UserID:   userID,
+		Kind:     TemplateStreakMilestone,
+		Title:    title,
+		Body:     body,
+		Priority: FCMPriorityNormal,
+		Data:     map[string]string{"streak": milestone},
+	})
+	return err
 }
@@ -0,0 +1,625 @@
+package notifications
+
+import (
+	"context"
+	"crypto/rand"
+	"database/sql"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"math"
+	mrand "math/rand"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/boolow5/quran-app-api/db"
+	"github.com/boolow5/quran-app-api/logger"
+	"github.com/boolow5/quran-app-api/metrics"
+	"github.com/boolow5/quran-app-api/models"
+	"github.com/boolow5/quran-app-api/utils"
+)
+
+type OutboxStatus string
+
+const (
+	OutboxStatusPending OutboxStatus = "pending"
+	OutboxStatusSending OutboxStatus = "sending"
+	OutboxStatusSent    OutboxStatus = "sent"
+	OutboxStatusFailed  OutboxStatus = "failed"
+)
+
+// KindTestPush is the kind of the pushes sent from the admin API to check a
+// user's devices
+const KindTestPush = "admin_test"
+
+const (
+	// DefaultMaxAttempts is how many times a message is tried before it is marked failed
+	DefaultMaxAttempts = 5
+
+	outboxBatchSize    = 1000
+	outboxPollInterval = 5 * time.Second
+	// a claim older than this belongs to a worker that died mid-send
+	outboxClaimTimeout = 10 * time.Minute
+
+	retryBaseDelay = 30 * time.Second
+	retryMaxDelay  = time.Hour
+
+	// per device token, protects users from a buggy producer flooding their phone
+	tokenRateLimit       = 5
+	tokenRateLimitWindow = time.Hour
+)
+
+// OutboxMessage is a push notification waiting to be delivered to all devices of a user
+type OutboxMessage struct {
+	ID             uint64            `json:"id" db:"id"`
+	UserID         uint64            `json:"user_id" db:"user_id"`
+	Kind           string            `json:"kind" db:"kind"`
+	Title          string            `json:"title" db:"title"`
+	Body           string            `json:"body" db:"body"`
+	ImageURL       string            `json:"image_url" db:"image_url"`
+	Topic          string            `json:"topic" db:"topic"`
+	Priority       FCMPriority       `json:"priority" db:"priority"`
+	AnalyticsLabel string            `json:"analytics_label" db:"analytics_label"`
+	Data           map[string]string `json:"data" db:"-"`
+	RawData        sql.NullString    `json:"-" db:"data"`
+	Status         OutboxStatus      `json:"status" db:"status"`
+	Attempts       int               `json:"attempts" db:"attempts"`
+	MaxAttempts    int               `json:"max_attempts" db:"max_attempts"`
+	NextAttemptAt  time.Time         `json:"next_attempt_at" db:"next_attempt_at"`
+	LastError      sql.NullString    `json:"last_error" db:"last_error"`
+	ClaimID        string            `json:"-" db:"claim_id"`
+	ClaimedAt      sql.NullTime      `json:"-" db:"claimed_at"`
+	SentAt         sql.NullTime      `json:"sent_at" db:"sent_at"`
+	CreatedAt      time.Time         `json:"created_at" db:"created_at"`
+	UpdatedAt      time.Time         `json:"updated_at" db:"updated_at"`
+}
+
+// DeliveryAttempt is one send of an outbox message to one device token
+type DeliveryAttempt struct {
+	ID           uint64         `json:"id" db:"id"`
+	OutboxID     uint64         `json:"outbox_id" db:"outbox_id"`
+	Attempt      int            `json:"attempt" db:"attempt"`
+	DeviceToken  string         `json:"device_token" db:"device_token"`
+	Success      bool           `json:"success" db:"success"`
+	MessageID    string         `json:"fcm_message_id" db:"fcm_message_id"`
+	ErrorCode    string         `json:"error_code" db:"error_code"`
+	ErrorMessage sql.NullString `json:"error_message" db:"error_message"`
+	CreatedAt    time.Time      `json:"created_at" db:"created_at"`
+}
+
+// Enqueue stores a message in the outbox, it is sent by the outbox workers
+func Enqueue(ctx context.Context, db db.Database, msg OutboxMessage) (uint64, error) {
+	if msg.UserID < 1 {
+		return 0, fmt.Errorf("user id is required")
+	}
+	if msg.Priority == "" {
+		msg.Priority = FCMPriorityHigh
+	}
+	if msg.MaxAttempts < 1 {
+		msg.MaxAttempts = DefaultMaxAttempts
+	}
+
+	data, err := msg.encodeData()
+	if err != nil {
+		return 0, err
+	}
+
+	query := `
+	INSERT INTO notification_outbox
+		(user_id, kind, title, body, image_url, topic, priority, analytics_label, data, status, max_attempts, next_attempt_at)
+	VALUES
+		(?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, NOW())
+	`
+	id, err := db.Insert(ctx, query, msg.UserID, msg.Kind, msg.Title, msg.Body, msg.ImageURL, msg.Topic,
+		string(msg.Priority), msg.AnalyticsLabel, data, OutboxStatusPending, msg.MaxAttempts)
+	if err != nil {
+		return 0, fmt.Errorf("failed to queue notification: %w", err)
+	}
+
+	return uint64(id), nil
+}
+
+// EnqueueBatch stores many messages with multi-row inserts, used by the reminder cron
+func EnqueueBatch(ctx context.Context, db db.Database, messages []OutboxMessage) error {
+	const rowsPerInsert = 500
+
+	for start := 0; start < len(messages); start += rowsPerInsert {
+		chunk := messages[start:min(start+rowsPerInsert, len(messages))]
+
+		rows := make([]string, 0, len(chunk))
+		args := make([]interface{}, 0, len(chunk)*11)
+		for _, msg := range chunk {
+			if msg.UserID < 1 {
+				return fmt.Errorf("user id is required")
+			}
+			if msg.Priority == "" {
+				msg.Priority = FCMPriorityHigh
+			}
+			if msg.MaxAttempts < 1 {
+				msg.MaxAttempts = DefaultMaxAttempts
+			}
+			data, err := msg.encodeData()
+			if err != nil {
+				return err
+			}
+
+			rows = append(rows, "(?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, NOW())")
+			args = append(args, msg.UserID, msg.Kind, msg.Title, msg.Body, msg.ImageURL, msg.Topic,
+				string(msg.Priority), msg.AnalyticsLabel, data, OutboxStatusPending, msg.MaxAttempts)
+		}
+
+		query := `
+		INSERT INTO notification_outbox
+			(user_id, kind, title, body, image_url, topic, priority, analytics_label, data, status, max_attempts, next_attempt_at)
+		VALUES ` + strings.Join(rows, ", ")
+		_, err := db.Exec(ctx, query, args...)
+		if err != nil {
+			return fmt.Errorf("failed to queue %d notifications: %w", len(chunk), err)
+		}
+	}
+
+	return nil
+}
+
+// GetOutboxMessage returns a message and every delivery attempt made for it
+func GetOutboxMessage(ctx context.Context, db db.Database, id uint64) (OutboxMessage, []DeliveryAttempt, error) {
+	var msg OutboxMessage
+	err := db.Get(ctx, &msg, "SELECT * FROM notification_outbox WHERE id = ?", id)
+	if err != nil {
+		return msg, nil, err
+	}
+	msg.decodeData()
+
+	var attempts []DeliveryAttempt
+	err = db.Select(ctx, &attempts, "SELECT * FROM notification_deliveries WHERE outbox_id = ? ORDER BY id", id)
+	if err != nil {
+		return msg, nil, fmt.Errorf("failed to get delivery attempts: %w", err)
+	}
+
+	return msg, attempts, nil
+}
+
+// GetOutboxMessagesForUser lists the most recent messages queued for a user
+func GetOutboxMessagesForUser(ctx context.Context, db db.Database, userID uint64, limit int) ([]OutboxMessage, error) {
+	var messages []OutboxMessage
+	query := "SELECT * FROM notification_outbox WHERE user_id = ? ORDER BY id DESC LIMIT ?"
+	err := db.Select(ctx, &messages, query, userID, limit)
+	if err != nil {
+		return nil, err
+	}
+
+	for i := range messages {
+		messages[i].decodeData()
+	}
+	return messages, nil
+}
+
+// encodeData returns Data as a JSON string, or nil when there is none
+func (m *OutboxMessage) encodeData() (interface{}, error) {
+	if len(m.Data) == 0 {
+		return nil, nil
+	}
+	raw, err := json.Marshal(m.Data)
+	if err != nil {
+		return nil, fmt.Errorf("failed to encode notification data: %w", err)
+	}
+	return string(raw), nil
+}
+
+func (m *OutboxMessage) decodeData() {
+	if !m.RawData.Valid || m.RawData.String == "" {
+		return
+	}
+	if err := json.Unmarshal([]byte(m.RawData.String), &m.Data); err != nil {
+		logger.Component("notifications.outbox").Warnf("Invalid data on message %d: %v", m.ID, err)
+	}
+}
+
+// retryDelay is an exponential backoff with jitter: 30s, 1m, 2m, ... capped at an hour
+func retryDelay(attempt int) time.Duration {
+	delay := time.Duration(float64(retryBaseDelay) * math.Pow(2, float64(attempt-1)))
+	if delay > retryMaxDelay || delay <= 0 {
+		delay = retryMaxDelay
+	}
+	return delay/2 + time.Duration(mrand.Int63n(int64(delay/2)+1))
+}
+
+// tokenLimiter is a sliding window limit of sends per device token
+type tokenLimiter struct {
+	mu     sync.Mutex
+	limit  int
+	window time.Duration
+	sent   map[string][]time.Time
+}
+
+func newTokenLimiter(limit int, window time.Duration) *tokenLimiter {
+	return &tokenLimiter{limit: limit, window: window, sent: map[string][]time.Time{}}
+}
+
+// Allow records a send and returns true, or returns how long to wait when the token is over its limit
+func (l *tokenLimiter) Allow(token string, now time.Time) (bool, time.Duration) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	recent := l.sent[token][:0]
+	for _, t := range l.sent[token] {
+		if now.Sub(t) < l.window {
+			recent = append(recent, t)
+		}
+	}
+
+	if len(recent) >= l.limit {
+		l.sent[token] = recent
+		return false, l.window - now.Sub(recent[0])
+	}
+
+	l.sent[token] = append(recent, now)
+	return true, 0
+}
+
+// prune drops tokens with no sends inside the window so the map does not grow forever
+func (l *tokenLimiter) prune(now time.Time) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	for token, times := range l.sent {
+		if len(times) == 0 || now.Sub(times[len(times)-1]) >= l.window {
+			delete(l.sent, token)
+		}
+	}
+}
+
+type outboxWorker struct {
+	db      db.Database
+	pusher  Pusher
+	limiter *tokenLimiter
+}
+
+func newOutboxWorker(db db.Database, pusher Pusher) *outboxWorker {
+	return &outboxWorker{
+		db:      db,
+		pusher:  pusher,
+		limiter: newTokenLimiter(tokenRateLimit, tokenRateLimitWindow),
+	}
+}
+
+// StartOutboxWorkers polls the outbox and delivers due messages through pusher.
+// It blocks until ctx is cancelled.
+func StartOutboxWorkers(ctx context.Context, db db.Database, pusher Pusher) {
+	w := newOutboxWorker(db, pusher)
+
+	logger.For(ctx, "notifications.outbox").Info("Started")
+
+	ticker := time.NewTicker(outboxPollInterval)
+	defer ticker.Stop()
+
+	for {
+		messages, err := w.claim(ctx)
+		if err != nil {
+			logger.For(ctx, "notifications.outbox").Errorf("Failed to claim messages: %v", err)
+		}
+		if len(messages) > 0 {
+			started := time.Now()
+			// claimed messages are sent even during shutdown, otherwise they
+			// would sit in sending until the stale claim is reclaimed
+			w.deliver(context.WithoutCancel(ctx), messages)
+			logger.For(ctx, "notifications.outbox").Infof("Delivered %d messages in %s", len(messages), time.Since(started))
+		}
+		w.limiter.prune(time.Now())
+
+		// keep draining while there is a backlog, otherwise wait for the next tick
+		if len(messages) == outboxBatchSize && ctx.Err() == nil {
+			continue
+		}
+		select {
+		case <-ctx.Done():
+			logger.For(ctx, "notifications.outbox").Info("Stopped")
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+// ProcessOutboxOnce claims and delivers one batch of due messages, it returns
+// how many messages were claimed. Useful in tests together with FakePusher.
+func ProcessOutboxOnce(ctx context.Context, db db.Database, pusher Pusher) (int, error) {
+	w := newOutboxWorker(db, pusher)
+	messages, err := w.claim(ctx)
+	if err != nil {
+		return 0, err
+	}
+	if len(messages) > 0 {
+		w.deliver(ctx, messages)
+	}
+	return len(messages), nil
+}
+
+// claim marks a batch of due messages as sending, the claim id keeps other
+// replicas from picking the same rows
+func (w *outboxWorker) claim(ctx context.Context) ([]OutboxMessage, error) {
+	claimID, err := newClaimID()
+	if err != nil {
+		return nil, err
+	}
+
+	query := `
+	UPDATE notification_outbox
+	SET status = ?, claim_id = ?, claimed_at = NOW()
+	WHERE (status = ? AND next_attempt_at <= NOW())
+		OR (status = ? AND claimed_at < NOW() - INTERVAL ? SECOND)
+	ORDER BY next_attempt_at
+	LIMIT ?
+	`
+	claimed, err := w.db.Exec(ctx, query, OutboxStatusSending, claimID, OutboxStatusPending,
+		OutboxStatusSending, int(outboxClaimTimeout.Seconds()), outboxBatchSize)
+	if err != nil {
+		return nil, err
+	}
+	if claimed == 0 {
+		return nil, nil
+	}
+
+	var messages []OutboxMessage
+	err = w.db.Select(ctx, &messages, "SELECT * FROM notification_outbox WHERE claim_id = ? AND status = ?", claimID, OutboxStatusSending)
+	if err != nil {
+		return nil, err
+	}
+	for i := range messages {
+		messages[i].decodeData()
+	}
+
+	return messages, nil
+}
+
+// deliveryOutcome collects what happened to one outbox message across all of its devices
+type deliveryOutcome struct {
+	attempt   int
+	devices   int
+	delivered int
+	sent      bool
+	retry     bool
+	deferBy   time.Duration
+	errs      []string
+}
+
+// deliver sends a batch of messages to every device of their users that has not
+// received them yet, then records and reschedules each message
+func (w *outboxWorker) deliver(ctx context.Context, messages []OutboxMessage) {
+	userIDs := make([]interface{}, 0, len(messages))
+	outboxIDs := make([]interface{}, 0, len(messages))
+	for _, msg := range messages {
+		userIDs = append(userIDs, msg.UserID)
+		outboxIDs = append(outboxIDs, msg.ID)
+	}
+
+	var devices []models.UserDevice
+	query := "SELECT user_id, device_token, transport, subscription FROM user_devices WHERE user_id IN " + utils.Placeholders(len(userIDs))
+	err := w.db.Select(ctx, &devices, query, userIDs...)
+	if err != nil {
+		for _, msg := range messages {
+			w.retryOrFail(ctx, msg, msg.Attempts+1, 0, fmt.Sprintf("failed to get device tokens: %v", err))
+		}
+		return
+	}
+	devicesByUser := map[uint64][]models.UserDevice{}
+	for _, device := range devices {
+		devicesByUser[device.UserID] = append(devicesByUser[device.UserID], device)
+	}
+
+	// devices that already got a message, or failed in a way retrying cannot fix
+	var finished []DeliveryAttempt
+	query = `
+	SELECT outbox_id, device_token, success
+	FROM notification_deliveries
+	WHERE outbox_id IN ` + utils.Placeholders(len(outboxIDs)) + `
+		AND (success = 1 OR error_code NOT IN ` + utils.Placeholders(len(retryableCodes)) + `)
+	`
+	args := append([]interface{}{}, outboxIDs...)
+	for _, code := range retryableCodes {
+		args = append(args, code)
+	}
+	err = w.db.Select(ctx, &finished, query, args...)
+	if err != nil {
+		for _, msg := range messages {
+			w.retryOrFail(ctx, msg, msg.Attempts+1, 0, fmt.Sprintf("failed to get previous deliveries: %v", err))
+		}
+		return
+	}
+
+	outcomes := make(map[uint64]*deliveryOutcome, len(messages))
+	skip := map[uint64]map[string]bool{}
+	for _, msg := range messages {
+		outcomes[msg.ID] = &deliveryOutcome{attempt: msg.Attempts + 1}
+		skip[msg.ID] = map[string]bool{}
+	}
+	for _, d := range finished {
+		skip[d.OutboxID][d.DeviceToken] = true
+		if d.Success {
+			outcomes[d.OutboxID].delivered++
+		}
+	}
+
+	// pushOutboxIDs[i] is the outbox message pushes[i] was built from
+	pushes := []PushMessage{}
+	pushOutboxIDs := []uint64{}
+	for _, msg := range messages {
+		outcome := outcomes[msg.ID]
+		for _, device := range devicesByUser[msg.UserID] {
+			if skip[msg.ID][device.DeviceToken] {
+				continue
+			}
+			outcome.devices++
+			if ok, wait := w.limiter.Allow(device.DeviceToken, time.Now()); !ok {
+				outcome.deferBy = max(outcome.deferBy, wait)
+				continue
+			}
+			pushes = append(pushes, PushMessage{
+				Transport:      device.Transport,
+				Token:          device.DeviceToken,
+				Subscription:   device.Subscription.String,
+				Title:          msg.Title,
+				Body:           msg.Body,
+				ImageURL:       msg.ImageURL,
+				Topic:          msg.Topic,
+				Priority:       msg.Priority,
+				Data:           msg.Data,
+				AnalyticsLabel: msg.AnalyticsLabel,
+			})
+			pushOutboxIDs = append(pushOutboxIDs, msg.ID)
+		}
+	}
+
+	results := w.pusher.Send(ctx, pushes)
+
+	invalid := []string{}
+	for i, result := range results {
+		outcome := outcomes[pushOutboxIDs[i]]
+		outcome.sent = true
+		if result.Err == nil {
+			outcome.delivered++
+			continue
+		}
+		outcome.errs = append(outcome.errs, result.Code)
+		switch classifyFCMError(result.Code) {
+		case FCMErrorRetryable:
+			outcome.retry = true
+		case FCMErrorInvalidToken:
+			invalid = append(invalid, pushes[i].Token)
+		}
+	}
+
+	w.logAttempts(ctx, pushes, pushOutboxIDs, results, outcomes)
+
+	if len(invalid) > 0 {
+		removed, err := models.DeleteDeviceTokens(ctx, w.db, invalid)
+		if err != nil {
+			logger.For(ctx, "notifications.outbox").Errorf("Failed to prune invalid tokens: %v", err)
+		} else {
+			metrics.PushInvalidTokens.Add(float64(removed))
+			logger.For(ctx, "notifications.outbox").Warnf("Pruned %d invalid device tokens", removed)
+		}
+	}
+
+	sentIDs := []interface{}{}
+	for _, msg := range messages {
+		outcome := outcomes[msg.ID]
+		lastError := strings.Join(outcome.errs, ", ")
+
+		switch {
+		case outcome.retry && outcome.attempt >= msg.MaxAttempts && outcome.delivered > 0:
+			// the devices left ran out of attempts, the user got it on the others
+			w.markPartlySent(ctx, msg, outcome.attempt, lastError)
+		case outcome.retry:
+			w.retryOrFail(ctx, msg, outcome.attempt, outcome.deferBy, lastError)
+		case outcome.deferBy > 0:
+			// rate limited devices get the message later, waiting does not spend an attempt
+			attempts := msg.Attempts
+			if outcome.sent {
+				attempts = outcome.attempt
+			}
+			w.reschedule(ctx, msg, attempts, outcome.deferBy, lastError)
+		case outcome.delivered > 0:
+			sentIDs = append(sentIDs, msg.ID)
+		default:
+			if outcome.devices == 0 {
+				lastError = "user has no device tokens"
+			}
+			w.fail(ctx, msg, outcome.attempt, lastError)
+		}
+	}
+
+	w.markSent(ctx, sentIDs)
+}
+
+// retryOrFail reschedules a message with backoff, or fails it once it has used all of its attempts
+func (w *outboxWorker) retryOrFail(ctx context.Context, msg OutboxMessage, attempt int, minDelay time.Duration, lastError string) {
+	if attempt >= msg.MaxAttempts {
+		w.fail(ctx, msg, attempt, lastError)
+		return
+	}
+	w.reschedule(ctx, msg, attempt, max(retryDelay(attempt), minDelay), lastError)
+}
+
+func (w *outboxWorker) reschedule(ctx context.Context, msg OutboxMessage, attempts int, delay time.Duration, lastError string) {
+	query := `
+	UPDATE notification_outbox
+	SET status = ?, attempts = ?, next_attempt_at = NOW() + INTERVAL ? SECOND, last_error = ?, claim_id = ''
+	WHERE id = ?
+	`
+	_, err := w.db.Exec(ctx, query, OutboxStatusPending, attempts, int(delay.Seconds())+1, lastError, msg.ID)
+	if err != nil {
+		logger.For(ctx, "notifications.outbox").Errorf("Failed to reschedule message %d: %v", msg.ID, err)
+	}
+}
+
+func (w *outboxWorker) markSent(ctx context.Context, ids []interface{}) {
+	if len(ids) == 0 {
+		return
+	}
+
+	query := `
+	UPDATE notification_outbox
+	SET status = ?, attempts = attempts + 1, sent_at = NOW(), claim_id = ''
+	WHERE id IN ` + utils.Placeholders(len(ids))
+	args := append([]interface{}{OutboxStatusSent}, ids...)
+	_, err := w.db.Exec(ctx, query, args...)
+	if err != nil {
+		logger.For(ctx, "notifications.outbox").Errorf("Failed to mark %d messages as sent: %v", len(ids), err)
+	}
+}
+
+// markPartlySent marks a message sent that some devices never got, the
+// error of the last attempt is kept
+func (w *outboxWorker) markPartlySent(ctx context.Context, msg OutboxMessage, attempt int, lastError string) {
+	query := "UPDATE notification_outbox SET status = ?, attempts = ?, sent_at = NOW(), last_error = ?, claim_id = '' WHERE id = ?"
+	_, err := w.db.Exec(ctx, query, OutboxStatusSent, attempt, lastError, msg.ID)
+	if err != nil {
+		logger.For(ctx, "notifications.outbox").Errorf("Failed to mark message %d as sent: %v", msg.ID, err)
+	}
+}
+
+func (w *outboxWorker) fail(ctx context.Context, msg OutboxMessage, attempt int, lastError string) {
+	query := "UPDATE notification_outbox SET status = ?, attempts = ?, last_error = ?, claim_id = '' WHERE id = ?"
+	_, err := w.db.Exec(ctx, query, OutboxStatusFailed, attempt, lastError, msg.ID)
+	if err != nil {
+		logger.For(ctx, "notifications.outbox").Errorf("Failed to mark message %d as failed: %v", msg.ID, err)
+	}
+}
+
+// logAttempts writes the delivery log for a batch, one multi-row insert per FCM batch
+func (w *outboxWorker) logAttempts(ctx context.Context, pushes []PushMessage, outboxIDs []uint64, results []PushResult, outcomes map[uint64]*deliveryOutcome) {
+	for start := 0; start < len(results); start += FCMMaxBatchSize {
+		end := min(start+FCMMaxBatchSize, len(results))
+
+		rows := make([]string, 0, end-start)
+		args := make([]interface{}, 0, (end-start)*7)
+		for i := start; i < end; i++ {
+			result := results[i]
+			var errorMessage interface{}
+			if result.Err != nil {
+				errorMessage = result.Err.Error()
+			}
+			rows = append(rows, utils.Placeholders(7))
+			args = append(args, outboxIDs[i], outcomes[outboxIDs[i]].attempt, pushes[i].Token,
+				result.Err == nil, result.MessageID, result.Code, errorMessage)
+		}
+
+		query := `
+		INSERT INTO notification_deliveries
+			(outbox_id, attempt, device_token, success, fcm_message_id, error_code, error_message)
+		VALUES ` + strings.Join(rows, ", ")
+		_, err := w.db.Exec(ctx, query, args...)
+		if err != nil {
+			logger.For(ctx, "notifications.outbox").Errorf("Failed to log %d deliveries: %v", end-start, err)
+		}
+	}
+}
+
+func newClaimID() (string, error) {
+	b := make([]byte, 16)
+	if _, err := rand.Read(b); err != nil {
+		return "", fmt.Errorf("failed to generate claim id: %w", err)
+	}
+	return hex.EncodeToString(b), nil
+}
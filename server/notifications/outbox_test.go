@@ -0,0 +1,323 @@
+package notifications
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/boolow5/quran-app-api/models"
+)
+
+// outboxDB is an in-memory notification_outbox, notification_deliveries and
+// user_devices that answers the queries of the outbox worker
+type outboxDB struct {
+	mu         sync.Mutex
+	messages   []OutboxMessage
+	deliveries []DeliveryAttempt
+	devices    []models.UserDevice
+}
+
+func (d *outboxDB) Exec(ctx context.Context, query string, args ...interface{}) (int64, error) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	query = strings.Join(strings.Fields(query), " ")
+	now := time.Now()
+	switch {
+	case strings.HasPrefix(query, "INSERT INTO notification_outbox"):
+		for i := 0; i+11 <= len(args); i += 11 {
+			d.messages = append(d.messages, OutboxMessage{
+				ID:            uint64(len(d.messages) + 1),
+				UserID:        args[i].(uint64),
+				Kind:          args[i+1].(string),
+				Title:         args[i+2].(string),
+				Body:          args[i+3].(string),
+				Status:        OutboxStatusPending,
+				MaxAttempts:   args[i+10].(int),
+				NextAttemptAt: now,
+			})
+		}
+		return int64(len(args) / 11), nil
+
+	case strings.HasPrefix(query, "UPDATE notification_outbox SET status = ?, claim_id = ?, claimed_at"):
+		var claimed int64
+		for i := range d.messages {
+			m := &d.messages[i]
+			if m.Status == OutboxStatusPending && !m.NextAttemptAt.After(now) {
+				m.Status, m.ClaimID = OutboxStatusSending, args[1].(string)
+				claimed++
+			}
+		}
+		return claimed, nil
+
+	case strings.HasPrefix(query, "UPDATE notification_outbox SET status = ?, attempts = ?, next_attempt_at"):
+		m := d.message(args[4].(uint64))
+		m.Status, m.Attempts, m.ClaimID = args[0].(OutboxStatus), args[1].(int), ""
+		m.NextAttemptAt = now.Add(time.Duration(args[2].(int)) * time.Second)
+		m.LastError = sql.NullString{String: args[3].(string), Valid: true}
+		return 1, nil
+
+	case strings.HasPrefix(query, "UPDATE notification_outbox SET status = ?, attempts = attempts + 1, sent_at"):
+		for _, id := range args[1:] {
+			m := d.message(id.(uint64))
+			m.Status, m.Attempts, m.ClaimID = args[0].(OutboxStatus), m.Attempts+1, ""
+		}
+		return int64(len(args) - 1), nil
+
+	case strings.HasPrefix(query, "UPDATE notification_outbox SET status = ?, attempts = ?, sent_at = NOW(), last_error = ?"):
+		m := d.message(args[3].(uint64))
+		m.Status, m.Attempts, m.ClaimID = args[0].(OutboxStatus), args[1].(int), ""
+		m.LastError = sql.NullString{String: args[2].(string), Valid: true}
+		return 1, nil
+
+	case strings.HasPrefix(query, "UPDATE notification_outbox SET status = ?, attempts = ?, last_error = ?"):
+		m := d.message(args[3].(uint64))
+		m.Status, m.Attempts, m.ClaimID = args[0].(OutboxStatus), args[1].(int), ""
+		m.LastError = sql.NullString{String: args[2].(string), Valid: true}
+		return 1, nil
+
+	case strings.HasPrefix(query, "INSERT INTO notification_deliveries"):
+		for i := 0; i+7 <= len(args); i += 7 {
+			d.deliveries = append(d.deliveries, DeliveryAttempt{
+				OutboxID:    args[i].(uint64),
+				Attempt:     args[i+1].(int),
+				DeviceToken: args[i+2].(string),
+				Success:     args[i+3].(bool),
+				ErrorCode:   args[i+5].(string),
+			})
+		}
+		return int64(len(args) / 7), nil
+
+	case strings.HasPrefix(query, "DELETE FROM user_devices WHERE device_token IN"):
+		remove := map[string]bool{}
+		for _, token := range args {
+			remove[token.(string)] = true
+		}
+		kept := d.devices[:0]
+		for _, device := range d.devices {
+			if !remove[device.DeviceToken] {
+				kept = append(kept, device)
+			}
+		}
+		deleted := int64(len(d.devices) - len(kept))
+		d.devices = kept
+		return deleted, nil
+	}
+	return 0, fmt.Errorf("outboxDB: unexpected exec %q", query)
+}
+
+func (d *outboxDB) Select(ctx context.Context, dest interface{}, query string, args ...interface{}) error {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	query = strings.Join(strings.Fields(query), " ")
+	switch {
+	case strings.HasPrefix(query, "SELECT * FROM notification_outbox WHERE claim_id = ?"):
+		messages := dest.(*[]OutboxMessage)
+		for _, m := range d.messages {
+			if m.ClaimID == args[0] && m.Status == args[1] {
+				*messages = append(*messages, m)
+			}
+		}
+		return nil
+
+	case strings.Contains(query, "FROM user_devices WHERE user_id IN"):
+		users := map[uint64]bool{}
+		for _, id := range args {
+			users[id.(uint64)] = true
+		}
+		devices := dest.(*[]models.UserDevice)
+		for _, device := range d.devices {
+			if users[device.UserID] {
+				*devices = append(*devices, device)
+			}
+		}
+		return nil
+
+	case strings.Contains(query, "FROM notification_deliveries WHERE outbox_id IN"):
+		attempts := dest.(*[]DeliveryAttempt)
+		for _, delivery := range d.deliveries {
+			if delivery.Success || classifyFCMError(delivery.ErrorCode) != FCMErrorRetryable {
+				*attempts = append(*attempts, delivery)
+			}
+		}
+		return nil
+	}
+	return fmt.Errorf("outboxDB: unexpected select %q", query)
+}
+
+func (d *outboxDB) Get(ctx context.Context, dest interface{}, query string, args ...interface{}) error {
+	return fmt.Errorf("outboxDB: unexpected get %q", query)
+}
+
+func (d *outboxDB) GetTx(ctx context.Context, tx *sql.Tx, dest interface{}, query string, args ...interface{}) error {
+	return d.Get(ctx, dest, query, args...)
+}
+
+func (d *outboxDB) ExecTx(ctx context.Context, tx *sql.Tx, query string, args ...interface{}) (int64, error) {
+	return d.Exec(ctx, query, args...)
+}
+
+func (d *outboxDB) Insert(ctx context.Context, query string, args ...interface{}) (int64, error) {
+	if _, err := d.Exec(ctx, query, args...); err != nil {
+		return 0, err
+	}
+	return int64(len(d.messages)), nil
+}
+
+func (d *outboxDB) Begin(ctx context.Context) (*sql.Tx, error) {
+	return nil, fmt.Errorf("outboxDB: transactions are not supported")
+}
+
+func (d *outboxDB) message(id uint64) *OutboxMessage {
+	for i := range d.messages {
+		if d.messages[i].ID == id {
+			return &d.messages[i]
+		}
+	}
+	panic(fmt.Sprintf("outboxDB: no message %d", id))
+}
+
+func (d *outboxDB) byUser(userID uint64) []OutboxMessage {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	messages := []OutboxMessage{}
+	for _, m := range d.messages {
+		if m.UserID == userID {
+			messages = append(messages, m)
+		}
+	}
+	return messages
+}
+
+func TestRemindersThroughOutbox(t *testing.T) {
+	ctx := context.Background()
+	store := &outboxDB{devices: []models.UserDevice{
+		{UserID: 1, DeviceToken: "phone-1", Transport: TransportFCM},
+		{UserID: 1, DeviceToken: "tablet-1", Transport: TransportFCM},
+		{UserID: 2, DeviceToken: "stale-2", Transport: TransportFCM},
+		{UserID: 4, DeviceToken: "phone-4", Transport: TransportFCM},
+	}}
+	pusher := NewFakePusher()
+	pusher.FailToken("stale-2", FCMErrorCodeNotRegistered)
+
+	// user 3 has no device, user 4 is reminded more often than the per-token limit
+	users := []models.NotificationUser{
+		{ID: 1, Name: "Amina Yusuf", Locale: "en", CurrentStreak: 4},
+		{ID: 2, Name: "Bilal", Locale: "en"},
+		{ID: 3, Name: "Cali", Locale: "so"},
+	}
+	if err := sendStreakNotification(ctx, store, "", TemplateStreakReminderMorning, users); err != nil {
+		t.Fatalf("queueing reminders: %v", err)
+	}
+	flood := make([]models.NotificationUser, tokenRateLimit+2)
+	for i := range flood {
+		flood[i] = models.NotificationUser{ID: 4, Locale: "en"}
+	}
+	if err := sendStreakNotification(ctx, store, "", TemplateStreakReminderEvening, flood); err != nil {
+		t.Fatalf("queueing reminders: %v", err)
+	}
+
+	claimed, err := ProcessOutboxOnce(ctx, store, pusher)
+	if err != nil {
+		t.Fatalf("processing outbox: %v", err)
+	}
+	if want := len(users) + len(flood); claimed != want {
+		t.Fatalf("claimed %d messages, want %d", claimed, want)
+	}
+
+	t.Run("recipients", func(t *testing.T) {
+		for _, token := range []string{"phone-1", "tablet-1"} {
+			sent := pusher.SentTo(token)
+			if len(sent) != 1 {
+				t.Fatalf("%s got %d messages, want 1", token, len(sent))
+			}
+			if !strings.Contains(sent[0].Body, "Amina") {
+				t.Errorf("%s got %q, want the reminder rendered for its user", token, sent[0].Body)
+			}
+		}
+		if m := store.byUser(1)[0]; m.Status != OutboxStatusSent || m.Attempts != 1 {
+			t.Errorf("user 1 message is %s after %d attempts, want sent after 1", m.Status, m.Attempts)
+		}
+		if m := store.byUser(3)[0]; m.Status != OutboxStatusFailed || m.LastError.String != "user has no device tokens" {
+			t.Errorf("user 3 message is %s with %q, want failed for having no devices", m.Status, m.LastError.String)
+		}
+	})
+
+	t.Run("invalid tokens are pruned", func(t *testing.T) {
+		if sent := pusher.SentTo("stale-2"); len(sent) != 0 {
+			t.Errorf("stale-2 got %d messages, want none", len(sent))
+		}
+		for _, device := range store.devices {
+			if device.DeviceToken == "stale-2" {
+				t.Fatal("stale-2 is still registered")
+			}
+		}
+		if m := store.byUser(2)[0]; m.Status != OutboxStatusFailed || m.LastError.String != FCMErrorCodeNotRegistered {
+			t.Errorf("user 2 message is %s with %q, want failed as not registered", m.Status, m.LastError.String)
+		}
+	})
+
+	t.Run("per token limit", func(t *testing.T) {
+		if sent := pusher.SentTo("phone-4"); len(sent) != tokenRateLimit {
+			t.Fatalf("phone-4 got %d messages, want %d", len(sent), tokenRateLimit)
+		}
+		var sent, deferred int
+		for _, m := range store.byUser(4) {
+			switch {
+			case m.Status == OutboxStatusSent:
+				sent++
+			case m.Status == OutboxStatusPending && m.Attempts == 0 && m.NextAttemptAt.After(time.Now()):
+				// waiting for the window does not spend an attempt
+				deferred++
+			default:
+				t.Errorf("user 4 message %d is %s after %d attempts", m.ID, m.Status, m.Attempts)
+			}
+		}
+		if sent != tokenRateLimit || deferred != len(flood)-tokenRateLimit {
+			t.Errorf("user 4 has %d sent and %d deferred messages, want %d and %d", sent, deferred, tokenRateLimit, len(flood)-tokenRateLimit)
+		}
+	})
+
+	t.Run("nothing is sent twice", func(t *testing.T) {
+		before := len(pusher.Sent())
+		claimed, err := ProcessOutboxOnce(ctx, store, pusher)
+		if err != nil {
+			t.Fatalf("processing outbox: %v", err)
+		}
+		if claimed != 0 || len(pusher.Sent()) != before {
+			t.Errorf("second run claimed %d and sent %d more messages, want none", claimed, len(pusher.Sent())-before)
+		}
+	})
+}
+
+func TestPartlyDeliveredMessageIsSent(t *testing.T) {
+	ctx := context.Background()
+	store := &outboxDB{devices: []models.UserDevice{
+		{UserID: 1, DeviceToken: "phone-1", Transport: TransportFCM},
+		{UserID: 1, DeviceToken: "tablet-1", Transport: TransportFCM},
+	}}
+	pusher := NewFakePusher()
+	pusher.FailToken("tablet-1", FCMErrorCodeServerUnavailable)
+
+	_, err := Enqueue(ctx, store, OutboxMessage{UserID: 1, Kind: TemplateStreakMilestone, Title: "7 days", Body: "Keep going", MaxAttempts: 1})
+	if err != nil {
+		t.Fatalf("queueing message: %v", err)
+	}
+	if _, err := ProcessOutboxOnce(ctx, store, pusher); err != nil {
+		t.Fatalf("processing outbox: %v", err)
+	}
+
+	if sent := pusher.SentTo("phone-1"); len(sent) != 1 {
+		t.Fatalf("phone-1 got %d messages, want 1", len(sent))
+	}
+	m := store.byUser(1)[0]
+	if m.Status != OutboxStatusSent || m.Attempts != 1 || m.LastError.String != FCMErrorCodeServerUnavailable {
+		t.Errorf("message is %s after %d attempts with %q, want sent after 1 with %q", m.Status, m.Attempts, m.LastError.String, FCMErrorCodeServerUnavailable)
+	}
+}
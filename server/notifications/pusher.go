@@ -0,0 +1,141 @@
+package notifications
+
+import (
+	"context"
+	"fmt"
+
+	"github.com/boolow5/quran-app-api/config"
+	"github.com/boolow5/quran-app-api/logger"
+	"github.com/boolow5/quran-app-api/metrics"
+)
+
+const (
+	TransportFCM     = "fcm"
+	TransportWebPush = "webpush"
+	TransportFake    = "fake"
+)
+
+// PushMessage is one notification to one device
+type PushMessage struct {
+	Transport      string
+	Token          string // device_token of the device, for web push a hash of the endpoint
+	Subscription   string // web push subscription JSON, empty for FCM
+	Title          string
+	Body           string
+	ImageURL       string
+	Topic          string
+	Priority       FCMPriority
+	Data           map[string]string
+	AnalyticsLabel string
+}
+
+// PushResult is the outcome of sending a PushMessage, Code is one of the FCMErrorCode values
+type PushResult struct {
+	MessageID string
+	Err       error
+	Code      string
+}
+
+// Pusher delivers push messages, results are returned in the same order as messages
+type Pusher interface {
+	Send(ctx context.Context, messages []PushMessage) []PushResult
+}
+
+// Router sends each message through the pusher registered for its transport
+type Router struct {
+	pushers map[string]Pusher
+}
+
+func NewRouter() *Router {
+	return &Router{pushers: map[string]Pusher{}}
+}
+
+// Register adds the pusher that handles a transport
+func (r *Router) Register(transport string, pusher Pusher) *Router {
+	r.pushers[transport] = pusher
+	return r
+}
+
+// Send implements Pusher.
+func (r *Router) Send(ctx context.Context, messages []PushMessage) []PushResult {
+	results := make([]PushResult, len(messages))
+
+	indexes := map[string][]int{}
+	for i, msg := range messages {
+		transport := msg.Transport
+		if transport == "" {
+			transport = TransportFCM
+		}
+		indexes[transport] = append(indexes[transport], i)
+	}
+
+	for transport, idx := range indexes {
+		pusher, ok := r.pushers[transport]
+		if !ok {
+			for _, i := range idx {
+				results[i] = PushResult{
+					Err:  fmt.Errorf("no pusher for transport %q", transport),
+					Code: FCMErrorCodeUnsupportedTransport,
+				}
+			}
+			continue
+		}
+
+		batch := make([]PushMessage, len(idx))
+		for j, i := range idx {
+			batch[j] = messages[i]
+		}
+		for j, result := range pusher.Send(ctx, batch) {
+			results[idx[j]] = result
+		}
+	}
+
+	for transport, idx := range indexes {
+		for _, i := range idx {
+			observePush(transport, results[i])
+		}
+	}
+
+	return results
+}
+
+func observePush(transport string, result PushResult) {
+	if result.Err == nil {
+		metrics.PushSends.WithLabelValues(transport, "success").Inc()
+		return
+	}
+
+	code := result.Code
+	if code == "" {
+		code = "unknown"
+	}
+	metrics.PushSends.WithLabelValues(transport, "failure").Inc()
+	metrics.PushFailures.WithLabelValues(transport, code).Inc()
+}
+
+// NewPusher builds the push transports. Transport "fake" records messages in
+// memory instead of sending them, otherwise FCM is used with the Firebase
+// service account. Web push is added when the VAPID keys are set.
+func NewPusher(ctx context.Context, cfg config.Push, credentialsJSON []byte) (Pusher, error) {
+	router := NewRouter()
+
+	if cfg.Transport == TransportFake {
+		fake := NewFakePusher()
+		logger.For(ctx, "notifications.NewPusher").Info("Push notifications use the in-memory fake transport")
+		return router.Register(TransportFCM, fake).Register(TransportWebPush, fake), nil
+	}
+
+	fcm, err := NewFCMPusher(ctx, credentialsJSON, cfg.Concurrency, cfg.FCMIcon)
+	if err != nil {
+		return nil, err
+	}
+	router.Register(TransportFCM, fcm)
+	logger.For(ctx, "notifications.NewPusher").Info("Firebase successfully initialized")
+
+	if cfg.VAPIDPublicKey != "" && cfg.VAPIDPrivateKey != "" {
+		router.Register(TransportWebPush, NewWebPushPusher(cfg.VAPIDPublicKey, cfg.VAPIDPrivateKey, cfg.VAPIDSubject, cfg.Concurrency))
+		logger.For(ctx, "notifications.NewPusher").Info("Web push successfully initialized")
+	}
+
+	return router, nil
+}
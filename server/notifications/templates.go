@@ -0,0 +1,204 @@
+package notifications
+
+import (
+	"bytes"
+	"fmt"
+	"strings"
+	"sync"
+	"text/template"
+)
+
+const (
+	LocaleSomali  = "so"
+	LocaleArabic  = "ar"
+	LocaleEnglish = "en"
+	LocaleTurkish = "tr"
+	LocaleUrdu    = "ur"
+
+	// DefaultLocale is used when neither the user's locale nor its base language has a variant
+	DefaultLocale = LocaleEnglish
+
+	// TotalQuranPages is the number of pages in the Madani mushaf the app renders
+	TotalQuranPages = 604
+)
+
+const (
+	TemplateStreakReminderMorning = "streak_reminder_morning"
+	TemplateStreakReminderEvening = "streak_reminder_evening"
+	TemplateStreakMilestone       = "streak_milestone"
+)
+
+// TemplateVars are the values available to notification templates
+type TemplateVars struct {
+	Name         string
+	Streak       int
+	PlanProgress int // percentage of the mushaf read so far
+	TargetPage   int // page the user should continue from today
+}
+
+// LocalizedTemplate is the title and body of one notification in one locale,
+// both are text/template strings rendered with TemplateVars
+type LocalizedTemplate struct {
+	Title string
+	Body  string
+}
+
+type compiledTemplate struct {
+	title *template.Template
+	body  *template.Template
+}
+
+var (
+	templatesMu sync.RWMutex
+	templates   = map[string]map[string]compiledTemplate{}
+)
+
+// RegisterTemplate adds or replaces the locale variants of a notification template
+func RegisterTemplate(name string, variants map[string]LocalizedTemplate) error {
+	compiled := make(map[string]compiledTemplate, len(variants))
+	for locale, variant := range variants {
+		title, err := template.New(name + ":" + locale + ":title").Parse(variant.Title)
+		if err != nil {
+			return fmt.Errorf("invalid title for template %s (%s): %w", name, locale, err)
+		}
+		body, err := template.New(name + ":" + locale + ":body").Parse(variant.Body)
+		if err != nil {
+			return fmt.Errorf("invalid body for template %s (%s): %w", name, locale, err)
+		}
+		compiled[NormalizeLocale(locale)] = compiledTemplate{title: title, body: body}
+	}
+
+	templatesMu.Lock()
+	defer templatesMu.Unlock()
+	templates[name] = compiled
+	return nil
+}
+
+// NormalizeLocale lower-cases a locale and converts "so_SO" to "so-so"
+func NormalizeLocale(locale string) string {
+	return strings.ReplaceAll(strings.ToLower(strings.TrimSpace(locale)), "_", "-")
+}
+
+// resolveLocale picks the best available variant, falling back from the exact
+// locale to its base language and finally to DefaultLocale
+func resolveLocale(variants map[string]compiledTemplate, locale string) (string, bool) {
+	locale = NormalizeLocale(locale)
+	candidates := []string{locale}
+	if base, _, found := strings.Cut(locale, "-"); found {
+		candidates = append(candidates, base)
+	}
+	candidates = append(candidates, DefaultLocale)
+
+	for _, candidate := range candidates {
+		if _, ok := variants[candidate]; ok {
+			return candidate, true
+		}
+	}
+	return "", false
+}
+
+// RenderTemplate renders the title and body of a registered template for a locale
+func RenderTemplate(name, locale string, vars TemplateVars) (title, body string, err error) {
+	templatesMu.RLock()
+	variants, ok := templates[name]
+	templatesMu.RUnlock()
+	if !ok {
+		return "", "", fmt.Errorf("notification template %s not found", name)
+	}
+
+	resolved, ok := resolveLocale(variants, locale)
+	if !ok {
+		return "", "", fmt.Errorf("notification template %s has no variant for %s or %s", name, locale, DefaultLocale)
+	}
+	tmpl := variants[resolved]
+
+	var buf bytes.Buffer
+	if err = tmpl.title.Execute(&buf, vars); err != nil {
+		return "", "", fmt.Errorf("failed to render title of %s (%s): %w", name, resolved, err)
+	}
+	title = buf.String()
+
+	buf.Reset()
+	if err = tmpl.body.Execute(&buf, vars); err != nil {
+		return "", "", fmt.Errorf("failed to render body of %s (%s): %w", name, resolved, err)
+	}
+	body = buf.String()
+
+	return title, body, nil
+}
+
+func mustRegisterTemplate(name string, variants map[string]LocalizedTemplate) {
+	if err := RegisterTemplate(name, variants); err != nil {
+		panic(err)
+	}
+}
+
+func init() {
+	mustRegisterTemplate(TemplateStreakReminderMorning, map[string]LocalizedTemplate{
+		LocaleEnglish: {
+			Title: "Good Morning",
+			Body:  "{{if .Name}}{{.Name}}! {{end}}Don't forget to read Quran today to maintain your {{.Streak}}-day streak! Continue from page {{.TargetPage}}.",
+		},
+		LocaleSomali: {
+			Title: "Subax wanaagsan",
+			Body:  "{{if .Name}}{{.Name}}! {{end}}Ha iloobin inaad maanta Quraanka akhrido si aad u sii wadato {{.Streak}} maalmood oo isku xigta! Ka sii wad bogga {{.TargetPage}}.",
+		},
+		LocaleArabic: {
+			Title: "صباح الخير",
+			Body:  "{{if .Name}}{{.Name}}! {{end}}لا تنسَ قراءة القرآن اليوم للحفاظ على سلسلتك البالغة {{.Streak}} يومًا! تابع من الصفحة {{.TargetPage}}.",
+		},
+		LocaleTurkish: {
+			Title: "Günaydın",
+			Body:  "{{if .Name}}{{.Name}}! {{end}}{{.Streak}} günlük serini korumak için bugün Kur'an okumayı unutma! {{.TargetPage}}. sayfadan devam et.",
+		},
+		LocaleUrdu: {
+			Title: "صبح بخیر",
+			Body:  "{{if .Name}}{{.Name}}! {{end}}اپنا {{.Streak}} دن کا سلسلہ برقرار رکھنے کے لیے آج قرآن پڑھنا نہ بھولیں! صفحہ {{.TargetPage}} سے جاری رکھیں۔",
+		},
+	})
+
+	mustRegisterTemplate(TemplateStreakReminderEvening, map[string]LocalizedTemplate{
+		LocaleEnglish: {
+			Title: "Good Evening",
+			Body:  "{{if .Name}}{{.Name}}! {{end}}Don't forget to read Quran today to maintain your {{.Streak}}-day streak! You have read {{.PlanProgress}}% of the Quran so far.",
+		},
+		LocaleSomali: {
+			Title: "Fiid wanaagsan",
+			Body:  "{{if .Name}}{{.Name}}! {{end}}Ha iloobin inaad maanta Quraanka akhrido si aad u sii wadato {{.Streak}} maalmood oo isku xigta! Ilaa hadda waxaad akhriday {{.PlanProgress}}% Quraanka.",
+		},
+		LocaleArabic: {
+			Title: "مساء الخير",
+			Body:  "{{if .Name}}{{.Name}}! {{end}}لا تنسَ قراءة القرآن اليوم للحفاظ على سلسلتك البالغة {{.Streak}} يومًا! لقد قرأت {{.PlanProgress}}% من القرآن حتى الآن.",
+		},
+		LocaleTurkish: {
+			Title: "İyi akşamlar",
+			Body:  "{{if .Name}}{{.Name}}! {{end}}{{.Streak}} günlük serini korumak için bugün Kur'an okumayı unutma! Şimdiye kadar Kur'an'ın yüzde {{.PlanProgress}} kadarını okudun.",
+		},
+		LocaleUrdu: {
+			Title: "شام بخیر",
+			Body:  "{{if .Name}}{{.Name}}! {{end}}اپنا {{.Streak}} دن کا سلسلہ برقرار رکھنے کے لیے آج قرآن پڑھنا نہ بھولیں! آپ اب تک {{.PlanProgress}}% قرآن پڑھ چکے ہیں۔",
+		},
+	})
+	mustRegisterTemplate(TemplateStreakMilestone, map[string]LocalizedTemplate{
+		LocaleEnglish: {
+			Title: "{{.Streak}}-day streak!",
+			Body:  "{{if .Name}}{{.Name}}, {{end}}you have read Quran {{.Streak}} days in a row. Keep it up!",
+		},
+		LocaleSomali: {
+			Title: "{{.Streak}} maalmood oo isku xigta!",
+			Body:  "{{if .Name}}{{.Name}}, {{end}}waxaad Quraanka akhriday {{.Streak}} maalmood oo isku xigta. Sii wad!",
+		},
+		LocaleArabic: {
+			Title: "سلسلة {{.Streak}} يومًا!",
+			Body:  "{{if .Name}}{{.Name}}، {{end}}لقد قرأت القرآن {{.Streak}} يومًا متتاليًا. واصل!",
+		},
+		LocaleTurkish: {
+			Title: "{{.Streak}} günlük seri!",
+			Body:  "{{if .Name}}{{.Name}}, {{end}}{{.Streak}} gündür aralıksız Kur'an okuyorsun. Böyle devam et!",
+		},
+		LocaleUrdu: {
+			Title: "{{.Streak}} دن کا سلسلہ!",
+			Body:  "{{if .Name}}{{.Name}}، {{end}}آپ نے مسلسل {{.Streak}} دن قرآن پڑھا ہے۔ جاری رکھیں!",
+		},
+	})
+}
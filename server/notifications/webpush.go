@@ -0,0 +1,127 @@
+package notifications
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"sync"
+
+	webpush "github.com/SherClockHolmes/webpush-go"
+)
+
+// webPushTTL is how long the browser's push service keeps an undelivered message, in seconds
+const webPushTTL = 24 * 60 * 60
+
+// WebPushPusher sends to browser push subscriptions signed with VAPID keys
+type WebPushPusher struct {
+	publicKey   string
+	privateKey  string
+	subject     string
+	concurrency int
+}
+
+func NewWebPushPusher(publicKey, privateKey, subject string, concurrency int) *WebPushPusher {
+	if concurrency < 1 {
+		concurrency = DefaultSendConcurrency
+	}
+	return &WebPushPusher{
+		publicKey:   publicKey,
+		privateKey:  privateKey,
+		subject:     subject,
+		concurrency: concurrency,
+	}
+}
+
+// webPushPayload is what the service worker receives in the push event
+type webPushPayload struct {
+	Title string            `json:"title"`
+	Body  string            `json:"body"`
+	Image string            `json:"image,omitempty"`
+	Data  map[string]string `json:"data,omitempty"`
+}
+
+// Send implements Pusher.
+func (p *WebPushPusher) Send(ctx context.Context, messages []PushMessage) []PushResult {
+	results := make([]PushResult, len(messages))
+
+	sem := make(chan struct{}, p.concurrency)
+	var wg sync.WaitGroup
+	for i, msg := range messages {
+		wg.Add(1)
+		sem <- struct{}{}
+		go func(i int, msg PushMessage) {
+			defer wg.Done()
+			defer func() { <-sem }()
+			results[i] = p.send(ctx, msg)
+		}(i, msg)
+	}
+	wg.Wait()
+
+	return results
+}
+
+func (p *WebPushPusher) send(ctx context.Context, msg PushMessage) PushResult {
+	subscription := &webpush.Subscription{}
+	if err := json.Unmarshal([]byte(msg.Subscription), subscription); err != nil || subscription.Endpoint == "" {
+		return PushResult{Err: fmt.Errorf("invalid web push subscription: %v", err), Code: FCMErrorCodeInvalidToken}
+	}
+
+	payload, err := json.Marshal(webPushPayload{
+		Title: msg.Title,
+		Body:  msg.Body,
+		Image: msg.ImageURL,
+		Data:  msg.Data,
+	})
+	if err != nil {
+		return PushResult{Err: err, Code: FCMErrorCodeInvalidArgument}
+	}
+
+	urgency := webpush.UrgencyHigh
+	if msg.Priority != FCMPriorityHigh && msg.Priority != "" {
+		urgency = webpush.UrgencyNormal
+	}
+
+	resp, err := webpush.SendNotificationWithContext(ctx, payload, subscription, &webpush.Options{
+		Subscriber:      p.subject,
+		VAPIDPublicKey:  p.publicKey,
+		VAPIDPrivateKey: p.privateKey,
+		TTL:             webPushTTL,
+		Urgency:         urgency,
+		Topic:           msg.Topic,
+	})
+	if err != nil {
+		return PushResult{Err: err, Code: FCMErrorCodeServerUnavailable}
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode >= 200 && resp.StatusCode < 300 {
+		return PushResult{MessageID: resp.Header.Get("Location")}
+	}
+
+	body, _ := io.ReadAll(io.LimitReader(resp.Body, 512))
+	return PushResult{
+		Err:  fmt.Errorf("web push failed with %d: %s", resp.StatusCode, body),
+		Code: webPushErrorCode(resp.StatusCode),
+	}
+}
+
+// webPushErrorCode maps push service responses to the FCM codes the outbox understands
+func webPushErrorCode(status int) string {
+	switch {
+	case status == http.StatusNotFound || status == http.StatusGone:
+		// the subscription expired or the user unsubscribed
+		return FCMErrorCodeNotRegistered
+	case status == http.StatusUnauthorized || status == http.StatusForbidden:
+		return FCMErrorCodeThirdPartyAuth
+	case status == http.StatusTooManyRequests:
+		return FCMErrorCodeQuotaExceeded
+	case status >= 500:
+		return FCMErrorCodeServerUnavailable
+	case status >= 400:
+		return FCMErrorCodeInvalidArgument
+	default:
+		return FCMErrorCodeUnknown
+	}
+}
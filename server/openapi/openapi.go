@@ -0,0 +1,133 @@
+// Package openapi holds the contract of /api/v1. The document in openapi.yaml
+// is embedded in the binary, served as JSON, and enforced on requests by
+// middlewares.ValidateRequest. CheckRoutes keeps it and the router in sync.
+package openapi
+
+import (
+	"context"
+	_ "embed"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"sort"
+	"strings"
+
+	"github.com/getkin/kin-openapi/openapi3"
+	"github.com/getkin/kin-openapi/routers"
+	"github.com/gin-gonic/gin"
+)
+
+// BasePath is where the documented routes are mounted
+const BasePath = "/api/v1"
+
+//go:embed openapi.yaml
+var document []byte
+
+// Spec is the parsed document with its JSON form
+type Spec struct {
+	Doc  *openapi3.T
+	JSON []byte
+}
+
+// Load parses and validates the embedded document
+func Load(ctx context.Context) (*Spec, error) {
+	doc, err := openapi3.NewLoader().LoadFromData(document)
+	if err != nil {
+		return nil, fmt.Errorf("failed to parse the openapi document: %w", err)
+	}
+	if err := doc.Validate(ctx); err != nil {
+		return nil, fmt.Errorf("invalid openapi document: %w", err)
+	}
+
+	data, err := json.Marshal(doc)
+	if err != nil {
+		return nil, fmt.Errorf("failed to encode the openapi document: %w", err)
+	}
+
+	return &Spec{Doc: doc, JSON: data}, nil
+}
+
+// Serve writes the document
+func (s *Spec) Serve(c *gin.Context) {
+	c.Data(http.StatusOK, "application/json; charset=utf-8", s.JSON)
+}
+
+// Route finds the operation of a gin route, e.g. GET /api/v1/bookmarks/:pageNumber,
+// it returns false for routes outside BasePath or missing from the document
+func (s *Spec) Route(method, fullPath string) (*routers.Route, bool) {
+	path, ok := specPath(fullPath)
+	if !ok {
+		return nil, false
+	}
+
+	item := s.Doc.Paths.Value(path)
+	if item == nil {
+		return nil, false
+	}
+	op := item.GetOperation(method)
+	if op == nil {
+		return nil, false
+	}
+
+	return &routers.Route{
+		Spec:      s.Doc,
+		Path:      path,
+		PathItem:  item,
+		Method:    method,
+		Operation: op,
+	}, true
+}
+
+// CheckRoutes returns an error naming every route under BasePath that is not
+// documented and every documented operation that is not routed
+func (s *Spec) CheckRoutes(routes gin.RoutesInfo) error {
+	routed := map[string]bool{}
+	var errs []error
+
+	for _, route := range routes {
+		path, ok := specPath(route.Path)
+		if !ok || route.Method == http.MethodOptions {
+			continue
+		}
+		routed[route.Method+" "+path] = true
+		if _, ok := s.Route(route.Method, route.Path); !ok {
+			errs = append(errs, fmt.Errorf("%s %s is not documented", route.Method, route.Path))
+		}
+	}
+
+	var documented []string
+	for path, item := range s.Doc.Paths.Map() {
+		for method := range item.Operations() {
+			documented = append(documented, method+" "+path)
+		}
+	}
+	sort.Strings(documented)
+	for _, op := range documented {
+		if !routed[op] {
+			errs = append(errs, fmt.Errorf("%s is documented but not routed", op))
+		}
+	}
+
+	return errors.Join(errs...)
+}
+
+// specPath converts a gin path to a document path, e.g. /api/v1/bookmarks/:pageNumber
+// to /bookmarks/{pageNumber}
+func specPath(fullPath string) (string, bool) {
+	rest, ok := strings.CutPrefix(fullPath, BasePath)
+	if !ok || (rest != "" && rest[0] != '/') {
+		return "", false
+	}
+	if rest == "" {
+		rest = "/"
+	}
+
+	segments := strings.Split(rest, "/")
+	for i, segment := range segments {
+		if strings.HasPrefix(segment, ":") || strings.HasPrefix(segment, "*") {
+			segments[i] = "{" + segment[1:] + "}"
+		}
+	}
+	return strings.Join(segments, "/"), true
+}
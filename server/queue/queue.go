@@ -0,0 +1,502 @@
+// Package queue runs deferred per-user work from Redis. Jobs of one user run
+// one at a time in the order they were enqueued, jobs of different users run
+// in parallel.
+//
+// Each user with pending jobs has a list queue:user:<id> and appears once in
+// either queue:ready (waiting for a worker), queue:delayed (backing off after a
+// failure) or is owned by a worker (queue:owner:<id>). queue:active holds every
+// user with pending jobs so a user is never queued twice.
+package queue
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"math"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/boolow5/quran-app-api/logger"
+	"github.com/boolow5/quran-app-api/metrics"
+	"github.com/redis/go-redis/v9"
+)
+
+const (
+	keyReady   = "queue:ready"
+	keyDelayed = "queue:delayed"
+	keyActive  = "queue:active"
+	keyDead    = "queue:dead"
+
+	DefaultMaxAttempts = 5
+
+	// ownerTTL is how long a crashed worker keeps a user's jobs before the reaper frees them
+	ownerTTL = 60 * time.Second
+	// userBatchSize is how many jobs a worker runs for one user before giving others a turn
+	userBatchSize = 20
+	popTimeout    = 5 * time.Second
+	reapInterval  = time.Minute
+	retryBase     = 5 * time.Second
+	retryMax      = 10 * time.Minute
+	// deadLetterLimit caps the dead-letter list, the oldest entries are dropped
+	deadLetterLimit = 10000
+)
+
+func userKey(userID uint64) string  { return "queue:user:" + strconv.FormatUint(userID, 10) }
+func ownerKey(userID uint64) string { return "queue:owner:" + strconv.FormatUint(userID, 10) }
+
+// enqueueScript appends a job and makes the user ready unless it already has pending jobs
+var enqueueScript = redis.NewScript(`
+redis.call("RPUSH", KEYS[1], ARGV[1])
+if redis.call("SADD", KEYS[2], ARGV[2]) == 1 then
+	redis.call("RPUSH", KEYS[3], ARGV[2])
+end
+return 1
+`)
+
+// releaseScript hands a user back after a worker is done with it for now
+var releaseScript = redis.NewScript(`
+redis.call("DEL", KEYS[4])
+if redis.call("LLEN", KEYS[1]) == 0 then
+	redis.call("SREM", KEYS[2], ARGV[1])
+else
+	redis.call("RPUSH", KEYS[3], ARGV[1])
+end
+return 1
+`)
+
+// promoteScript moves users whose retry delay has passed back to the ready list
+var promoteScript = redis.NewScript(`
+local due = redis.call("ZRANGEBYSCORE", KEYS[1], "-inf", ARGV[1], "LIMIT", 0, 100)
+for _, id in ipairs(due) do
+	if redis.call("ZREM", KEYS[1], id) == 1 then
+		redis.call("RPUSH", KEYS[2], id)
+	end
+end
+return #due
+`)
+
+// Job is one unit of work for a user
+type Job struct {
+	ID          string          `json:"id"`
+	Type        string          `json:"type"`
+	UserID      uint64          `json:"user_id"`
+	Payload     json.RawMessage `json:"payload"`
+	Attempts    int             `json:"attempts"`
+	MaxAttempts int             `json:"max_attempts"`
+	EnqueuedAt  time.Time       `json:"enqueued_at"`
+	LastError   string          `json:"last_error,omitempty"`
+	FailedAt    *time.Time      `json:"failed_at,omitempty"`
+}
+
+// Handler runs a job of one type, returning an error retries the job
+type Handler func(ctx context.Context, job Job) error
+
+// Stats is a snapshot of the queue for the admin API
+type Stats struct {
+	ReadyUsers   int64 `json:"ready_users"`
+	DelayedUsers int64 `json:"delayed_users"`
+	ActiveUsers  int64 `json:"active_users"`
+	DeadJobs     int64 `json:"dead_jobs"`
+}
+
+type Queue struct {
+	redis      *redis.Client
+	instanceID string
+
+	mu       sync.RWMutex
+	handlers map[string]Handler
+}
+
+func New(client *redis.Client) *Queue {
+	b := make([]byte, 4)
+	rand.Read(b)
+	return &Queue{
+		redis:      client,
+		instanceID: hex.EncodeToString(b),
+		handlers:   map[string]Handler{},
+	}
+}
+
+// Handle registers the handler of a job type
+func (q *Queue) Handle(jobType string, handler Handler) {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	q.handlers[jobType] = handler
+}
+
+// Enqueue adds a job to the end of the user's queue
+func (q *Queue) Enqueue(ctx context.Context, userID uint64, jobType string, payload interface{}) error {
+	raw, err := json.Marshal(payload)
+	if err != nil {
+		return fmt.Errorf("invalid payload for %s: %w", jobType, err)
+	}
+
+	id := make([]byte, 8)
+	if _, err := rand.Read(id); err != nil {
+		return fmt.Errorf("failed to generate job id: %w", err)
+	}
+
+	job, err := json.Marshal(Job{
+		ID:          hex.EncodeToString(id),
+		Type:        jobType,
+		UserID:      userID,
+		Payload:     raw,
+		MaxAttempts: DefaultMaxAttempts,
+		EnqueuedAt:  time.Now().UTC(),
+	})
+	if err != nil {
+		return err
+	}
+
+	err = enqueueScript.Run(ctx, q.redis, []string{userKey(userID), keyActive, keyReady}, job, userID).Err()
+	if err != nil {
+		return fmt.Errorf("failed to enqueue %s for user %d: %w", jobType, userID, err)
+	}
+
+	return nil
+}
+
+// Start runs workers goroutines and the retry and reaper loops. It blocks until
+// ctx is cancelled and the workers finished their current job.
+func (q *Queue) Start(ctx context.Context, workers int) {
+	if workers < 1 {
+		workers = 1
+	}
+	logger.For(ctx, "queue.Start").Infof("Started %d workers", workers)
+
+	var wg sync.WaitGroup
+	for i := 0; i < workers; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			q.work(ctx)
+		}()
+	}
+
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		q.maintain(ctx)
+	}()
+
+	wg.Wait()
+	logger.For(ctx, "queue.Start").Info("Stopped")
+}
+
+func (q *Queue) work(ctx context.Context) {
+	for ctx.Err() == nil {
+		res, err := q.redis.BLPop(ctx, popTimeout, keyReady).Result()
+		if errors.Is(err, redis.Nil) || ctx.Err() != nil {
+			continue
+		}
+		if err != nil {
+			logger.For(ctx, "queue.work").Errorf("Failed to pop ready user: %v", err)
+			time.Sleep(time.Second)
+			continue
+		}
+
+		userID, err := strconv.ParseUint(res[1], 10, 64)
+		if err != nil {
+			logger.For(ctx, "queue.work").Warnf("Dropping invalid user id %q", res[1])
+			continue
+		}
+		q.processUser(ctx, userID)
+	}
+}
+
+// processUser runs the user's jobs in order until the queue is empty, a job
+// has to be retried later, or the batch size is reached
+func (q *Queue) processUser(ctx context.Context, userID uint64) {
+	// the background context keeps the bookkeeping going when ctx is cancelled mid-job
+	bg := context.Background()
+	q.redis.Set(bg, ownerKey(userID), q.instanceID, ownerTTL)
+
+	// a slow job must not look like a crashed worker to the reaper
+	keepAlive, stop := context.WithCancel(bg)
+	defer stop()
+	go q.keepOwner(keepAlive, userID)
+
+	for i := 0; i < userBatchSize && ctx.Err() == nil; i++ {
+		raw, err := q.redis.LIndex(bg, userKey(userID), 0).Result()
+		if errors.Is(err, redis.Nil) {
+			break
+		}
+		if err != nil {
+			logger.For(ctx, "queue.processUser").Errorf("Failed to read jobs of user %d: %v", userID, err)
+			break
+		}
+
+		var job Job
+		if err := json.Unmarshal([]byte(raw), &job); err != nil {
+			logger.For(ctx, "queue.processUser").Warnf("Dropping malformed job of user %d: %v", userID, err)
+			q.redis.LPop(bg, userKey(userID))
+			continue
+		}
+
+		log := logger.For(ctx, "queue.processUser").WithFields(logger.Fields{
+			"job_id":   job.ID,
+			"job_type": job.Type,
+			"user_id":  userID,
+			"attempt":  job.Attempts + 1,
+		})
+		runErr := q.run(logger.WithContext(ctx, log), job)
+		q.redis.Expire(bg, ownerKey(userID), ownerTTL)
+		if runErr == nil {
+			metrics.QueueJobs.WithLabelValues(job.Type, "succeeded").Inc()
+			q.redis.LPop(bg, userKey(userID))
+			continue
+		}
+
+		job.Attempts++
+		job.LastError = runErr.Error()
+		if job.Attempts >= job.MaxAttempts {
+			metrics.QueueJobs.WithLabelValues(job.Type, "dead").Inc()
+			log.WithError(runErr).Errorf("Job failed %d times, moving to dead letters", job.Attempts)
+			q.bury(bg, job)
+			continue
+		}
+
+		// the job stays at the head so later jobs of the user wait for it
+		delay := retryDelay(job.Attempts)
+		metrics.QueueJobs.WithLabelValues(job.Type, "retried").Inc()
+		log.WithError(runErr).Warnf("Job failed, retrying in %s", delay)
+		updated, _ := json.Marshal(job)
+		pipe := q.redis.TxPipeline()
+		pipe.LSet(bg, userKey(userID), 0, updated)
+		pipe.ZAdd(bg, keyDelayed, redis.Z{Score: float64(time.Now().Add(delay).Unix()), Member: userID})
+		pipe.Del(bg, ownerKey(userID))
+		if _, err := pipe.Exec(bg); err != nil {
+			logger.For(ctx, "queue.processUser").Errorf("Failed to schedule retry for user %d: %v", userID, err)
+		}
+		return
+	}
+
+	err := releaseScript.Run(bg, q.redis, []string{userKey(userID), keyActive, keyReady, ownerKey(userID)}, userID).Err()
+	if err != nil {
+		logger.For(ctx, "queue.processUser").Errorf("Failed to release user %d: %v", userID, err)
+	}
+}
+
+// keepOwner extends the owner key of a user every third of ownerTTL until ctx
+// is done. Expire never recreates the key once it is released.
+func (q *Queue) keepOwner(ctx context.Context, userID uint64) {
+	ticker := time.NewTicker(ownerTTL / 3)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			if err := q.redis.Expire(ctx, ownerKey(userID), ownerTTL).Err(); err != nil && ctx.Err() == nil {
+				// a single failed round trip is fine, the key is still valid for 2/3 of its ttl
+				logger.For(ctx, "queue.keepOwner").Errorf("Failed to extend owner of user %d: %v", userID, err)
+			}
+		}
+	}
+}
+
+func (q *Queue) run(ctx context.Context, job Job) (err error) {
+	q.mu.RLock()
+	handler, ok := q.handlers[job.Type]
+	q.mu.RUnlock()
+	if !ok {
+		return fmt.Errorf("no handler for job type %s", job.Type)
+	}
+
+	defer func() {
+		if r := recover(); r != nil {
+			err = fmt.Errorf("panic: %v", r)
+		}
+	}()
+	return handler(ctx, job)
+}
+
+// bury moves the head job of the user to the dead-letter list
+func (q *Queue) bury(ctx context.Context, job Job) {
+	now := time.Now().UTC()
+	job.FailedAt = &now
+	raw, _ := json.Marshal(job)
+
+	pipe := q.redis.TxPipeline()
+	pipe.LPop(ctx, userKey(job.UserID))
+	pipe.LPush(ctx, keyDead, raw)
+	pipe.LTrim(ctx, keyDead, 0, deadLetterLimit-1)
+	if _, err := pipe.Exec(ctx); err != nil {
+		logger.For(ctx, "queue.bury").Errorf("Failed to move job %s to dead letters: %v", job.ID, err)
+	}
+}
+
+// maintain promotes users whose retry is due and frees users of crashed workers
+func (q *Queue) maintain(ctx context.Context) {
+	ticker := time.NewTicker(time.Second)
+	defer ticker.Stop()
+	lastReap := time.Now()
+	suspects := map[string]bool{}
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+
+		err := promoteScript.Run(ctx, q.redis, []string{keyDelayed, keyReady}, time.Now().Unix()).Err()
+		if err != nil && ctx.Err() == nil {
+			logger.For(ctx, "queue.maintain").Errorf("Failed to promote delayed users: %v", err)
+		}
+
+		if time.Since(lastReap) >= reapInterval {
+			lastReap = time.Now()
+			suspects = q.reap(ctx, suspects)
+		}
+	}
+}
+
+// reap re-queues users that have pending jobs but are neither ready, delayed nor
+// owned. A user is only re-queued after two scans in a row, which leaves time
+// for a worker that just popped it to take ownership.
+func (q *Queue) reap(ctx context.Context, suspects map[string]bool) map[string]bool {
+	next := map[string]bool{}
+
+	iter := q.redis.SScan(ctx, keyActive, 0, "", 500).Iterator()
+	for iter.Next(ctx) {
+		id := iter.Val()
+		userID, err := strconv.ParseUint(id, 10, 64)
+		if err != nil {
+			continue
+		}
+
+		owned, _ := q.redis.Exists(ctx, ownerKey(userID)).Result()
+		if owned > 0 {
+			continue
+		}
+		if _, err := q.redis.ZScore(ctx, keyDelayed, id).Result(); err == nil {
+			continue
+		}
+		if _, err := q.redis.LPos(ctx, keyReady, id, redis.LPosArgs{}).Result(); err == nil {
+			continue
+		}
+
+		if !suspects[id] {
+			next[id] = true
+			continue
+		}
+		logger.For(ctx, "queue.reap").Infof("Re-queueing orphaned jobs of user %d", userID)
+		q.redis.RPush(ctx, keyReady, id)
+	}
+	if err := iter.Err(); err != nil && ctx.Err() == nil {
+		logger.For(ctx, "queue.reap").Errorf("Failed to scan active users: %v", err)
+	}
+
+	return next
+}
+
+// Stats returns the current size of the queue
+func (q *Queue) Stats(ctx context.Context) (Stats, error) {
+	pipe := q.redis.Pipeline()
+	ready := pipe.LLen(ctx, keyReady)
+	delayed := pipe.ZCard(ctx, keyDelayed)
+	active := pipe.SCard(ctx, keyActive)
+	dead := pipe.LLen(ctx, keyDead)
+	if _, err := pipe.Exec(ctx); err != nil {
+		return Stats{}, fmt.Errorf("failed to get queue stats: %w", err)
+	}
+
+	return Stats{
+		ReadyUsers:   ready.Val(),
+		DelayedUsers: delayed.Val(),
+		ActiveUsers:  active.Val(),
+		DeadJobs:     dead.Val(),
+	}, nil
+}
+
+// DeadJobs returns the latest dead-letter jobs
+func (q *Queue) DeadJobs(ctx context.Context, limit int64) ([]Job, error) {
+	raws, err := q.redis.LRange(ctx, keyDead, 0, limit-1).Result()
+	if err != nil {
+		return nil, fmt.Errorf("failed to get dead jobs: %w", err)
+	}
+
+	jobs := make([]Job, 0, len(raws))
+	for _, raw := range raws {
+		var job Job
+		if err := json.Unmarshal([]byte(raw), &job); err == nil {
+			jobs = append(jobs, job)
+		}
+	}
+	return jobs, nil
+}
+
+// RetryDead moves a dead-letter job back to the end of its user's queue with
+// fresh attempts, it returns false if no dead job has that id
+func (q *Queue) RetryDead(ctx context.Context, id string) (bool, error) {
+	raws, err := q.redis.LRange(ctx, keyDead, 0, -1).Result()
+	if err != nil {
+		return false, fmt.Errorf("failed to get dead jobs: %w", err)
+	}
+
+	for _, raw := range raws {
+		var job Job
+		if err := json.Unmarshal([]byte(raw), &job); err != nil || job.ID != id {
+			continue
+		}
+
+		removed, err := q.redis.LRem(ctx, keyDead, 1, raw).Result()
+		if err != nil {
+			return false, fmt.Errorf("failed to remove dead job: %w", err)
+		}
+		if removed == 0 {
+			// retried by someone else in the meantime
+			return false, nil
+		}
+
+		job.Attempts = 0
+		job.LastError = ""
+		job.FailedAt = nil
+		updated, _ := json.Marshal(job)
+		err = enqueueScript.Run(ctx, q.redis, []string{userKey(job.UserID), keyActive, keyReady}, updated, job.UserID).Err()
+		if err != nil {
+			return false, fmt.Errorf("failed to re-enqueue job %s: %w", id, err)
+		}
+		return true, nil
+	}
+
+	return false, nil
+}
+
+// DropUser deletes the pending and dead-letter jobs of a user, for accounts
+// being purged. A worker holding the user finds the queue empty and lets go.
+func (q *Queue) DropUser(ctx context.Context, userID uint64) error {
+	if err := q.redis.Del(ctx, userKey(userID)).Err(); err != nil {
+		return fmt.Errorf("failed to drop jobs of user %d: %w", userID, err)
+	}
+
+	raws, err := q.redis.LRange(ctx, keyDead, 0, -1).Result()
+	if err != nil {
+		return fmt.Errorf("failed to get dead jobs: %w", err)
+	}
+	for _, raw := range raws {
+		var job Job
+		if err := json.Unmarshal([]byte(raw), &job); err != nil || job.UserID != userID {
+			continue
+		}
+		if err := q.redis.LRem(ctx, keyDead, 1, raw).Err(); err != nil {
+			return fmt.Errorf("failed to remove dead job %s: %w", job.ID, err)
+		}
+	}
+	return nil
+}
+
+// retryDelay backs off exponentially from retryBase up to retryMax
+func retryDelay(attempt int) time.Duration {
+	delay := time.Duration(float64(retryBase) * math.Pow(2, float64(attempt-1)))
+	if delay > retryMax || delay <= 0 {
+		return retryMax
+	}
+	return delay
+}
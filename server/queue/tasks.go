@@ -0,0 +1,113 @@
+package queue
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"time"
+
+	"github.com/boolow5/quran-app-api/account"
+	"github.com/boolow5/quran-app-api/db"
+	"github.com/boolow5/quran-app-api/notifications"
+	"github.com/boolow5/quran-app-api/score"
+	"github.com/boolow5/quran-app-api/streak"
+)
+
+const (
+	TypeRecomputeSummary = "recompute_summary"
+	TypeRecomputeScore   = "recompute_score"
+	TypeMilestonePush    = "milestone_push"
+	TypeBuildExport      = "build_export"
+)
+
+// RecomputeSummary rebuilds the daily summary and streak of a user for a day
+type RecomputeSummary struct {
+	Date time.Time `json:"date"`
+}
+
+// RecomputeScore rebuilds the daily score of a user, Date is YYYY-MM-DD
+type RecomputeScore struct {
+	Date string `json:"date"`
+}
+
+// MilestonePush congratulates a user on reaching a streak milestone
+type MilestonePush struct {
+	Streak int `json:"streak"`
+}
+
+// BuildExport builds the archive of a data export
+type BuildExport struct {
+	ExportID uint64 `json:"export_id"`
+}
+
+// EnqueueReadingUpdate queues the work that follows a reading event, the
+// summary runs before the score because the score uses the streak
+func (q *Queue) EnqueueReadingUpdate(ctx context.Context, userID uint64, date time.Time) error {
+	err := q.Enqueue(ctx, userID, TypeRecomputeSummary, RecomputeSummary{Date: date})
+	if err != nil {
+		return err
+	}
+	return q.Enqueue(ctx, userID, TypeRecomputeScore, RecomputeScore{Date: date.Format("2006-01-02")})
+}
+
+// RegisterTasks registers the handlers of the typed jobs
+func (q *Queue) RegisterTasks(db db.Database) {
+	q.Handle(TypeRecomputeSummary, func(ctx context.Context, job Job) error {
+		var payload RecomputeSummary
+		if err := json.Unmarshal(job.Payload, &payload); err != nil {
+			return fmt.Errorf("invalid payload: %w", err)
+		}
+
+		if _, err := streak.UpdateDailySummary(ctx, db, job.UserID, payload.Date, streak.Cause{Trigger: streak.TriggerReadEvent}); err != nil {
+			return err
+		}
+
+		// the milestone is read from the streak events of the day, not from
+		// the streak before and after, so a retry after a failed Enqueue
+		// still finds it. SendStreakMilestone sends each milestone once.
+		reached, err := streak.GetReachedOn(ctx, db, job.UserID, payload.Date)
+		if err != nil {
+			return err
+		}
+		if streak.IsMilestone(reached) {
+			return q.Enqueue(ctx, job.UserID, TypeMilestonePush, MilestonePush{Streak: reached})
+		}
+		return nil
+	})
+
+	q.Handle(TypeRecomputeScore, func(ctx context.Context, job Job) error {
+		var payload RecomputeScore
+		if err := json.Unmarshal(job.Payload, &payload); err != nil {
+			return fmt.Errorf("invalid payload: %w", err)
+		}
+
+		_, err := score.RecomputeUserScore(ctx, db, job.UserID, payload.Date)
+		return err
+	})
+
+	q.Handle(TypeMilestonePush, func(ctx context.Context, job Job) error {
+		var payload MilestonePush
+		if err := json.Unmarshal(job.Payload, &payload); err != nil {
+			return fmt.Errorf("invalid payload: %w", err)
+		}
+
+		return notifications.SendStreakMilestone(ctx, db, job.UserID, payload.Streak)
+	})
+
+	q.Handle(TypeBuildExport, func(ctx context.Context, job Job) error {
+		var payload BuildExport
+		if err := json.Unmarshal(job.Payload, &payload); err != nil {
+			return fmt.Errorf("invalid payload: %w", err)
+		}
+
+		err := account.BuildExport(ctx, db, job.UserID, payload.ExportID)
+		if err != nil && job.Attempts+1 >= job.MaxAttempts {
+			// the last attempt, the user should see it failed rather than wait forever
+			if failErr := account.FailExport(ctx, db, payload.ExportID, err); failErr != nil {
+				return errors.Join(err, failErr)
+			}
+		}
+		return err
+	})
+}
@@ -0,0 +1,58 @@
+package ratelimit
+
+import (
+	"net"
+	"strings"
+)
+
+// Allowlist holds the internal callers that are never limited, by IP, CIDR or
+// Firebase UID
+type Allowlist struct {
+	nets []*net.IPNet
+	uids map[string]bool
+}
+
+// NewAllowlist sorts entries into networks and UIDs, anything that is not an
+// IP or a CIDR is taken as a UID
+func NewAllowlist(entries []string) *Allowlist {
+	a := &Allowlist{uids: map[string]bool{}}
+	for _, entry := range entries {
+		entry = strings.TrimSpace(entry)
+		if entry == "" {
+			continue
+		}
+		if _, network, err := net.ParseCIDR(entry); err == nil {
+			a.nets = append(a.nets, network)
+			continue
+		}
+		if ip := net.ParseIP(entry); ip != nil {
+			bits := 8 * len(ip)
+			if ip.To4() != nil {
+				ip, bits = ip.To4(), 32
+			}
+			a.nets = append(a.nets, &net.IPNet{IP: ip, Mask: net.CIDRMask(bits, bits)})
+			continue
+		}
+		a.uids[entry] = true
+	}
+	return a
+}
+
+// AllowsIP reports whether ip is in one of the networks
+func (a *Allowlist) AllowsIP(ip string) bool {
+	parsed := net.ParseIP(ip)
+	if parsed == nil {
+		return false
+	}
+	for _, network := range a.nets {
+		if network.Contains(parsed) {
+			return true
+		}
+	}
+	return false
+}
+
+// AllowsUID reports whether uid is listed
+func (a *Allowlist) AllowsUID(uid string) bool {
+	return uid != "" && a.uids[uid]
+}
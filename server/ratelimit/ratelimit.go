@@ -0,0 +1,162 @@
+// Package ratelimit is a token bucket limiter in Redis shared by every
+// replica. A bucket holds up to Burst tokens and refills at Rate per second,
+// every request takes one token from each of its buckets.
+package ratelimit
+
+import (
+	"context"
+	"fmt"
+	"math"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/redis/go-redis/v9"
+)
+
+const keyPrefix = "ratelimit:"
+
+// takeScript takes a token from every bucket in KEYS, or from none of them when
+// one is empty. It uses the Redis clock so replicas with skewed clocks agree.
+// It returns whether the request is allowed, the milliseconds until it would
+// be and the tokens left in the emptiest bucket.
+var takeScript = redis.NewScript(`
+local rate = tonumber(ARGV[1])
+local burst = tonumber(ARGV[2])
+local ttl = tonumber(ARGV[3])
+local t = redis.call("TIME")
+local now = tonumber(t[1]) * 1000 + math.floor(tonumber(t[2]) / 1000)
+
+local tokens = {}
+local wait = 0
+local remaining = burst
+for i, key in ipairs(KEYS) do
+	local bucket = redis.call("HMGET", key, "tokens", "ts")
+	local available = tonumber(bucket[1]) or burst
+	local ts = tonumber(bucket[2]) or now
+	available = math.min(burst, available + math.max(0, now - ts) * rate / 1000)
+	tokens[i] = available
+	if available < 1 then
+		wait = math.max(wait, math.ceil((1 - available) * 1000 / rate))
+	end
+	remaining = math.min(remaining, available)
+end
+
+local allowed = 0
+if wait == 0 then
+	allowed = 1
+	remaining = remaining - 1
+end
+for i, key in ipairs(KEYS) do
+	local left = tokens[i]
+	if allowed == 1 then
+		left = left - 1
+	end
+	redis.call("HSET", key, "tokens", tostring(left), "ts", now)
+	redis.call("PEXPIRE", key, ttl)
+end
+return {allowed, wait, math.floor(remaining)}
+`)
+
+// Limit is the size and refill rate of a bucket
+type Limit struct {
+	// Rate is the tokens added per second
+	Rate float64
+	// Burst is the most tokens a bucket holds
+	Burst int
+}
+
+// Unlimited reports whether the limit lets everything through
+func (l Limit) Unlimited() bool {
+	return l.Rate <= 0 || l.Burst <= 0
+}
+
+func (l Limit) String() string {
+	if l.Unlimited() {
+		return "unlimited"
+	}
+	return fmt.Sprintf("%g/s burst=%d", l.Rate, l.Burst)
+}
+
+// ParseLimit reads "<requests>/<duration>" with an optional " burst=<n>",
+// e.g. "120/1m burst=60". The burst defaults to the requests. An empty string
+// is unlimited.
+func ParseLimit(s string) (Limit, error) {
+	fields := strings.Fields(s)
+	if len(fields) == 0 {
+		return Limit{}, nil
+	}
+	if len(fields) > 2 {
+		return Limit{}, fmt.Errorf("%q is not <requests>/<duration> [burst=<n>]", s)
+	}
+
+	count, period, ok := strings.Cut(fields[0], "/")
+	if !ok {
+		return Limit{}, fmt.Errorf("%q is not <requests>/<duration> [burst=<n>]", s)
+	}
+	n, err := strconv.Atoi(count)
+	if err != nil || n < 1 {
+		return Limit{}, fmt.Errorf("%q: requests must be a positive whole number", s)
+	}
+	d, err := time.ParseDuration(period)
+	if err != nil || d <= 0 {
+		return Limit{}, fmt.Errorf("%q: %q is not a positive duration", s, period)
+	}
+
+	limit := Limit{Rate: float64(n) / d.Seconds(), Burst: n}
+	if len(fields) == 2 {
+		raw, ok := strings.CutPrefix(fields[1], "burst=")
+		burst, err := strconv.Atoi(raw)
+		if !ok || err != nil || burst < 1 {
+			return Limit{}, fmt.Errorf("%q: burst must be burst=<positive whole number>", s)
+		}
+		limit.Burst = burst
+	}
+	return limit, nil
+}
+
+// Result is the outcome of Take
+type Result struct {
+	Allowed bool
+	// RetryAfter is how long until the request would be allowed
+	RetryAfter time.Duration
+	// Remaining is the tokens left in the emptiest bucket
+	Remaining int
+}
+
+type Limiter struct {
+	redis *redis.Client
+}
+
+func New(client *redis.Client) *Limiter {
+	return &Limiter{redis: client}
+}
+
+// Take takes a token from the bucket of every key under limit. Keys name the
+// group and the identity, e.g. "streaks:user:42".
+func (l *Limiter) Take(ctx context.Context, limit Limit, keys ...string) (Result, error) {
+	if limit.Unlimited() || len(keys) == 0 {
+		return Result{Allowed: true, Remaining: math.MaxInt32}, nil
+	}
+
+	redisKeys := make([]string, len(keys))
+	for i, key := range keys {
+		redisKeys[i] = keyPrefix + key
+	}
+	// an idle bucket is full again after burst/rate, there is no need to keep it longer
+	ttl := int64(math.Ceil(float64(limit.Burst)/limit.Rate*1000)) + 1000
+
+	values, err := takeScript.Run(ctx, l.redis, redisKeys, limit.Rate, limit.Burst, ttl).Int64Slice()
+	if err != nil {
+		return Result{}, fmt.Errorf("failed to take a token for %v: %w", keys, err)
+	}
+	if len(values) != 3 {
+		return Result{}, fmt.Errorf("unexpected rate limit reply %v", values)
+	}
+
+	return Result{
+		Allowed:    values[0] == 1,
+		RetryAfter: time.Duration(values[1]) * time.Millisecond,
+		Remaining:  int(values[2]),
+	}, nil
+}
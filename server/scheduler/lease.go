@@ -0,0 +1,128 @@
+package scheduler
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"time"
+
+	"github.com/boolow5/quran-app-api/logger"
+	"github.com/redis/go-redis/v9"
+)
+
+// renewScript extends a lease only if it is still held by the same owner
+var renewScript = redis.NewScript(`
+if redis.call("GET", KEYS[1]) == ARGV[1] then
+	return redis.call("PEXPIRE", KEYS[1], ARGV[2])
+end
+return 0
+`)
+
+// releaseScript deletes a lease only if it is still held by the same owner
+var releaseScript = redis.NewScript(`
+if redis.call("GET", KEYS[1]) == ARGV[1] then
+	return redis.call("DEL", KEYS[1])
+end
+return 0
+`)
+
+// Lease is a lock in Redis that expires unless its owner renews it
+type Lease struct {
+	client *redis.Client
+	key    string
+	token  string
+	ttl    time.Duration
+}
+
+// AcquireLease takes the lease on key for ttl, ok is false if another owner holds it
+func AcquireLease(ctx context.Context, client *redis.Client, key, owner string, ttl time.Duration) (lease *Lease, ok bool, err error) {
+	token, err := newToken(owner)
+	if err != nil {
+		return nil, false, err
+	}
+
+	ok, err = client.SetNX(ctx, key, token, ttl).Result()
+	if err != nil {
+		return nil, false, fmt.Errorf("failed to acquire lease %s: %w", key, err)
+	}
+	if !ok {
+		return nil, false, nil
+	}
+
+	return &Lease{client: client, key: key, token: token, ttl: ttl}, true, nil
+}
+
+// Renew extends the lease by its ttl, it returns false once the lease was lost
+func (l *Lease) Renew(ctx context.Context) (bool, error) {
+	renewed, err := renewScript.Run(ctx, l.client, []string{l.key}, l.token, l.ttl.Milliseconds()).Int()
+	if err != nil {
+		return false, fmt.Errorf("failed to renew lease %s: %w", l.key, err)
+	}
+	return renewed == 1, nil
+}
+
+// Release gives the lease up early, it does nothing if the lease already expired
+func (l *Lease) Release(ctx context.Context) error {
+	err := releaseScript.Run(ctx, l.client, []string{l.key}, l.token).Err()
+	if err != nil && !errors.Is(err, redis.Nil) {
+		return fmt.Errorf("failed to release lease %s: %w", l.key, err)
+	}
+	return nil
+}
+
+// KeepAlive renews the lease every third of its ttl until ctx is done. lost is
+// called once if the lease could not be renewed.
+func (l *Lease) KeepAlive(ctx context.Context, lost func()) {
+	ticker := time.NewTicker(l.ttl / 3)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			renewed, err := l.Renew(ctx)
+			if err != nil {
+				logger.For(ctx, "scheduler.KeepAlive").Error(err)
+				// a single failed round trip is fine, the lease is still valid for 2/3 of its ttl
+				continue
+			}
+			if !renewed {
+				lost()
+				return
+			}
+		}
+	}
+}
+
+// Owner returns who holds the lease on key, empty if nobody does
+func Owner(ctx context.Context, client *redis.Client, key string) (string, error) {
+	token, err := client.Get(ctx, key).Result()
+	if errors.Is(err, redis.Nil) {
+		return "", nil
+	}
+	if err != nil {
+		return "", err
+	}
+	return tokenOwner(token), nil
+}
+
+// tokens are "<owner>/<random>" so a restarted process never mistakes an old lease for its own
+func newToken(owner string) (string, error) {
+	b := make([]byte, 8)
+	if _, err := rand.Read(b); err != nil {
+		return "", fmt.Errorf("failed to generate lease token: %w", err)
+	}
+	return owner + "/" + hex.EncodeToString(b), nil
+}
+
+func tokenOwner(token string) string {
+	for i := len(token) - 1; i >= 0; i-- {
+		if token[i] == '/' {
+			return token[:i]
+		}
+	}
+	return token
+}
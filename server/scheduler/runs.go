@@ -0,0 +1,114 @@
+package scheduler
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+	"time"
+
+	"github.com/boolow5/quran-app-api/db"
+)
+
+type RunStatus string
+
+const (
+	RunStatusRunning   RunStatus = "running"
+	RunStatusSucceeded RunStatus = "succeeded"
+	RunStatusFailed    RunStatus = "failed"
+	// RunStatusSkipped is a scheduled time that was missed for longer than the job's MaxLateness
+	RunStatusSkipped RunStatus = "skipped"
+	// RunStatusAbandoned is a run whose process died before it finished
+	RunStatusAbandoned RunStatus = "abandoned"
+)
+
+// JobRun is one row of the job_runs history
+type JobRun struct {
+	ID           uint64         `json:"id" db:"id"`
+	JobName      string         `json:"job_name" db:"job_name"`
+	ScheduledFor time.Time      `json:"scheduled_for" db:"scheduled_for"`
+	InstanceID   string         `json:"instance_id" db:"instance_id"`
+	Status       RunStatus      `json:"status" db:"status"`
+	Error        sql.NullString `json:"error" db:"error"`
+	StartedAt    time.Time      `json:"started_at" db:"started_at"`
+	FinishedAt   sql.NullTime   `json:"finished_at" db:"finished_at"`
+	DurationMs   int64          `json:"duration_ms" db:"duration_ms"`
+}
+
+// GetJobRuns returns the latest runs, of one job if name is not empty
+func GetJobRuns(ctx context.Context, db db.Database, name string, limit int) ([]JobRun, error) {
+	query := "SELECT * FROM job_runs"
+	args := []interface{}{}
+	if name != "" {
+		query += " WHERE job_name = ?"
+		args = append(args, name)
+	}
+	query += " ORDER BY scheduled_for DESC, id DESC LIMIT ?"
+	args = append(args, limit)
+
+	var runs []JobRun
+	err := db.Select(ctx, &runs, query, args...)
+	if err != nil {
+		return nil, fmt.Errorf("failed to get job runs: %w", err)
+	}
+
+	return runs, nil
+}
+
+// lastScheduled is the latest scheduled time recorded for a job, zero if it never ran
+func lastScheduled(ctx context.Context, db db.Database, name string) (time.Time, error) {
+	var last sql.NullTime
+	err := db.Get(ctx, &last, "SELECT MAX(scheduled_for) FROM job_runs WHERE job_name = ?", name)
+	if err != nil {
+		return time.Time{}, err
+	}
+	return last.Time, nil
+}
+
+// startRun records a run, started is false if a run for the same scheduled time already exists
+func startRun(ctx context.Context, db db.Database, name string, scheduledFor time.Time, instanceID string, status RunStatus, runError string) (started bool, err error) {
+	var errValue interface{}
+	if runError != "" {
+		errValue = runError
+	}
+
+	query := `
+	INSERT IGNORE INTO job_runs (job_name, scheduled_for, instance_id, status, error)
+	VALUES (?, ?, ?, ?, ?)
+	`
+	inserted, err := db.Exec(ctx, query, name, scheduledFor.UTC(), instanceID, status, errValue)
+	if err != nil {
+		return false, fmt.Errorf("failed to record run of %s: %w", name, err)
+	}
+
+	return inserted > 0, nil
+}
+
+func finishRun(ctx context.Context, db db.Database, name string, scheduledFor time.Time, status RunStatus, duration time.Duration, runError string) error {
+	var errValue interface{}
+	if runError != "" {
+		errValue = runError
+	}
+
+	query := `
+	UPDATE job_runs
+	SET status = ?, error = ?, finished_at = NOW(), duration_ms = ?
+	WHERE job_name = ? AND scheduled_for = ?
+	`
+	_, err := db.Exec(ctx, query, status, errValue, duration.Milliseconds(), name, scheduledFor.UTC())
+	if err != nil {
+		return fmt.Errorf("failed to finish run of %s: %w", name, err)
+	}
+
+	return nil
+}
+
+// abandonRuns marks runs left as running by a process that died, the caller must hold the job's lease
+func abandonRuns(ctx context.Context, db db.Database, name string) error {
+	query := `
+	UPDATE job_runs
+	SET status = ?, error = 'process stopped before the run finished', finished_at = NOW()
+	WHERE job_name = ? AND status = ?
+	`
+	_, err := db.Exec(ctx, query, RunStatusAbandoned, name, RunStatusRunning)
+	return err
+}
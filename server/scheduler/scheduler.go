@@ -0,0 +1,344 @@
+// Package scheduler runs cron jobs on exactly one replica. Replicas elect a leader
+// through a lease in Redis, only the leader starts jobs, and every run takes a
+// per-job lease and a unique job_runs row so a scheduled time is never run twice.
+package scheduler
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"fmt"
+	"os"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/boolow5/quran-app-api/db"
+	"github.com/boolow5/quran-app-api/logger"
+	"github.com/boolow5/quran-app-api/metrics"
+	"github.com/redis/go-redis/v9"
+	"github.com/robfig/cron/v3"
+)
+
+const (
+	// LeaderKey is the Redis key of the leader lease
+	LeaderKey = "scheduler:leader"
+
+	leaderTTL    = 30 * time.Second
+	jobLeaseTTL  = 60 * time.Second
+	tickInterval = 15 * time.Second
+
+	defaultTimeout     = time.Hour
+	defaultMaxLateness = time.Hour
+)
+
+// Job is a function run on a cron schedule
+type Job struct {
+	Name     string
+	Schedule string // standard 5 field cron expression
+	Run      func(ctx context.Context) error
+	// Timeout cancels the run's context, default 1 hour
+	Timeout time.Duration
+	// MaxLateness is how late a missed run may still start, e.g. after every
+	// replica was down. Older missed runs are recorded as skipped. Default 1 hour.
+	MaxLateness time.Duration
+
+	schedule cron.Schedule
+}
+
+// JobInfo describes a registered job for the admin API
+type JobInfo struct {
+	Name          string    `json:"name"`
+	Schedule      string    `json:"schedule"`
+	LastScheduled time.Time `json:"last_scheduled"`
+	NextRun       time.Time `json:"next_run"`
+	Running       bool      `json:"running"`
+}
+
+type Scheduler struct {
+	db         db.Database
+	redis      *redis.Client
+	instanceID string
+
+	mu      sync.Mutex
+	jobs    []*Job
+	last    map[string]time.Time
+	running map[string]bool
+	leader  bool
+	wg      sync.WaitGroup
+}
+
+func New(db db.Database, client *redis.Client) *Scheduler {
+	return &Scheduler{
+		db:         db,
+		redis:      client,
+		instanceID: newInstanceID(),
+		last:       map[string]time.Time{},
+		running:    map[string]bool{},
+	}
+}
+
+// Add registers a job, it must be called before Start
+func (s *Scheduler) Add(job Job) error {
+	schedule, err := cron.ParseStandard(job.Schedule)
+	if err != nil {
+		return fmt.Errorf("invalid schedule %q for job %s: %w", job.Schedule, job.Name, err)
+	}
+	job.schedule = schedule
+	if job.Timeout <= 0 {
+		job.Timeout = defaultTimeout
+	}
+	if job.MaxLateness <= 0 {
+		job.MaxLateness = defaultMaxLateness
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for _, j := range s.jobs {
+		if j.Name == job.Name {
+			return fmt.Errorf("job %s is already registered", job.Name)
+		}
+	}
+	s.jobs = append(s.jobs, &job)
+	return nil
+}
+
+// InstanceID identifies this process in leases and job_runs
+func (s *Scheduler) InstanceID() string {
+	return s.instanceID
+}
+
+// IsLeader reports whether this process currently schedules jobs
+func (s *Scheduler) IsLeader() bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.leader
+}
+
+// Jobs lists the registered jobs with their last and next scheduled times
+func (s *Scheduler) Jobs() []JobInfo {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	now := time.Now()
+	infos := make([]JobInfo, 0, len(s.jobs))
+	for _, job := range s.jobs {
+		infos = append(infos, JobInfo{
+			Name:          job.Name,
+			Schedule:      job.Schedule,
+			LastScheduled: s.last[job.Name],
+			NextRun:       job.schedule.Next(now),
+			Running:       s.running[job.Name],
+		})
+	}
+	sort.Slice(infos, func(i, j int) bool { return infos[i].Name < infos[j].Name })
+	return infos
+}
+
+// Start campaigns for leadership and runs due jobs while leader. It blocks
+// until ctx is cancelled, then waits for running jobs to return.
+func (s *Scheduler) Start(ctx context.Context) {
+	logger.For(ctx, "scheduler.Start").Infof("Started as %s with %d jobs", s.instanceID, len(s.jobs))
+
+	ticker := time.NewTicker(tickInterval)
+	defer ticker.Stop()
+
+	var lease *Lease
+	for {
+		if lease == nil {
+			lease = s.campaign(ctx)
+		} else if renewed, err := lease.Renew(ctx); err != nil {
+			logger.For(ctx, "scheduler.Start").Error(err)
+		} else if !renewed {
+			logger.For(ctx, "scheduler.Start").Warnf("%s lost leadership", s.instanceID)
+			lease = nil
+			s.setLeader(false)
+		}
+
+		if lease != nil {
+			s.runDue(ctx, time.Now())
+		}
+
+		select {
+		case <-ctx.Done():
+			s.wg.Wait()
+			if lease != nil {
+				// let another replica take over right away instead of after the ttl
+				if err := lease.Release(context.Background()); err != nil {
+					logger.For(ctx, "scheduler.Start").Error(err)
+				}
+			}
+			logger.For(ctx, "scheduler.Start").Info("Stopped")
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+// campaign tries to become the leader, on success the last scheduled times are
+// reloaded so runs missed while there was no leader are caught up
+func (s *Scheduler) campaign(ctx context.Context) *Lease {
+	lease, ok, err := AcquireLease(ctx, s.redis, LeaderKey, s.instanceID, leaderTTL)
+	if err != nil {
+		logger.For(ctx, "scheduler.campaign").Error(err)
+		return nil
+	}
+	if !ok {
+		return nil
+	}
+
+	now := time.Now()
+	for _, job := range s.jobs {
+		last, err := lastScheduled(ctx, s.db, job.Name)
+		if err != nil {
+			logger.For(ctx, "scheduler.campaign").Errorf("Failed to get last run of %s: %v", job.Name, err)
+			// without history the job starts from its next scheduled time
+			last = time.Time{}
+		}
+		if last.IsZero() {
+			last = now
+		}
+		s.mu.Lock()
+		s.last[job.Name] = last
+		s.mu.Unlock()
+	}
+
+	logger.For(ctx, "scheduler.campaign").Infof("%s is the leader", s.instanceID)
+	s.setLeader(true)
+	return lease
+}
+
+func (s *Scheduler) setLeader(leader bool) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.leader = leader
+
+	if leader {
+		metrics.SchedulerLeader.Set(1)
+	} else {
+		metrics.SchedulerLeader.Set(0)
+	}
+}
+
+// runDue starts every job with a scheduled time between its last run and now.
+// Several missed times are coalesced into one run of the latest.
+func (s *Scheduler) runDue(ctx context.Context, now time.Time) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	for _, job := range s.jobs {
+		if s.running[job.Name] {
+			continue
+		}
+
+		var due time.Time
+		for next := job.schedule.Next(s.last[job.Name]); !next.After(now); next = job.schedule.Next(next) {
+			due = next
+		}
+		if due.IsZero() {
+			continue
+		}
+		s.last[job.Name] = due
+
+		if late := now.Sub(due); late > job.MaxLateness {
+			logger.For(ctx, "scheduler.runDue").Warnf("Skipping %s scheduled for %s, %s late", job.Name, due.Format(time.RFC3339), late.Truncate(time.Second))
+			_, err := startRun(ctx, s.db, job.Name, due, s.instanceID, RunStatusSkipped, fmt.Sprintf("missed by %s", late.Truncate(time.Second)))
+			if err != nil {
+				logger.For(ctx, "scheduler.runDue").Error(err)
+			}
+			metrics.ObserveJob(job.Name, string(RunStatusSkipped), 0)
+			continue
+		}
+
+		s.running[job.Name] = true
+		s.wg.Add(1)
+		go func(job *Job, due time.Time) {
+			defer s.wg.Done()
+			defer func() {
+				s.mu.Lock()
+				s.running[job.Name] = false
+				s.mu.Unlock()
+			}()
+			s.run(ctx, job, due)
+		}(job, due)
+	}
+}
+
+// run executes one scheduled time of a job under the job's lease
+func (s *Scheduler) run(ctx context.Context, job *Job, scheduledFor time.Time) {
+	lease, ok, err := AcquireLease(ctx, s.redis, "scheduler:job:"+job.Name, s.instanceID, jobLeaseTTL)
+	if err != nil {
+		logger.For(ctx, "scheduler.run").Error(err)
+		return
+	}
+	if !ok {
+		// a previous leader is still running it
+		return
+	}
+	defer func() {
+		if err := lease.Release(context.Background()); err != nil {
+			logger.For(ctx, "scheduler.run").Error(err)
+		}
+	}()
+
+	if err := abandonRuns(ctx, s.db, job.Name); err != nil {
+		logger.For(ctx, "scheduler.run").Errorf("Failed to abandon old runs of %s: %v", job.Name, err)
+	}
+
+	started, err := startRun(ctx, s.db, job.Name, scheduledFor, s.instanceID, RunStatusRunning, "")
+	if err != nil {
+		logger.For(ctx, "scheduler.run").Error(err)
+		return
+	}
+	if !started {
+		return
+	}
+
+	// a shutdown waits for the run instead of cancelling it, only the timeout
+	// or a lost lease stops it
+	runCtx, cancel := context.WithTimeout(context.WithoutCancel(ctx), job.Timeout)
+	defer cancel()
+	go lease.KeepAlive(runCtx, func() {
+		logger.For(ctx, "scheduler.run").Warnf("Lost the lease of %s, cancelling the run", job.Name)
+		cancel()
+	})
+
+	logger.For(ctx, "scheduler.run").Infof("Running %s scheduled for %s", job.Name, scheduledFor.Format(time.RFC3339))
+	began := time.Now()
+	runErr := safeRun(runCtx, job)
+	duration := time.Since(began)
+
+	status, message := RunStatusSucceeded, ""
+	if runErr != nil {
+		status, message = RunStatusFailed, runErr.Error()
+		logger.For(ctx, "scheduler.run").Errorf("%s failed after %s: %v", job.Name, duration, runErr)
+	} else {
+		logger.For(ctx, "scheduler.run").Infof("%s finished in %s", job.Name, duration)
+	}
+	metrics.ObserveJob(job.Name, string(status), duration)
+
+	// record the outcome even if ctx was cancelled by a shutdown
+	if err := finishRun(context.Background(), s.db, job.Name, scheduledFor, status, duration, message); err != nil {
+		logger.For(ctx, "scheduler.run").Error(err)
+	}
+}
+
+// safeRun turns a panic in a job into an error so the scheduler keeps running
+func safeRun(ctx context.Context, job *Job) (err error) {
+	defer func() {
+		if r := recover(); r != nil {
+			err = fmt.Errorf("panic: %v", r)
+		}
+	}()
+	return job.Run(ctx)
+}
+
+func newInstanceID() string {
+	host, err := os.Hostname()
+	if err != nil || host == "" {
+		host = "unknown"
+	}
+	b := make([]byte, 4)
+	rand.Read(b)
+	return fmt.Sprintf("%s-%d-%s", host, os.Getpid(), hex.EncodeToString(b))
+}
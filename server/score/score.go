@@ -2,8 +2,10 @@ package score
 
 import (
 	"context"
+	"fmt"
 
 	"github.com/boolow5/quran-app-api/db"
+	"github.com/boolow5/quran-app-api/streak"
 )
 
 type DailyScore struct {
@@ -18,6 +20,7 @@ type DailyScore struct {
 	TotalScore       int    `json:"total_score" db:"total_score"`
 	PagesRead        int    `json:"pages_read" db:"pages_read"`
 	ReadingMinutes   int    `json:"reading_minutes" db:"reading_minutes"`
+	ListeningMinutes int    `json:"listening_minutes" db:"listening_minutes"`
 }
 
 type WeeklyScore struct {
@@ -120,3 +123,73 @@ func Leaderboard(ctx context.Context, db db.Database, date string, userID uint64
 
 	return scores, nil
 }
+
+// RecomputeUserScore calculates a user's score for a day and stores it in
+// user_daily_scores, listening counts towards the reading time score by the
+// score weight of the streak.Listening policy. The pages of listening
+// sessions count as read, their time as listening.
+func RecomputeUserScore(ctx context.Context, db db.Database, userID uint64, date string) (DailyScore, error) {
+	query := `
+		SELECT
+			a.user_id,
+			COUNT(DISTINCT a.page_number) AS pages_read,
+			COUNT(DISTINCT a.page_number) * 10 AS progress_score,
+			FLOOR(SUM(a.reading_seconds) / 60) AS reading_minutes,
+			FLOOR(SUM(a.listening_seconds) / 60) AS listening_minutes,
+			FLOOR((SUM(a.reading_seconds) + SUM(a.listening_seconds) * ?) / 60) * 10 AS reading_time_score,
+			COALESCE(MAX(us.current_streak), 0) * 10 AS consistency_score
+		FROM (
+			SELECT re.user_id, re.page_number,
+				CASE WHEN s.mode = ? THEN 0 ELSE re.seconds_open END AS reading_seconds,
+				CASE WHEN s.mode = ? THEN re.seconds_open ELSE 0 END AS listening_seconds
+			FROM reading_events re
+			LEFT JOIN reading_sessions s ON s.id = re.session_id
+			WHERE re.user_id = ? AND DATE(re.created_at) = ?
+			UNION ALL
+			SELECT user_id, NULL, 0, seconds_listened
+			FROM listening_events
+			WHERE user_id = ? AND DATE(created_at) = ?
+		) AS a
+		LEFT JOIN user_streaks as us
+			ON a.user_id = us.user_id
+		GROUP BY a.user_id;
+	`
+	var scores []DailyScore
+	err := db.Select(ctx, &scores, query, streak.Listening.ScoreWeight(), streak.ModeListening, streak.ModeListening, userID, date, userID, date)
+	if err != nil {
+		return DailyScore{}, fmt.Errorf("failed to calculate score: %w", err)
+	}
+	if len(scores) == 0 {
+		// no reading or listening that day
+		return DailyScore{UserID: int64(userID), Date: date}, nil
+	}
+
+	score := scores[0]
+	score.Date = date
+	if score.ConsistencyScore < 50 && score.ReadingMinutes+score.ListeningMinutes > 30 {
+		score.ConsistencyScore = 50
+	}
+	score.TotalScore = max(score.ReadingTimeScore+score.ConsistencyScore+score.ProgressScore+score.EngagementScore, 0)
+
+	upsertQuery := `
+		INSERT INTO user_daily_scores
+			(user_id, date, reading_time_score, consistency_score, progress_score, engagement_score, total_score, pages_read, reading_minutes, listening_minutes)
+		VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?, ?)
+		ON DUPLICATE KEY UPDATE
+		reading_time_score = VALUES(reading_time_score),
+		consistency_score = VALUES(consistency_score),
+		progress_score = VALUES(progress_score),
+		engagement_score = VALUES(engagement_score),
+		total_score = VALUES(total_score),
+		pages_read = VALUES(pages_read),
+		reading_minutes = VALUES(reading_minutes),
+		listening_minutes = VALUES(listening_minutes)
+	`
+	_, err = db.Exec(ctx, upsertQuery, userID, date, score.ReadingTimeScore, score.ConsistencyScore, score.ProgressScore,
+		score.EngagementScore, score.TotalScore, score.PagesRead, score.ReadingMinutes, score.ListeningMinutes)
+	if err != nil {
+		return score, fmt.Errorf("failed to save score: %w", err)
+	}
+
+	return score, nil
+}
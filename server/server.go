@@ -2,19 +2,36 @@ package main
 
 import (
 	"context"
+	"errors"
+	"flag"
 	"fmt"
-	"log"
 	"net/http"
 	"os"
+	"os/signal"
+	"sync"
+	"syscall"
 	"time"
+	// the alpine image has no zoneinfo, user time zones are loaded from here
+	_ "time/tzdata"
 
+	"github.com/boolow5/quran-app-api/config"
 	"github.com/boolow5/quran-app-api/controllers"
 	"github.com/boolow5/quran-app-api/db"
+	"github.com/boolow5/quran-app-api/health"
+	"github.com/boolow5/quran-app-api/logger"
+	"github.com/boolow5/quran-app-api/metrics"
+	"github.com/boolow5/quran-app-api/middlewares"
 	"github.com/boolow5/quran-app-api/models"
 	"github.com/boolow5/quran-app-api/notifications"
+	"github.com/boolow5/quran-app-api/queue"
+	"github.com/boolow5/quran-app-api/scheduler"
+	"github.com/boolow5/quran-app-api/streak"
+	"github.com/boolow5/quran-app-api/tracing"
 	rdb "github.com/boolow5/redis"
 	"github.com/gin-gonic/gin"
 	"github.com/joho/godotenv"
+	"github.com/redis/go-redis/v9"
+	"go.opentelemetry.io/contrib/instrumentation/github.com/gin-gonic/gin/otelgin"
 )
 
 var (
@@ -25,23 +42,81 @@ var (
 )
 
 func main() {
-	err := godotenv.Load()
+	envErr := godotenv.Load()
+	// after loading .env so every setting can be put there
+	cfg, opts, err := config.Load(os.Args[1:])
 	if err != nil {
-		fmt.Println("⚠ Error loading .env file")
-		fmt.Println(err)
+		if errors.Is(err, flag.ErrHelp) {
+			return
+		}
+		logger.Setup("", "")
+		logger.Component("main.main").Fatal(err)
+	}
+	if opts.PrintConfig {
+		fmt.Print(cfg.Dump())
+		return
+	}
+
+	logger.Setup(cfg.Log.Level, cfg.Log.Format)
+	if envErr != nil {
+		logger.Component("main.main").WithError(envErr).Warn("Error loading .env file")
 	} else {
-		fmt.Println("✅ Loaded .env file")
+		logger.Component("main.main").Info("Loaded .env file")
+	}
+
+	if len(opts.Command) > 0 {
+		if err := runCommand(cfg, opts.Command); err != nil {
+			logger.Component("main.main").Fatal(err)
+		}
+		return
 	}
 
-	appName := os.Getenv("APP_NAME")
-	log.Printf("Starting '%s' server...\n", appName)
+	appName := cfg.AppName
+	logger.Component("main.main").Infof("Starting '%s' server...", appName)
+	logger.Component("main.main").WithField("config", cfg.Redacted()).Info("Loaded configuration")
 	// Just to force the github action to start,
 	// without actually doing anything
 
+	streak.MinReadingTimeThreshold = cfg.Streak.MinReadingSeconds
+	streak.SessionTimeout = cfg.Streak.SessionTimeout
+	streak.Listening = streak.ListeningPolicy{
+		Mode:       cfg.Streak.ListeningPolicy,
+		Weight:     cfg.Streak.ListeningWeight,
+		MinSeconds: cfg.Streak.MinListeningSeconds,
+	}
+
+	shutdownTracing, err := tracing.Setup(context.Background(), cfg.Tracing, Version)
+	if err != nil {
+		logger.Component("main.main").WithError(err).Error("Failed to set up tracing, continuing without it")
+		shutdownTracing = func(context.Context) error { return nil }
+	}
+
 	// gin.SetMode(gin.ReleaseMode)
-	router := gin.Default()
+	router := gin.New()
+	router.Use(
+		gin.Recovery(),
+		// scrapes and probes would drown the real traces
+		otelgin.Middleware(cfg.Tracing.ServiceName, otelgin.WithFilter(func(r *http.Request) bool {
+			switch r.URL.Path {
+			case "/metrics", "/healthz", "/readyz":
+				return false
+			}
+			return true
+		})),
+		middlewares.RequestLogger(),
+		middlewares.Metrics(),
+		middlewares.ErrorHandler(),
+	)
 
-	db := SetupServices()
+	db, pusher := SetupServices(cfg)
+	if granted, err := models.GrantAdmins(context.Background(), db, cfg.Admin.UIDs); err != nil {
+		logger.Component("main.main").WithError(err).Error("Error granting admin roles")
+	} else if granted > 0 {
+		logger.Component("main.main").Infof("Granted the admin role to %d users", granted)
+	}
+	sched := scheduler.New(db, models.Redis)
+	jobQueue := queue.New(models.Redis)
+	jobQueue.RegisterTasks(db)
 
 	router.GET("/", func(c *gin.Context) {
 		c.JSON(200, gin.H{
@@ -55,47 +130,129 @@ func main() {
 	router.OPTIONS("/", func(c *gin.Context) {
 		c.AbortWithStatus(http.StatusNoContent)
 	})
-	controllers.SetupHandlers(router, db)
+	router.GET("/metrics", middlewares.MetricsAuth(cfg.Metrics.Token), gin.WrapH(metrics.Handler()))
+
+	checker := health.New().
+		Add("mysql", 2*time.Second, models.MySQLDB.Ping).
+		Add("redis", 2*time.Second, func(ctx context.Context) error {
+			return models.Redis.Ping(ctx).Err()
+		})
+	router.GET("/healthz", checker.Liveness())
+	router.GET("/readyz", checker.Readiness())
+
+	controllers.SetupHandlers(router, db, cfg, sched, jobQueue, checker)
+
+	// the workers have their own context so they keep running while HTTP drains
+	workersCtx, stopWorkers := context.WithCancel(context.Background())
+	var workers sync.WaitGroup
+	for _, start := range []func(ctx context.Context){
+		func(ctx context.Context) { StartCronJobs(ctx, db, models.Redis, sched, jobQueue, cfg) },
+		func(ctx context.Context) { notifications.StartOutboxWorkers(ctx, db, pusher) },
+		func(ctx context.Context) { jobQueue.Start(ctx, cfg.Queue.Workers) },
+		func(ctx context.Context) { metrics.StartBusinessGauges(ctx, db) },
+	} {
+		workers.Add(1)
+		go func(start func(ctx context.Context)) {
+			defer workers.Done()
+			start(workersCtx)
+		}(start)
+	}
 
-	go StartCronJobs(db)
+	server := &http.Server{
+		Addr:    cfg.HTTP.Addr,
+		Handler: router,
+	}
+	go func() {
+		if err := server.ListenAndServe(); err != nil && !errors.Is(err, http.ErrServerClosed) {
+			logger.Component("main.main").Fatalf("HTTP server failed: %v", err)
+		}
+	}()
+
+	signals, stopSignals := signal.NotifyContext(context.Background(), syscall.SIGINT, syscall.SIGTERM)
+	<-signals.Done()
+	// a second signal kills the process right away
+	stopSignals()
+
+	ctx, cancel := context.WithTimeout(context.Background(), cfg.HTTP.ShutdownTimeout)
+	defer cancel()
+	logger.Component("main.main").Info("Shutting down")
+
+	// stop being ready first so the load balancer stops sending new requests
+	checker.Drain()
+	select {
+	case <-time.After(cfg.HTTP.DrainDelay):
+	case <-ctx.Done():
+	}
+
+	// waits for in-flight requests, e.g. reading event writes
+	if err := server.Shutdown(ctx); err != nil {
+		logger.Component("main.main").WithError(err).Error("HTTP requests did not finish in time")
+	}
+
+	// the scheduler waits for running jobs, the outbox for its claimed batch
+	stopWorkers()
+	stopped := make(chan struct{})
+	go func() {
+		workers.Wait()
+		close(stopped)
+	}()
+	select {
+	case <-stopped:
+	case <-ctx.Done():
+		logger.Component("main.main").Error("Background workers did not stop in time")
+	}
 
-	router.Run("0.0.0.0:1140")
+	if err := models.MySQLDB.Close(); err != nil {
+		logger.Component("main.main").WithError(err).Error("Failed to close MySQL")
+	}
+	if err := models.Redis.Close(); err != nil {
+		logger.Component("main.main").WithError(err).Error("Failed to close Redis")
+	}
+	if err := shutdownTracing(ctx); err != nil {
+		logger.Component("main.main").WithError(err).Error("Failed to flush traces")
+	}
+	logger.Component("main.main").Info("Stopped")
 }
 
-func SetupServices() db.Database {
-	fmt.Printf("Connecting to redis on %s\n", os.Getenv("REDIS_HOST"))
-	redisDB, err := rdb.NewRedisDB("", "", 0)
+func SetupServices(cfg *config.Config) (db.Database, notifications.Pusher) {
+	logger.Component("main.SetupServices").Infof("Connecting to redis on %s", cfg.Redis.Addr())
+	redisDB, err := rdb.NewRedisDB(cfg.Redis.Addr(), cfg.Redis.Password, 0)
 	if err != nil {
 		panic(fmt.Sprintf("Failed to connect to redis: %v", err))
 	}
 	if redisDB == nil {
 		panic("RedisDB is nil")
 	}
-	fmt.Printf("Connected to Redis\n")
+	logger.Component("main.SetupServices").Info("Connected to Redis")
 	models.RedisDB = redisDB
+	models.Redis = redis.NewClient(&redis.Options{
+		Addr:     cfg.Redis.Addr(),
+		Password: cfg.Redis.Password,
+	})
 	ctx := context.Background()
-	models.RedisDB.Set(ctx, "test", "test")
-	time.Sleep(1 * time.Second)
-	val, err := models.RedisDB.Get(ctx, "test")
-	if err != nil {
-		fmt.Printf("Error getting value: %v\n", err)
+	pingCtx, cancel := context.WithTimeout(ctx, 5*time.Second)
+	defer cancel()
+	if err := models.Redis.Ping(pingCtx).Err(); err != nil {
+		logger.For(ctx, "main.SetupServices").Errorf("Failed to ping Redis on %s: %v", cfg.Redis.Addr(), err)
 		panic(err)
 	}
-	fmt.Printf("Got value: %s\n", val)
 
-	mysql, err := db.NewMysqlDB(os.Getenv("QURAN_API_MYSQL_URL"))
+	mysql, err := db.NewMysqlDB(cfg.MySQL.URL)
 	if err != nil {
 		panic(err)
 	}
 	if mysql == nil {
 		panic("MySQLDB is nil")
 	}
-	fmt.Printf("Connected to MySQL\n")
+	logger.For(ctx, "main.SetupServices").Info("Connected to MySQL")
 	models.MySQLDB = mysql
 
-	db.InitTables(mysql)
+	db.InitTables(mysql, cfg.MySQL.CreateTablesPath)
 
-	notifications.InitFirebase()
+	pusher, err := notifications.NewPusher(ctx, cfg.Push, cfg.Firebase.CredentialsJSON)
+	if err != nil {
+		panic(fmt.Sprintf("Failed to initialize push notifications: %v", err))
+	}
 
-	return mysql
+	return mysql, pusher
 }
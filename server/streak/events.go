@@ -0,0 +1,197 @@
+package streak
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+	"time"
+
+	"github.com/boolow5/quran-app-api/db"
+)
+
+// Triggers are what changed a streak
+const (
+	// TriggerReadEvent is a summary recomputed after the user read
+	TriggerReadEvent = "read_event"
+	// TriggerCron is the daily streak processing
+	TriggerCron = "cron"
+	// TriggerAdmin is a change from the admin API
+	TriggerAdmin = "admin"
+	// TriggerMerge is another account merged into the user's
+	TriggerMerge = "merge"
+	// TriggerRecompute is a streak rebuilt from its daily summaries
+	TriggerRecompute = "recompute"
+)
+
+// Cause is why a streak changed, it is logged with the change
+type Cause struct {
+	Trigger string `json:"trigger" db:"trigger_type"`
+	// Date is the day that was read or processed, today for the other triggers
+	Date time.Time `json:"date" db:"trigger_date"`
+	// TotalSeconds is the reading of Date when its summary changed the streak
+	TotalSeconds *int `json:"total_seconds" db:"total_seconds"`
+	// ActorUserID is the admin who made the change
+	ActorUserID *uint64 `json:"actor_user_id" db:"actor_user_id"`
+	Reason      string  `json:"reason" db:"reason"`
+}
+
+// Event is one change of a user's streak in streak_events
+type Event struct {
+	ID     uint64 `json:"id" db:"id"`
+	UserID uint64 `json:"user_id" db:"user_id"`
+	Cause
+	PreviousCurrentStreak  int          `json:"previous_current_streak" db:"previous_current_streak"`
+	PreviousLongestStreak  int          `json:"previous_longest_streak" db:"previous_longest_streak"`
+	PreviousLastActiveDate sql.NullTime `json:"previous_last_active_date" db:"previous_last_active_date"`
+	CurrentStreak          int          `json:"current_streak" db:"current_streak"`
+	LongestStreak          int          `json:"longest_streak" db:"longest_streak"`
+	LastActiveDate         sql.NullTime `json:"last_active_date" db:"last_active_date"`
+	CreatedAt              time.Time    `json:"created_at" db:"created_at"`
+}
+
+// Previous is the streak before the event
+func (e Event) Previous() UserStreak {
+	return UserStreak{UserID: e.UserID, CurrentStreak: e.PreviousCurrentStreak, LongestStreak: e.PreviousLongestStreak, LastActiveDate: e.PreviousLastActiveDate}
+}
+
+// Streak is the streak after the event
+func (e Event) Streak() UserStreak {
+	return UserStreak{UserID: e.UserID, CurrentStreak: e.CurrentStreak, LongestStreak: e.LongestStreak, LastActiveDate: e.LastActiveDate}
+}
+
+// sameStreak reports whether two streaks are equal, last active dates are
+// compared by day
+func sameStreak(a, b UserStreak) bool {
+	return a.CurrentStreak == b.CurrentStreak && a.LongestStreak == b.LongestStreak && nullDate(a.LastActiveDate) == nullDate(b.LastActiveDate)
+}
+
+func nullDate(t sql.NullTime) interface{} {
+	if !t.Valid {
+		return nil
+	}
+	return t.Time.Format("2006-01-02")
+}
+
+// RecordEvent appends the change of a streak from before to after to
+// streak_events in tx, nothing is recorded when the streak did not change
+func RecordEvent(ctx context.Context, db db.Database, tx *sql.Tx, cause Cause, before, after UserStreak) error {
+	if sameStreak(before, after) {
+		return nil
+	}
+	if cause.Date.IsZero() {
+		cause.Date = time.Now().UTC()
+	}
+
+	query := `
+		INSERT INTO streak_events
+		(user_id, trigger_type, trigger_date, total_seconds, actor_user_id, reason,
+		previous_current_streak, previous_longest_streak, previous_last_active_date,
+		current_streak, longest_streak, last_active_date)
+		VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?)
+	`
+	_, err := db.ExecTx(ctx, tx, query, after.UserID, cause.Trigger, cause.Date.Format("2006-01-02"), cause.TotalSeconds, cause.ActorUserID, cause.Reason,
+		before.CurrentStreak, before.LongestStreak, nullDate(before.LastActiveDate),
+		after.CurrentStreak, after.LongestStreak, nullDate(after.LastActiveDate))
+	if err != nil {
+		return fmt.Errorf("failed to record streak event of user %d: %w", after.UserID, err)
+	}
+	return nil
+}
+
+// GetEvents returns the latest limit streak events of a user, oldest first
+func GetEvents(ctx context.Context, db db.Database, userID uint64, limit int) ([]Event, error) {
+	var events []Event
+	query := `
+		SELECT * FROM (
+			SELECT id, user_id, trigger_type, trigger_date, total_seconds, actor_user_id, reason,
+			previous_current_streak, previous_longest_streak, previous_last_active_date,
+			current_streak, longest_streak, last_active_date, created_at
+			FROM streak_events
+			WHERE user_id = ?
+			ORDER BY id DESC
+			LIMIT ?
+		) latest
+		ORDER BY id
+	`
+	if err := db.Select(ctx, &events, query, userID, limit); err != nil {
+		return nil, fmt.Errorf("failed to get streak events of user %d: %w", userID, err)
+	}
+	return events, nil
+}
+
+// GetReachedOn returns the highest streak the reading of date counted a
+// user's streak up to, 0 when it did not count it up. The events stay when
+// the streak does, so a retried job gets the same answer as the first try.
+func GetReachedOn(ctx context.Context, db db.Database, userID uint64, date time.Time) (int, error) {
+	var reached int
+	query := `
+		SELECT COALESCE(MAX(current_streak), 0)
+		FROM streak_events
+		WHERE user_id = ? AND trigger_type = ? AND trigger_date = ? AND current_streak > previous_current_streak
+	`
+	err := db.Get(ctx, &reached, query, userID, TriggerReadEvent, date.Format("2006-01-02"))
+	if err != nil {
+		return 0, fmt.Errorf("failed to get streak reached on %s by user %d: %w", date.Format("2006-01-02"), userID, err)
+	}
+	return reached, nil
+}
+
+// Kinds of change in a Timeline
+const (
+	ChangeStarted   = "started"
+	ChangeContinued = "continued"
+	ChangeReset     = "reset"
+	ChangeUnchanged = "unchanged"
+)
+
+// TimelineEntry is an event replayed in order
+type TimelineEntry struct {
+	Event
+	// Change is how the current streak moved
+	Change string `json:"change"`
+	// Untracked is set when the streak before the event is not the one the
+	// event before it left, it was changed without being logged, e.g. before
+	// the log existed
+	Untracked bool `json:"untracked"`
+}
+
+// Timeline is the history of a user's streak
+type Timeline struct {
+	Entries []TimelineEntry `json:"entries"`
+	// Streak is the stored streak
+	Streak UserStreak `json:"streak"`
+	// InSync reports whether the last event left the stored streak, it is
+	// false when the streak changed after it without being logged
+	InSync bool `json:"in_sync"`
+}
+
+// Replay walks the events of a user in order and explains each change of
+// their streak
+func Replay(events []Event, current UserStreak) Timeline {
+	timeline := Timeline{
+		Entries: make([]TimelineEntry, len(events)),
+		Streak:  current,
+		InSync:  sameStreak(current, UserStreak{}),
+	}
+	for i, event := range events {
+		entry := TimelineEntry{Event: event}
+		switch {
+		case event.CurrentStreak > event.PreviousCurrentStreak && event.CurrentStreak == 1:
+			entry.Change = ChangeStarted
+		case event.CurrentStreak > event.PreviousCurrentStreak:
+			entry.Change = ChangeContinued
+		case event.CurrentStreak < event.PreviousCurrentStreak:
+			entry.Change = ChangeReset
+		default:
+			entry.Change = ChangeUnchanged
+		}
+		if i > 0 {
+			entry.Untracked = !sameStreak(event.Previous(), events[i-1].Streak())
+		}
+		timeline.Entries[i] = entry
+	}
+	if len(events) > 0 {
+		timeline.InSync = sameStreak(current, events[len(events)-1].Streak())
+	}
+	return timeline
+}
@@ -0,0 +1,261 @@
+package streak
+
+import (
+	"context"
+	"fmt"
+	"math"
+	"sort"
+	"time"
+
+	"github.com/boolow5/quran-app-api/apperrors"
+	"github.com/boolow5/quran-app-api/db"
+)
+
+// Listening policies
+const (
+	// ListeningFull counts listening as reading
+	ListeningFull = "full"
+	// ListeningPartial counts the Weight of listening as reading
+	ListeningPartial = "partial"
+	// ListeningSeparate counts a day when either reading or listening meets
+	// its own goal
+	ListeningSeparate = "separate"
+)
+
+// ListeningPolicy is how listening to a recitation counts towards a day
+type ListeningPolicy struct {
+	Mode string
+	// Weight is the share of listening counted as reading by ListeningPartial,
+	// and towards scores by ListeningSeparate
+	Weight float64
+	// MinSeconds is the listening goal of ListeningSeparate
+	MinSeconds int
+}
+
+// Listening is the policy in use, main sets it from config.Streak
+var Listening = ListeningPolicy{Mode: ListeningPartial, Weight: 0.5, MinSeconds: 600}
+
+// ScoreWeight is the share of listening counted as reading time in scores
+func (p ListeningPolicy) ScoreWeight() float64 {
+	if p.Mode == ListeningFull {
+		return 1
+	}
+	return p.Weight
+}
+
+// Goal is the listening that meets the day on its own, 0 when listening only
+// counts as weighted reading
+func (p ListeningPolicy) Goal() int {
+	if p.Mode == ListeningSeparate {
+		return p.MinSeconds
+	}
+	return 0
+}
+
+// Total is the reading time of a day with its listening weighted in, the
+// separate policy keeps listening out of it
+func (p ListeningPolicy) Total(readingSeconds, listeningSeconds int) int {
+	switch p.Mode {
+	case ListeningFull:
+		return readingSeconds + listeningSeconds
+	case ListeningSeparate:
+		return readingSeconds
+	default:
+		return readingSeconds + int(math.Floor(float64(listeningSeconds)*p.Weight))
+	}
+}
+
+// Met reports whether a day with the weighted total and listening counts
+// towards the streak
+func (p ListeningPolicy) Met(totalSeconds, listeningSeconds, threshold int) bool {
+	if totalSeconds >= threshold {
+		return true
+	}
+	goal := p.Goal()
+	return goal > 0 && listeningSeconds >= goal
+}
+
+// Activity is what a user did on a day
+type Activity struct {
+	ReadingSeconds   int `json:"reading_seconds" db:"reading_seconds"`
+	ListeningSeconds int `json:"listening_seconds" db:"listening_seconds"`
+}
+
+// Total is the activity weighted by the Listening policy
+func (a Activity) Total() int {
+	return Listening.Total(a.ReadingSeconds, a.ListeningSeconds)
+}
+
+// Met reports whether the activity counts the day towards the streak
+func (a Activity) Met() bool {
+	return Listening.Met(a.Total(), a.ListeningSeconds, MinReadingTimeThreshold)
+}
+
+// PercentageDone is how much of the day's goal the activity met, with the
+// separate policy the goal closest to being met
+func (a Activity) PercentageDone() float64 {
+	percentage := float64(a.Total()) / float64(MinReadingTimeThreshold) * 100
+	if goal := Listening.Goal(); goal > 0 {
+		percentage = max(percentage, float64(a.ListeningSeconds)/float64(goal)*100)
+	}
+	return min(percentage, 100)
+}
+
+// GetDailyActivity sums the reading and listening of a user on a day, the
+// pages of listening sessions were followed along a recitation and count as
+// listening
+func GetDailyActivity(ctx context.Context, db db.Database, userID uint64, date time.Time) (Activity, error) {
+	var activity Activity
+	query := `
+		SELECT
+			COALESCE(SUM(CASE WHEN s.mode = ? THEN 0 ELSE re.seconds_open END), 0) AS reading_seconds,
+			COALESCE(SUM(CASE WHEN s.mode = ? THEN re.seconds_open ELSE 0 END), 0)
+				+ (SELECT COALESCE(SUM(seconds_listened), 0) FROM listening_events WHERE user_id = ? AND DATE(created_at) = ?) AS listening_seconds
+		FROM reading_events re
+		LEFT JOIN reading_sessions s ON s.id = re.session_id
+		WHERE re.user_id = ? AND DATE(re.created_at) = ?
+	`
+	dateStr := date.Format("2006-01-02")
+	err := db.Get(ctx, &activity, query, ModeListening, ModeListening, userID, dateStr, userID, dateStr)
+	if err != nil {
+		return activity, fmt.Errorf("failed to calculate daily activity: %w", err)
+	}
+	return activity, nil
+}
+
+// ListeningEvent is a recitation the user listened to, from one ayah of a
+// surah to another
+type ListeningEvent struct {
+	ID              uint64    `json:"id" db:"id"`
+	UserID          uint64    `json:"user_id" db:"user_id"`
+	Reciter         string    `json:"reciter" db:"reciter" binding:"required,max=100"`
+	Surah           int       `json:"surah" db:"surah"`
+	FromAyah        int       `json:"from_ayah" db:"from_ayah"`
+	ToAyah          int       `json:"to_ayah" db:"to_ayah"`
+	SecondsListened int       `json:"seconds_listened" db:"seconds_listened"`
+	CreatedAt       time.Time `json:"created_at" db:"created_at"`
+}
+
+// AyahCounts are the number of ayahs of each surah, surah 1 first
+var AyahCounts = [114]int{
+	7, 286, 200, 176, 120, 165, 206, 75, 129, 109, 123, 111, 43, 52, 99, 128, 111, 110, 98, 135,
+	112, 78, 118, 64, 77, 227, 93, 88, 69, 60, 34, 30, 73, 54, 45, 83, 182, 88, 75, 85,
+	54, 53, 89, 59, 37, 35, 38, 29, 18, 45, 60, 49, 62, 55, 78, 96, 29, 22, 24, 13,
+	14, 11, 11, 18, 12, 12, 30, 52, 52, 44, 28, 28, 20, 56, 40, 31, 50, 40, 46, 42,
+	29, 19, 36, 25, 22, 17, 19, 26, 30, 20, 15, 21, 11, 8, 8, 19, 5, 8, 8, 11,
+	11, 8, 3, 9, 5, 4, 7, 3, 6, 3, 5, 4, 5, 6,
+}
+
+// TotalAyahs is the number of ayahs in the Quran
+const TotalAyahs = 6236
+
+// RecordListeningEvent stores a new listening event
+func RecordListeningEvent(ctx context.Context, db db.Database, event ListeningEvent) error {
+	query := `
+		INSERT INTO listening_events
+		(user_id, reciter, surah, from_ayah, to_ayah, seconds_listened, created_at)
+		VALUES (?, ?, ?, ?, ?, ?, ?)
+	`
+
+	// validation
+	if event.Surah < 1 || event.Surah > 114 {
+		return apperrors.Invalid("surah", "between 1 and 114")
+	}
+	if event.FromAyah < 1 || event.FromAyah > AyahCounts[event.Surah-1] {
+		return apperrors.Invalid("from_ayah", fmt.Sprintf("between 1 and %d", AyahCounts[event.Surah-1]))
+	}
+	if event.ToAyah < event.FromAyah || event.ToAyah > AyahCounts[event.Surah-1] {
+		return apperrors.Invalid("to_ayah", fmt.Sprintf("between from_ayah and %d", AyahCounts[event.Surah-1]))
+	}
+	if event.SecondsListened < 30 {
+		return apperrors.Invalid("seconds_listened", "min 30")
+	}
+	// the app sends an event at least every hour it plays
+	if event.SecondsListened > 3600 {
+		event.SecondsListened = 3600
+	}
+
+	_, err := db.Insert(ctx, query, event.UserID, event.Reciter, event.Surah, event.FromAyah, event.ToAyah, event.SecondsListened, event.CreatedAt)
+	if err != nil {
+		return fmt.Errorf("failed to record listening event: %w", err)
+	}
+
+	return nil
+}
+
+// SurahListening is how much of a surah a user listened to
+type SurahListening struct {
+	Surah      int `json:"surah"`
+	Ayahs      int `json:"ayahs"`
+	AyahsHeard int `json:"ayahs_heard"`
+	Seconds    int `json:"seconds"`
+	// LastReciter is the reciter of the latest event
+	LastReciter    string    `json:"last_reciter"`
+	LastListenedAt time.Time `json:"last_listened_at"`
+}
+
+// ListeningProgress is how much of the Quran a user listened to
+type ListeningProgress struct {
+	Surahs     []SurahListening `json:"surahs"`
+	AyahsHeard int              `json:"ayahs_heard"`
+	Seconds    int              `json:"seconds"`
+	// Percentage is the share of the ayahs of the Quran heard at least once
+	Percentage float64 `json:"percentage"`
+}
+
+// CountListening adds up the events of a user by surah, an ayah heard in
+// several events counts once
+func CountListening(events []ListeningEvent) ListeningProgress {
+	progress := ListeningProgress{Surahs: []SurahListening{}}
+
+	bySurah := map[int][]ListeningEvent{}
+	for _, event := range events {
+		bySurah[event.Surah] = append(bySurah[event.Surah], event)
+	}
+
+	for surah, events := range bySurah {
+		if surah < 1 || surah > 114 {
+			continue
+		}
+		listening := SurahListening{Surah: surah, Ayahs: AyahCounts[surah-1]}
+		sort.Slice(events, func(i, j int) bool { return events[i].FromAyah < events[j].FromAyah })
+
+		// the ranges are sorted by their start, an ayah is counted by the
+		// first range that reaches past the ones before it
+		heardTo := 0
+		for _, event := range events {
+			from, to := max(event.FromAyah, heardTo+1), min(event.ToAyah, listening.Ayahs)
+			if to >= from {
+				listening.AyahsHeard += to - from + 1
+				heardTo = to
+			}
+			listening.Seconds += event.SecondsListened
+			if !event.CreatedAt.Before(listening.LastListenedAt) {
+				listening.LastListenedAt = event.CreatedAt
+				listening.LastReciter = event.Reciter
+			}
+		}
+
+		progress.Surahs = append(progress.Surahs, listening)
+		progress.AyahsHeard += listening.AyahsHeard
+		progress.Seconds += listening.Seconds
+	}
+
+	sort.Slice(progress.Surahs, func(i, j int) bool { return progress.Surahs[i].Surah < progress.Surahs[j].Surah })
+	progress.Percentage = float64(progress.AyahsHeard) / TotalAyahs * 100
+	return progress
+}
+
+// GetListeningProgress returns how much of the Quran a user listened to
+func GetListeningProgress(ctx context.Context, db db.Database, userID uint64) (ListeningProgress, error) {
+	var events []ListeningEvent
+	query := `
+		SELECT id, user_id, reciter, surah, from_ayah, to_ayah, seconds_listened, created_at
+		FROM listening_events
+		WHERE user_id = ?
+	`
+	if err := db.Select(ctx, &events, query, userID); err != nil {
+		return ListeningProgress{}, fmt.Errorf("failed to get listening events: %w", err)
+	}
+	return CountListening(events), nil
+}
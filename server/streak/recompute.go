@@ -0,0 +1,132 @@
+package streak
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+	"sort"
+	"time"
+
+	"github.com/boolow5/quran-app-api/db"
+)
+
+// Recompute derives a streak from the full daily summary history of a user.
+// A day counts when its weighted total reaches threshold, or its listening
+// the goal of the Listening policy, days after today in loc are
+// ignored, so a summary dated by a skewed clock cannot end a streak in the
+// future. Summary dates are calendar days and are compared as such, a DST
+// change in loc never splits or merges two days. The current streak is the
+// run ending on the last active day, as UpdateStreak keeps it.
+func Recompute(summaries []DailySummary, threshold int, today time.Time, loc *time.Location) UserStreak {
+	var streak UserStreak
+	if len(summaries) > 0 {
+		streak.UserID = summaries[0].UserID
+	}
+
+	local := today.In(loc)
+	last := civilDate(local.Year(), local.Month(), local.Day())
+
+	seconds := map[time.Time]int{}
+	listening := map[time.Time]int{}
+	for _, summary := range summaries {
+		y, m, d := summary.Date.Date()
+		day := civilDate(y, m, d)
+		if day.After(last) {
+			continue
+		}
+		seconds[day] += summary.TotalSeconds
+		listening[day] += summary.ListeningSeconds
+	}
+
+	days := make([]time.Time, 0, len(seconds))
+	for day, total := range seconds {
+		if Listening.Met(total, listening[day], threshold) {
+			days = append(days, day)
+		}
+	}
+	sort.Slice(days, func(i, j int) bool { return days[i].Before(days[j]) })
+
+	streak.CurrentStreak, streak.LongestStreak = CountStreaks(days)
+	if len(days) > 0 {
+		streak.LastActiveDate = sql.NullTime{Time: days[len(days)-1], Valid: true}
+	}
+	return streak
+}
+
+// civilDate is a calendar day at midnight UTC, where every day is 24 hours
+func civilDate(year int, month time.Month, day int) time.Time {
+	return time.Date(year, month, day, 0, 0, 0, 0, time.UTC)
+}
+
+// Drift is a stored streak and the one recomputed from its summaries
+type Drift struct {
+	UserID   uint64     `json:"user_id"`
+	Stored   UserStreak `json:"stored"`
+	Computed UserStreak `json:"computed"`
+	// Fields are the fields that differ, none when the stored streak is right
+	Fields []string `json:"fields"`
+}
+
+// diffStreaks returns the fields of stored that differ from computed
+func diffStreaks(stored, computed UserStreak) []string {
+	fields := []string{}
+	if stored.CurrentStreak != computed.CurrentStreak {
+		fields = append(fields, "current_streak")
+	}
+	if stored.LongestStreak != computed.LongestStreak {
+		fields = append(fields, "longest_streak")
+	}
+	if nullDate(stored.LastActiveDate) != nullDate(computed.LastActiveDate) {
+		fields = append(fields, "last_active_date")
+	}
+	return fields
+}
+
+// RecomputeUser recomputes the streak of a user in their timezone and
+// compares it with the stored one
+func RecomputeUser(ctx context.Context, db db.Database, userID uint64, today time.Time) (Drift, error) {
+	drift := Drift{UserID: userID}
+
+	var timezone string
+	err := db.Get(ctx, &timezone, "SELECT COALESCE(timezone, 'UTC') FROM users WHERE id = ?", userID)
+	if err != nil {
+		return drift, fmt.Errorf("failed to get timezone of user %d: %w", userID, err)
+	}
+	loc, err := time.LoadLocation(timezone)
+	if err != nil {
+		loc = time.UTC
+	}
+
+	var summaries []DailySummary
+	query := `
+		SELECT id, user_id, date, total_seconds, listening_seconds, threshold_met
+		FROM daily_summaries
+		WHERE user_id = ?
+		ORDER BY date
+	`
+	if err := db.Select(ctx, &summaries, query, userID); err != nil {
+		return drift, fmt.Errorf("failed to get daily summaries: %w", err)
+	}
+
+	drift.Stored, err = GetUserStreak(ctx, db, userID)
+	if err != nil {
+		return drift, err
+	}
+	drift.Computed = Recompute(summaries, MinReadingTimeThreshold, today, loc)
+	drift.Computed.UserID = userID
+	drift.Fields = diffStreaks(drift.Stored, drift.Computed)
+	return drift, nil
+}
+
+// FixDrift stores the recomputed streak of a drift, the change is logged
+// with cause. A streak written since the drift was recomputed is kept and
+// apperrors.ErrConflict returned, recomputing again picks it up.
+func FixDrift(ctx context.Context, db db.Database, drift Drift, cause Cause) error {
+	if len(drift.Fields) == 0 {
+		return nil
+	}
+	if cause.Trigger == "" {
+		cause.Trigger = TriggerRecompute
+	}
+	return setStreak(ctx, db, &drift.Stored, drift.Computed, cause)
+}
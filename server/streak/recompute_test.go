@@ -0,0 +1,221 @@
+package streak
+
+import (
+	"fmt"
+	"math/rand"
+	"reflect"
+	"testing"
+	"testing/quick"
+	"time"
+	_ "time/tzdata"
+)
+
+// testThreshold is the reading that meets a day in these tests
+const testThreshold = 300
+
+// newYork has DST, its days are 23 and 25 hours long in March and November
+var newYork = mustLoadLocation("America/New_York")
+
+func mustLoadLocation(name string) *time.Location {
+	loc, err := time.LoadLocation(name)
+	if err != nil {
+		panic(err)
+	}
+	return loc
+}
+
+// history is a generated run of days of a New York user, each active or not
+type history struct {
+	start time.Time
+	// active are the days that met the threshold, from start
+	active []bool
+	// split days are summed from two summaries, partial days that were not
+	// active have a summary below the threshold
+	split, partial []bool
+	// today is the index of the day the streak is recomputed on, it may be
+	// before the last generated day
+	today int
+}
+
+// Generate makes histories that start on any day of 2024, so they cross both
+// DST changes of New York
+func (history) Generate(r *rand.Rand, size int) reflect.Value {
+	n := 1 + r.Intn(size+1)
+	h := history{
+		start:   time.Date(2024, 1, 1+r.Intn(366), 0, 0, 0, 0, newYork),
+		active:  make([]bool, n),
+		split:   make([]bool, n),
+		partial: make([]bool, n),
+		today:   r.Intn(n + 2),
+	}
+	for i := 0; i < n; i++ {
+		h.active[i] = r.Intn(10) < 7
+		h.split[i] = r.Intn(2) == 0
+		h.partial[i] = r.Intn(2) == 0
+	}
+	return reflect.ValueOf(h)
+}
+
+// day is the date of the i-th day at midnight in New York
+func (h history) day(i int) time.Time {
+	return h.start.AddDate(0, 0, i)
+}
+
+// now is late in the evening of today in New York, already tomorrow in UTC.
+// The spring forward day is 23 hours long, so it is no later than 22:00.
+func (h history) now() time.Time {
+	return h.day(h.today).Add(22 * time.Hour)
+}
+
+func (h history) summaries() []DailySummary {
+	var summaries []DailySummary
+	for i, active := range h.active {
+		switch {
+		case active && h.split[i]:
+			summaries = append(summaries,
+				DailySummary{UserID: 1, Date: h.day(i), TotalSeconds: testThreshold / 2},
+				DailySummary{UserID: 1, Date: h.day(i), TotalSeconds: testThreshold - testThreshold/2},
+			)
+		case active:
+			summaries = append(summaries, DailySummary{UserID: 1, Date: h.day(i), TotalSeconds: testThreshold})
+		case h.partial[i]:
+			summaries = append(summaries, DailySummary{UserID: 1, Date: h.day(i), TotalSeconds: testThreshold - 1})
+		}
+	}
+	return summaries
+}
+
+// reference counts the streak by walking the days one by one: a day that was
+// not active resets the run, days after today are not walked
+func (h history) reference() (current, longest int, lastActive time.Time) {
+	run := 0
+	for i := 0; i < len(h.active) && i <= h.today; i++ {
+		if !h.active[i] {
+			run = 0
+			continue
+		}
+		run++
+		current, lastActive = run, h.day(i)
+		longest = max(longest, run)
+	}
+	return current, longest, lastActive
+}
+
+// sameDate reports whether a recomputed last active date is the calendar day
+// of want, a zero want is no last active date
+func sameDate(got UserStreak, want time.Time) bool {
+	if want.IsZero() {
+		return !got.LastActiveDate.Valid
+	}
+	return got.LastActiveDate.Valid && got.LastActiveDate.Time.Format("2006-01-02") == want.Format("2006-01-02")
+}
+
+func TestRecompute(t *testing.T) {
+	config := &quick.Config{MaxCount: 1000}
+
+	t.Run("matches the day by day count", func(t *testing.T) {
+		check := func(h history) bool {
+			got := Recompute(h.summaries(), testThreshold, h.now(), newYork)
+			current, longest, lastActive := h.reference()
+			if got.CurrentStreak != current || got.LongestStreak != longest || !sameDate(got, lastActive) {
+				t.Logf("from %s today %d active %v: got %s, want current=%d longest=%d last_active=%s",
+					h.start.Format("2006-01-02"), h.today, h.active, formatTestStreak(got), current, longest, lastActive.Format("2006-01-02"))
+				return false
+			}
+			return true
+		}
+		if err := quick.Check(check, config); err != nil {
+			t.Error(err)
+		}
+	})
+
+	t.Run("current is at most longest", func(t *testing.T) {
+		check := func(h history) bool {
+			got := Recompute(h.summaries(), testThreshold, h.now(), newYork)
+			return got.CurrentStreak <= got.LongestStreak
+		}
+		if err := quick.Check(check, config); err != nil {
+			t.Error(err)
+		}
+	})
+
+	t.Run("backdated summaries never move the last active date back", func(t *testing.T) {
+		check := func(h history, backdated uint8) bool {
+			summaries := h.summaries()
+			before := Recompute(summaries, testThreshold, h.now(), newYork)
+
+			// a summary of an earlier day that arrives after the others, the
+			// order it is stored in must not matter either
+			day := h.day(h.today - 1 - int(backdated)%(h.today+1))
+			late := append([]DailySummary{}, summaries...)
+			late = append(late, DailySummary{UserID: 1, Date: day, TotalSeconds: testThreshold})
+			after := Recompute(late, testThreshold, h.now(), newYork)
+			reversed := make([]DailySummary, len(late))
+			for i, summary := range late {
+				reversed[len(late)-1-i] = summary
+			}
+
+			if before.LastActiveDate.Valid && after.LastActiveDate.Time.Before(before.LastActiveDate.Time) {
+				t.Logf("summary of %s moved last active date from %s to %s", day.Format("2006-01-02"),
+					before.LastActiveDate.Time.Format("2006-01-02"), after.LastActiveDate.Time.Format("2006-01-02"))
+				return false
+			}
+			return after == Recompute(reversed, testThreshold, h.now(), newYork)
+		}
+		if err := quick.Check(check, config); err != nil {
+			t.Error(err)
+		}
+	})
+
+	cases := []struct {
+		name string
+		// dates are the days that met the threshold, in loc at midnight
+		dates []string
+		today string
+		loc   *time.Location
+		// current, longest and lastActive are the expected streak
+		current, longest int
+		lastActive       string
+	}{
+		{"no summaries", nil, "2024-03-10", time.UTC, 0, 0, ""},
+		{"a gap resets the streak", []string{"2024-05-01", "2024-05-02", "2024-05-03", "2024-05-05"}, "2024-05-05", time.UTC, 1, 3, "2024-05-05"},
+		{"a run after the gap", []string{"2024-05-01", "2024-05-03", "2024-05-04"}, "2024-05-06", time.UTC, 2, 2, "2024-05-04"},
+		{"spring forward day counts once", []string{"2024-03-09", "2024-03-10", "2024-03-11"}, "2024-03-11", newYork, 3, 3, "2024-03-11"},
+		{"fall back day counts once", []string{"2024-11-02", "2024-11-03", "2024-11-04"}, "2024-11-04", newYork, 3, 3, "2024-11-04"},
+		{"a gap on the DST day resets the streak", []string{"2024-03-09", "2024-03-11"}, "2024-03-11", newYork, 1, 1, "2024-03-11"},
+		{"days after today are ignored", []string{"2024-03-09", "2024-03-10", "2024-03-12"}, "2024-03-10", newYork, 2, 2, "2024-03-10"},
+	}
+	for _, tc := range cases {
+		t.Run(tc.name, func(t *testing.T) {
+			var summaries []DailySummary
+			for _, date := range tc.dates {
+				day, err := time.ParseInLocation("2006-01-02", date, tc.loc)
+				if err != nil {
+					t.Fatal(err)
+				}
+				summaries = append(summaries, DailySummary{UserID: 1, Date: day, TotalSeconds: testThreshold})
+			}
+			today, err := time.ParseInLocation("2006-01-02", tc.today, tc.loc)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			got := Recompute(summaries, testThreshold, today.Add(22*time.Hour), tc.loc)
+			var lastActive time.Time
+			if tc.lastActive != "" {
+				lastActive, _ = time.Parse("2006-01-02", tc.lastActive)
+			}
+			if got.CurrentStreak != tc.current || got.LongestStreak != tc.longest || !sameDate(got, lastActive) {
+				t.Errorf("got %s, want current=%d longest=%d last_active=%s", formatTestStreak(got), tc.current, tc.longest, tc.lastActive)
+			}
+		})
+	}
+}
+
+func formatTestStreak(s UserStreak) string {
+	lastActive := "-"
+	if s.LastActiveDate.Valid {
+		lastActive = s.LastActiveDate.Time.Format("2006-01-02")
+	}
+	return fmt.Sprintf("current=%d longest=%d last_active=%s", s.CurrentStreak, s.LongestStreak, lastActive)
+}
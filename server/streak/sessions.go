@@ -0,0 +1,374 @@
+package streak
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"fmt"
+	"sort"
+	"time"
+
+	"github.com/boolow5/quran-app-api/apperrors"
+	"github.com/boolow5/quran-app-api/db"
+)
+
+// SessionTimeout ends a session that sent no heartbeat for this long, main
+// sets it from config.Streak
+var SessionTimeout = 10 * time.Minute
+
+// heartbeatSlack is the dwell time a heartbeat may report beyond the time
+// since the one before it, for clock and network jitter
+const heartbeatSlack = 30 * time.Second
+
+// Modes of a reading session
+const (
+	ModeReading    = "reading"
+	ModeListening  = "listening"
+	ModeMemorising = "memorising"
+)
+
+// Why a session ended
+const (
+	EndReasonEnded    = "ended"
+	EndReasonTimeout  = "timeout"
+	EndReasonReplaced = "replaced"
+)
+
+// Session is a stretch of reading on one device, from the app opening the
+// mushaf to closing it. Its pages are reading events with its id.
+type Session struct {
+	ID              uint64     `json:"id" db:"id"`
+	UserID          uint64     `json:"user_id" db:"user_id"`
+	DeviceID        string     `json:"device_id" db:"device_id"`
+	Mode            string     `json:"mode" db:"mode"`
+	StartedAt       time.Time  `json:"started_at" db:"started_at"`
+	LastHeartbeatAt time.Time  `json:"last_heartbeat_at" db:"last_heartbeat_at"`
+	EndedAt         *time.Time `json:"ended_at" db:"ended_at"`
+	EndReason       string     `json:"end_reason" db:"end_reason"`
+	// LastPage is where the user was at the last heartbeat, the page to continue from
+	LastPage      *int   `json:"last_page" db:"last_page"`
+	LastSurahName string `json:"last_surah_name" db:"last_surah_name"`
+	// TotalSeconds is the dwell time of all its pages
+	TotalSeconds int           `json:"total_seconds" db:"total_seconds"`
+	Pages        []SessionPage `json:"pages,omitempty" db:"-"`
+}
+
+// SessionPage is a page visited in a session with the time spent on it
+type SessionPage struct {
+	PageNumber  int       `json:"page_number" db:"page_number"`
+	SurahName   string    `json:"surah_name" db:"surah_name"`
+	Seconds     int       `json:"seconds" db:"seconds"`
+	FirstSeenAt time.Time `json:"first_seen_at" db:"first_seen_at"`
+	LastSeenAt  time.Time `json:"last_seen_at" db:"last_seen_at"`
+}
+
+// PageVisit is a page the app reports in a heartbeat, with the seconds spent
+// on it since the heartbeat before. The last visit is the page on screen.
+type PageVisit struct {
+	PageNumber int    `json:"page_number" binding:"required,min=1,max=604"`
+	SurahName  string `json:"surah_name" binding:"max=100"`
+	Seconds    int    `json:"seconds" binding:"min=0,max=3600"`
+}
+
+// ValidMode reports whether mode is a session mode
+func ValidMode(mode string) bool {
+	return mode == ModeReading || mode == ModeListening || mode == ModeMemorising
+}
+
+const sessionColumns = `
+	s.id, s.user_id, s.device_id, s.mode, s.started_at, s.last_heartbeat_at, s.ended_at, s.end_reason,
+	s.last_page, s.last_surah_name,
+	COALESCE((SELECT SUM(re.seconds_open) FROM reading_events re WHERE re.session_id = s.id), 0) AS total_seconds
+`
+
+// StartSession opens a session, a session still open on the same device is
+// ended first
+func StartSession(ctx context.Context, db db.Database, session Session) (Session, error) {
+	now := time.Now()
+	if session.DeviceID != "" {
+		_, err := db.Exec(ctx, `
+			UPDATE reading_sessions SET ended_at = last_heartbeat_at, end_reason = ?
+			WHERE user_id = ? AND device_id = ? AND ended_at IS NULL
+		`, EndReasonReplaced, session.UserID, session.DeviceID)
+		if err != nil {
+			return session, fmt.Errorf("failed to end open sessions of user %d: %w", session.UserID, err)
+		}
+	}
+
+	id, err := db.Insert(ctx, `
+		INSERT INTO reading_sessions (user_id, device_id, mode, started_at, last_heartbeat_at, last_page, last_surah_name)
+		VALUES (?, ?, ?, ?, ?, ?, ?)
+	`, session.UserID, session.DeviceID, session.Mode, now, now, session.LastPage, session.LastSurahName)
+	if err != nil {
+		return session, fmt.Errorf("failed to start session: %w", err)
+	}
+	return GetSession(ctx, db, session.UserID, uint64(id))
+}
+
+// GetSession returns a session of a user with its pages
+func GetSession(ctx context.Context, db db.Database, userID, sessionID uint64) (Session, error) {
+	var session Session
+	err := db.Get(ctx, &session, "SELECT "+sessionColumns+" FROM reading_sessions s WHERE s.id = ? AND s.user_id = ?", sessionID, userID)
+	if errors.Is(err, sql.ErrNoRows) {
+		return session, apperrors.ErrSessionNotFound
+	}
+	if err != nil {
+		return session, fmt.Errorf("failed to get session %d: %w", sessionID, err)
+	}
+
+	err = db.Select(ctx, &session.Pages, `
+		SELECT page_number, MAX(surah_name) AS surah_name, SUM(seconds_open) AS seconds,
+		MIN(created_at) AS first_seen_at, MAX(created_at) AS last_seen_at
+		FROM reading_events
+		WHERE session_id = ?
+		GROUP BY page_number
+		ORDER BY first_seen_at
+	`, sessionID)
+	if err != nil {
+		return session, fmt.Errorf("failed to get pages of session %d: %w", sessionID, err)
+	}
+	if session.Pages == nil {
+		session.Pages = []SessionPage{}
+	}
+	return session, nil
+}
+
+// GetSessions returns the latest sessions of a user without their pages
+func GetSessions(ctx context.Context, db db.Database, userID uint64, limit int) ([]Session, error) {
+	var sessions []Session
+	err := db.Select(ctx, &sessions, "SELECT "+sessionColumns+" FROM reading_sessions s WHERE s.user_id = ? ORDER BY s.started_at DESC LIMIT ?", userID, limit)
+	if err != nil {
+		return nil, fmt.Errorf("failed to get sessions of user %d: %w", userID, err)
+	}
+	return sessions, nil
+}
+
+// Heartbeat records the pages visited in a session since its last heartbeat
+// and keeps it open. A session past SessionTimeout is ended instead and
+// ErrSessionEnded returned. The dwell time reported cannot exceed the time
+// since the last heartbeat, so a replayed or buggy heartbeat does not count
+// more reading than happened, and a page left after less than MinPageSeconds
+// is not counted at all.
+func Heartbeat(ctx context.Context, db db.Database, userID, sessionID uint64, pages []PageVisit) (Session, error) {
+	return recordPages(ctx, db, userID, sessionID, pages, "")
+}
+
+// EndSession records the last pages of a session and ends it
+func EndSession(ctx context.Context, db db.Database, userID, sessionID uint64, pages []PageVisit) (Session, error) {
+	return recordPages(ctx, db, userID, sessionID, pages, EndReasonEnded)
+}
+
+func recordPages(ctx context.Context, db db.Database, userID, sessionID uint64, pages []PageVisit, endReason string) (Session, error) {
+	tx, err := db.Begin(ctx)
+	if err != nil {
+		return Session{}, fmt.Errorf("failed to begin transaction: %w", err)
+	}
+	defer tx.Rollback()
+
+	// the row stays locked until commit, a concurrent or retried heartbeat
+	// waits for it and gets its budget from the heartbeat time stored here
+	var session Session
+	err = db.GetTx(ctx, tx, &session, `
+		SELECT id, user_id, mode, last_heartbeat_at, ended_at, end_reason, last_page
+		FROM reading_sessions
+		WHERE id = ? AND user_id = ?
+		FOR UPDATE
+	`, sessionID, userID)
+	if errors.Is(err, sql.ErrNoRows) {
+		return session, apperrors.ErrSessionNotFound
+	}
+	if err != nil {
+		return session, fmt.Errorf("failed to lock session %d: %w", sessionID, err)
+	}
+	if session.EndedAt != nil {
+		return session, apperrors.ErrSessionEnded.WithDetails(map[string]interface{}{"reason": session.EndReason})
+	}
+
+	now := time.Now()
+	if now.Sub(session.LastHeartbeatAt) > SessionTimeout {
+		// CloseIdleSessions ends the locked row
+		tx.Rollback()
+		if _, err := CloseIdleSessions(ctx, db, now); err != nil {
+			return session, err
+		}
+		return session, apperrors.ErrSessionEnded.WithDetails(map[string]interface{}{"reason": EndReasonTimeout})
+	}
+
+	budget := int((now.Sub(session.LastHeartbeatAt) + heartbeatSlack).Seconds())
+	for i, page := range pages {
+		seconds := min(page.Seconds, budget)
+		// a page left before this heartbeat needs the time of a read event.
+		// The last page is still on screen and the first may be the one on
+		// screen at the heartbeat before, their visits go on across
+		// heartbeats so each part counts.
+		left := i < len(pages)-1
+		continued := i == 0 && session.LastPage != nil && *session.LastPage == page.PageNumber
+		if seconds == 0 || (left && !continued && seconds < MinPageSeconds) {
+			continue
+		}
+		budget -= seconds
+		_, err := db.ExecTx(ctx, tx, `
+			INSERT INTO reading_events (user_id, session_id, page_number, surah_name, seconds_open, created_at)
+			VALUES (?, ?, ?, ?, ?, ?)
+		`, userID, sessionID, page.PageNumber, page.SurahName, seconds, now)
+		if err != nil {
+			return session, fmt.Errorf("failed to record page %d of session %d: %w", page.PageNumber, sessionID, err)
+		}
+	}
+
+	query := "UPDATE reading_sessions SET last_heartbeat_at = ?"
+	args := []interface{}{now}
+	if len(pages) > 0 {
+		last := pages[len(pages)-1]
+		query += ", last_page = ?, last_surah_name = ?"
+		args = append(args, last.PageNumber, last.SurahName)
+	}
+	if endReason != "" {
+		query += ", ended_at = ?, end_reason = ?"
+		args = append(args, now, endReason)
+	}
+	query += " WHERE id = ? AND ended_at IS NULL"
+	args = append(args, sessionID)
+	if _, err := db.ExecTx(ctx, tx, query, args...); err != nil {
+		return session, fmt.Errorf("failed to update session %d: %w", sessionID, err)
+	}
+
+	if err := tx.Commit(); err != nil {
+		return session, err
+	}
+	return GetSession(ctx, db, userID, sessionID)
+}
+
+// CloseIdleSessions ends the sessions without a heartbeat for SessionTimeout
+// at their last heartbeat, it returns how many were ended
+func CloseIdleSessions(ctx context.Context, db db.Database, now time.Time) (int64, error) {
+	closed, err := db.Exec(ctx, `
+		UPDATE reading_sessions SET ended_at = last_heartbeat_at, end_reason = ?
+		WHERE ended_at IS NULL AND last_heartbeat_at < ?
+	`, EndReasonTimeout, now.Add(-SessionTimeout))
+	if err != nil {
+		return 0, fmt.Errorf("failed to end idle sessions: %w", err)
+	}
+	return closed, nil
+}
+
+// SessionAnalytics describes the sessions of a user between two days
+type SessionAnalytics struct {
+	From     string `json:"from"`
+	To       string `json:"to"`
+	Sessions int    `json:"sessions"`
+	// TotalSeconds is the dwell time of all pages, SecondsByMode splits it by session mode
+	TotalSeconds  int            `json:"total_seconds"`
+	SecondsByMode map[string]int `json:"seconds_by_mode"`
+	DistinctPages int            `json:"distinct_pages"`
+	// AverageSessionSeconds is the time from start to last heartbeat
+	AverageSessionSeconds int `json:"average_session_seconds"`
+	LongestSessionSeconds int `json:"longest_session_seconds"`
+	AveragePageSeconds    int `json:"average_page_seconds"`
+}
+
+// GetSessionAnalytics describes the sessions a user started between from and
+// to, both included
+func GetSessionAnalytics(ctx context.Context, db db.Database, userID uint64, from, to time.Time) (SessionAnalytics, error) {
+	analytics := SessionAnalytics{
+		From:          from.Format("2006-01-02"),
+		To:            to.Format("2006-01-02"),
+		SecondsByMode: map[string]int{},
+	}
+	sessionsWhere := "user_id = ? AND started_at >= ? AND started_at < ?"
+	args := []interface{}{userID, analytics.From, to.AddDate(0, 0, 1).Format("2006-01-02")}
+
+	var lengths struct {
+		Sessions int `db:"sessions"`
+		Average  int `db:"average"`
+		Longest  int `db:"longest"`
+	}
+	err := db.Get(ctx, &lengths, `
+		SELECT COUNT(*) AS sessions,
+		COALESCE(ROUND(AVG(TIMESTAMPDIFF(SECOND, started_at, last_heartbeat_at))), 0) AS average,
+		COALESCE(MAX(TIMESTAMPDIFF(SECOND, started_at, last_heartbeat_at)), 0) AS longest
+		FROM reading_sessions
+		WHERE `+sessionsWhere, args...)
+	if err != nil {
+		return analytics, fmt.Errorf("failed to get sessions of user %d: %w", userID, err)
+	}
+	analytics.Sessions, analytics.AverageSessionSeconds, analytics.LongestSessionSeconds = lengths.Sessions, lengths.Average, lengths.Longest
+
+	var modes []struct {
+		Mode    string `db:"mode"`
+		Seconds int    `db:"seconds"`
+	}
+	err = db.Select(ctx, &modes, `
+		SELECT s.mode, SUM(re.seconds_open) AS seconds
+		FROM reading_sessions s
+		JOIN reading_events re ON re.session_id = s.id
+		WHERE s.user_id = ? AND s.started_at >= ? AND s.started_at < ?
+		GROUP BY s.mode
+	`, args...)
+	if err != nil {
+		return analytics, fmt.Errorf("failed to get reading time of user %d: %w", userID, err)
+	}
+	for _, mode := range modes {
+		analytics.SecondsByMode[mode.Mode] = mode.Seconds
+		analytics.TotalSeconds += mode.Seconds
+	}
+
+	var pages struct {
+		Distinct int `db:"distinct_pages"`
+		Visits   int `db:"visits"`
+	}
+	err = db.Get(ctx, &pages, `
+		SELECT COUNT(DISTINCT page_number) AS distinct_pages, COUNT(DISTINCT session_id, page_number) AS visits
+		FROM reading_events
+		WHERE session_id IN (SELECT id FROM reading_sessions WHERE `+sessionsWhere+`)
+	`, args...)
+	if err != nil {
+		return analytics, fmt.Errorf("failed to get pages of user %d: %w", userID, err)
+	}
+	analytics.DistinctPages = pages.Distinct
+	if pages.Visits > 0 {
+		analytics.AveragePageSeconds = analytics.TotalSeconds / pages.Visits
+	}
+	return analytics, nil
+}
+
+// recentSessionPages are the pages the latest sessions of a user ended on,
+// the first is where to continue reading
+func recentSessionPages(ctx context.Context, db db.Database, userID uint64, limit int) ([]RecentPage, error) {
+	var pages []RecentPage
+	err := db.Select(ctx, &pages, `
+		SELECT last_page AS page_number, last_surah_name AS surah_name,
+		started_at AS start_date, last_heartbeat_at AS end_date
+		FROM reading_sessions
+		WHERE user_id = ? AND last_page IS NOT NULL
+		ORDER BY last_heartbeat_at DESC
+		LIMIT ?
+	`, userID, limit)
+	if err != nil {
+		return nil, fmt.Errorf("failed to get recent sessions of user %d: %w", userID, err)
+	}
+	return pages, nil
+}
+
+// mergeRecentPages orders pages by when they were last read and keeps the
+// latest of each page number
+func mergeRecentPages(pages []RecentPage, limit int) []RecentPage {
+	lastRead := func(p RecentPage) time.Time {
+		if p.EndDate.After(p.StartDate) {
+			return p.EndDate
+		}
+		return p.StartDate
+	}
+	sort.SliceStable(pages, func(i, j int) bool { return lastRead(pages[i]).After(lastRead(pages[j])) })
+
+	seen := map[int]bool{}
+	merged := make([]RecentPage, 0, limit)
+	for _, page := range pages {
+		if seen[page.PageNumber] || len(merged) == limit {
+			continue
+		}
+		seen[page.PageNumber] = true
+		merged = append(merged, page)
+	}
+	return merged
+}
@@ -6,11 +6,43 @@ import (
 	"fmt"
 	"time"
 
+	"github.com/boolow5/quran-app-api/apperrors"
 	"github.com/boolow5/quran-app-api/db"
+	"github.com/boolow5/quran-app-api/logger"
 )
 
-// Minimum reading time in seconds to count a day (5 minutes = 300 seconds)
-const MinReadingTimeThreshold = 300
+// Minimum reading time in seconds to count a day (5 minutes = 300 seconds),
+// main sets it from config.Streak
+var MinReadingTimeThreshold = 300
+
+// Milestones are the streak lengths users are congratulated for
+var Milestones = []int{3, 7, 14, 30, 50, 100, 200, 365, 500, 1000}
+
+// IsMilestone reports whether a streak length is one of the Milestones
+func IsMilestone(streak int) bool {
+	for _, m := range Milestones {
+		if m == streak {
+			return true
+		}
+	}
+	return false
+}
+
+// CountStreaks returns the streak ending on the last of days and the longest
+// streak in them, days are the dates that met the threshold in order
+func CountStreaks(days []time.Time) (current, longest int) {
+	for i, day := range days {
+		if i > 0 && day.Format("2006-01-02") == days[i-1].AddDate(0, 0, 1).Format("2006-01-02") {
+			current++
+		} else {
+			current = 1
+		}
+		if current > longest {
+			longest = current
+		}
+	}
+	return current, longest
+}
 
 // Models
 type ReadingEvent struct {
@@ -22,12 +54,16 @@ type ReadingEvent struct {
 	CreatedAt   time.Time `json:"created_at" db:"created_at"`
 }
 
+// DailySummary is the activity of a user on a day, TotalSeconds is their
+// reading with their listening weighted in by the Listening policy in use
+// when it was summed
 type DailySummary struct {
-	ID           uint64    `json:"id" db:"id"`
-	UserID       uint64    `json:"user_id" db:"user_id"`
-	Date         time.Time `json:"date" db:"date"`
-	TotalSeconds int       `json:"total_seconds" db:"total_seconds"`
-	ThresholdMet bool      `json:"threshold_met" db:"threshold_met"`
+	ID               uint64    `json:"id" db:"id"`
+	UserID           uint64    `json:"user_id" db:"user_id"`
+	Date             time.Time `json:"date" db:"date"`
+	TotalSeconds     int       `json:"total_seconds" db:"total_seconds"`
+	ListeningSeconds int       `json:"listening_seconds" db:"listening_seconds"`
+	ThresholdMet     bool      `json:"threshold_met" db:"threshold_met"`
 }
 
 type UserStreak struct {
@@ -44,6 +80,10 @@ type RecentPage struct {
 	EndDate    time.Time `json:"end_date" db:"end_date"`
 }
 
+// MinPageSeconds is the least time on a page that counts as reading it,
+// shorter visits were flipped past
+const MinPageSeconds = 30
+
 // RecordReadingEvent stores a new reading event
 func RecordReadingEvent(ctx context.Context, db db.Database, event ReadingEvent) error {
 	query := `
@@ -53,14 +93,14 @@ func RecordReadingEvent(ctx context.Context, db db.Database, event ReadingEvent)
 	`
 
 	// validation
-	if event.SecondsOpen < 30 {
-		return fmt.Errorf("seconds_open must be greater than 30")
+	if event.SecondsOpen < MinPageSeconds {
+		return apperrors.Invalid("seconds_open", fmt.Sprintf("min %d", MinPageSeconds))
 	}
 	if event.SecondsOpen > 600 {
 		event.SecondsOpen = 600
 	}
 	if event.PageNumber < 1 || event.PageNumber > 604 {
-		return fmt.Errorf("page_number must be between 1 and 604")
+		return apperrors.Invalid("page_number", "between 1 and 604")
 	}
 
 	_, err := db.Insert(ctx, query, event.UserID, event.PageNumber, event.SurahName, event.SecondsOpen, event.CreatedAt)
@@ -71,52 +111,62 @@ func RecordReadingEvent(ctx context.Context, db db.Database, event ReadingEvent)
 	return nil
 }
 
-// UpdateDailySummary calculates and updates the daily summary for a user
-func UpdateDailySummary(ctx context.Context, db db.Database, userID uint64, date time.Time) (totalSeconds int, err error) {
+// GetDailyTotal sums the weighted activity of a user on a day without touching the summary
+func GetDailyTotal(ctx context.Context, db db.Database, userID uint64, date time.Time) (totalSeconds int, err error) {
+	activity, err := GetDailyActivity(ctx, db, userID, date)
+	if err != nil {
+		return 0, err
+	}
+	return activity.Total(), nil
+}
+
+// UpdateDailySummary calculates and updates the daily summary for a user from
+// their reading and listening weighted by the Listening policy, a change of
+// their streak is logged with cause
+func UpdateDailySummary(ctx context.Context, db db.Database, userID uint64, date time.Time, cause Cause) (totalSeconds int, err error) {
 	// Format date as YYYY-MM-DD for SQL
 	dateStr := date.Format("2006-01-02")
 
-	fmt.Printf("Updating daily summary for user: %d, date: %s\n", userID, dateStr)
+	logger.For(ctx, "streak.UpdateDailySummary").Debugf("Updating daily summary for user: %d, date: %s", userID, dateStr)
 
 	// Calculate total seconds for the day
-	query := `
-		SELECT COALESCE(SUM(seconds_open), 0) 
-		FROM reading_events 
-		WHERE user_id = ? 
-		AND DATE(created_at) = ?
-	`
-	err = db.Get(ctx, &totalSeconds, query, userID, dateStr)
+	activity, err := GetDailyActivity(ctx, db, userID, date)
 	if err != nil {
-		return totalSeconds, fmt.Errorf("failed to calculate daily total: %w", err)
+		return totalSeconds, err
 	}
+	totalSeconds = activity.Total()
 
 	// Check if threshold is met
-	thresholdMet := totalSeconds >= MinReadingTimeThreshold
+	thresholdMet := activity.Met()
 
-	fmt.Printf("Total seconds: %d, threshold met: %t\n", totalSeconds, thresholdMet)
+	logger.For(ctx, "streak.UpdateDailySummary").Debugf("Total seconds: %d, listening seconds: %d, threshold met: %t", totalSeconds, activity.ListeningSeconds, thresholdMet)
 
 	// Upsert daily summary
 	upsertQuery := `
-		INSERT INTO daily_summaries (user_id, date, total_seconds, threshold_met)
-		VALUES (?, ?, ?, ?)
+		INSERT INTO daily_summaries (user_id, date, total_seconds, listening_seconds, threshold_met)
+		VALUES (?, ?, ?, ?, ?)
 		ON DUPLICATE KEY UPDATE
 		total_seconds = VALUES(total_seconds),
+		listening_seconds = VALUES(listening_seconds),
 		threshold_met = VALUES(threshold_met)
 	`
-	_, err = db.Exec(ctx, upsertQuery, userID, dateStr, totalSeconds, thresholdMet)
+	_, err = db.Exec(ctx, upsertQuery, userID, dateStr, totalSeconds, activity.ListeningSeconds, thresholdMet)
 	if err != nil {
-		fmt.Printf("Failed to upsert daily summary: %v\n", err)
+		logger.For(ctx, "streak.UpdateDailySummary").Errorf("Failed to upsert daily summary: %v", err)
 		return totalSeconds, fmt.Errorf("failed to update daily summary: %w", err)
 	}
 
-	fmt.Printf("Updated daily summary for user: %d, date: %s\n", userID, dateStr)
+	logger.For(ctx, "streak.UpdateDailySummary").Debugf("Updated daily summary for user: %d, date: %s", userID, dateStr)
 	// Update streak if needed
-	err = UpdateStreak(ctx, db, userID, date, thresholdMet)
+	cause.Date = date
+	cause.TotalSeconds = &totalSeconds
+	err = UpdateStreak(ctx, db, userID, date, thresholdMet, cause)
 	return totalSeconds, err
 }
 
-// UpdateStreak updates a user's streak based on their activity
-func UpdateStreak(ctx context.Context, db db.Database, userID uint64, today time.Time, thresholdMet bool) error {
+// UpdateStreak updates a user's streak based on their activity, a change is
+// logged in streak_events with cause
+func UpdateStreak(ctx context.Context, db db.Database, userID uint64, today time.Time, thresholdMet bool, cause Cause) error {
 	tx, err := db.Begin(ctx)
 	if err != nil {
 		return fmt.Errorf("failed to begin transaction: %w", err)
@@ -128,25 +178,11 @@ func UpdateStreak(ctx context.Context, db db.Database, userID uint64, today time
 		}
 	}()
 
-	// Get current streak info
-	var streak UserStreak
-	query := `
-		SELECT user_id, current_streak, longest_streak, last_active_date
-		FROM user_streaks
-		WHERE user_id = ?
-	`
-	err = db.Get(ctx, &streak, query, userID)
-	if err != nil && err != sql.ErrNoRows {
-		return fmt.Errorf("failed to get streak info: %w", err)
-	}
-
-	// Initialize streak if not exists
-	if err == sql.ErrNoRows {
-		streak = UserStreak{
-			UserID:        userID,
-			CurrentStreak: 0,
-			LongestStreak: 0,
-		}
+	// Get current streak info, locked so the previous streak logged is the
+	// one this overwrites
+	streak, err := lockUserStreak(ctx, db, tx, userID)
+	if err != nil {
+		return err
 	}
 
 	// Format dates for comparison
@@ -155,42 +191,48 @@ func UpdateStreak(ctx context.Context, db db.Database, userID uint64, today time
 	yesterdayDate := yesterday.Format("2006-01-02")
 
 	var newStreak int
+	backdated := false
 
 	if thresholdMet {
 		if streak.LastActiveDate.Valid {
 			lastActiveDate := streak.LastActiveDate.Time.Format("2006-01-02")
-			fmt.Printf("Threshold met for user: %d\tLast active date: %s\n", userID, lastActiveDate)
+			logger.For(ctx, "streak.UpdateStreak").Debugf("Threshold met for user: %d Last active date: %s", userID, lastActiveDate)
 
 			// Check if last active date was yesterday
 			if lastActiveDate == yesterdayDate {
 				// Continue streak
 				newStreak = streak.CurrentStreak + 1
-				fmt.Printf("Continuing streak for user: %d\tNew streak: %d\n", userID, newStreak)
+				logger.For(ctx, "streak.UpdateStreak").Debugf("Continuing streak for user: %d New streak: %d", userID, newStreak)
 			} else if lastActiveDate == todayDate {
 				// Already processed today, keep current streak
 				newStreak = streak.CurrentStreak
-				fmt.Printf("Already processed today for user: %d\tNew streak: %d\n", userID, newStreak)
+				logger.For(ctx, "streak.UpdateStreak").Debugf("Already processed today for user: %d New streak: %d", userID, newStreak)
+			} else if lastActiveDate > todayDate {
+				// A backdated day must not move the streak back, recompute-streaks counts it
+				backdated = true
+				newStreak = streak.CurrentStreak
+				logger.For(ctx, "streak.UpdateStreak").Debugf("Backdated %s before last active date for user: %d New streak: %d", todayDate, userID, newStreak)
 			} else {
 				// Streak broken, start new streak
 				newStreak = 1
-				fmt.Printf("Streak broken for user: %d\tNew streak: %d\n", userID, newStreak)
+				logger.For(ctx, "streak.UpdateStreak").Debugf("Streak broken for user: %d New streak: %d", userID, newStreak)
 			}
 		} else {
 			// First time reading, start streak at 1
 			newStreak = 1
-			fmt.Printf("First time reading for user: %d\tNew streak: %d\n", userID, newStreak)
+			logger.For(ctx, "streak.UpdateStreak").Debugf("First time reading for user: %d New streak: %d", userID, newStreak)
 		}
 	} else {
 		// Threshold not met, keep existing streak
 		newStreak = streak.CurrentStreak
-		fmt.Printf("Threshold not met for user: %d\tNew streak: %d\n", userID, newStreak)
+		logger.For(ctx, "streak.UpdateStreak").Debugf("Threshold not met for user: %d New streak: %d", userID, newStreak)
 	}
 
 	// Calculate longest streak
 	longestStreak := streak.LongestStreak
 	if newStreak > longestStreak {
 		longestStreak = newStreak
-		fmt.Printf("Longest streak updated for user: %d\tNew longest streak: %d\n", userID, longestStreak)
+		logger.For(ctx, "streak.UpdateStreak").Debugf("Longest streak updated for user: %d New longest streak: %d", userID, longestStreak)
 	}
 
 	// Update or insert streak record
@@ -205,7 +247,7 @@ func UpdateStreak(ctx context.Context, db db.Database, userID uint64, today time
 
 	// Only update last_active_date if threshold was met today
 	var lastActiveDate interface{} = nil
-	if thresholdMet {
+	if thresholdMet && !backdated {
 		lastActiveDate = todayDate
 	} else if streak.LastActiveDate.Valid {
 		lastActiveDate = streak.LastActiveDate.Time.Format("2006-01-02")
@@ -216,32 +258,46 @@ func UpdateStreak(ctx context.Context, db db.Database, userID uint64, today time
 		return fmt.Errorf("failed to update streak: %w", err)
 	}
 
+	updated := UserStreak{UserID: userID, CurrentStreak: newStreak, LongestStreak: longestStreak}
+	if lastActiveDate != nil {
+		date, _ := time.Parse("2006-01-02", lastActiveDate.(string))
+		updated.LastActiveDate = sql.NullTime{Time: date, Valid: true}
+	}
+	if cause.Date.IsZero() {
+		cause.Date = today
+	}
+	err = RecordEvent(ctx, db, tx, cause, streak, updated)
+	if err != nil {
+		return err
+	}
+
 	return tx.Commit()
 }
 
-// ProcessDailyStreaks is a function that can be run as a daily scheduled job
-func ProcessDailyStreaks(ctx context.Context, db db.Database, todayDate time.Time) error {
-	// Get all users who had reading activity today
+// ProcessDailyStreaks is a function that can be run as a daily scheduled job,
+// the streaks it changes are logged with cause
+func ProcessDailyStreaks(ctx context.Context, db db.Database, todayDate time.Time, cause Cause) error {
+	// Get all users who read or listened today
 	today := todayDate.Format("2006-01-02")
 
 	var userIDs []uint64
 	query := `
-		SELECT DISTINCT user_id 
-		FROM reading_events 
-		WHERE DATE(created_at) = ?
+		SELECT user_id FROM reading_events WHERE DATE(created_at) = ?
+		UNION
+		SELECT user_id FROM listening_events WHERE DATE(created_at) = ?
 	`
 
-	err := db.Select(ctx, &userIDs, query, today)
+	err := db.Select(ctx, &userIDs, query, today, today)
 	if err != nil {
 		return fmt.Errorf("failed to get active users: %w", err)
 	}
 
 	// Process each user's streak
 	for _, userID := range userIDs {
-		_, err := UpdateDailySummary(ctx, db, userID, todayDate)
+		_, err := UpdateDailySummary(ctx, db, userID, todayDate, cause)
 		if err != nil {
 			// Log error but continue with other users
-			fmt.Printf("Error updating streak for user %d: %v\n", userID, err)
+			logger.For(ctx, "streak.ProcessDailyStreaks").Errorf("Error updating streak for user %d: %v", userID, err)
 		}
 	}
 
@@ -269,9 +325,102 @@ func GetUserStreak(ctx context.Context, db db.Database, userID uint64) (UserStre
 	return streak, nil
 }
 
+// lockUserStreak reads the streak of a user for update in tx, writers of
+// user_streaks wait for tx so the streak events they log follow each other
+func lockUserStreak(ctx context.Context, db db.Database, tx *sql.Tx, userID uint64) (UserStreak, error) {
+	var streak UserStreak
+	query := `
+		SELECT user_id, current_streak, longest_streak, last_active_date
+		FROM user_streaks
+		WHERE user_id = ?
+		FOR UPDATE
+	`
+
+	err := db.GetTx(ctx, tx, &streak, query, userID)
+	if err == sql.ErrNoRows {
+		return UserStreak{UserID: userID, CurrentStreak: 0, LongestStreak: 0}, nil
+	}
+	if err != nil {
+		return UserStreak{}, fmt.Errorf("failed to lock streak of user %d: %w", userID, err)
+	}
+
+	return streak, nil
+}
+
+// GetDailySummaries returns the daily summaries of a user from one date to
+// another, both included
+func GetDailySummaries(ctx context.Context, db db.Database, userID uint64, from, to time.Time) ([]DailySummary, error) {
+	var summaries []DailySummary
+	query := `
+		SELECT id, user_id, date, total_seconds, listening_seconds, threshold_met
+		FROM daily_summaries
+		WHERE user_id = ? AND date BETWEEN ? AND ?
+		ORDER BY date
+	`
+	err := db.Select(ctx, &summaries, query, userID, from.Format("2006-01-02"), to.Format("2006-01-02"))
+	if err != nil {
+		return nil, fmt.Errorf("failed to get daily summaries: %w", err)
+	}
+	return summaries, nil
+}
+
+// SetStreak overwrites the streak of a user, it is how support corrects one.
+// The change is logged with cause.
+func SetStreak(ctx context.Context, db db.Database, streak UserStreak, cause Cause) error {
+	return setStreak(ctx, db, nil, streak, cause)
+}
+
+// setStreak overwrites the streak of a user, when expected is set only if the
+// stored streak is still expected
+func setStreak(ctx context.Context, db db.Database, expected *UserStreak, streak UserStreak, cause Cause) error {
+	tx, err := db.Begin(ctx)
+	if err != nil {
+		return fmt.Errorf("failed to begin transaction: %w", err)
+	}
+	defer tx.Rollback()
+
+	before, err := lockUserStreak(ctx, db, tx, streak.UserID)
+	if err != nil {
+		return err
+	}
+	if expected != nil {
+		if fields := diffStreaks(*expected, before); len(fields) > 0 {
+			return apperrors.ErrConflict.WithDetails(map[string]interface{}{
+				"reason": "the streak changed while it was recomputed",
+				"fields": fields,
+			})
+		}
+	}
+
+	query := `
+		INSERT INTO user_streaks (user_id, current_streak, longest_streak, last_active_date)
+		VALUES (?, ?, ?, ?)
+		ON DUPLICATE KEY UPDATE
+		current_streak = VALUES(current_streak),
+		longest_streak = VALUES(longest_streak),
+		last_active_date = VALUES(last_active_date)
+	`
+	_, err = db.ExecTx(ctx, tx, query, streak.UserID, streak.CurrentStreak, streak.LongestStreak, nullDate(streak.LastActiveDate))
+	if err != nil {
+		return fmt.Errorf("failed to set streak of user %d: %w", streak.UserID, err)
+	}
+	if err := RecordEvent(ctx, db, tx, cause, before, streak); err != nil {
+		return err
+	}
+	return tx.Commit()
+}
+
+// GetRecentPages returns the pages the user last read, latest first, the
+// first is where to continue reading. They are the pages the latest sessions
+// ended on, and the reading events of apps that do not send sessions yet.
 func GetRecentPages(ctx context.Context, db db.Database, userID uint64, limit int) ([]RecentPage, error) {
-	var pages []RecentPage
+	pages, err := recentSessionPages(ctx, db, userID, limit)
+	if err != nil {
+		return nil, err
+	}
 
+	// the last page of each run of pages read in order
+	var events []RecentPage
 	query := ` 
 	WITH RankedPages AS (
 		SELECT 
@@ -284,8 +433,8 @@ func GetRecentPages(ctx context.Context, db db.Database, userID uint64, limit in
 				page_number,
 				surah_name,
 				created_at
-			FROM meezansync_app_db.reading_events
-			WHERE user_id = ? AND seconds_open >= 30
+			FROM reading_events
+			WHERE user_id = ? AND session_id IS NULL AND seconds_open >= 30
 		) AS distinct_pages
 	), 
 	LastPagesInSequence AS (
@@ -315,10 +464,9 @@ func GetRecentPages(ctx context.Context, db db.Database, userID uint64, limit in
 	ORDER BY start_date DESC
 	LIMIT ?; 
   `
-
-	err := db.Select(ctx, &pages, query, userID, limit)
-	if err != nil {
-		return nil, err
+	if err := db.Select(ctx, &events, query, userID, limit); err != nil {
+		return nil, fmt.Errorf("failed to get recent reading events of user %d: %w", userID, err)
 	}
-	return pages, nil
+
+	return mergeRecentPages(append(pages, events...), limit), nil
 }
@@ -0,0 +1,39 @@
+package tracing
+
+import (
+	"regexp"
+	"strings"
+)
+
+// maxStatementLength caps db.statement so huge generated queries do not bloat spans
+const maxStatementLength = 2000
+
+var (
+	sqlStringLiteral  = regexp.MustCompile(`'(?:[^'\\]|\\.|'')*'|"(?:[^"\\]|\\.)*"`)
+	sqlNumericLiteral = regexp.MustCompile(`\b\d+(?:\.\d+)?\b`)
+	sqlPlaceholders   = regexp.MustCompile(`\(\s*\?(?:\s*,\s*\?)+\s*\)`)
+	sqlWhitespace     = regexp.MustCompile(`\s+`)
+)
+
+// SanitizeSQL replaces literals in query with ?, so values built into a query
+// never reach the trace backend, and shortens placeholder lists like IN (?, ?, ?)
+func SanitizeSQL(query string) string {
+	query = sqlStringLiteral.ReplaceAllString(query, "?")
+	query = sqlNumericLiteral.ReplaceAllString(query, "?")
+	query = sqlPlaceholders.ReplaceAllString(query, "(?)")
+	query = strings.TrimSpace(sqlWhitespace.ReplaceAllString(query, " "))
+
+	if len(query) > maxStatementLength {
+		query = query[:maxStatementLength] + "..."
+	}
+	return query
+}
+
+// SQLOperation returns the first keyword of query, e.g. SELECT or INSERT
+func SQLOperation(query string) string {
+	fields := strings.Fields(query)
+	if len(fields) == 0 {
+		return ""
+	}
+	return strings.ToUpper(fields[0])
+}
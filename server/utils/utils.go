@@ -3,28 +3,34 @@ package utils
 import (
 	"errors"
 	"fmt"
+	"net/http"
 	"reflect"
 	"strings"
+
+	"github.com/boolow5/quran-app-api/apperrors"
+	"github.com/boolow5/quran-app-api/logger"
 )
 
+// The errors clients can act on are apperrors domain errors, so handlers can
+// return them as they are and the error middleware picks the status and code
 var (
-	ErrUserAlreadyExists    = errors.New("user already exists")
-	ErrWrongEmailOrPassword = errors.New("wrong email or password")
-	ErrAuthenticationFailed = errors.New("authentication failed")
-	ErrUserNotFound         = errors.New("user not found")
-	ErrInvalidToken         = errors.New("invalid token")
-	ErrTokenExpired         = errors.New("token expired")
+	ErrUserAlreadyExists    = apperrors.ErrUserAlreadyExists
+	ErrWrongEmailOrPassword = apperrors.New(apperrors.CodeUnauthenticated, http.StatusUnauthorized, "wrong email or password")
+	ErrAuthenticationFailed = apperrors.New(apperrors.CodeUnauthenticated, http.StatusUnauthorized, "authentication failed")
+	ErrUserNotFound         = apperrors.ErrUserNotFound
+	ErrInvalidToken         = apperrors.ErrInvalidToken
+	ErrTokenExpired         = apperrors.ErrTokenExpired
 	ErrInvalidRole          = errors.New("invalid role")
-	ErrInvalidRequest       = errors.New("invalid request")
+	ErrInvalidRequest       = apperrors.ErrInvalidRequest
 	ErrInvalidCompany       = errors.New("invalid company")
 	ErrInvalidProduct       = errors.New("invalid product")
 	ErrInvalidTransaction   = errors.New("invalid transaction")
 	ErrFailedToGenerateJWT  = errors.New("failed to generate jwt")
 	ErrResetCodeAlreadyUsed = errors.New("reset code already used")
 	ErrResetCodeTypeInvalid = errors.New("invalid reset code type")
-	ErrNoFieldsToUpdate     = errors.New("no fields to update")
+	ErrNoFieldsToUpdate     = apperrors.ErrNoFieldsToUpdate
 	ErrPasswordMaxExceeded  = errors.New("password cannot be longer than 32 characters")
-	ErrNoRowsAffected       = errors.New("no rows affected")
+	ErrNoRowsAffected       = apperrors.New(apperrors.CodeNotFound, http.StatusNotFound, "no rows affected")
 )
 
 func ToPtr[T any](value T) *T {
@@ -115,11 +121,11 @@ func processStructFields(val reflect.Value, typ reflect.Type, result map[string]
 }
 
 func CreateTypeInstance(slice interface{}) (interface{}, error) {
-	fmt.Printf("[CreateTypeInstance] slice: %T\n", slice)
+	logger.Component("utils.CreateTypeInstance").Debugf("Slice: %T", slice)
 	// Get the type of the slice
 	sliceType := reflect.TypeOf(slice)
 	if sliceType.Kind() != reflect.Slice {
-		fmt.Errorf("[CreateTypeInstance] input must be a slice, got %v\n", sliceType.Kind())
+		logger.Component("utils.CreateTypeInstance").Warnf("Input must be a slice, got %v", sliceType.Kind())
 		return nil, fmt.Errorf("input must be a slice, got %v", sliceType.Kind())
 	}
 
@@ -129,14 +135,14 @@ func CreateTypeInstance(slice interface{}) (interface{}, error) {
 	// If it's a pointer type, get the element type it points to
 	if elemType.Kind() == reflect.Ptr {
 		elemType = elemType.Elem()
-		fmt.Printf("[CreateTypeInstance] ptr elemType: %v\n", elemType)
+		logger.Component("utils.CreateTypeInstance").Debugf("Ptr elemType: %v", elemType)
 	} else {
-		fmt.Printf("[CreateTypeInstance] elemType: %v\n", elemType)
+		logger.Component("utils.CreateTypeInstance").Debugf("ElemType: %v", elemType)
 	}
 
 	// Create a new instance of the concrete type
 	instance := reflect.New(elemType).Interface()
-	fmt.Printf("[CreateTypeInstance] instance: %T\n", instance)
+	logger.Component("utils.CreateTypeInstance").Debugf("Instance: %T", instance)
 
 	return instance, nil
 }